@@ -0,0 +1,79 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// AccessStats counts the opens of each secret, so that secrets which are provisioned but never
+// read can be found. They are kept out of the metrics registry, since secret names must not be
+// sent to the metrics collector. A nil AccessStats records nothing.
+type AccessStats struct {
+	secrets map[string]*secretAccess
+	lock    sync.Mutex
+	now     func() time.Time
+}
+
+type secretAccess struct {
+	opens      int64
+	lastAccess time.Time
+}
+
+// NewAccessStats creates empty access statistics.
+func NewAccessStats() *AccessStats {
+	return &AccessStats{secrets: map[string]*secretAccess{}, now: time.Now}
+}
+
+// Record counts an open of the named secret.
+func (s *AccessStats) Record(name string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	access, ok := s.secrets[name]
+	if !ok {
+		access = &secretAccess{}
+		s.secrets[name] = access
+	}
+	access.opens++
+	access.lastAccess = s.now()
+}
+
+// Registry returns a snapshot of the statistics of the named secrets, plus any other secret
+// opened since, as secret.<name>.opens counters and secret.<name>.last_access gauges (in seconds
+// since the epoch, zero if never opened).
+func (s *AccessStats) Registry(names []string) metrics.Registry {
+	registry := metrics.NewRegistry()
+	for _, name := range names {
+		metrics.GetOrRegisterCounter("secret."+name+".opens", registry)
+		metrics.GetOrRegisterGauge("secret."+name+".last_access", registry)
+	}
+	if s == nil {
+		return registry
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, access := range s.secrets {
+		metrics.GetOrRegisterCounter("secret."+name+".opens", registry).Inc(access.opens)
+		metrics.GetOrRegisterGauge("secret."+name+".last_access", registry).Update(access.lastAccess.Unix())
+	}
+	return registry
+}
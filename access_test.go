@@ -0,0 +1,54 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessStats(t *testing.T) {
+	assert := assert.New(t)
+
+	stats := NewAccessStats()
+	stats.now = func() time.Time { return time.Unix(1500000000, 0) }
+	stats.Record("used")
+	stats.Record("used")
+	stats.Record("deleted")
+
+	registry := stats.Registry([]string{"used", "unused"})
+	opens := func(name string) int64 {
+		return registry.Get("secret." + name + ".opens").(metrics.Counter).Count()
+	}
+	lastAccess := func(name string) int64 {
+		return registry.Get("secret." + name + ".last_access").(metrics.Gauge).Value()
+	}
+	assert.EqualValues(2, opens("used"))
+	assert.EqualValues(1500000000, lastAccess("used"))
+	assert.EqualValues(0, opens("unused"))
+	assert.EqualValues(0, lastAccess("unused"))
+	assert.EqualValues(1, opens("deleted"))
+
+	// Snapshots are independent of later opens.
+	stats.Record("used")
+	assert.EqualValues(2, opens("used"))
+
+	var none *AccessStats
+	none.Record("used")
+	assert.NotNil(none.Registry([]string{"used"}).Get("secret.used.opens"))
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// secretTimeoutFS sets the attribute and entry timeouts of secrets, leaving those set by the
+// connector, which are the timeouts of special files, for everything else. Special files (any
+// path starting with a dot), directories and alias symlinks change whenever the cache does, so
+// they are usually cached briefly if at all, while the attributes of a secret only change when
+// its content does, which invalidates them in the kernel anyway.
+//
+// Secrets are recognized by path, so the path of every node the kernel looked up is tracked
+// until it is forgotten. Entries returned by READDIRPLUS bypass this wrapper and get the
+// timeouts of special files until they are looked up again.
+type secretTimeoutFS struct {
+	fuse.RawFileSystem
+	attrTimeout  time.Duration
+	entryTimeout time.Duration
+
+	lock  sync.Mutex
+	nodes map[uint64]timeoutNode
+}
+
+type timeoutNode struct {
+	path   string
+	secret bool
+}
+
+// newSecretTimeoutFS wraps fs to apply the given timeouts to secrets.
+func newSecretTimeoutFS(fs fuse.RawFileSystem, attrTimeout, entryTimeout time.Duration) fuse.RawFileSystem {
+	return &secretTimeoutFS{
+		RawFileSystem: fs,
+		attrTimeout:   attrTimeout,
+		entryTimeout:  entryTimeout,
+		nodes:         make(map[uint64]timeoutNode),
+	}
+}
+
+func (fs *secretTimeoutFS) Lookup(header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	status := fs.RawFileSystem.Lookup(header, name, out)
+	if !status.Ok() {
+		return status
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var parent string
+	if header.NodeId != fuse.FUSE_ROOT_ID {
+		node, ok := fs.nodes[header.NodeId]
+		if !ok {
+			return status
+		}
+		parent = node.path
+	}
+	node := timeoutNode{path: path.Join(parent, name)}
+	node.secret = out.Attr.IsRegular() && !strings.HasPrefix(node.path, ".")
+	fs.nodes[out.NodeId] = node
+	if node.secret {
+		out.EntryValid, out.EntryValidNsec = splitTimeout(fs.entryTimeout)
+		out.AttrValid, out.AttrValidNsec = splitTimeout(fs.attrTimeout)
+	}
+	return status
+}
+
+func (fs *secretTimeoutFS) GetAttr(input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	status := fs.RawFileSystem.GetAttr(input, out)
+	if !status.Ok() {
+		return status
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.nodes[input.NodeId].secret {
+		out.AttrValid, out.AttrValidNsec = splitTimeout(fs.attrTimeout)
+	}
+	return status
+}
+
+func (fs *secretTimeoutFS) Forget(nodeID, nlookup uint64) {
+	fs.lock.Lock()
+	delete(fs.nodes, nodeID)
+	fs.lock.Unlock()
+	fs.RawFileSystem.Forget(nodeID, nlookup)
+}
+
+// splitTimeout converts a timeout to the seconds and nanoseconds sent to the kernel.
+func splitTimeout(d time.Duration) (uint64, uint32) {
+	return uint64(d / time.Second), uint32(d % time.Second)
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// modeRawFS answers lookups with the mode of the named entry, and node ids in lookup order.
+type modeRawFS struct {
+	fuse.RawFileSystem
+	modes  map[string]uint32
+	nextID uint64
+}
+
+func (fs *modeRawFS) Lookup(header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	mode, ok := fs.modes[name]
+	if !ok {
+		return fuse.ENOENT
+	}
+	fs.nextID++
+	out.NodeId = fs.nextID
+	out.Mode = mode
+	return fuse.OK
+}
+
+func (fs *modeRawFS) GetAttr(input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	return fuse.OK
+}
+
+func TestSecretTimeoutFS(t *testing.T) {
+	assert := assert.New(t)
+
+	modes := map[string]uint32{
+		"secret":   fuse.S_IFREG | 0440,
+		"group":    fuse.S_IFDIR | 0755,
+		"alias":    fuse.S_IFLNK | 0777,
+		".version": fuse.S_IFREG | 0444,
+		".json":    fuse.S_IFDIR | 0700,
+	}
+	fs := newSecretTimeoutFS(&modeRawFS{RawFileSystem: fuse.NewDefaultRawFileSystem(), modes: modes, nextID: 1}, 1500*time.Millisecond, 3*time.Second)
+
+	lookup := func(parent uint64, name string) *fuse.EntryOut {
+		out := &fuse.EntryOut{}
+		assert.Equal(fuse.OK, fs.Lookup(&fuse.InHeader{NodeId: parent}, name, out), name)
+		return out
+	}
+	getAttr := func(node uint64) *fuse.AttrOut {
+		out := &fuse.AttrOut{}
+		assert.Equal(fuse.OK, fs.GetAttr(&fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: node}}, out))
+		return out
+	}
+
+	secret := lookup(fuse.FUSE_ROOT_ID, "secret")
+	assert.EqualValues(3, secret.EntryValid)
+	assert.EqualValues(1, secret.AttrValid)
+	assert.EqualValues(500*time.Millisecond, secret.AttrValidNsec)
+	assert.EqualValues(1, getAttr(secret.NodeId).AttrValid)
+
+	// Special files, directories and symlinks keep the connector's timeouts, as do files under
+	// special directories.
+	for _, name := range []string{".version", "group", "alias"} {
+		out := lookup(fuse.FUSE_ROOT_ID, name)
+		assert.EqualValues(0, out.EntryValid, name)
+		assert.EqualValues(0, out.AttrValid, name)
+		assert.EqualValues(0, getAttr(out.NodeId).AttrValid, name)
+	}
+	jsonDir := lookup(fuse.FUSE_ROOT_ID, ".json")
+	assert.EqualValues(0, lookup(jsonDir.NodeId, "secret").AttrValid)
+	group := lookup(fuse.FUSE_ROOT_ID, "group")
+	assert.EqualValues(1, lookup(group.NodeId, "secret").AttrValid)
+
+	// Forgotten nodes are no longer known to be secrets.
+	fs.Forget(secret.NodeId, 1)
+	assert.EqualValues(0, getAttr(secret.NodeId).AttrValid)
+	assert.Equal(fuse.ENOENT, fs.Lookup(&fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, "missing", &fuse.EntryOut{}))
+}
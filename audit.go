@@ -0,0 +1,166 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// AuditEvent records an open of a secret. Events are numbered and chained: each includes the
+// SHA-256 of the previous line of the log, so that modified or removed lines are detected.
+type AuditEvent struct {
+	Seq       uint64    `json:"seq"`
+	Prev      string    `json:"prev"`
+	Time      time.Time `json:"time"`
+	Secret    string    `json:"secret"`
+	Uid       uint32    `json:"uid"`
+	Gid       uint32    `json:"gid"`
+	Pid       uint32    `json:"pid"`
+	Process   string    `json:"process,omitempty"`
+	Exe       string    `json:"exe,omitempty"`
+	Write     bool      `json:"write,omitempty"`
+	Allowed   bool      `json:"allowed"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// AuditLog writes a JSON event per line for every open of a secret, separately from the debug
+// log, so that it can be shipped to and queried by security tooling. A nil AuditLog discards
+// events.
+//
+// Truncation of the end of the log can't be detected from the chain alone. The head of the
+// chain (see Anchor) should periodically be recorded elsewhere, e.g. in syslog, to compare with.
+type AuditLog struct {
+	out  io.Writer
+	seq  uint64
+	head string
+	lock sync.Mutex
+	now  func() time.Time
+}
+
+// NewAuditLog creates an audit log writing a new chain to out.
+func NewAuditLog(out io.Writer) *AuditLog {
+	return &AuditLog{out: out, now: time.Now}
+}
+
+// OpenAuditLog creates an audit log appending to file. The chain of existing events in file is
+// verified and continued.
+func OpenAuditLog(file string) (*AuditLog, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	seq, head, err := VerifyAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %s: %v", file, err)
+	}
+	a := NewAuditLog(f)
+	a.seq, a.head = seq, head
+	return a, nil
+}
+
+// VerifyAuditLog checks the chain of events read from r, returning the sequence number and hash
+// of the last event.
+func VerifyAuditLog(r io.Reader) (seq uint64, head string, err error) {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return 0, "", fmt.Errorf("line %d: %v", line, err)
+		}
+		if event.Seq != seq+1 || event.Prev != head {
+			return 0, "", fmt.Errorf("line %d: chain broken, expected seq %d after %s", line, seq+1, head)
+		}
+		seq, head = event.Seq, auditHash(scanner.Bytes())
+	}
+	return seq, head, scanner.Err()
+}
+
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// Anchor returns the sequence number and hash of the last event written.
+func (a *AuditLog) Anchor() (seq uint64, head string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.seq, a.head
+}
+
+// Record logs an open of the named secret by the caller.
+func (a *AuditLog) Record(name string, context *fuse.Context, write, allowed bool) {
+	a.RecordRequest(name, context, "", write, allowed)
+}
+
+// RecordRequest is like Record, for the FUSE operation with the given request ID.
+func (a *AuditLog) RecordRequest(name string, context *fuse.Context, requestID string, write, allowed bool) {
+	if a == nil {
+		return
+	}
+	event := AuditEvent{Time: a.now().UTC(), Secret: name, Write: write, Allowed: allowed, RequestID: requestID}
+	if context != nil {
+		event.Uid, event.Gid, event.Pid = context.Uid, context.Gid, context.Pid
+		event.Process, event.Exe = processName(context.Pid)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	event.Seq, event.Prev = a.seq+1, a.head
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	// Write errors are ignored: failing to audit must not make secrets unavailable.
+	if _, err := a.out.Write(append(line, '\n')); err == nil {
+		a.seq, a.head = event.Seq, auditHash(line)
+	}
+}
+
+// Close closes the underlying file, if any.
+func (a *AuditLog) Close() error {
+	if c, ok := a.out.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// processName returns the command name and executable path of a process. Either is empty if
+// unknown, e.g. because the process already exited.
+func processName(pid uint32) (comm, exe string) {
+	if pid == 0 {
+		return "", ""
+	}
+	dir := filepath.Join(procDir, strconv.FormatUint(uint64(pid), 10))
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		comm = strings.TrimSpace(string(data))
+	}
+	exe, _ = os.Readlink(filepath.Join(dir, "exe"))
+	return comm, exe
+}
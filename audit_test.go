@@ -0,0 +1,133 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+	dir, cleanup := fakeProc()
+	defer cleanup()
+
+	var out bytes.Buffer
+	audit := NewAuditLog(&out)
+	audit.now = func() time.Time { return time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+	audit.Record("db.password", &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 100}, Pid: 100}, false, true)
+	audit.Record("hmac.key", &fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 100}, Pid: 300}, true, false)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(lines, 2)
+
+	var event AuditEvent
+	assert.NoError(json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(AuditEvent{
+		Seq:     1,
+		Time:    time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC),
+		Secret:  "db.password",
+		Uid:     1000,
+		Gid:     100,
+		Pid:     100,
+		Process: "app",
+		Exe:     filepath.Join(dir, "bin", "app"),
+		Allowed: true,
+	}, event)
+	assert.Contains(lines[0], `"time":"2015-06-01T12:00:00Z"`)
+
+	event = AuditEvent{}
+	assert.NoError(json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal("hmac.key", event.Secret)
+	assert.EqualValues(2, event.Seq)
+	assert.Equal(auditHash([]byte(lines[0])), event.Prev)
+	assert.Empty(event.Process, "unknown pid")
+	assert.True(event.Write)
+	assert.False(event.Allowed)
+
+	out.Reset()
+	audit.RecordRequest("db.password", nil, "4bf92f3577b34da6a3ce929d0e0e4736", false, true)
+	event = AuditEvent{}
+	assert.NoError(json.Unmarshal(out.Bytes(), &event))
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", event.RequestID)
+	assert.NotContains(lines[0], "request_id")
+
+	var nilAudit *AuditLog
+	nilAudit.Record("db.password", nil, false, true)
+}
+
+func TestAuditLogChain(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := ioutil.TempFile("", "audit")
+	assert.NoError(err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	audit, err := OpenAuditLog(file.Name())
+	assert.NoError(err)
+	audit.Record("a", nil, false, true)
+	audit.Record("b", nil, false, true)
+	audit.Close()
+
+	// Reopening continues the chain.
+	audit, err = OpenAuditLog(file.Name())
+	assert.NoError(err)
+	seq, head := audit.Anchor()
+	assert.EqualValues(2, seq)
+	audit.Record("c", nil, false, true)
+	seq, head = audit.Anchor()
+	audit.Close()
+
+	data, err := ioutil.ReadFile(file.Name())
+	assert.NoError(err)
+	verifiedSeq, verifiedHead, err := VerifyAuditLog(bytes.NewReader(data))
+	assert.NoError(err)
+	assert.EqualValues(3, verifiedSeq)
+	assert.Equal(head, verifiedHead)
+	assert.EqualValues(3, seq)
+
+	lines := strings.SplitAfter(string(data), "\n")
+
+	// Modified events break the chain.
+	modified := strings.Replace(string(data), `"secret":"b"`, `"secret":"x"`, 1)
+	_, _, err = VerifyAuditLog(strings.NewReader(modified))
+	assert.Error(err)
+
+	// So do removed events.
+	_, _, err = VerifyAuditLog(strings.NewReader(lines[0] + lines[2]))
+	assert.Error(err)
+
+	// Truncation is only detected by comparing with an anchor.
+	truncatedSeq, truncatedHead, err := VerifyAuditLog(strings.NewReader(lines[0] + lines[1]))
+	assert.NoError(err)
+	assert.EqualValues(2, truncatedSeq)
+	assert.NotEqual(head, truncatedHead)
+
+	// Broken logs aren't appended to.
+	assert.NoError(ioutil.WriteFile(file.Name(), []byte(modified), 0600))
+	_, err = OpenAuditLog(file.Name())
+	assert.Error(err)
+}
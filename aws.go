@@ -0,0 +1,388 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+var (
+	// awsMetadataURL is the EC2 instance metadata service.
+	awsMetadataURL = "http://169.254.169.254"
+	// awsContainerURL serves the credentials of ECS tasks.
+	awsContainerURL = "http://169.254.170.2"
+)
+
+// Tags and labels of cloud secrets which set the attributes of their files, as the mode, owner
+// and group of Keywhiz secrets do. Prefixed, since tags like "owner" are commonly used for other
+// purposes.
+const (
+	cloudModeTag  = "kwfs-mode"
+	cloudOwnerTag = "kwfs-owner"
+	cloudGroupTag = "kwfs-group"
+)
+
+// awsCredentials sign requests to AWS. Temporary credentials have a session token and expire.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// AWSBackend serves secrets from AWS Secrets Manager. Secrets whose name starts with a prefix are
+// served under their name without it, so that "/" in names makes directories. Credentials are
+// taken from the environment (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN), or
+// else the ECS task role or EC2 instance role.
+type AWSBackend struct {
+	*log.Logger
+	http     *http.Client
+	region   string
+	prefix   string
+	endpoint string
+
+	lock        sync.Mutex
+	credentials *awsCredentials
+}
+
+// awsSecret is a secret as described by ListSecrets and DescribeSecret.
+type awsSecret struct {
+	Name            string
+	CreatedDate     float64
+	LastChangedDate float64
+	Tags            []struct {
+		Key   string
+		Value string
+	}
+}
+
+// NewAWSBackend returns a backend for the secrets of region whose name starts with prefix.
+func NewAWSBackend(region, prefix string, timeout time.Duration, logConfig log.Config) (*AWSBackend, error) {
+	if region == "" {
+		return nil, errors.New("no AWS region")
+	}
+	return &AWSBackend{
+		Logger:   log.New("kwfs_aws", logConfig),
+		http:     &http.Client{Timeout: timeout},
+		region:   region,
+		prefix:   prefix,
+		endpoint: fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", region),
+	}, nil
+}
+
+// List lists the secrets under the prefix. Listings don't include content or its length, which
+// file attributes need, so each secret's value is also read.
+func (b *AWSBackend) List() ([]Secret, bool) {
+	var described []awsSecret
+	request := map[string]interface{}{"MaxResults": 100}
+	if b.prefix != "" {
+		request["Filters"] = []map[string]interface{}{{"Key": "name", "Values": []string{b.prefix}}}
+	}
+	for {
+		var response struct {
+			SecretList []awsSecret
+			NextToken  string
+		}
+		if err := b.call("ListSecrets", request, &response); err != nil {
+			b.Errorf("Error listing AWS secrets: %v", err)
+			return nil, false
+		}
+		described = append(described, response.SecretList...)
+		if response.NextToken == "" {
+			break
+		}
+		request["NextToken"] = response.NextToken
+	}
+
+	secrets := []Secret{}
+	for _, d := range described {
+		// The name filter matches prefixes of words too, not only of the whole name.
+		if !strings.HasPrefix(d.Name, b.prefix) || d.Name == b.prefix {
+			continue
+		}
+		secret, err := b.secret(d)
+		if _, deleted := err.(SecretDeleted); deleted {
+			continue
+		} else if err != nil {
+			b.Errorf("Error listing AWS secrets: %v", err)
+			return nil, false
+		}
+		secrets = append(secrets, *secret)
+	}
+	return secrets, true
+}
+
+// Fetch reads the current value of a secret.
+func (b *AWSBackend) Fetch(name string) (*Secret, error) {
+	var d awsSecret
+	if err := b.call("DescribeSecret", map[string]string{"SecretId": b.prefix + name}, &d); err != nil {
+		if _, deleted := err.(SecretDeleted); !deleted {
+			b.Errorf("Error retrieving AWS secret %v: %v", name, err)
+		}
+		return nil, err
+	}
+	return b.secret(d)
+}
+
+// Invalidate does nothing, since the backend holds nothing per secret.
+func (b *AWSBackend) Invalidate(name string) {}
+
+// secret reads the current value of a described secret.
+func (b *AWSBackend) secret(d awsSecret) (*Secret, error) {
+	var value struct {
+		SecretString string
+		SecretBinary []byte
+	}
+	if err := b.call("GetSecretValue", map[string]string{"SecretId": d.Name}, &value); err != nil {
+		return nil, err
+	}
+	data := value.SecretBinary
+	if data == nil {
+		data = []byte(value.SecretString)
+	}
+
+	tags := map[string]string{}
+	for _, tag := range d.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return &Secret{
+		Name:      strings.TrimPrefix(d.Name, b.prefix),
+		Content:   decodedContent(data),
+		Length:    uint64(len(data)),
+		CreatedAt: awsTime(d.CreatedDate),
+		UpdatedAt: awsTime(d.LastChangedDate),
+		Mode:      tags[cloudModeTag],
+		Owner:     tags[cloudOwnerTag],
+		Group:     tags[cloudGroupTag],
+	}, nil
+}
+
+// awsTime converts AWS timestamps, in fractional seconds since the epoch.
+func awsTime(seconds float64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+}
+
+// call makes a Secrets Manager API request and decodes its response into v. Secrets which don't
+// exist, or are scheduled for deletion, are reported as SecretDeleted.
+func (b *AWSBackend) call(action string, request, v interface{}) error {
+	credentials, err := b.currentCredentials()
+	if err != nil {
+		return fmt.Errorf("no AWS credentials: %v", err)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", b.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager."+action)
+	signAWSRequest(req, body, credentials, b.region, "secretsmanager", time.Now())
+
+	now := time.Now()
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b.Infof("%s %d %v", action, resp.StatusCode, time.Since(now))
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &failure)
+		if strings.HasSuffix(failure.Type, "ResourceNotFoundException") ||
+			(strings.HasSuffix(failure.Type, "InvalidRequestException") && strings.Contains(failure.Message, "marked for deletion")) {
+			return SecretDeleted{}
+		}
+		return fmt.Errorf("%s failed with status %d: %s %s", action, resp.StatusCode, failure.Type, failure.Message)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// currentCredentials returns credentials to sign requests with, refreshing temporary credentials
+// shortly before they expire.
+func (b *AWSBackend) currentCredentials() (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.credentials != nil && time.Now().Add(5*time.Minute).Before(b.credentials.Expiration) {
+		return b.credentials, nil
+	}
+	credentials, err := b.roleCredentials()
+	if err != nil {
+		return nil, err
+	}
+	b.credentials = credentials
+	return credentials, nil
+}
+
+// roleCredentials fetches temporary credentials of the ECS task role, or else the EC2 instance
+// role (with IMDSv2).
+func (b *AWSBackend) roleCredentials() (*awsCredentials, error) {
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return b.fetchCredentials(awsContainerURL+uri, nil)
+	}
+
+	req, err := http.NewRequest("PUT", awsMetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := b.metadata(req)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+
+	base := awsMetadataURL + "/latest/meta-data/iam/security-credentials/"
+	req, err = http.NewRequest("GET", base, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	roles, err := b.metadata(req)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, errors.New("no instance role")
+	}
+	return b.fetchCredentials(base+url.PathEscape(role), header)
+}
+
+// fetchCredentials reads credentials in the JSON format of the ECS and EC2 metadata services.
+func (b *AWSBackend) fetchCredentials(u string, header http.Header) (*awsCredentials, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	data, err := b.metadata(req)
+	if err != nil {
+		return nil, err
+	}
+	var credentials awsCredentials
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, err
+	}
+	if credentials.AccessKeyID == "" {
+		return nil, fmt.Errorf("no credentials at %s", u)
+	}
+	return &credentials, nil
+}
+
+// metadata makes a request to a metadata service.
+func (b *AWSBackend) metadata(req *http.Request) ([]byte, error) {
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: status %d", req.Method, req.URL, resp.StatusCode)
+	}
+	return data, nil
+}
+
+// signAWSRequest signs a request with AWS Signature Version 4.
+func signAWSRequest(req *http.Request, body []byte, credentials *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payload := sha256.Sum256(body)
+	canonical := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payload[:])}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	hashed := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hashed[:])}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(credentials.SecretAccessKey, date, region, service), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsSigningKey derives the key signing requests for a day, region and service.
+func awsSigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAWSSigningKey(t *testing.T) {
+	// Example from the AWS Signature Version 4 documentation.
+	key := awsSigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	assert.Equal(t, "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d", hex.EncodeToString(key))
+}
+
+func TestAWSBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(403)
+			return
+		}
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		switch target := r.Header.Get("X-Amz-Target"); {
+		case target == "secretsmanager.ListSecrets" && request["NextToken"] == nil:
+			fmt.Fprint(w, `{"SecretList": [{"Name": "prod/db", "CreatedDate": 1.5e9, "Tags": [{"Key": "kwfs-mode", "Value": "0400"}]}], "NextToken": "2"}`)
+		case target == "secretsmanager.ListSecrets":
+			fmt.Fprint(w, `{"SecretList": [{"Name": "prod/tls/key"}, {"Name": "production"}]}`)
+		case target == "secretsmanager.DescribeSecret" && request["SecretId"] == "prod/db":
+			fmt.Fprint(w, `{"Name": "prod/db", "Tags": [{"Key": "kwfs-owner", "Value": "db"}]}`)
+		case target == "secretsmanager.GetSecretValue" && request["SecretId"] == "prod/db":
+			fmt.Fprint(w, `{"SecretString": "password"}`)
+		case target == "secretsmanager.GetSecretValue" && request["SecretId"] == "prod/tls/key":
+			fmt.Fprint(w, `{"SecretBinary": "AAEC"}`)
+		default:
+			w.WriteHeader(400)
+			fmt.Fprint(w, `{"__type": "ResourceNotFoundException", "message": "not found"}`)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	backend, err := NewAWSBackend("us-east-1", "prod/", time.Second, logConfig)
+	assert.NoError(err)
+	backend.endpoint = server.URL
+
+	secrets, ok := backend.List()
+	assert.True(ok)
+	assert.Len(secrets, 2)
+	assert.Equal("db", secrets[0].Name)
+	assert.Equal("0400", secrets[0].Mode)
+	assert.Equal(int64(1.5e9), secrets[0].CreatedAt.Unix())
+	assert.Equal("tls/key", secrets[1].Name)
+	assert.Equal([]byte{0, 1, 2}, secrets[1].Content.Bytes())
+
+	secret, err := backend.Fetch("db")
+	assert.NoError(err)
+	assert.Equal("password", string(secret.Content.Bytes()))
+	assert.EqualValues(8, secret.Length)
+	assert.Equal("db", secret.Owner)
+
+	_, err = backend.Fetch("missing")
+	assert.Equal(SecretDeleted{}, err)
+}
+
+func TestAWSInstanceRoleCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+			fmt.Fprint(w, "imds-token")
+		case r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token":
+			w.WriteHeader(401)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "app-role\n")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/app-role":
+			fmt.Fprintf(w, `{"AccessKeyId": "ASIA", "SecretAccessKey": "secret", "Token": "session", "Expiration": "%s"}`, expiration)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer metadata.Close()
+	defer func(u string) { awsMetadataURL = u }(awsMetadataURL)
+	awsMetadataURL = metadata.URL
+
+	backend, _ := NewAWSBackend("us-east-1", "", time.Second, logConfig)
+	credentials, err := backend.currentCredentials()
+	assert.NoError(err)
+	assert.Equal("ASIA", credentials.AccessKeyID)
+	assert.Equal("session", credentials.Token)
+
+	// Cached until shortly before expiring.
+	metadata.Close()
+	credentials, err = backend.currentCredentials()
+	assert.NoError(err)
+	assert.Equal("ASIA", credentials.AccessKeyID)
+}
@@ -0,0 +1,33 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// SecretBackend is a source of secrets served by the filesystem. The Keywhiz client is the
+// default implementation; other backends only need to implement this interface. Secrets must
+// carry their Length, which file attributes report.
+type SecretBackend interface {
+	// List returns all secrets, usually without content, and false if they couldn't be listed.
+	List() (secrets []Secret, ok bool)
+	// Fetch returns a secret with its content, or SecretDeleted if it doesn't exist.
+	Fetch(name string) (secret *Secret, err error)
+	// Invalidate drops anything held for a secret, so that the next Fetch gets it from its
+	// source. Called when a secret is explicitly refreshed, or the cache cleared.
+	Invalidate(name string)
+}
+
+// tracedBackend is implemented by backends which can record their requests in a trace.
+type tracedBackend interface {
+	TracedFetch(name string, span *Span) (secret *Secret, err error)
+}
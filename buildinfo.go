@@ -0,0 +1,83 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// BuildInfo describes the build of keywhiz-fs, as set with ldflags by the Makefile. It is served
+// in .buildinfo and summarized in the User-Agent of server requests, so that server operators
+// can tell which versions are talking to them.
+type BuildInfo struct {
+	Version      string    `json:"version"`
+	Revision     string    `json:"revision"`
+	BuildTime    time.Time `json:"build_time"`
+	BuildMachine string    `json:"build_machine"`
+	FsVersion    string    `json:"fs_version"`
+	GoVersion    string    `json:"go_version"`
+}
+
+// currentBuildInfo returns the build of the running binary. The build time is the zero time if
+// it wasn't set.
+func currentBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:      buildVersion,
+		Revision:     buildRevision,
+		BuildMachine: buildMachine,
+		FsVersion:    fsVersion,
+		GoVersion:    runtime.Version(),
+	}
+	if seconds, err := strconv.ParseInt(buildTime, 10, 64); err == nil && seconds > 0 {
+		info.BuildTime = time.Unix(seconds, 0).UTC()
+	}
+	return info
+}
+
+// buildInfoJSON returns the content of .buildinfo.
+func buildInfoJSON() []byte {
+	data, err := json.MarshalIndent(currentBuildInfo(), "", "  ")
+	panicOnError(err)
+	return append(data, '\n')
+}
+
+// userAgent returns the User-Agent of server requests, e.g.
+// "keywhiz-fs/v2.1.0 (rev 1a2b3c4d5e6f; built 2015-06-01; go1.21.0)".
+func (b BuildInfo) userAgent() string {
+	revision := b.Revision
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	built := "unknown"
+	if !b.BuildTime.IsZero() {
+		built = b.BuildTime.Format("2006-01-02")
+	}
+	return fmt.Sprintf("keywhiz-fs/%s (rev %s; built %s; %s)", b.Version, revision, built, b.GoVersion)
+}
+
+// userAgentTransport sets the User-Agent of requests to the build of keywhiz-fs.
+type userAgentTransport struct {
+	http.RoundTripper
+	userAgent string
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.RoundTripper.RoundTrip(req)
+}
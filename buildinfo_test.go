@@ -0,0 +1,49 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	info := BuildInfo{Version: "v2.1.0", Revision: "1a2b3c4d5e6f7a8b9c0d", BuildTime: time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC), GoVersion: "go1.21.0"}
+	assert.Equal("keywhiz-fs/v2.1.0 (rev 1a2b3c4d5e6f; built 2015-06-01; go1.21.0)", info.userAgent())
+	assert.Equal("keywhiz-fs/unknown (rev unknown; built unknown; go1.21.0)", BuildInfo{Version: "unknown", Revision: "unknown", GoVersion: "go1.21.0"}.userAgent())
+
+	var served BuildInfo
+	assert.NoError(json.Unmarshal(buildInfoJSON(), &served))
+	assert.Equal(currentBuildInfo(), served)
+	assert.Equal(fsVersion, served.FsVersion)
+	assert.True(served.BuildTime.IsZero(), "not set by ldflags in tests")
+
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: userAgentTransport{http.DefaultTransport, info.userAgent()}}
+	resp, err := client.Get(server.URL)
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(info.userAgent(), userAgent)
+}
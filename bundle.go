@@ -0,0 +1,268 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Bundle is a pre-fetched snapshot of secrets. It is produced on a machine which can reach the
+// server (`keywhiz-fs bundle`) and used to bootstrap a mount when the backend is unreachable.
+type Bundle struct {
+	CreatedAt time.Time         `json:"created_at"`
+	Secrets   []json.RawMessage `json:"secrets"`
+}
+
+// sealedBundle is the on-disk format of a bundle. Payload is the AES-GCM encrypted Bundle and
+// Signature is an ed25519 signature over nonce and payload.
+type sealedBundle struct {
+	Nonce     []byte `json:"nonce"`
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// ParsedSecrets deserializes the secrets contained in a bundle.
+func (b Bundle) ParsedSecrets() (secrets []Secret, err error) {
+	for _, data := range b.Secrets {
+		s, err := ParseSecret(data)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, *s)
+	}
+	return secrets, nil
+}
+
+// SealBundle encrypts a bundle with a 256-bit key and signs the result.
+func SealBundle(b Bundle, key []byte, signingKey ed25519.PrivateKey) ([]byte, error) {
+	plaintext, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := bundleCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	payload := gcm.Seal(nil, nonce, plaintext, nil)
+	signature := ed25519.Sign(signingKey, append(nonce, payload...))
+
+	return json.Marshal(sealedBundle{nonce, payload, signature})
+}
+
+// OpenBundle verifies the signature on a sealed bundle and decrypts it.
+func OpenBundle(data, key []byte, verifyKey ed25519.PublicKey) (*Bundle, error) {
+	var sealed sealedBundle
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("Fail to deserialize bundle: %v", err)
+	}
+
+	if !ed25519.Verify(verifyKey, append(sealed.Nonce, sealed.Payload...), sealed.Signature) {
+		return nil, errors.New("bundle signature verification failed")
+	}
+
+	gcm, err := bundleCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("bundle has invalid nonce")
+	}
+	plaintext, err := gcm.Open(nil, sealed.Nonce, sealed.Payload, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to decrypt bundle: %v", err)
+	}
+
+	var b Bundle
+	if err := json.Unmarshal(plaintext, &b); err != nil {
+		return nil, fmt.Errorf("Fail to deserialize bundle: %v", err)
+	}
+	return &b, nil
+}
+
+// ReadBundle loads a sealed bundle and its keys from files.
+func ReadBundle(bundleFile, keyFile, verifyKeyFile string) (*Bundle, error) {
+	data, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := readBundleKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	verifyKey, err := readBundleVerifyKey(verifyKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return OpenBundle(data, key, verifyKey)
+}
+
+// FetchBundle builds a bundle from every secret the client has access to.
+func FetchBundle(client *Client) (*Bundle, error) {
+	secrets, ok := client.List()
+	if !ok {
+		return nil, errors.New("unable to list secrets")
+	}
+
+	b := &Bundle{CreatedAt: time.Now()}
+	for _, s := range secrets {
+		data, err := client.RawSecret(s.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch secret %v: %v", s.Name, err)
+		}
+		b.Secrets = append(b.Secrets, data)
+	}
+	return b, nil
+}
+
+func bundleCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("bundle key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// checkBundleKeys checks that the keys of an offline bundle are given and can be read, so that
+// a missing key is reported on startup rather than during an outage, when the bundle is needed.
+func checkBundleKeys(keyFile, verifyKeyFile string) error {
+	if keyFile == "" || verifyKeyFile == "" {
+		return errors.New("--bundle requires --bundle-key and --bundle-verify-key")
+	}
+	key, err := readBundleKey(keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to read bundle key: %v", err)
+	}
+	if _, err := bundleCipher(key); err != nil {
+		return err
+	}
+	if _, err := readBundleVerifyKey(verifyKeyFile); err != nil {
+		return fmt.Errorf("unable to read bundle verify key: %v", err)
+	}
+	return nil
+}
+
+// readBundleKey reads a hex-encoded 256-bit key from a file, or from the kernel keyring if file
+// is keyring:KEYRING:NAME.
+func readBundleKey(file string) ([]byte, error) {
+	read := ioutil.ReadFile
+	if isKeyringKey(file) {
+		read = readKeyringKey
+	}
+	data, err := read(file)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// sealingBundleKey returns the key to seal a bundle with, like readBundleKey. A key in the kernel
+// keyring is generated and stored there if it doesn't exist yet, so it is never written to disk,
+// and generated is set. Keyrings don't survive a reboot, so the caller must have the new key
+// backed up, see bundleKeyBackup.
+func sealingBundleKey(file string) (key []byte, generated bool, err error) {
+	key, err = readBundleKey(file)
+	notFound, ok := err.(KeyNotFound)
+	if !ok {
+		return key, false, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, false, err
+	}
+	if err := notFound.Key.Store([]byte(hex.EncodeToString(key))); err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+// bundleKeyBackup returns instructions to back up a key generated in the kernel keyring, named by
+// a keyring:KEYRING:NAME argument, and to restore it.
+func bundleKeyBackup(arg string) string {
+	key, err := parseKeyringKey(arg)
+	if err != nil {
+		return ""
+	}
+	ring := map[string]string{"session": "@s", "user": "@u"}[key.Keyring]
+	return fmt.Sprintf("Generated a new bundle key %s in the %s keyring. Keyrings are lost on reboot, "+
+		"and bundles sealed with the key can't be opened without it: back it up now, away from the "+
+		"bundle, with \"keyctl pipe %%user:%s > FILE\", and restore it with \"keyctl padd user %s %s < FILE\".",
+		key.Name, key.Keyring, key.Name, key.Name, ring)
+}
+
+// readBundleSigningKey reads a PEM-encoded (PKCS#8) ed25519 private key from a file.
+func readBundleSigningKey(file string) (ed25519.PrivateKey, error) {
+	block, err := readPEMBlock(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%v does not contain an ed25519 private key", file)
+	}
+	return signingKey, nil
+}
+
+// readBundleVerifyKey reads a PEM-encoded (PKIX) ed25519 public key from a file.
+func readBundleVerifyKey(file string) (ed25519.PublicKey, error) {
+	block, err := readPEMBlock(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	verifyKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%v does not contain an ed25519 public key", file)
+	}
+	return verifyKey, nil
+}
+
+func readPEMBlock(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %v", file)
+	}
+	return block, nil
+}
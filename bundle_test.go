@@ -0,0 +1,112 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	panicOnError(err)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	panicOnError(err)
+
+	bundle := Bundle{
+		CreatedAt: time.Date(2016, time.June, 29, 20, 5, 21, 0, time.UTC),
+		Secrets:   []json.RawMessage{fixture("secret.json"), fixture("secretNormalOwner.json")},
+	}
+	sealed, err := SealBundle(bundle, key, priv)
+	assert.NoError(err)
+	assert.NotContains(string(sealed), "Nobody_PgPass")
+
+	opened, err := OpenBundle(sealed, key, pub)
+	assert.NoError(err)
+	assert.True(bundle.CreatedAt.Equal(opened.CreatedAt))
+
+	secrets, err := opened.ParsedSecrets()
+	assert.NoError(err)
+	assert.Len(secrets, 2)
+	assert.Equal("Nobody_PgPass", secrets[0].Name)
+	assert.EqualValues("asddas", secrets[0].Content.Bytes())
+
+	// Wrong decryption key
+	otherKey := make([]byte, 32)
+	_, err = OpenBundle(sealed, otherKey, pub)
+	assert.Error(err)
+
+	// Wrong verification key
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = OpenBundle(sealed, key, otherPub)
+	assert.Error(err)
+}
+
+func TestCheckBundleKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-bundle")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "bundle.key")
+	verifyKeyFile := filepath.Join(dir, "bundle.pub")
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	panicOnError(err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	panicOnError(err)
+	panicOnError(ioutil.WriteFile(verifyKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	panicOnError(ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(make([]byte, 32))+"\n"), 0600))
+
+	assert.NoError(checkBundleKeys(keyFile, verifyKeyFile))
+	assert.EqualError(checkBundleKeys("", verifyKeyFile), "--bundle requires --bundle-key and --bundle-verify-key")
+	assert.EqualError(checkBundleKeys(keyFile, ""), "--bundle requires --bundle-key and --bundle-verify-key")
+	assert.Error(checkBundleKeys(filepath.Join(dir, "missing.key"), verifyKeyFile))
+	assert.Error(checkBundleKeys(keyFile, filepath.Join(dir, "missing.pub")))
+
+	panicOnError(ioutil.WriteFile(keyFile, []byte("abcd\n"), 0600))
+	assert.EqualError(checkBundleKeys(keyFile, verifyKeyFile), "bundle key must be 32 bytes, got 2")
+}
+
+func TestCacheBootstrapFromBundle(t *testing.T) {
+	assert := assert.New(t)
+
+	created := time.Now().Add(-24 * time.Hour)
+	bundle := &Bundle{CreatedAt: created, Secrets: []json.RawMessage{fixture("secret.json")}}
+
+	cache := NewCache(FailingBackend{}, timeouts, logConfig, nil)
+	assert.False(cache.Warmup())
+	assert.NoError(cache.Bootstrap(bundle))
+	assert.Equal(1, cache.Len())
+
+	// Backend is still failing, so the bundled content is served.
+	secret, ok := cache.Secret("Nobody_PgPass")
+	assert.True(ok)
+	assert.EqualValues("asddas", secret.Content.Bytes())
+}
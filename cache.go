@@ -15,32 +15,90 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/square/keywhiz-fs/log"
 )
 
-// SecretBackend represents an interface for storing secrets.
-type SecretBackend interface {
-	Secret(string) (secret *Secret, err error)
-	SecretList() (secretList []Secret, ok bool)
-}
-
 // Timeouts contains configuration for timeouts:
 // timeout_backend_deadline: optimistic timeout to wait for cache
 // timeout_max_wait: timeout for client to get data from server
+//
+// Secret content, directory listings and control files have separate budgets, so a large secret
+// can be given time to arrive without slowing down listings, and the other way around.
 type Timeouts struct {
 	// FUSE may make many lookups in quick succession. If cached data is recent within the threshold,
 	// a backend request is not attempted.
 	Fresh time.Duration
 	// BackendDeadline is distinct from the backend timeout. It is an optimistic timeout to wait
-	// until resorting to cached data.
+	// for secret content until resorting to cached data.
 	BackendDeadline time.Duration
-	MaxWait         time.Duration
-	// Controls how long to keep a deleted entry before purging it.
+	// MaxWait is how long a filesystem operation on a secret may wait for its content.
+	MaxWait time.Duration
+	// Controls how long to keep a deleted entry before purging it. Deleted entries with content
+	// keep being served until then.
 	DeletionDelay time.Duration
+	// ListDeadline and ListWait are the BackendDeadline and MaxWait of directory listings. Zero
+	// means the same as for secret content.
+	ListDeadline time.Duration
+	ListWait     time.Duration
+	// ControlWait is how long operations on control files may take. Zero means MaxWait.
+	ControlWait time.Duration
+}
+
+// listDeadline returns the optimistic timeout to wait for a listing from the backend.
+func (t Timeouts) listDeadline() time.Duration {
+	if t.ListDeadline > 0 {
+		return t.ListDeadline
+	}
+	return t.BackendDeadline
+}
+
+// listWait returns how long a directory listing may take.
+func (t Timeouts) listWait() time.Duration {
+	if t.ListWait > 0 {
+		return t.ListWait
+	}
+	return t.MaxWait
 }
 
+// controlWait returns how long an operation on a control file may take.
+func (t Timeouts) controlWait() time.Duration {
+	if t.ControlWait > 0 {
+		return t.ControlWait
+	}
+	return t.MaxWait
+}
+
+// degradedAfter is the number of consecutive failed backend requests after which the cache stops
+// waiting on the backend, as when offline.
+const degradedAfter = 3
+
+// degradedProbeInterval is how often a degraded cache lets a request through to the backend, in
+// the background, to detect that it recovered.
+const degradedProbeInterval = 30 * time.Second
+
+// defaultMissBackoff is the longest time a secret the backend reported missing is answered from
+// memory, unless changed with SetMissBackoff.
+const defaultMissBackoff = 30 * time.Second
+
+// ErrOffline is returned for requests which need the backend while the cache is offline.
+var ErrOffline = errors.New("offline")
+
+// errBackendTimeout is recorded for secrets whose fetch didn't complete within the backend
+// deadline.
+var errBackendTimeout = errors.New("backend timeout")
+
+// reloadConcurrency bounds the number of secrets fetched in parallel by Reload.
+const reloadConcurrency = 8
+
 // Cache contains necessary state to return secrets, using previously cached content or retrieving
 // from a server if necessary.
 type Cache struct {
@@ -49,6 +107,91 @@ type Cache struct {
 	backend   SecretBackend
 	timeouts  Timeouts
 	now       func() time.Time
+	flights   *flightGroup
+	listeners []func(SecretChange)
+	// listingListeners are called with every listing fetched from the backend.
+	listingListeners []func([]Secret)
+	// listedAt is when the listing was last fetched from the backend, in nanoseconds since the
+	// epoch. Accessed atomically.
+	listedAt int64
+	// fresh is timeouts.Fresh, in nanoseconds, adjustable at runtime. Accessed atomically.
+	fresh int64
+	// maxStale is how long past the fresh threshold cached content is served right away while
+	// being refreshed in the background, in nanoseconds. Accessed atomically.
+	maxStale int64
+	// corrupt holds the names of secrets whose content, when last fetched, didn't match its digest
+	// or signature. withheld holds those whose cached content isn't served, by the error policy,
+	// since the backend couldn't be reached. fetchErrors holds the error of the last fetch of
+	// secrets for which the backend couldn't be reached or refused access. All are guarded by
+	// corruptLock.
+	corrupt     map[string]bool
+	withheld    map[string]bool
+	fetchErrors map[string]error
+	corruptLock sync.Mutex
+	// offline is set while only cached secrets are served, without any backend requests.
+	// failures counts consecutive failed backend requests, and probedAt is when a degraded cache
+	// last let a request through, on the monotonic clock (see monotonic). All accessed atomically.
+	offline  int32
+	failures int32
+	probedAt int64
+	// fallbackDir, if set, holds secret files served when secrets are neither cached nor
+	// available from the backend.
+	fallbackDir string
+	// prefetch bounds the number of concurrent requests fetching, after a listing, the content of
+	// secrets which changed or aren't cached. Prefetching is disabled when nil.
+	prefetch chan struct{}
+	// staleServed counts secrets served past the fresh threshold because the backend couldn't be
+	// reached.
+	staleServed metrics.Counter
+	// deletedServed counts secrets served while scheduled for deletion.
+	deletedServed metrics.Counter
+	// errorPolicy decides what happens to reads of cached secrets which couldn't be refreshed.
+	errorPolicy ErrorPolicy
+	// misses tracks names the backend recently reported missing, and missSuppressed counts
+	// the requests for them answered without asking the backend.
+	misses         *missTracker
+	missSuppressed metrics.Counter
+	// panics counts panics recovered from, in backend requests and FUSE operations.
+	panics metrics.Counter
+	// changes logs the secrets added, updated and removed, for .json/changes.
+	changes *ChangeLog
+	// servedSizes records the size of each secret served to a reader.
+	servedSizes metrics.Histogram
+}
+
+// ErrorPolicy decides whether cached content which couldn't be refreshed from the backend, past
+// the fresh threshold, is served.
+type ErrorPolicy string
+
+const (
+	// ServeStale serves the last content fetched, however old.
+	ServeStale ErrorPolicy = "stale"
+	// FailEIO fails reads of the secret with EIO.
+	FailEIO ErrorPolicy = "eio"
+	// FailENOENT hides the secret, as if it didn't exist.
+	FailENOENT ErrorPolicy = "enoent"
+)
+
+// SecretChange describes a change to a cached secret detected when refreshing from the backend.
+type SecretChange struct {
+	Name string
+	// Deleted is set when the backend reports the secret no longer exists.
+	Deleted bool
+}
+
+// CacheEntry describes a cached secret, without its content.
+type CacheEntry struct {
+	Name   string `json:"name"`
+	Length uint64 `json:"length"`
+	Mode   string `json:"mode,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Group  string `json:"group,omitempty"`
+	// Content is set when the content is cached, rather than only the listing.
+	Content bool      `json:"content"`
+	Updated time.Time `json:"updated"`
+	// Expires is when an entry scheduled for deletion is dropped.
+	Expires *time.Time `json:"expires,omitempty"`
+	Corrupt bool       `json:"corrupt,omitempty"`
 }
 
 type secretResult struct {
@@ -56,34 +199,400 @@ type secretResult struct {
 	err    error
 }
 
+// flightGroup coalesces concurrent backend requests for the same secret, so a burst of opens on
+// a hot secret results in a single request to the server.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done   chan struct{}
+	secret *Secret
+	err    error
+}
+
+// Do calls fetch, unless a call for the same name is already in flight, in which case it waits
+// for that call and shares its result.
+func (g *flightGroup) Do(name string, fetch func() (*Secret, error)) (*Secret, error) {
+	g.lock.Lock()
+	if call, ok := g.calls[name]; ok {
+		g.lock.Unlock()
+		<-call.done
+		return call.secret, call.err
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[name] = call
+	g.lock.Unlock()
+
+	call.secret, call.err = fetch()
+
+	g.lock.Lock()
+	delete(g.calls, name)
+	g.lock.Unlock()
+	close(call.done)
+
+	return call.secret, call.err
+}
+
 // NewCache initializes a Cache.
 func NewCache(backend SecretBackend, timeouts Timeouts, logConfig log.Config, now func() time.Time) *Cache {
 	logger := log.New("kwfs_cache", logConfig)
-	return &Cache{logger, NewSecretMap(timeouts, now), backend, timeouts, now}
+	flights := &flightGroup{calls: make(map[string]*flightCall)}
+	return &Cache{
+		Logger:         logger,
+		secretMap:      NewSecretMap(timeouts, now),
+		backend:        backend,
+		timeouts:       timeouts,
+		now:            now,
+		flights:        flights,
+		fresh:          int64(timeouts.Fresh),
+		corrupt:        map[string]bool{},
+		withheld:       map[string]bool{},
+		fetchErrors:    map[string]error{},
+		staleServed:    metrics.NilCounter{},
+		deletedServed:  metrics.NilCounter{},
+		errorPolicy:    ServeStale,
+		misses:         newMissTracker(defaultMissBackoff, now),
+		missSuppressed: metrics.NilCounter{},
+		panics:         metrics.NilCounter{},
+		changes:        NewChangeLog(changeLogSize, now),
+		servedSizes:    metrics.NilHistogram{},
+	}
+}
+
+// OnChange registers a function called whenever a refresh detects that the content of a cached
+// secret changed or that it was deleted. Listeners are called asynchronously.
+// Should only be called during initialization.
+func (c *Cache) OnChange(listener func(SecretChange)) {
+	c.listeners = append(c.listeners, listener)
+}
+
+// OnListing registers a function called with every listing fetched from the backend. Listeners
+// are called asynchronously. Should only be called during initialization.
+func (c *Cache) OnListing(listener func([]Secret)) {
+	c.listingListeners = append(c.listingListeners, listener)
+}
+
+func (c *Cache) notify(change SecretChange) {
+	c.Debugf("Secret changed: %+v", change)
+	for _, listener := range c.listeners {
+		go listener(change)
+	}
 }
 
 // Warmup reads the secret list from the backend to prime the cache.
 // Should only be called after creating a new cache on startup.
-func (c *Cache) Warmup() {
+func (c *Cache) Warmup() bool {
+	if c.Offline() {
+		return false
+	}
 	// Attempt to warmup cache
-	secrets, ok := c.backend.SecretList()
+	secrets, ok := c.backendList()
+	c.recordList(ok)
 	if ok {
+		var names []string
 		for _, backendSecret := range secrets {
 			c.secretMap.Put(backendSecret.Name, backendSecret, time.Time{})
+			names = append(names, backendSecret.Name)
 		}
+		go c.prefetchSecrets(names)
 	} else {
 		c.Warnf("Failed to warmup cache on startup")
 	}
+	return ok
+}
+
+// Bootstrap primes the cache with secrets from an offline bundle. Entries are timestamped
+// with the bundle creation time, so they are replaced as soon as the backend is reachable. The
+// timestamp is anchored to the monotonic clock, so that setting the system clock back can't make
+// them look fresh.
+func (c *Cache) Bootstrap(b *Bundle) error {
+	secrets, err := b.ParsedSecrets()
+	if err != nil {
+		return err
+	}
+	created := anchored(b.CreatedAt, c.secretMap.getNow())
+	for _, s := range secrets {
+		c.secretMap.Put(s.Name, s, created)
+	}
+	c.Infof("Bootstrapped cache with %d secrets from bundle created at %v", len(secrets), b.CreatedAt)
+	return nil
 }
 
 // Clear empties the internal cache. This function does not honor the
 // delayed deletion contract. The function is called when the user deletes
 // .clear_cache.
 func (c *Cache) Clear() {
+	for _, s := range c.secretMap.Values() {
+		c.backend.Invalidate(s.Name)
+	}
 	c.Infof("Cache cleared")
 	c.secretMap = NewSecretMap(c.timeouts, c.now)
 }
 
+// SetFallbackDir sets a directory of secret files, as read by ReadSecretsDir, which are served
+// when the cache is cold and the backend fails, so that critical secrets such as the host's own
+// certificates are always available. Fallback secrets are never cached, and a secret the backend
+// reports deleted, or whose content failed verification, isn't served from the directory.
+// Should only be called during initialization.
+func (c *Cache) SetFallbackDir(dir string) {
+	c.fallbackDir = dir
+}
+
+// fallbackSecrets returns the secrets of the fallback directory, if any.
+func (c *Cache) fallbackSecrets() []Secret {
+	if c.fallbackDir == "" {
+		return nil
+	}
+	dirSecrets, err := ReadSecretsDir(c.fallbackDir)
+	if err != nil {
+		c.Errorf("Unable to read fallback directory: %v", err)
+		return nil
+	}
+	secrets := []Secret{}
+	for _, s := range dirSecrets {
+		secrets = append(secrets, s.Secret())
+	}
+	return secrets
+}
+
+// fallbackSecret returns a secret of the fallback directory, if any.
+func (c *Cache) fallbackSecret(name string) *Secret {
+	for _, s := range c.fallbackSecrets() {
+		if s.Name == name {
+			c.Warnf("Serving %s from the fallback directory", name)
+			return &s
+		}
+	}
+	return nil
+}
+
+// cachedListOrFallback returns the cached listing, or the fallback directory's if the cache is
+// cold.
+func (c *Cache) cachedListOrFallback() []Secret {
+	secrets := c.cacheSecretList()
+	if len(secrets) == 0 {
+		return c.fallbackSecrets()
+	}
+	return secrets
+}
+
+// SetOffline switches offline mode, in which only cached secrets are served and the backend is
+// never used, e.g. for maintenance windows.
+func (c *Cache) SetOffline(offline bool) {
+	var value int32
+	if offline {
+		value = 1
+	}
+	if atomic.SwapInt32(&c.offline, value) != value {
+		c.Warnf("Offline mode enabled: %v", offline)
+	}
+}
+
+// Offline returns true in offline mode.
+func (c *Cache) Offline() bool {
+	return atomic.LoadInt32(&c.offline) == 1
+}
+
+// Degraded returns true while the backend is failing, in which case cached secrets are served
+// without waiting on it, as when offline. Degraded mode ends with the first successful backend
+// request, which is let through in the background every degradedProbeInterval.
+func (c *Cache) Degraded() bool {
+	return atomic.LoadInt32(&c.failures) >= degradedAfter
+}
+
+// Online returns true unless offline or degraded.
+func (c *Cache) Online() bool {
+	return !c.Offline() && !c.Degraded()
+}
+
+// Mode describes the mode of the cache: "online", "degraded" or "offline".
+func (c *Cache) Mode() string {
+	switch {
+	case c.Offline():
+		return "offline"
+	case c.Degraded():
+		return "degraded"
+	}
+	return "online"
+}
+
+// recordBackend tracks whether the backend is failing. Responses reporting a deleted secret or
+// corrupt content come from a working backend.
+func (c *Cache) recordBackend(err error) {
+	if !backendAnswered(err) {
+		if atomic.AddInt32(&c.failures, 1) == degradedAfter {
+			c.Warnf("Backend failed %d times in a row, serving cached secrets without waiting on it", degradedAfter)
+		}
+		return
+	}
+	if atomic.SwapInt32(&c.failures, 0) >= degradedAfter {
+		c.Infof("Backend recovered, leaving degraded mode")
+	}
+}
+
+// backendAnswered returns true if err, returned by a backend request, is an answer from the
+// backend rather than a failure to reach it. Refusing access is an answer.
+func backendAnswered(err error) bool {
+	switch err.(type) {
+	case nil, SecretDeleted, SecretTooLarge, ContentCorrupt, InvalidSignature:
+		return true
+	}
+	return accessDenied(err)
+}
+
+// recordList tracks whether the backend is failing, from the result of a listing.
+func (c *Cache) recordList(ok bool) {
+	if ok {
+		c.recordBackend(nil)
+	} else {
+		c.recordBackend(errors.New("listing failed"))
+	}
+}
+
+// probe returns true if a degraded cache should let a request through to the backend now.
+func (c *Cache) probe() bool {
+	last := atomic.LoadInt64(&c.probedAt)
+	now := monotonic(c.secretMap.getNow())
+	if last != 0 && now-last < int64(degradedProbeInterval) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&c.probedAt, last, now)
+}
+
+// Evict drops a secret from the cache, so that it is fetched from the backend when next used.
+// Returns false if it wasn't cached.
+func (c *Cache) Evict(name string) bool {
+	c.backend.Invalidate(name)
+	c.setCorrupt(name, false)
+	if !c.secretMap.Remove(name) {
+		return false
+	}
+	c.Infof("Evicted %s", name)
+	return true
+}
+
+// Entries describes the cached secrets, sorted by name.
+func (c *Cache) Entries() []CacheEntry {
+	entries := []CacheEntry{}
+	for _, e := range c.secretMap.Entries() {
+		s := e.Secret
+		entry := CacheEntry{
+			Name:    s.Name,
+			Length:  s.Length,
+			Mode:    s.Mode,
+			Owner:   s.Owner,
+			Group:   s.Group,
+			Content: !s.Content.Empty(),
+			Updated: e.Time,
+			Corrupt: c.Corrupt(s.Name),
+		}
+		if !e.ttl.IsZero() {
+			expires := e.ttl
+			entry.Expires = &expires
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Wipe overwrites the content of all cached secrets with zeros and empties the cache, so that
+// secrets don't linger in memory after the filesystem is unmounted.
+func (c *Cache) Wipe() {
+	c.secretMap.Wipe()
+	c.Infof("Cache wiped")
+}
+
+// Reload re-fetches the secret listing and the content of every cached secret from the backend,
+// regardless of freshness, and returns once done. The function is called when the user deletes
+// .reload.
+func (c *Cache) Reload() error {
+	if c.Offline() {
+		return ErrOffline
+	}
+	// Every cached secret is re-fetched below, so the listing isn't followed by a prefetch.
+	if _, ok := c.listSecrets(); !ok {
+		return errors.New("unable to list secrets")
+	}
+
+	var names []string
+	for _, s := range c.secretMap.Values() {
+		if !s.Content.Empty() {
+			names = append(names, s.Name)
+		}
+	}
+
+	failed := c.refreshAll(names, make(chan struct{}, reloadConcurrency))
+	c.Infof("Reloaded %d secrets", len(names))
+	if failed > 0 {
+		return fmt.Errorf("unable to reload %d of %d secrets", failed, len(names))
+	}
+	return nil
+}
+
+// refreshAll refreshes the named secrets, with at most as many concurrent requests as the capacity
+// of sem, and returns the number of secrets which couldn't be refreshed.
+func (c *Cache) refreshAll(names []string, sem chan struct{}) int {
+	var failed int32
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+			if err := c.Refresh(name); err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+		}(name)
+	}
+	wg.Wait()
+	return int(failed)
+}
+
+// SetPrefetch sets the number of secrets whose content is fetched in parallel after a listing
+// reports them changed or not yet cached, so that they are warm by the time they are read.
+// The bound is shared by overlapping listings. Zero disables prefetching.
+// Should only be called during initialization.
+func (c *Cache) SetPrefetch(workers int) {
+	if workers > 0 {
+		c.prefetch = make(chan struct{}, workers)
+	} else {
+		c.prefetch = nil
+	}
+}
+
+// prefetchSecrets fetches the content of the named secrets and returns once done.
+func (c *Cache) prefetchSecrets(names []string) {
+	if c.prefetch == nil || len(names) == 0 || c.Offline() {
+		return
+	}
+	start := time.Now()
+	failed := c.refreshAll(names, c.prefetch)
+	c.Infof("Prefetched %d secrets in %v, %d failed", len(names)-failed, time.Since(start), failed)
+}
+
+// Refresh re-fetches a single secret from the backend, regardless of freshness, and returns
+// once done. A secret which the backend reports deleted is scheduled for delayed deletion,
+// which is not an error. The function is called when the user deletes .refresh/<name>.
+func (c *Cache) Refresh(name string) error {
+	if c.Offline() {
+		return ErrOffline
+	}
+	c.backend.Invalidate(name)
+	result := <-c.backendSecret(name, nil)
+	if _, ok := result.err.(SecretDeleted); ok {
+		if s, ok := c.secretMap.Get(name); ok && !s.deleted {
+			c.secretMap.Delete(name)
+			c.recordRemoved(s)
+			c.notify(SecretChange{Name: name, Deleted: true})
+		}
+		return nil
+	}
+	return result.err
+}
+
 // Secret retrieves a Secret by name from cache or a server.
 //
 // Cache logic:
@@ -95,38 +604,234 @@ func (c *Cache) Clear() {
 //			* If backend returns deleted: set delayed deletion, return data from cache.
 //  3. If timeout backend deadline hit return whatever we have.
 func (c *Cache) Secret(name string) (*Secret, bool) {
+	return c.TracedSecret(name, nil)
+}
+
+// TracedSecret is like Secret, recording whether the cache was hit on span and any backend
+// request as its child.
+func (c *Cache) TracedSecret(name string, span *Span) (*Secret, bool) {
+	secret, success, deleted := c.lookup(name, span)
+	if success && c.secretMap.Pending(name) {
+		c.deletedServed.Inc(1)
+	}
+	// Content which failed verification isn't masked by the fallback directory.
+	if secret == nil && !deleted && c.fallbackDir != "" && !c.Corrupt(name) && !c.Withheld(name) {
+		if fallback := c.fallbackSecret(name); fallback != nil {
+			return fallback, true
+		}
+	}
+	return secret, success
+}
+
+// lookup implements TracedSecret, without the fallback directory. Also returns true if the
+// backend reported the secret deleted.
+func (c *Cache) lookup(name string, span *Span) (secret *Secret, success, deleted bool) {
 	// Perform cache lookup first
 	cacheResult := c.cacheSecret(name)
 
-	var secret *Secret
-	var success bool
-
 	if cacheResult != nil {
 		secret = &cacheResult.Secret
 		success = !cacheResult.deleted
 
 		// immediately return fresh cache result
-		if time.Since(cacheResult.Time) < c.timeouts.Fresh {
-			return secret, success
+		if time.Since(cacheResult.Time) < c.freshThreshold() {
+			span.SetAttribute("keywhiz.cache.hit", true)
+			return secret, success, false
 		}
 	}
+	span.SetAttribute("keywhiz.cache.hit", false)
+
+	// Offline or degraded, stale or missing entries are served as they are.
+	if c.Offline() {
+		return secret, success, false
+	}
+	if c.Degraded() {
+		if c.probe() {
+			c.backendSecret(name, nil)
+		}
+		if success && !c.serveStale(name) {
+			return nil, false, false
+		}
+		return secret, success, false
+	}
+
+	// Within the max-stale window, stale content is served right away and refreshed in the
+	// background.
+	if success && time.Since(cacheResult.Time) < c.freshThreshold()+c.MaxStale() {
+		span.SetAttribute("keywhiz.cache.revalidate", true)
+		backendDone := c.backendSecret(name, nil)
+		go func() {
+			c.fetched(name, cacheResult, <-backendDone)
+		}()
+		return secret, success, false
+	}
+
+	// Secrets recently reported missing aren't asked for again until their backoff expires, or
+	// they are listed.
+	if cacheResult == nil && !c.Known(name) && c.misses.suppressed(name) {
+		c.missSuppressed.Inc(1)
+		return nil, false, false
+	}
 
 	backendDeadline := time.After(c.timeouts.BackendDeadline)
-	backendDone := c.backendSecret(name)
+	backendDone := c.backendSecret(name, span)
 
 	select {
 	case s := <-backendDone:
+		deleted = c.fetched(name, cacheResult, s)
 		if s.err == nil {
 			secret = s.secret
 			success = true
-		} else if _, ok := s.err.(SecretDeleted); ok {
-			c.secretMap.Delete(name)
+		} else if accessDenied(s.err) {
+			// Content the backend no longer grants access to isn't served, even if cached.
+			return nil, false, false
+		} else if success && !deleted && !backendAnswered(s.err) && !c.serveStale(name) {
+			return nil, false, false
 		}
 	case <-backendDeadline:
 		c.Errorf("Backend timeout on secret fetch for '%s'", name)
+		c.setFetchError(name, errBackendTimeout)
+		if success && !c.serveStale(name) {
+			return nil, false, false
+		}
 	}
 
-	return secret, success
+	return secret, success, deleted
+}
+
+// fetched handles the result of fetching a secret from the backend, given the entry cached
+// before, if any. Returns true if the backend reported the secret deleted.
+func (c *Cache) fetched(name string, cached *SecretTime, s secretResult) (deleted bool) {
+	c.setCorrupt(name, isContentCorrupt(s.err))
+	if backendAnswered(s.err) {
+		c.setWithheld(name, false)
+	}
+	if s.err == nil {
+		c.misses.forget(name)
+	}
+	if _, ok := s.err.(SecretDeleted); !ok {
+		return false
+	}
+	if cached == nil {
+		c.misses.missed(name)
+	}
+	c.secretMap.Delete(name)
+	if cached != nil && !cached.deleted {
+		c.recordRemoved(*cached)
+		c.notify(SecretChange{Name: name, Deleted: true})
+	}
+	return true
+}
+
+// CachedSecret returns the cached secret, however old, without asking the backend.
+func (c *Cache) CachedSecret(name string) (*Secret, bool) {
+	s, ok := c.secretMap.Get(name)
+	if !ok || s.deleted || s.Secret.Content.Empty() {
+		return nil, false
+	}
+	return &s.Secret, true
+}
+
+// Corrupt returns true if the content of the named secret didn't match its digest or signature
+// when last fetched. The secret is then only served from the cache, if at all.
+func (c *Cache) Corrupt(name string) bool {
+	c.corruptLock.Lock()
+	defer c.corruptLock.Unlock()
+	return c.corrupt[name]
+}
+
+// SetErrorPolicy decides whether cached content which couldn't be refreshed from the backend is
+// served. Offline, cached content is always served. Should only be called during initialization.
+func (c *Cache) SetErrorPolicy(policy ErrorPolicy) {
+	c.errorPolicy = policy
+}
+
+// serveStale returns true if the cached content of the named secret is to be served, although it
+// couldn't be refreshed from the backend, and otherwise records it withheld.
+func (c *Cache) serveStale(name string) bool {
+	if c.errorPolicy == ServeStale {
+		c.staleServed.Inc(1)
+		return true
+	}
+	if !c.Withheld(name) {
+		c.Warnf("Backend unavailable, withholding stale content of %s by error policy %s", name, c.errorPolicy)
+		c.setWithheld(name, true)
+	}
+	return false
+}
+
+// Withheld returns true if the cached content of the named secret was last withheld by the error
+// policy, since it couldn't be refreshed from the backend.
+func (c *Cache) Withheld(name string) bool {
+	c.corruptLock.Lock()
+	defer c.corruptLock.Unlock()
+	return c.withheld[name]
+}
+
+func (c *Cache) setWithheld(name string, withheld bool) {
+	c.corruptLock.Lock()
+	defer c.corruptLock.Unlock()
+	if withheld {
+		c.withheld[name] = true
+	} else {
+		delete(c.withheld, name)
+	}
+}
+
+// Failed returns true if reading the named secret should fail with EIO: its content was corrupt,
+// it was withheld under the FailEIO error policy, or it isn't cached and the backend couldn't be
+// reached, unless the FailENOENT error policy hides it.
+func (c *Cache) Failed(name string) bool {
+	if c.Corrupt(name) || c.errorPolicy == FailEIO && c.Withheld(name) {
+		return true
+	}
+	if _, cached := c.CachedSecret(name); cached || c.errorPolicy == FailENOENT {
+		return false
+	}
+	err := c.FetchError(name)
+	return err != nil && !accessDenied(err)
+}
+
+// Denied returns true if the backend refused access to the named secret when last asked, so that
+// reading it should fail with EACCES.
+func (c *Cache) Denied(name string) bool {
+	return accessDenied(c.FetchError(name))
+}
+
+// FetchError returns the error of the last fetch of the named secret if the backend couldn't be
+// reached or refused access, and nil if it answered.
+func (c *Cache) FetchError(name string) error {
+	c.corruptLock.Lock()
+	defer c.corruptLock.Unlock()
+	return c.fetchErrors[name]
+}
+
+func (c *Cache) setFetchError(name string, err error) {
+	c.corruptLock.Lock()
+	defer c.corruptLock.Unlock()
+	if err != nil && (accessDenied(err) || !backendAnswered(err)) {
+		c.fetchErrors[name] = err
+	} else {
+		delete(c.fetchErrors, name)
+	}
+}
+
+func (c *Cache) setCorrupt(name string, corrupt bool) {
+	c.corruptLock.Lock()
+	defer c.corruptLock.Unlock()
+	if corrupt {
+		c.corrupt[name] = true
+	} else {
+		delete(c.corrupt, name)
+	}
+}
+
+func isContentCorrupt(err error) bool {
+	switch err.(type) {
+	case ContentCorrupt, InvalidSignature:
+		return true
+	}
+	return false
 }
 
 // SecretList returns a listing of Secrets from cache or a server.
@@ -136,7 +841,17 @@ func (c *Cache) Secret(name string) (*Secret, bool) {
 //  * If timeout backend deadline: return cache entries, background update cache.
 //  * If timeout max wait: return cache version.
 func (c *Cache) SecretList() []Secret {
-	backendDeadline := time.After(c.timeouts.BackendDeadline)
+	if c.Offline() {
+		return c.cachedListOrFallback()
+	}
+	if c.Degraded() {
+		if c.probe() {
+			c.backendSecretList()
+		}
+		return c.cachedListOrFallback()
+	}
+
+	backendDeadline := time.After(c.timeouts.listDeadline())
 	backendDone := c.backendSecretList()
 
 	for {
@@ -145,11 +860,64 @@ func (c *Cache) SecretList() []Secret {
 			return backendResult
 		case <-backendDeadline:
 			c.Errorf("Backend timeout for secret list")
-			return c.cacheSecretList()
+			return c.cachedListOrFallback()
 		}
 	}
 }
 
+// ListedSecret returns a secret described by a fresh listing, without fetching its content.
+// Listings carry the length, mode and ownership of secrets, which is all that file attributes
+// need, so attributes for a whole directory (READDIRPLUS, ls -l) or a stat(2) don't fetch every
+// secret. Secrets with cached content are only returned if the listing showed the content to be
+// current, by its update time, length and digest; Secret handles the others.
+func (c *Cache) ListedSecret(name string) (*Secret, bool) {
+	s, ok := c.secretMap.Get(name)
+	if !ok || s.deleted {
+		return nil, false
+	}
+	listed := s.Time
+	if !s.Secret.Content.Empty() {
+		listed = s.listed
+	}
+	if listed.IsZero() || time.Since(listed) >= c.freshThreshold() {
+		return nil, false
+	}
+	return &s.Secret, true
+}
+
+// Known returns true if the named secret is cached or listed, without asking the backend.
+func (c *Cache) Known(name string) bool {
+	s, ok := c.secretMap.Get(name)
+	return ok && !s.deleted
+}
+
+// Alias resolves an alias name to the name of the secret which reports it. Names of actual
+// secrets are never treated as aliases.
+func (c *Cache) Alias(name string) (string, bool) {
+	if _, ok := c.secretMap.Get(name); ok {
+		return "", false
+	}
+	return c.secretMap.Alias(name)
+}
+
+// IsDirectory returns true if name is the directory part of cached secret names, i.e. the
+// namespace of a backend in composite mode.
+func (c *Cache) IsDirectory(name string) bool {
+	return c.secretMap.IsDirectory(name)
+}
+
+// Update replaces the cached content of a secret after it was written to the backend. The content
+// is cached without copying, and must not be modified afterwards.
+func (c *Cache) Update(name string, content []byte) {
+	s, _ := c.secretMap.Get(name)
+	from := s.Secret.contentDigest()
+	s.Secret.Name = name
+	s.Secret.Content = decodedContent(content)
+	s.Secret.Length = uint64(len(content))
+	c.secretMap.Put(name, s.Secret, time.Time{})
+	c.changes.Record(ChangeUpdated, name, from, s.Secret.contentDigest())
+}
+
 // Add inserts a secret into the cache. If a secret is already in the cache with a matching
 // identifier, it will be overridden  This method is most useful for testing since lookups
 // may add data to the cache.
@@ -158,8 +926,7 @@ func (c *Cache) Add(s Secret) {
 	c.secretMap.Put(s.Name, s, time.Time{})
 }
 
-// Len returns the number of values stored in the cache. This method is most useful for testing.
-// only used by tests
+// Len returns the number of values stored in the cache.
 func (c *Cache) Len() int {
 	return c.secretMap.Len()
 }
@@ -167,7 +934,7 @@ func (c *Cache) Len() int {
 // cacheSecret retrieves a secret from the cache.
 func (c *Cache) cacheSecret(name string) *SecretTime {
 	secret, ok := c.secretMap.Get(name)
-	if ok && (len(secret.Secret.Content) > 0 || secret.deleted) {
+	if ok && (!secret.Secret.Content.Empty() || secret.deleted) {
 		c.Debugf("Cache hit: %v", name)
 		return &secret
 	}
@@ -175,6 +942,25 @@ func (c *Cache) cacheSecret(name string) *SecretTime {
 	return nil
 }
 
+// listed returns true once a listing was fetched from the backend, after which secrets which
+// appear are logged as added, rather than as part of the initial contents of the cache.
+func (c *Cache) listed() bool {
+	return atomic.LoadInt64(&c.listedAt) > 0
+}
+
+// recordRemoved logs a cached entry as removed to the change log, unless it was already scheduled
+// for deletion.
+func (c *Cache) recordRemoved(entry SecretTime) {
+	if entry.ttl.IsZero() {
+		c.changes.Record(ChangeRemoved, entry.Secret.Name, entry.Secret.contentDigest(), "")
+	}
+}
+
+// Changes returns the secrets added, updated and removed recently, latest first.
+func (c *Cache) Changes() []ChangeEvent {
+	return c.changes.Events()
+}
+
 // cacheSecretList retrieves a secret listing from the cache.
 func (c *Cache) cacheSecretList() []Secret {
 	return c.secretMap.Values()
@@ -183,20 +969,56 @@ func (c *Cache) cacheSecretList() []Secret {
 // backendSecret retrieves a secret from the backend and updates the cache.
 //
 // Retrieval is concurrent, so a channel is returned to communicate a successful value.
-// The channel will not be fulfilled on error.
-func (c *Cache) backendSecret(name string) chan secretResult {
-	secretc := make(chan secretResult)
+// The channel will not be fulfilled on error. Concurrent retrievals of the same secret share
+// a single backend request, which is traced as a child of the span of the first.
+func (c *Cache) backendSecret(name string, span *Span) chan secretResult {
+	// Buffered, so that the result can be ignored.
+	secretc := make(chan secretResult, 1)
 	go func() {
 		defer close(secretc)
-		secret, err := c.backend.Secret(name)
+		secret, err := c.flights.Do(name, func() (*Secret, error) {
+			secret, err := c.backendFetch(name, span)
+			c.recordBackend(err)
+			c.setFetchError(name, err)
+			if err == nil {
+				previous, ok := c.secretMap.Get(name)
+				c.secretMap.Put(name, *secret, time.Time{})
+				if ok && !previous.Secret.Content.Empty() && !bytes.Equal(previous.Secret.Content.Bytes(), secret.Content.Bytes()) {
+					c.changes.Record(ChangeUpdated, name, previous.Secret.contentDigest(), secret.contentDigest())
+					c.notify(SecretChange{Name: name})
+				} else if !ok && c.listed() {
+					c.changes.Record(ChangeAdded, name, "", secret.contentDigest())
+				}
+			}
+			return secret, err
+		})
 		secretc <- secretResult{secret, err}
-		if err == nil {
-			c.secretMap.Put(name, *secret, time.Time{})
-		}
 	}()
 	return secretc
 }
 
+// backendFetch fetches a secret from the backend, as a child of span if tracing. A panic, e.g.
+// caused by a malformed response, fails the fetch rather than crashing the process.
+func (c *Cache) backendFetch(name string, span *Span) (secret *Secret, err error) {
+	defer c.recoverPanic("fetching "+name, &err)
+	if traced, ok := c.backend.(tracedBackend); ok && span != nil {
+		return traced.TracedFetch(name, span)
+	}
+	return c.backend.Fetch(name)
+}
+
+// backendList lists the secrets of the backend, failing on a panic like backendFetch.
+func (c *Cache) backendList() (secrets []Secret, ok bool) {
+	var err error
+	defer func() {
+		if err != nil {
+			secrets, ok = nil, false
+		}
+	}()
+	defer c.recoverPanic("listing secrets", &err)
+	return c.backend.List()
+}
+
 // backendSecretList retrieves a secret listing from the backend and updates the cache.
 //
 // Retrieval is concurrent, so a channel is returned to communicate successful values. The channel
@@ -204,29 +1026,116 @@ func (c *Cache) backendSecret(name string) chan secretResult {
 func (c *Cache) backendSecretList() chan []Secret {
 	secretsc := make(chan []Secret, 1)
 	go func() {
-		secrets, ok := c.backend.SecretList()
-		if !ok {
+		if !c.refreshSecretList() {
 			// Don't close the channel so that we use the result from the cache.
 			return
 		}
+		secretsc <- c.cacheSecretList()
+		close(secretsc)
+	}()
+	return secretsc
+}
 
-		newMap := NewSecretMap(c.timeouts, c.now)
-		for _, backendSecret := range secrets {
-			// The cache might contain a secret with content, in which case we want to keep the cache's
-			// value (and not schedule it for delayed deletion).
-			if s, ok := c.secretMap.Get(backendSecret.Name); ok && len(s.Secret.Content) > 0 {
-				newMap.Put(backendSecret.Name, s.Secret, s.Time)
+// refreshSecretList replaces the cached listing with the backend's, keeping cached content, and
+// prefetches in the background the secrets which changed or aren't cached.
+func (c *Cache) refreshSecretList() bool {
+	stale, ok := c.listSecrets()
+	if ok {
+		go c.prefetchSecrets(stale)
+	}
+	return ok
+}
+
+// listSecrets implements refreshSecretList, without prefetching. Also returns the names of listed
+// secrets whose content isn't cached or is older than the listing's.
+func (c *Cache) listSecrets() (stale []string, ok bool) {
+	secrets, ok := c.backendList()
+	c.recordList(ok)
+	if !ok {
+		return nil, false
+	}
+
+	listed := c.listed()
+	newMap := NewSecretMap(c.timeouts, c.now)
+	for _, backendSecret := range secrets {
+		s, known := c.secretMap.Get(backendSecret.Name)
+		if listed && (!known || !s.ttl.IsZero()) {
+			c.changes.Record(ChangeAdded, backendSecret.Name, "", backendSecret.contentDigest())
+		}
+		// The cache might contain a secret with content, in which case we want to keep the cache's
+		// value (and not schedule it for delayed deletion).
+		if known && !s.Secret.Content.Empty() {
+			newMap.Put(backendSecret.Name, s.Secret, s.Time)
+			if listingChanged(s.Secret, backendSecret) {
+				stale = append(stale, backendSecret.Name)
 			} else {
-				// We don't have content for this secret. This happens when the cache has never seen a given secret
-				// (at startup or when a new secret is added).
-				// can happen.
-				newMap.Put(backendSecret.Name, backendSecret, time.Time{})
+				newMap.Confirm(backendSecret.Name)
 			}
+		} else {
+			// We don't have content for this secret. This happens when the cache has never seen a given secret
+			// (at startup or when a new secret is added).
+			// can happen.
+			newMap.Put(backendSecret.Name, backendSecret, time.Time{})
+			stale = append(stale, backendSecret.Name)
 		}
-		c.secretMap.Replace(newMap)
+	}
+	for _, entry := range c.secretMap.Entries() {
+		if _, ok := newMap.Get(entry.Secret.Name); ok {
+			continue
+		}
+		c.recordRemoved(entry)
+		if entry.ttl.IsZero() && !entry.Secret.Content.Empty() {
+			c.Warnf("Secret %s is no longer listed, serving it for %v before deleting it", entry.Secret.Name, c.timeouts.DeletionDelay)
+		}
+	}
+	c.secretMap.Replace(newMap)
+	atomic.StoreInt64(&c.listedAt, time.Now().UnixNano())
+	for _, listener := range c.listingListeners {
+		go listener(secrets)
+	}
+	return stale, true
+}
 
-		secretsc <- c.cacheSecretList()
-		close(secretsc)
-	}()
-	return secretsc
+// listingChanged returns true if the listing entry of a secret shows that its cached content is
+// out of date.
+func listingChanged(cached, listed Secret) bool {
+	if listed.UpdatedAt.After(cached.UpdatedAt) || listed.Length != cached.Length {
+		return true
+	}
+	return listed.Digest != "" && cached.Digest != "" && listed.Digest != cached.Digest
+}
+
+// SetMissBackoff sets the longest time a secret the backend reported missing is answered from
+// memory. 0 asks the backend on every request.
+func (c *Cache) SetMissBackoff(backoff time.Duration) {
+	c.misses.SetMax(backoff)
+}
+
+// SetMaxStale changes how long past the fresh threshold cached content is served without waiting
+// on the backend, while it is refreshed in the background. Zero waits on the backend as soon as
+// content is no longer fresh.
+func (c *Cache) SetMaxStale(maxStale time.Duration) {
+	atomic.StoreInt64(&c.maxStale, int64(maxStale))
+}
+
+// MaxStale returns how long past the fresh threshold cached content is served while refreshed.
+func (c *Cache) MaxStale() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.maxStale))
+}
+
+// SetFreshThreshold changes how long cached data is used without asking the backend.
+func (c *Cache) SetFreshThreshold(fresh time.Duration) {
+	atomic.StoreInt64(&c.fresh, int64(fresh))
+}
+
+func (c *Cache) freshThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.fresh))
+}
+
+// ListedAt returns when the listing was last fetched from the backend, or the zero time if never.
+func (c *Cache) ListedAt() time.Time {
+	if nanos := atomic.LoadInt64(&c.listedAt); nanos > 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
 }
@@ -16,6 +16,13 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -29,43 +36,135 @@ var logConfig = log.Config{Debug: false, Mountpoint: "/tmp/mnt"}
 type FailingBackend struct {
 }
 
-func (b FailingBackend) Secret(name string) (*Secret, error) {
+func (b FailingBackend) Fetch(name string) (*Secret, error) {
 	return nil, errors.New("some error")
 }
 
-func (b FailingBackend) SecretList() ([]Secret, bool) {
+func (b FailingBackend) List() ([]Secret, bool) {
 	return nil, false
 }
 
+func (b FailingBackend) Invalidate(name string) {}
+
 // DeletedBackend, always returns ok==true, deleted==true
 type DeletedBackend struct {
 }
 
-func (b DeletedBackend) Secret(name string) (*Secret, error) {
+func (b DeletedBackend) Fetch(name string) (*Secret, error) {
 	return nil, SecretDeleted{}
 }
 
-func (b DeletedBackend) SecretList() ([]Secret, bool) {
+func (b DeletedBackend) List() ([]Secret, bool) {
 	return []Secret{}, true
 }
 
+func (b DeletedBackend) Invalidate(name string) {}
+
+// CorruptBackend always returns content which doesn't match its digest.
+type CorruptBackend struct {
+}
+
+func (b CorruptBackend) Fetch(name string) (*Secret, error) {
+	return nil, ContentCorrupt{name}
+}
+
+func (b CorruptBackend) List() ([]Secret, bool) {
+	return nil, false
+}
+
+func (b CorruptBackend) Invalidate(name string) {}
+
 // ChannelBackend reads values from channels to return or blocks.
 type ChannelBackend struct {
 	secretc     chan *Secret
 	secretListc chan []Secret
 }
 
-func (b ChannelBackend) Secret(name string) (*Secret, error) {
+func (b ChannelBackend) Fetch(name string) (*Secret, error) {
 	secret := <-b.secretc
 	return secret, nil
 }
 
-func (b ChannelBackend) SecretList() ([]Secret, bool) {
+func (b ChannelBackend) List() ([]Secret, bool) {
 	secretList := <-b.secretListc
 	return secretList, true
 }
 
-var timeouts = Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour}
+func (b ChannelBackend) Invalidate(name string) {}
+
+// CountingBackend counts secret requests and blocks them until release is closed.
+type CountingBackend struct {
+	calls   *int32
+	release chan struct{}
+}
+
+func (b CountingBackend) Fetch(name string) (*Secret, error) {
+	atomic.AddInt32(b.calls, 1)
+	<-b.release
+	return &Secret{Name: name, Content: decodedContent([]byte("hot"))}, nil
+}
+
+func (b CountingBackend) List() ([]Secret, bool) {
+	return nil, false
+}
+
+func (b CountingBackend) Invalidate(name string) {}
+
+// ListingBackend serves a fixed listing and counts secret requests, which always fail.
+type ListingBackend struct {
+	secrets []Secret
+	calls   *int32
+}
+
+func (b ListingBackend) Fetch(name string) (*Secret, error) {
+	atomic.AddInt32(b.calls, 1)
+	return nil, errors.New("unexpected secret fetch")
+}
+
+func (b ListingBackend) List() ([]Secret, bool) {
+	return b.secrets, true
+}
+
+func (b ListingBackend) Invalidate(name string) {}
+
+// InvalidatingBackend records invalidated names. Secrets are always deleted.
+type InvalidatingBackend struct {
+	invalidated *[]string
+}
+
+func (b InvalidatingBackend) Fetch(name string) (*Secret, error) {
+	return nil, SecretDeleted{}
+}
+
+func (b InvalidatingBackend) List() ([]Secret, bool) {
+	return []Secret{}, true
+}
+
+func (b InvalidatingBackend) Invalidate(name string) {
+	*b.invalidated = append(*b.invalidated, name)
+}
+
+var timeouts = Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+
+// FlakyBackend counts secret requests, which fail while failing is set.
+type FlakyBackend struct {
+	calls   *int32
+	failing *int32
+}
+
+func (b FlakyBackend) Fetch(name string) (*Secret, error) {
+	atomic.AddInt32(b.calls, 1)
+	if atomic.LoadInt32(b.failing) == 1 {
+		return nil, errors.New("unreachable")
+	}
+	return &Secret{Name: name, Content: decodedContent([]byte("fresh"))}, nil
+}
+
+func (b FlakyBackend) List() ([]Secret, bool) {
+	return nil, atomic.LoadInt32(b.failing) == 0
+}
+
+func (b FlakyBackend) Invalidate(name string) {}
 
 func TestCacheSecretUsesValuesFromClient(t *testing.T) {
 	assert := assert.New(t)
@@ -188,7 +287,7 @@ func TestCacheSecretAvoidsBackendWhenResultFresh(t *testing.T) {
 	secretc <- fixture1
 
 	// 1 Hour fresh threshold is sure to be fresh
-	timeouts := Timeouts{1 * time.Hour, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour}
+	timeouts := Timeouts{1 * time.Hour, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
 	cache := NewCache(backend, timeouts, logConfig, nil)
 	cache.Add(*fixture2)
 
@@ -200,7 +299,7 @@ func TestCacheSecretAvoidsBackendWhenResultFresh(t *testing.T) {
 	assert.Equal(fixture2, secret)
 
 	// 1 Nanosecond fresh threshold is sure to make a server request
-	timeouts = Timeouts{1 * time.Nanosecond, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour}
+	timeouts = Timeouts{1 * time.Nanosecond, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
 	cache = NewCache(backend, timeouts, logConfig, nil)
 	cache.Add(*fixture2)
 	time.Sleep(2 * time.Nanosecond)
@@ -223,7 +322,7 @@ func TestCacheSecretUsesBackendWhenResultStale(t *testing.T) {
 	secretc <- fixture1
 	secretc <- fixture2
 
-	timeouts = Timeouts{1 * time.Nanosecond, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour}
+	timeouts = Timeouts{1 * time.Nanosecond, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
 	cache := NewCache(backend, timeouts, logConfig, nil)
 	secret, ok := cache.Secret(fixture1.Name)
 	assert.True(ok)
@@ -297,6 +396,50 @@ func TestCacheSecretListWhenClientTimesOut(t *testing.T) {
 	assert.Contains(list, *secretFixture)
 }
 
+func TestCacheSeparatesContentAndListDeadlines(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := ParseSecret(fixture("secret.json"))
+	backend := ChannelBackend{make(chan *Secret, 1), make(chan []Secret, 1)}
+	slow := func() {
+		time.Sleep(50 * time.Millisecond)
+		backend.secretc <- secretFixture
+		backend.secretListc <- []Secret{*secretFixture}
+	}
+
+	// A slow listing is waited for, while a slow secret fetch gives up.
+	listing := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, time.Second, 0, 0}
+	cache := NewCache(backend, listing, logConfig, nil)
+	go slow()
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.False(ok)
+	assert.Len(cache.SecretList(), 1)
+
+	// And the other way around.
+	backend = ChannelBackend{make(chan *Secret, 1), make(chan []Secret, 1)}
+	content := Timeouts{0, time.Second, 2 * time.Second, 1 * time.Hour, 10 * time.Millisecond, 0, 0}
+	cache = NewCache(backend, content, logConfig, nil)
+	go slow()
+	assert.Empty(cache.SecretList())
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+}
+
+func TestTimeoutsDefaultToContentBudgets(t *testing.T) {
+	assert := assert.New(t)
+
+	t1 := Timeouts{BackendDeadline: time.Second, MaxWait: 2 * time.Second}
+	assert.Equal(time.Second, t1.listDeadline())
+	assert.Equal(2*time.Second, t1.listWait())
+	assert.Equal(2*time.Second, t1.controlWait())
+
+	t2 := Timeouts{BackendDeadline: time.Second, MaxWait: 2 * time.Second, ListDeadline: 3 * time.Second, ListWait: 4 * time.Second, ControlWait: 5 * time.Second}
+	assert.Equal(3*time.Second, t2.listDeadline())
+	assert.Equal(4*time.Second, t2.listWait())
+	assert.Equal(5*time.Second, t2.controlWait())
+}
+
 func TestCacheSecretListUsesValuesFromClient(t *testing.T) {
 	assert := assert.New(t)
 
@@ -344,7 +487,8 @@ func TestCacheSecretListUsesClientOverCache(t *testing.T) {
 func TestCacheClears(t *testing.T) {
 	assert := assert.New(t)
 
-	cache := NewCache(nil, timeouts, logConfig, nil)
+	backend := InvalidatingBackend{&[]string{}}
+	cache := NewCache(backend, timeouts, logConfig, nil)
 
 	secretFixture, _ := ParseSecret(fixture("secret.json"))
 	cache.Add(*secretFixture)
@@ -352,6 +496,17 @@ func TestCacheClears(t *testing.T) {
 
 	cache.Clear()
 	assert.Equal(0, cache.Len())
+	assert.Equal([]string{secretFixture.Name}, *backend.invalidated)
+}
+
+func TestCacheRefreshInvalidates(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := InvalidatingBackend{&[]string{}}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+
+	cache.Refresh("foo")
+	assert.Equal([]string{"foo"}, *backend.invalidated)
 }
 
 func TestCacheSecretListDoesNotOverrideWithEmptyContent(t *testing.T) {
@@ -380,7 +535,7 @@ func TestCacheSecretListDoesNotReturnDeletedEmptyContentSecrets(t *testing.T) {
 	assert := assert.New(t)
 
 	secretFixture, _ := ParseSecret(fixture("secret.json"))
-	secretFixture.Content = []byte{}
+	secretFixture.Content = content{}
 
 	fake_clock := time.Now()
 	cache := NewCache(DeletedBackend{}, timeouts, logConfig, func() time.Time { return fake_clock })
@@ -429,6 +584,122 @@ func TestClientSecretListDoesNotFreshenCache(t *testing.T) {
 	assert.Equal(fixture1, secret)
 }
 
+func TestCacheCoalescesConcurrentSecretRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	backend := CountingBackend{&calls, make(chan struct{})}
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			secret, ok := cache.Secret("hot")
+			assert.True(ok)
+			assert.EqualValues("hot", secret.Content.Bytes())
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	assert.EqualValues(1, atomic.LoadInt32(&calls))
+}
+
+func TestCacheNotifiesOnContentChange(t *testing.T) {
+	assert := assert.New(t)
+
+	fixture1, _ := ParseSecret(fixture("secret.json"))
+	fixture2, _ := ParseSecret(fixture("secretNormalOwner.json"))
+	fixture2.Name = fixture1.Name
+
+	secretc := make(chan *Secret, 3)
+	backend := ChannelBackend{secretc: secretc}
+	secretc <- fixture1
+	secretc <- fixture1
+	secretc <- fixture2
+
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	changes := make(chan SecretChange, 10)
+	cache.OnChange(func(change SecretChange) { changes <- change })
+
+	// Initial fetch and unchanged content do not notify.
+	cache.Secret(fixture1.Name)
+	cache.Secret(fixture1.Name)
+	select {
+	case change := <-changes:
+		t.Fatalf("unexpected change %+v", change)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cache.Secret(fixture1.Name)
+	select {
+	case change := <-changes:
+		assert.Equal(SecretChange{Name: fixture1.Name}, change)
+	case <-time.After(time.Second):
+		t.Fatal("expected change notification")
+	}
+}
+
+func TestCacheReload(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := MapBackend{"a": "1", "b": "2"}
+	timeouts := Timeouts{time.Hour, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	changes := make(chan SecretChange, 10)
+	cache.OnChange(func(change SecretChange) { changes <- change })
+
+	cache.Secret("a")
+	cache.Secret("b")
+	backend["a"] = "3"
+	delete(backend, "b")
+
+	// Fresh entries are served from the cache until reloaded.
+	secret, _ := cache.Secret("a")
+	assert.EqualValues("1", secret.Content.Bytes())
+
+	assert.NoError(cache.Reload())
+	secret, _ = cache.Secret("a")
+	assert.EqualValues("3", secret.Content.Bytes())
+
+	received := map[SecretChange]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case change := <-changes:
+			received[change] = true
+		case <-time.After(time.Second):
+			t.Fatal("expected change notification")
+		}
+	}
+	assert.True(received[SecretChange{Name: "a"}])
+	assert.True(received[SecretChange{Name: "b", Deleted: true}])
+
+	assert.Error(NewCache(FailingBackend{}, timeouts, logConfig, nil).Reload())
+}
+
+func TestCacheRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := MapBackend{"a": "1"}
+	timeouts := Timeouts{time.Hour, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+
+	cache.Secret("a")
+	backend["a"] = "2"
+	assert.NoError(cache.Refresh("a"))
+	secret, _ := cache.Secret("a")
+	assert.EqualValues("2", secret.Content.Bytes())
+
+	// Deleted secrets are not an error.
+	assert.NoError(cache.Refresh("missing"))
+	assert.Error(NewCache(FailingBackend{}, timeouts, logConfig, nil).Refresh("a"))
+}
+
 // An interesting test to write might be a combination of data being returned and deleted.
 // E.g.
 // Get content A.
@@ -438,3 +709,371 @@ func TestClientSecretListDoesNotFreshenCache(t *testing.T) {
 // make sure A & B are still there.
 // time passes.
 // make sure A goes away, B is still there.
+
+func TestCacheListedSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	listing, _ := ParseSecretList(fixture("secretsWithoutContent.json"))
+	var calls int32
+	fresh := Timeouts{time.Hour, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	cache := NewCache(ListingBackend{listing, &calls}, fresh, logConfig, nil)
+	assert.True(cache.Warmup())
+
+	secret, ok := cache.ListedSecret("Nobody_PgPass")
+	assert.True(ok)
+	assert.EqualValues(6, secret.Length)
+	assert.Equal("nobody", secret.Owner)
+
+	_, ok = cache.ListedSecret("unknown")
+	assert.False(ok)
+
+	// Secrets with content are left to Secret.
+	cache.Add(Secret{Name: "Nobody_PgPass", Content: decodedContent([]byte("asddas"))})
+	_, ok = cache.ListedSecret("Nobody_PgPass")
+	assert.False(ok)
+	assert.EqualValues(0, calls)
+
+	// Unless a listing shows the content to be current.
+	cached := listing[0]
+	cached.Content = decodedContent([]byte("asddas"))
+	cache.Add(cached)
+	_, ok = cache.listSecrets()
+	assert.True(ok)
+	secret, ok = cache.ListedSecret("Nobody_PgPass")
+	assert.True(ok)
+	assert.EqualValues("asddas", secret.Content.Bytes())
+	cached.Length = 7
+	cache.Add(cached)
+	cache.listSecrets()
+	_, ok = cache.ListedSecret("Nobody_PgPass")
+	assert.False(ok)
+	assert.EqualValues(0, calls)
+
+	// Stale listings aren't used.
+	stale := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	cache = NewCache(ListingBackend{listing, &calls}, stale, logConfig, nil)
+	assert.True(cache.Warmup())
+	_, ok = cache.ListedSecret("Nobody_PgPass")
+	assert.False(ok)
+}
+
+func TestCacheCorruptSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	secretFixture, _ := ParseSecret(fixture("secret.json"))
+
+	fake_clock := time.Now()
+	cache := NewCache(CorruptBackend{}, timeouts, logConfig, func() time.Time { return fake_clock })
+	_, ok := cache.Secret(secretFixture.Name)
+	assert.False(ok)
+	assert.True(cache.Corrupt(secretFixture.Name))
+	assert.False(cache.Corrupt("other"))
+
+	// Previously fetched, stale content is still served.
+	fake_clock = fake_clock.Add(-2 * time.Hour)
+	cache.Add(*secretFixture)
+	secret, ok := cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.Equal(secretFixture, secret)
+	assert.True(cache.Corrupt(secretFixture.Name))
+
+	release := make(chan struct{})
+	close(release)
+	cache.backend = CountingBackend{new(int32), release}
+	_, ok = cache.Secret(secretFixture.Name)
+	assert.True(ok)
+	assert.False(cache.Corrupt(secretFixture.Name), "cleared by a good fetch")
+}
+
+func TestCacheOffline(t *testing.T) {
+	assert := assert.New(t)
+	// Generous deadlines, so that the backend is only ever skipped on purpose.
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+
+	var calls, failing int32
+	cache := NewCache(FlakyBackend{&calls, &failing}, timeouts, logConfig, nil)
+	cache.Add(Secret{Name: "cached", Content: decodedContent([]byte("stale"))})
+	cache.SetOffline(true)
+	assert.Equal("offline", cache.Mode())
+	assert.False(cache.Online())
+
+	secret, ok := cache.Secret("cached")
+	assert.True(ok)
+	assert.Equal("stale", string(secret.Content.Bytes()))
+	_, ok = cache.Secret("missing")
+	assert.False(ok)
+	assert.Len(cache.SecretList(), 1)
+	assert.Equal(ErrOffline, cache.Refresh("cached"))
+	assert.Equal(ErrOffline, cache.Reload())
+	assert.False(cache.Warmup())
+	assert.EqualValues(0, atomic.LoadInt32(&calls), "backend never used")
+
+	cache.SetOffline(false)
+	assert.Equal("online", cache.Mode())
+	secret, ok = cache.Secret("cached")
+	assert.True(ok)
+	assert.Equal("fresh", string(secret.Content.Bytes()))
+	assert.EqualValues(1, atomic.LoadInt32(&calls))
+}
+
+func TestCacheDegraded(t *testing.T) {
+	assert := assert.New(t)
+	// Generous deadlines, so that the backend is only ever skipped on purpose.
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+
+	var calls, failing int32 = 0, 1
+	clock := time.Now()
+	var clockLock sync.Mutex
+	now := func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return clock
+	}
+	cache := NewCache(FlakyBackend{&calls, &failing}, timeouts, logConfig, now)
+	cache.Add(Secret{Name: "cached", Content: decodedContent([]byte("stale"))})
+
+	for i := 0; i < degradedAfter; i++ {
+		assert.True(cache.Online())
+		cache.Secret("missing")
+	}
+	assert.True(cache.Degraded())
+	assert.Equal("degraded", cache.Mode())
+
+	// Degraded, cached secrets are served without waiting on the backend, which is only probed
+	// in the background once per interval.
+	start := time.Now()
+	secret, ok := cache.Secret("cached")
+	assert.True(ok)
+	assert.Equal("stale", string(secret.Content.Bytes()))
+	_, ok = cache.Secret("missing")
+	assert.False(ok)
+	assert.True(time.Since(start) < timeouts.BackendDeadline)
+	waitFor(func() bool { return atomic.LoadInt32(&calls) == degradedAfter+1 })
+	assert.EqualValues(degradedAfter+1, atomic.LoadInt32(&calls), "a single probe")
+
+	// Once the backend recovers, the next probe ends degraded mode.
+	atomic.StoreInt32(&failing, 0)
+	cache.Secret("cached")
+	assert.True(cache.Degraded(), "no probe before the interval")
+	clockLock.Lock()
+	clock = clock.Add(degradedProbeInterval)
+	clockLock.Unlock()
+	cache.Secret("cached")
+	waitFor(func() bool { return cache.Online() })
+	assert.True(cache.Online())
+	secret, _ = cache.Secret("cached")
+	assert.Equal("fresh", string(secret.Content.Bytes()))
+}
+
+// waitFor polls condition for up to a second.
+func waitFor(condition func() bool) {
+	for i := 0; i < 100 && !condition(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheFallbackDir(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_fallback")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "host.pem"), []byte("local"), 0400))
+
+	// Cold and unreachable, secrets and the listing come from the directory.
+	cache := NewCache(FailingBackend{}, timeouts, logConfig, nil)
+	cache.SetFallbackDir(dir)
+	secret, ok := cache.Secret("host.pem")
+	assert.True(ok)
+	assert.Equal("local", string(secret.Content.Bytes()))
+	assert.EqualValues(len("local"), secret.Length)
+	assert.Equal("0400", secret.Mode)
+	_, ok = cache.Secret("missing")
+	assert.False(ok)
+	list := cache.SecretList()
+	if assert.Len(list, 1) {
+		assert.Equal("host.pem", list[0].Name)
+	}
+	assert.Equal(0, cache.Len(), "fallback secrets aren't cached")
+
+	// Cached content takes precedence.
+	cache.Add(Secret{Name: "host.pem", Content: decodedContent([]byte("cached"))})
+	secret, ok = cache.Secret("host.pem")
+	assert.True(ok)
+	assert.Equal("cached", string(secret.Content.Bytes()))
+	assert.Len(cache.SecretList(), 1)
+
+	// Secrets the backend reports deleted aren't served from the directory.
+	cache = NewCache(DeletedBackend{}, timeouts, logConfig, nil)
+	cache.SetFallbackDir(dir)
+	_, ok = cache.Secret("host.pem")
+	assert.False(ok)
+}
+
+// PrefetchBackend serves a listing of versioned secrets, recording the number of secret requests
+// and the most that were in flight at once.
+type PrefetchBackend struct {
+	lock     *sync.Mutex
+	versions map[string]int
+	calls    *int32
+	inflight *int32
+	peak     *int32
+}
+
+func (b PrefetchBackend) secret(name string) Secret {
+	version := b.versions[name]
+	return Secret{
+		Name:      name,
+		Content:   decodedContent([]byte(strconv.Itoa(version))),
+		Length:    1,
+		UpdatedAt: time.Unix(int64(version), 0),
+	}
+}
+
+func (b PrefetchBackend) Fetch(name string) (*Secret, error) {
+	atomic.AddInt32(b.calls, 1)
+	inflight := atomic.AddInt32(b.inflight, 1)
+	defer atomic.AddInt32(b.inflight, -1)
+	for peak := atomic.LoadInt32(b.peak); inflight > peak; peak = atomic.LoadInt32(b.peak) {
+		if atomic.CompareAndSwapInt32(b.peak, peak, inflight) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	secret := b.secret(name)
+	return &secret, nil
+}
+
+func (b PrefetchBackend) List() ([]Secret, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var secrets []Secret
+	for name := range b.versions {
+		secret := b.secret(name)
+		secret.Content = content{}
+		secrets = append(secrets, secret)
+	}
+	return secrets, true
+}
+
+func (b PrefetchBackend) Invalidate(name string) {}
+
+func TestCachePrefetch(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls, inflight, peak int32
+	backend := PrefetchBackend{&sync.Mutex{}, map[string]int{}, &calls, &inflight, &peak}
+	for i := 0; i < 12; i++ {
+		backend.versions[fmt.Sprintf("secret%d", i)] = 1
+	}
+	timeouts := Timeouts{time.Hour, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	cache.SetPrefetch(3)
+
+	cached := func() (n int) {
+		for _, entry := range cache.Entries() {
+			if entry.Content {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Every listed secret is fetched after the initial listing, at most 3 at a time.
+	assert.True(cache.Warmup())
+	waitFor(func() bool { return cached() == 12 && atomic.LoadInt32(&inflight) == 0 })
+	assert.Equal(12, cached())
+	assert.EqualValues(12, atomic.LoadInt32(&calls))
+	assert.True(atomic.LoadInt32(&peak) <= 3)
+	assert.True(atomic.LoadInt32(&peak) > 1)
+
+	// Only secrets which changed according to the listing are fetched again.
+	backend.lock.Lock()
+	backend.versions["secret4"] = 2
+	backend.lock.Unlock()
+	assert.True(cache.refreshSecretList())
+	updated := func() bool {
+		secret, _ := cache.Secret("secret4")
+		return string(secret.Content.Bytes()) == "2"
+	}
+	waitFor(updated)
+	assert.True(updated())
+	assert.True(cache.refreshSecretList())
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(13, atomic.LoadInt32(&calls))
+
+	// Without prefetching, secrets are only fetched when read.
+	atomic.StoreInt32(&calls, 0)
+	cache = NewCache(backend, timeouts, logConfig, nil)
+	assert.True(cache.Warmup())
+	assert.True(cache.refreshSecretList())
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(0, atomic.LoadInt32(&calls))
+}
+
+func TestCacheMaxStale(t *testing.T) {
+	assert := assert.New(t)
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+
+	var calls int32
+	release := make(chan struct{})
+	cache := NewCache(CountingBackend{&calls, release}, timeouts, logConfig, nil)
+	cache.SetMaxStale(time.Hour)
+	cache.Add(Secret{Name: "recent", Content: decodedContent([]byte("stale"))})
+	cache.secretMap.Put("old", Secret{Name: "old", Content: decodedContent([]byte("stale"))}, time.Now().Add(-2*time.Hour))
+
+	// Stale content is served without waiting on the backend, which refreshes it in the background.
+	secret, ok := cache.Secret("recent")
+	assert.True(ok)
+	assert.Equal("stale", string(secret.Content.Bytes()))
+	waitFor(func() bool { return atomic.LoadInt32(&calls) == 1 })
+	assert.EqualValues(1, atomic.LoadInt32(&calls))
+	close(release)
+	waitFor(func() bool {
+		s, _ := cache.CachedSecret("recent")
+		return string(s.Content.Bytes()) == "hot"
+	})
+	secret, _ = cache.CachedSecret("recent")
+	assert.Equal("hot", string(secret.Content.Bytes()))
+
+	// Past the max-stale window, the backend is waited on.
+	secret, ok = cache.Secret("old")
+	assert.True(ok)
+	assert.Equal("hot", string(secret.Content.Bytes()))
+}
+
+func TestCacheErrorPolicy(t *testing.T) {
+	assert := assert.New(t)
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+
+	for _, policy := range []ErrorPolicy{ServeStale, FailEIO, FailENOENT} {
+		var calls, failing int32 = 0, 1
+		cache := NewCache(FlakyBackend{&calls, &failing}, timeouts, logConfig, nil)
+		cache.SetErrorPolicy(policy)
+		cache.Add(Secret{Name: "cached", Content: decodedContent([]byte("stale"))})
+
+		secret, ok := cache.Secret("cached")
+		assert.Equal(policy == ServeStale, ok, string(policy))
+		if ok {
+			assert.Equal("stale", string(secret.Content.Bytes()))
+		}
+		assert.Equal(policy != ServeStale, cache.Withheld("cached"), string(policy))
+		assert.Equal(policy == FailEIO, cache.Failed("cached"), string(policy))
+
+		// Secrets which aren't cached fail, unless the policy hides them.
+		_, ok = cache.Secret("missing")
+		assert.False(ok)
+		assert.Equal(policy != FailENOENT, cache.Failed("missing"), string(policy))
+
+		// Once the backend answers, the secret is served again.
+		atomic.StoreInt32(&failing, 0)
+		secret, ok = cache.Secret("cached")
+		assert.True(ok)
+		assert.Equal("fresh", string(secret.Content.Bytes()))
+		assert.False(cache.Withheld("cached"))
+		assert.False(cache.Failed("cached"))
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// SetMetrics registers metrics of the cache in registry: runtime.cache.oldest_age and
+// runtime.cache.median_age, the ages in seconds of cached content, and runtime.cache.stale_served,
+// counting secrets served past the cache timeout because the backend couldn't be reached. Content
+// is as old as the last fetch or listing which confirmed it current. Secrets removed from the
+// backend are counted by runtime.cache.deleted_pending while served during the deletion delay, and
+// their reads by runtime.cache.deleted_served. Requests for secrets recently reported missing
+// which weren't sent to the backend are counted by runtime.cache.miss_suppressed, and the names
+// tracked by runtime.cache.miss_tracked. The sizes in bytes of secrets served are recorded by the
+// runtime.secret.served_size histogram, and the content held in the cache is reported by
+// runtime.cache.bytes. Should only be called during initialization.
+func (c *Cache) SetMetrics(registry metrics.Registry) {
+	for name, median := range map[string]bool{"runtime.cache.oldest_age": false, "runtime.cache.median_age": true} {
+		registry.Unregister(name)
+		registry.Register(name, contentAgeGauge{c, median})
+	}
+	registry.Unregister("runtime.cache.deleted_pending")
+	registry.Register("runtime.cache.deleted_pending", pendingGauge{c})
+	registry.Unregister("runtime.cache.miss_tracked")
+	registry.Register("runtime.cache.miss_tracked", missGauge{c.misses})
+	c.staleServed = metrics.GetOrRegisterCounter("runtime.cache.stale_served", registry)
+	c.deletedServed = metrics.GetOrRegisterCounter("runtime.cache.deleted_served", registry)
+	c.missSuppressed = metrics.GetOrRegisterCounter("runtime.cache.miss_suppressed", registry)
+	c.panics = metrics.GetOrRegisterCounter("runtime.panics", registry)
+	registry.Unregister("runtime.cache.bytes")
+	registry.Register("runtime.cache.bytes", cachedBytesGauge{c})
+	c.servedSizes = metrics.GetOrRegisterHistogram("runtime.secret.served_size", registry, metrics.NewExpDecaySample(1028, 0.015))
+}
+
+// recordServed records the size of a secret served to a reader.
+func (c *Cache) recordServed(size int) {
+	c.servedSizes.Update(int64(size))
+}
+
+// cachedBytes returns the size of the content held in the cache, before decoding. Secrets
+// scheduled for deletion are included, since their content is still held.
+func (c *Cache) cachedBytes() int64 {
+	var total int64
+	for _, entry := range c.secretMap.Entries() {
+		if !entry.Secret.Content.Empty() {
+			total += int64(entry.Secret.Content.size)
+		}
+	}
+	return total
+}
+
+// pendingDeletions returns the number of secrets with content which are scheduled for deletion.
+func (c *Cache) pendingDeletions() int {
+	pending := 0
+	for _, entry := range c.secretMap.Entries() {
+		if !entry.ttl.IsZero() && !entry.Secret.Content.Empty() {
+			pending++
+		}
+	}
+	return pending
+}
+
+// contentAges returns the ages of cached content, oldest first.
+func (c *Cache) contentAges() []time.Duration {
+	now := c.secretMap.getNow()
+	var ages []time.Duration
+	for _, entry := range c.secretMap.Entries() {
+		if entry.deleted || entry.Secret.Content.Empty() {
+			continue
+		}
+		current := entry.Time
+		if entry.listed.After(current) {
+			current = entry.listed
+		}
+		ages = append(ages, now.Sub(current))
+	}
+	sort.Slice(ages, func(i, j int) bool { return ages[i] > ages[j] })
+	return ages
+}
+
+// contentAgeGauge reports the oldest or median age of cached content in seconds, computed when
+// read. It is zero when nothing is cached.
+type contentAgeGauge struct {
+	cache  *Cache
+	median bool
+}
+
+func (g contentAgeGauge) Snapshot() metrics.Gauge { return metrics.GaugeSnapshot(g.Value()) }
+
+// Update panics, since the age is computed from the cache.
+func (contentAgeGauge) Update(int64) {
+	panic("Update called on a contentAgeGauge")
+}
+
+func (g contentAgeGauge) Value() int64 {
+	ages := g.cache.contentAges()
+	switch {
+	case len(ages) == 0:
+		return 0
+	case g.median:
+		return int64(ages[len(ages)/2] / time.Second)
+	default:
+		return int64(ages[0] / time.Second)
+	}
+}
+
+// pendingGauge reports the number of secrets served while scheduled for deletion, computed when
+// read.
+type pendingGauge struct {
+	cache *Cache
+}
+
+func (g pendingGauge) Snapshot() metrics.Gauge { return metrics.GaugeSnapshot(g.Value()) }
+
+// Update panics, since the number is computed from the cache.
+func (pendingGauge) Update(int64) {
+	panic("Update called on a pendingGauge")
+}
+
+func (g pendingGauge) Value() int64 {
+	return int64(g.cache.pendingDeletions())
+}
+
+// missGauge reports the number of names recently reported missing, computed when read.
+type missGauge struct {
+	misses *missTracker
+}
+
+func (g missGauge) Snapshot() metrics.Gauge { return metrics.GaugeSnapshot(g.Value()) }
+
+// Update panics, since the number is computed from the tracked misses.
+func (missGauge) Update(int64) {
+	panic("Update called on a missGauge")
+}
+
+func (g missGauge) Value() int64 {
+	return int64(g.misses.Len())
+}
+
+// cachedBytesGauge reports the size of the content held in the cache, computed when read.
+type cachedBytesGauge struct {
+	cache *Cache
+}
+
+func (g cachedBytesGauge) Snapshot() metrics.Gauge { return metrics.GaugeSnapshot(g.Value()) }
+
+// Update panics, since the size is computed from the cache.
+func (cachedBytesGauge) Update(int64) {
+	panic("Update called on a cachedBytesGauge")
+}
+
+func (g cachedBytesGauge) Value() int64 {
+	return g.cache.cachedBytes()
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheMetrics(t *testing.T) {
+	assert := assert.New(t)
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+
+	clock := time.Now()
+	cache := NewCache(FailingBackend{}, timeouts, logConfig, func() time.Time { return clock })
+	registry := metrics.NewRegistry()
+	cache.SetMetrics(registry)
+	oldest := registry.Get("runtime.cache.oldest_age").(metrics.Gauge)
+	median := registry.Get("runtime.cache.median_age").(metrics.Gauge)
+	stale := registry.Get("runtime.cache.stale_served").(metrics.Counter)
+	assert.EqualValues(0, oldest.Value())
+	assert.EqualValues(0, median.Value())
+
+	cache.Add(Secret{Name: "a", Content: decodedContent([]byte("a"))})
+	clock = clock.Add(10 * time.Second)
+	cache.Add(Secret{Name: "b", Content: decodedContent([]byte("b"))})
+	clock = clock.Add(20 * time.Second)
+	cache.Add(Secret{Name: "c", Content: decodedContent([]byte("c"))})
+	cache.Add(Secret{Name: "listed"})
+	clock = clock.Add(5 * time.Second)
+	assert.EqualValues(35, oldest.Value())
+	assert.EqualValues(25, median.Value())
+	assert.EqualValues(35, oldest.Snapshot().Value())
+
+	// A listing confirming content current makes it younger.
+	cache.secretMap.Confirm("a")
+	assert.EqualValues(25, oldest.Value())
+	assert.EqualValues(5, median.Value())
+
+	// Past the fresh threshold, the backend fails and the cached secret is served.
+	secret, ok := cache.Secret("a")
+	assert.True(ok)
+	assert.Equal("a", string(secret.Content.Bytes()))
+	assert.EqualValues(1, stale.Count())
+
+	// Secrets which aren't cached, and those served offline on purpose, aren't counted.
+	_, ok = cache.Secret("missing")
+	assert.False(ok)
+	cache.SetOffline(true)
+	_, ok = cache.Secret("b")
+	assert.True(ok)
+	assert.EqualValues(1, stale.Count())
+}
+
+func TestCacheDeletionGrace(t *testing.T) {
+	assert := assert.New(t)
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+
+	clock := time.Now()
+	cache := NewCache(DeletedBackend{}, timeouts, logConfig, func() time.Time { return clock })
+	registry := metrics.NewRegistry()
+	cache.SetMetrics(registry)
+	pending := registry.Get("runtime.cache.deleted_pending").(metrics.Gauge)
+	served := registry.Get("runtime.cache.deleted_served").(metrics.Counter)
+	cache.Add(Secret{Name: "removed", Content: decodedContent([]byte("content"))})
+	cache.Add(Secret{Name: "deleted", Content: decodedContent([]byte("content"))})
+
+	// Secrets removed from the listing, or reported deleted, are served during the deletion delay.
+	cache.Reload()
+	assert.EqualValues(2, pending.Value())
+	secret, ok := cache.Secret("deleted")
+	assert.True(ok)
+	assert.Equal("content", string(secret.Content.Bytes()))
+	assert.EqualValues(1, served.Count())
+
+	clock = clock.Add(timeouts.DeletionDelay + time.Second)
+	_, ok = cache.Secret("deleted")
+	assert.False(ok)
+	assert.EqualValues(0, pending.Value())
+	assert.EqualValues(1, served.Count())
+}
+
+func TestCacheSizeMetrics(t *testing.T) {
+	assert := assert.New(t)
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+
+	kwfs, _, _ := NewKeywhizFs(nil, MapBackend{"small": "abc", "large": strings.Repeat("x", 4096)}, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	registry := metrics.NewRegistry()
+	kwfs.Cache.SetMetrics(registry)
+	cached := registry.Get("runtime.cache.bytes").(metrics.Gauge)
+	served := registry.Get("runtime.secret.served_size").(metrics.Histogram)
+	assert.EqualValues(0, cached.Value())
+
+	// Listed secrets without content take no space.
+	kwfs.Cache.SecretList()
+	assert.EqualValues(0, cached.Value())
+
+	context := &fuse.Context{}
+	for _, name := range []string{"small", "large", "large"} {
+		_, status := kwfs.Open(name, 0, context)
+		assert.Equal(fuse.OK, status)
+	}
+	assert.EqualValues(4096+3, cached.Value())
+	assert.EqualValues(4096+3, cached.Snapshot().Value())
+	assert.EqualValues(3, served.Count())
+	assert.EqualValues(3, served.Min())
+	assert.EqualValues(4096, served.Max())
+
+	// Attributes and control files aren't secrets served.
+	_, status := kwfs.GetAttr("large", context)
+	assert.Equal(fuse.OK, status)
+	_, status = kwfs.Open(".json/metrics", 0, context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(3, served.Count())
+}
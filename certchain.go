@@ -0,0 +1,120 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadClientCertificate reads a client certificate and its private key. The certificate file may
+// hold a full chain, in any order: the certificate matching the key is presented first, followed
+// by the intermediates in issuing order, so that servers requiring the chain can verify it.
+// Certificates which aren't part of that chain are an error, rather than silently sent along.
+func loadClientCertificate(certFile, keyFile string) (cert tls.Certificate, err error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return
+	}
+	return parseClientCertificate(certPEM, keyPEM, certFile, keyFile)
+}
+
+// parseClientCertificate is loadClientCertificate for the content of the files, whose names are
+// only used in errors.
+func parseClientCertificate(certPEM, keyPEM []byte, certFile, keyFile string) (cert tls.Certificate, err error) {
+	var certs []*x509.Certificate
+	for rest := certPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		parsed, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return cert, fmt.Errorf("parsing certificate %d in %s: %v", len(certs)+1, certFile, err)
+		}
+		certs = append(certs, parsed)
+	}
+	if len(certs) == 0 {
+		return cert, fmt.Errorf("no certificates found in %s", certFile)
+	}
+
+	leaf := -1
+	for i, c := range certs {
+		var pair tls.Certificate
+		pair, err = tls.X509KeyPair(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}), keyPEM)
+		if err == nil {
+			leaf, cert.PrivateKey = i, pair.PrivateKey
+			break
+		}
+	}
+	if leaf < 0 {
+		return cert, fmt.Errorf("no certificate in %s matches the private key in %s: %v", certFile, keyFile, err)
+	}
+
+	chain, err := orderChain(certs[leaf], append(certs[:leaf:leaf], certs[leaf+1:]...))
+	if err != nil {
+		return cert, fmt.Errorf("certificate chain in %s: %v", certFile, err)
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	cert.Leaf = chain[0]
+	return cert, nil
+}
+
+// orderChain returns leaf followed by the certificates of others which issued it, each one
+// followed by its own issuer. All of others must be part of the chain.
+func orderChain(leaf *x509.Certificate, others []*x509.Certificate) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{leaf}
+	for current := leaf; len(others) > 0 && !bytes.Equal(current.RawIssuer, current.RawSubject); {
+		issuer := -1
+		for i, c := range others {
+			if bytes.Equal(c.RawSubject, current.RawIssuer) && current.CheckSignatureFrom(c) == nil {
+				issuer = i
+				break
+			}
+		}
+		if issuer < 0 {
+			break
+		}
+		current = others[issuer]
+		chain = append(chain, current)
+		others = append(others[:issuer:issuer], others[issuer+1:]...)
+	}
+	if len(others) > 0 {
+		return nil, fmt.Errorf("%q doesn't belong to the chain of %q", others[0].Subject, leaf.Subject)
+	}
+	return chain, nil
+}
+
+// describeChain summarizes a certificate loaded by loadClientCertificate for logs.
+func describeChain(cert tls.Certificate) string {
+	if cert.Leaf == nil {
+		return "no certificate"
+	}
+	return fmt.Sprintf("%q issued by %q, followed by %d chain certificate(s)", cert.Leaf.Subject, cert.Leaf.Issuer, len(cert.Certificate)-1)
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate for name valid for the surrounding hour, signed by issuer or
+// self-signed if nil.
+func newTestCert(t *testing.T, name string, isCA bool, issuer *testCert) *testCert {
+	return newTestCertValid(t, name, isCA, issuer, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// newTestCertValid is newTestCert for a certificate valid from notBefore to notAfter.
+func newTestCertValid(t *testing.T, name string, isCA bool, issuer *testCert, notBefore, notAfter time.Time) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert, key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// writeChain writes the key of leaf followed by the given certificates to a file.
+func writeChain(t *testing.T, dir string, leaf *testCert, certs ...*testCert) string {
+	data := leaf.keyPEM(t)
+	for _, c := range certs {
+		data = append(data, c.certPEM()...)
+	}
+	file := filepath.Join(dir, "client.pem")
+	assert.NoError(t, ioutil.WriteFile(file, data, 0600))
+	return file
+}
+
+func TestLoadClientCertificateOrdersChain(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-chain")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	root := newTestCert(t, "root", true, nil)
+	intermediate := newTestCert(t, "intermediate", true, root)
+	issuing := newTestCert(t, "issuing", true, intermediate)
+	leaf := newTestCert(t, "client", false, issuing)
+
+	file := writeChain(t, dir, leaf, intermediate, leaf, issuing)
+	cert, err := loadClientCertificate(file, file)
+	assert.NoError(err)
+	assert.Equal([][]byte{leaf.cert.Raw, issuing.cert.Raw, intermediate.cert.Raw}, cert.Certificate)
+	assert.Equal("client", cert.Leaf.Subject.CommonName)
+	assert.Contains(describeChain(cert), "followed by 2 chain certificate(s)")
+
+	// The fixture holds a single certificate.
+	cert, err = loadClientCertificate(clientFile, clientFile)
+	assert.NoError(err)
+	assert.Len(cert.Certificate, 1)
+}
+
+func TestLoadClientCertificateErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-chain")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	root := newTestCert(t, "root", true, nil)
+	leaf := newTestCert(t, "client", false, root)
+	other := newTestCert(t, "other", true, nil)
+
+	file := writeChain(t, dir, leaf, leaf, other)
+	_, err = loadClientCertificate(file, file)
+	assert.EqualError(err, "certificate chain in "+file+`: "CN=other" doesn't belong to the chain of "CN=client"`)
+
+	file = writeChain(t, dir, leaf, root)
+	_, err = loadClientCertificate(file, file)
+	assert.Contains(err.Error(), "no certificate in "+file+" matches the private key")
+
+	file = writeChain(t, dir, leaf)
+	_, err = loadClientCertificate(file, file)
+	assert.EqualError(err, "no certificates found in "+file)
+}
+
+func TestClientCertificateChainHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-chain")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	root := newTestCert(t, "root", true, nil)
+	intermediate := newTestCert(t, "intermediate", true, root)
+	leaf := newTestCert(t, "client", false, intermediate)
+	server := newTestCert(t, "server", false, root)
+
+	// The server only trusts the root, so the intermediate must be presented by the client.
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	}
+
+	file := writeChain(t, dir, leaf, leaf, intermediate)
+	cert, err := loadClientCertificate(file, file)
+	assert.NoError(err)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- tls.Server(serverConn, serverConfig).Handshake()
+	}()
+	client := tls.Client(clientConn, &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+	assert.NoError(client.Handshake())
+	assert.NoError(<-done)
+}
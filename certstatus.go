@@ -0,0 +1,210 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics"
+	klog "github.com/square/keywhiz-fs/log"
+)
+
+// defaultCertCheck is how often certificate expiry is checked.
+var defaultCertCheck = time.Hour
+
+// CertInfo describes one certificate in .json/cert_status.
+type CertInfo struct {
+	// Role is client, intermediate or ca.
+	Role      string    `json:"role"`
+	File      string    `json:"file"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// ExpiresIn is the number of seconds until NotAfter, negative once expired.
+	ExpiresIn int64 `json:"expires_in"`
+	Expired   bool  `json:"expired"`
+}
+
+// CertStatus is the content of .json/cert_status: the certificates used to talk to the server,
+// as currently found in their files.
+type CertStatus struct {
+	Certificates []CertInfo `json:"certificates"`
+	// Errors lists files which couldn't be read.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// certStatus reads the client certificate chain and CA certificates of params. There is no
+// client certificate with a bearer token or through a unix socket.
+func certStatus(params httpClientParams, now time.Time) CertStatus {
+	status := CertStatus{Certificates: []CertInfo{}}
+	if params.Socket != "" {
+		return status
+	}
+	if params.TokenFile == "" {
+		cert, err := loadClientCertificate(params.CertFile, params.KeyFile)
+		if err != nil {
+			status.Errors = append(status.Errors, err.Error())
+		}
+		for i, der := range cert.Certificate {
+			parsed, err := x509.ParseCertificate(der)
+			if err != nil {
+				continue
+			}
+			role := "client"
+			if i > 0 {
+				role = "intermediate"
+			}
+			status.Certificates = append(status.Certificates, newCertInfo(role, params.CertFile, parsed, now))
+		}
+	}
+	if params.CaBundle != "" {
+		cas, err := readCertificates(params.CaBundle)
+		if err != nil {
+			status.Errors = append(status.Errors, err.Error())
+		}
+		for _, ca := range cas {
+			status.Certificates = append(status.Certificates, newCertInfo("ca", params.CaBundle, ca, now))
+		}
+	}
+	return status
+}
+
+func newCertInfo(role, file string, cert *x509.Certificate, now time.Time) CertInfo {
+	expiresIn := cert.NotAfter.Sub(now)
+	return CertInfo{role, file, cert.Subject.String(), cert.Issuer.String(), cert.NotBefore, cert.NotAfter, int64(expiresIn / time.Second), expiresIn <= 0}
+}
+
+// readCertificates returns the PEM-encoded certificates of file.
+func readCertificates(file string) (certs []*x509.Certificate, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return certs, fmt.Errorf("parsing certificate %d in %s: %v", len(certs)+1, file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return certs, nil
+}
+
+// Expiry returns when the first certificate of the given role expires, or the zero time if there
+// is none.
+func (s CertStatus) Expiry(role string) (first time.Time) {
+	for _, cert := range s.Certificates {
+		if cert.Role == role && (first.IsZero() || cert.NotAfter.Before(first)) {
+			first = cert.NotAfter
+		}
+	}
+	return
+}
+
+// CertMonitor periodically checks the certificates of a client, reporting their expiry in the
+// runtime.cert.client.expiry and runtime.cert.ca.expiry gauges (seconds since the epoch) and
+// logging warnings as it approaches.
+type CertMonitor struct {
+	*klog.Logger
+	client       *Client
+	warnBefore   time.Duration
+	clientExpiry metrics.Gauge
+	caExpiry     metrics.Gauge
+}
+
+// NewCertMonitor returns a CertMonitor warning about certificates expiring within warnBefore.
+func NewCertMonitor(client *Client, warnBefore time.Duration, logConfig klog.Config, metricsHandle *sqmetrics.SquareMetrics) *CertMonitor {
+	return &CertMonitor{
+		klog.New("kwfs_certs", logConfig),
+		client,
+		warnBefore,
+		metrics.GetOrRegisterGauge("runtime.cert.client.expiry", metricsHandle.Registry),
+		metrics.GetOrRegisterGauge("runtime.cert.ca.expiry", metricsHandle.Registry),
+	}
+}
+
+// Check updates the gauges and logs certificates which expired or expire within warnBefore.
+func (m *CertMonitor) Check() CertStatus {
+	status := certStatus(m.client.current().params, time.Now())
+	for _, err := range status.Errors {
+		m.Warnf("Unable to check certificate expiry: %s", err)
+	}
+	for _, cert := range status.Certificates {
+		switch {
+		case cert.Expired:
+			m.Errorf("The %s certificate %s in %s expired at %v", cert.Role, cert.Subject, cert.File, cert.NotAfter.Format(time.RFC3339))
+		case time.Duration(cert.ExpiresIn)*time.Second <= m.warnBefore:
+			m.Warnf("The %s certificate %s in %s expires at %v", cert.Role, cert.Subject, cert.File, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	m.clientExpiry.Update(unixOrZero(status.Expiry("client")))
+	m.caExpiry.Update(unixOrZero(status.Expiry("ca")))
+	return status
+}
+
+// Run calls Check every interval.
+func (m *CertMonitor) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.Check()
+	}
+}
+
+// Expired returns an error naming the client certificate if it expired or isn't valid yet.
+func (s CertStatus) Expired(now time.Time) error {
+	for _, cert := range s.Certificates {
+		if cert.Role != "client" {
+			continue
+		}
+		if cert.Expired {
+			return fmt.Errorf("client certificate %s in %s expired at %v", cert.Subject, cert.File, cert.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(cert.NotBefore) {
+			return fmt.Errorf("client certificate %s in %s isn't valid before %v", cert.Subject, cert.File, cert.NotBefore.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// certStatusJSON returns the content of .json/cert_status.
+func (kwfs KeywhizFs) certStatusJSON() []byte {
+	status, err := json.Marshal(certStatus(kwfs.Client.current().params, time.Now()))
+	panicOnError(err)
+	return status
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-certs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	root := newTestCertValid(t, "root", true, nil, now.Add(-time.Hour), now.Add(240*time.Hour))
+	intermediate := newTestCert(t, "intermediate", true, root)
+	leaf := newTestCertValid(t, "client", false, intermediate, now.Add(-2*time.Hour), now.Add(-time.Minute))
+	keyFile := writeChain(t, dir, leaf, leaf, intermediate)
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(ioutil.WriteFile(caFile, root.certPEM(), 0644))
+
+	status := certStatus(httpClientParams{CertFile: keyFile, KeyFile: keyFile, CaBundle: caFile}, now)
+	assert.Empty(status.Errors)
+	if assert.Len(status.Certificates, 3) {
+		assert.Equal("client", status.Certificates[0].Role)
+		assert.Equal("CN=client", status.Certificates[0].Subject)
+		assert.True(status.Certificates[0].Expired)
+		assert.Equal("intermediate", status.Certificates[1].Role)
+		assert.Equal("ca", status.Certificates[2].Role)
+		assert.Equal(caFile, status.Certificates[2].File)
+		assert.Equal(int64(root.cert.NotAfter.Sub(now)/time.Second), status.Certificates[2].ExpiresIn)
+	}
+	assert.Equal(root.cert.NotAfter, status.Expiry("ca"))
+	assert.Contains(status.Expired(now).Error(), "client certificate CN=client in "+keyFile+" expired at")
+
+	// The gauges report expiry as seconds since the epoch.
+	client := NewClient(clientFile, clientFile, testCaFile, nil, time.Second, ClientOptions{}, logConfig, setupMetrics(metricsURL, metricsPrefix, *mountpoint))
+	assert.NoError(client.Reload(keyFile, keyFile, caFile, nil, time.Second))
+	monitor := NewCertMonitor(&client, time.Hour, logConfig, setupMetrics(metricsURL, metricsPrefix, *mountpoint))
+	monitor.Check()
+	assert.Equal(leaf.cert.NotAfter.Unix(), monitor.clientExpiry.Value())
+	assert.Equal(root.cert.NotAfter.Unix(), monitor.caExpiry.Value())
+
+	// Missing files are reported, and there's no client certificate with a bearer token.
+	status = certStatus(httpClientParams{CaBundle: filepath.Join(dir, "missing.crt"), ClientOptions: ClientOptions{TokenFile: "token"}}, now)
+	assert.Empty(status.Certificates)
+	assert.Len(status.Errors, 1)
+	assert.NoError(status.Expired(now))
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// changeLogSize is the number of changes kept by the change log of a cache.
+const changeLogSize = 256
+
+// Kinds of changes recorded in the change log.
+const (
+	ChangeAdded   = "added"
+	ChangeUpdated = "updated"
+	ChangeRemoved = "removed"
+)
+
+// ChangeEvent is an entry of the change log.
+type ChangeEvent struct {
+	Time  time.Time `json:"time"`
+	Name  string    `json:"name"`
+	Event string    `json:"event"`
+	// From and To are the digests of the content before and after the change, "sha256:<hex>",
+	// where known.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// ChangeLog is a rolling in-memory log of the secrets added, updated and removed, served at
+// .json/changes so operators can see what rotated recently. Only the latest changes are kept.
+type ChangeLog struct {
+	lock   sync.Mutex
+	events []ChangeEvent
+	size   int
+	now    func() time.Time
+}
+
+// NewChangeLog creates a change log keeping the last size changes. now defaults to time.Now.
+func NewChangeLog(size int, now func() time.Time) *ChangeLog {
+	if now == nil {
+		now = time.Now
+	}
+	return &ChangeLog{size: size, now: now}
+}
+
+// Record appends a change, timestamped now, dropping the oldest if the log is full.
+func (l *ChangeLog) Record(event, name, from, to string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, ChangeEvent{l.now(), name, event, from, to})
+	if len(l.events) > l.size {
+		l.events = append(l.events[:0], l.events[len(l.events)-l.size:]...)
+	}
+}
+
+// Events returns the changes in the log, latest first.
+func (l *ChangeLog) Events() []ChangeEvent {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	events := make([]ChangeEvent, len(l.events))
+	for i, e := range l.events {
+		events[len(events)-1-i] = e
+	}
+	return events
+}
+
+// changesJSON returns the change log of the cache.
+func (kwfs KeywhizFs) changesJSON() []byte {
+	changes, err := json.Marshal(kwfs.Cache.Changes())
+	panicOnError(err)
+	return changes
+}
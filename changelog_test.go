@@ -0,0 +1,110 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestChangeLogRolls(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, time.June, 29, 20, 5, 21, 0, time.UTC)
+	log := NewChangeLog(2, func() time.Time { return now })
+	log.Record(ChangeAdded, "first", "", "sha256:1")
+	log.Record(ChangeUpdated, "second", "sha256:1", "sha256:2")
+	log.Record(ChangeRemoved, "third", "sha256:2", "")
+
+	assert.Equal([]ChangeEvent{
+		{now, "third", ChangeRemoved, "sha256:2", ""},
+		{now, "second", ChangeUpdated, "sha256:1", "sha256:2"},
+	}, log.Events())
+}
+
+func TestCacheLogsChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	backend := MapBackend{"kept": "old", "removed": "gone"}
+	cache := NewCache(backend, timeouts, logConfig, nil)
+
+	// The initial contents of the cache aren't changes.
+	cache.SecretList()
+	_, ok := cache.Secret("kept")
+	assert.True(ok)
+	assert.Empty(cache.Changes())
+
+	backend["added"] = "new"
+	delete(backend, "removed")
+	cache.SecretList()
+	backend["kept"] = "rotated"
+	_, ok = cache.Secret("kept")
+	assert.True(ok)
+	// Fetching a secret already logged as removed doesn't log it again.
+	cache.Refresh("removed")
+
+	changes := cache.Changes()
+	if assert.Len(changes, 3) {
+		assert.Equal(ChangeUpdated, changes[0].Event)
+		assert.Equal("kept", changes[0].Name)
+		assert.Equal(sha256Digest("old"), changes[0].From)
+		assert.Equal(sha256Digest("rotated"), changes[0].To)
+		assert.False(changes[0].Time.IsZero())
+
+		removed, added := changes[1], changes[2]
+		if removed.Event != ChangeRemoved {
+			removed, added = added, removed
+		}
+		assert.Equal(ChangeEvent{removed.Time, "removed", ChangeRemoved, "", ""}, removed)
+		assert.Equal(ChangeEvent{added.Time, "added", ChangeAdded, "", ""}, added)
+	}
+}
+
+func TestChangesFile(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	kwfs, _, _ := NewKeywhizFs(nil, MapBackend{"secret": "content"}, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	kwfs.Cache.Update("secret", []byte("written"))
+
+	attr, status := kwfs.GetAttr(".json/changes", &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	assert.Equal(uint32(0400), attr.Mode&0777)
+
+	file, status := kwfs.Open(".json/changes", 0, &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 4096)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	var changes []ChangeEvent
+	assert.NoError(json.Unmarshal(data, &changes))
+	if assert.Len(changes, 1) {
+		assert.Equal("secret", changes[0].Name)
+		assert.Equal(ChangeUpdated, changes[0].Event)
+		assert.Equal(sha256Digest("written"), changes[0].To)
+	}
+}
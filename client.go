@@ -15,14 +15,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -47,14 +56,73 @@ var ciphers = []uint16{
 	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 }
 
+// resolverTimeout bounds a lookup against a single configured DNS server before the next one
+// is tried.
+var resolverTimeout = 2 * time.Second
+
+// statusCacheTTL is how long a server status response is served from memory.
+var statusCacheTTL = 5 * time.Second
+
 // Client basic struct.
 type Client struct {
 	*klog.Logger
-	http        func() *http.Client
-	url         *url.URL
-	params      httpClientParams
+	conn        *unsafe.Pointer
 	failCount   metrics.Counter
 	lastSuccess metrics.Gauge
+	corrupt     metrics.Counter
+	unsigned    metrics.Counter
+	status      *statusCache
+	// large holds a token for every large secret response being read.
+	large chan struct{}
+	// reauths counts rebuilds of the HTTP client after authentication errors, and lastReauth
+	// is when the last one happened, on the monotonic clock (see monotonic).
+	reauths    metrics.Counter
+	lastReauth *int64
+	// registry holds the runtime.server.status.<status> counters of responses by status code.
+	registry metrics.Registry
+	// clockSkew is how far ahead of ours the server's clock was at the last response, in seconds.
+	clockSkew metrics.Gauge
+	// succeededAt is when a request last succeeded, on the monotonic clock, for Health.
+	succeededAt *int64
+}
+
+// clientConn is how a Client reaches the server. It is replaced as a whole when the HTTP client
+// is refreshed or the client is reloaded with new settings.
+type clientConn struct {
+	http   *http.Client
+	url    *url.URL
+	params httpClientParams
+}
+
+// endpoint returns the URL of the path formed by elements, below the server URL. Requests
+// through a unix socket go to http://localhost, the socket being dialed by the transport.
+func (conn *clientConn) endpoint(elements ...string) url.URL {
+	t := *conn.url
+	if conn.params.Socket != "" {
+		t = url.URL{Scheme: "http", Host: "localhost", Path: "/"}
+	}
+	t.Path = path.Join(append([]string{t.Path}, elements...)...)
+	return t
+}
+
+// socketPath returns the path of the unix socket of a unix:///path/to.sock server URL, or ""
+// for other URLs.
+func socketPath(serverURL *url.URL) (string, error) {
+	if serverURL == nil || serverURL.Scheme != "unix" {
+		return "", nil
+	}
+	if serverURL.Host != "" || !strings.HasPrefix(serverURL.Path, "/") {
+		return "", fmt.Errorf("invalid unix socket URL %s, expected unix:///path/to.sock", serverURL)
+	}
+	return serverURL.Path, nil
+}
+
+// statusCache holds the last server status response.
+type statusCache struct {
+	lock    sync.Mutex
+	data    []byte
+	err     error
+	fetched time.Time
 }
 
 // httpClientParams are values necessary for constructing a TLS client.
@@ -62,71 +130,256 @@ type httpClientParams struct {
 	CertFile string `json:"cert_file"`
 	KeyFile  string `json:"key_file"`
 	CaBundle string `json:"ca_bundle"`
-	timeout  time.Duration
+	// Socket is the path of a unix socket the server is reached through, without TLS, if set.
+	Socket string `json:"socket,omitempty"`
+	// host is the host requests to the server go to. The bearer token is only sent there.
+	host    string
+	timeout time.Duration
+	ClientOptions
+}
+
+// ClientOptions are optional settings of a client.
+type ClientOptions struct {
+	// Resolvers are DNS servers ("host" or "host:port") used to resolve the server hostname,
+	// tried in order. The system resolver is used if empty.
+	Resolvers []string `json:"resolvers,omitempty"`
+	// Tracer records spans for server requests, if set.
+	Tracer *Tracer `json:"-"`
+	// VerifyKey, if set, must have signed the content of secrets before it is used.
+	VerifyKey ed25519.PublicKey `json:"-"`
+	// MaxSecretSize limits the size in bytes of a secret response, content included. Zero means
+	// no limit.
+	MaxSecretSize int64 `json:"max_secret_size,omitempty"`
+	// TokenFile, if set, holds a bearer token sent with every request instead of presenting a
+	// client certificate. It is read again when the file changes.
+	TokenFile string `json:"token_file,omitempty"`
 }
 
+// largeResponseSize is the size past which a secret response counts as large. Only
+// largeResponses large responses are read at a time; others wait, without reading from the
+// server, so that a burst of fetches of big secrets doesn't buffer all of them at once.
+const (
+	largeResponseSize = 1 << 20
+	largeResponses    = 2
+)
+
 type SecretDeleted struct{}
 
 func (e SecretDeleted) Error() string {
 	return "deleted"
 }
 
+// SecretTooLarge is returned when a secret response exceeds ClientOptions.MaxSecretSize.
+type SecretTooLarge struct {
+	Name  string
+	Limit int64
+}
+
+func (e SecretTooLarge) Error() string {
+	return fmt.Sprintf("secret %s is larger than %d bytes", e.Name, e.Limit)
+}
+
+// BackendStatus is returned when the server answers a secret request with an unexpected status
+// code.
+type BackendStatus struct {
+	Status  int
+	Message string
+}
+
+func (e BackendStatus) Error() string {
+	return e.Message
+}
+
+// accessDenied returns true if err is the server refusing access to a secret.
+func accessDenied(err error) bool {
+	e, ok := err.(BackendStatus)
+	return ok && (e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden)
+}
+
+type SecretExists struct{}
+
+func (e SecretExists) Error() string {
+	return "already exists"
+}
+
 func (c Client) failCountInc() {
 	c.failCount.Inc(1)
 }
 
 func (c Client) markSuccess() {
+	now := time.Now()
 	c.failCount.Clear()
-	c.lastSuccess.Update(time.Now().Unix())
+	c.lastSuccess.Update(now.Unix())
+	atomic.StoreInt64(c.succeededAt, monotonic(now))
+}
+
+// logRequest logs a completed server request, with op, secret, status, duration and the
+// request ID sent to the server, if any, as structured fields.
+func (c Client) logRequest(op, secret, requestID string, status int, duration time.Duration, format string, v ...interface{}) {
+	fields := klog.Fields{"op": op, "status": status, "duration": duration}
+	if secret != "" {
+		fields["secret"] = secret
+	}
+	if requestID != "" {
+		fields["request_id"] = requestID
+		format += " [%s]"
+		v = append(v, requestID)
+	}
+	c.Log(klog.LevelInfo, fields, format, v...)
+}
+
+// Server health states reported by Client.Health.
+const (
+	healthOK          = "OK"
+	healthDegraded    = "DEGRADED"
+	healthUnreachable = "UNREACHABLE"
+)
+
+// Health summarizes recent communication with the server. The server is degraded while requests
+// fail, and unreachable once no request has succeeded for longer than threshold, counting from
+// since (usually the mount time) if none ever has. Elapsed time is measured on the monotonic
+// clock, so that a change of the system clock doesn't make the server look unreachable.
+func (c Client) Health(threshold time.Duration, since time.Time) (state string, lastSuccess time.Time, failures int64) {
+	failures = c.failCount.Count()
+	if seconds := c.lastSuccess.Value(); seconds > 0 {
+		lastSuccess = time.Unix(seconds, 0)
+	}
+
+	elapsed := time.Since(since)
+	if succeeded := atomic.LoadInt64(c.succeededAt); succeeded != 0 && monotonicSince(succeeded) < elapsed {
+		elapsed = monotonicSince(succeeded)
+	}
+	switch {
+	case failures == 0:
+		state = healthOK
+	case elapsed > threshold:
+		state = healthUnreachable
+	default:
+		state = healthDegraded
+	}
+	return
 }
 
 // NewClient produces a read-to-use client struct given PEM-encoded certificate file, key file, and
 // ca file with the list of trusted certificate authorities.
-func NewClient(certFile, keyFile, caFile string, serverURL *url.URL, timeout time.Duration, logConfig klog.Config, metricsHandle *sqmetrics.SquareMetrics) (client Client) {
+func NewClient(certFile, keyFile, caFile string, serverURL *url.URL, timeout time.Duration, opts ClientOptions, logConfig klog.Config, metricsHandle *sqmetrics.SquareMetrics) (client Client) {
 	logger := klog.New("kwfs_client", logConfig)
-	params := httpClientParams{certFile, keyFile, caFile, timeout}
+	socket, err := socketPath(serverURL)
+	panicOnError(err)
+	params := httpClientParams{certFile, keyFile, caFile, socket, serverHost(serverURL, socket), timeout, opts}
 
 	failCount := metrics.GetOrRegisterCounter("runtime.server.fails", metricsHandle.Registry)
 	lastSuccess := metrics.GetOrRegisterGauge("runtime.server.lastsuccess", metricsHandle.Registry)
-
-	var httpClient unsafe.Pointer
-
-	// Load HTTP client from atomic pointer
-	getClient := func() *http.Client {
-		return (*http.Client)(atomic.LoadPointer(&httpClient))
-	}
+	corrupt := metrics.GetOrRegisterCounter("runtime.secret.corrupt", metricsHandle.Registry)
+	unsigned := metrics.GetOrRegisterCounter("runtime.secret.invalid_signature", metricsHandle.Registry)
+	reauths := metrics.GetOrRegisterCounter("runtime.server.reauth", metricsHandle.Registry)
+	clockSkew := metrics.GetOrRegisterGauge("runtime.server.clock_skew", metricsHandle.Registry)
 
 	initial, err := params.buildClient()
 	panicOnError(err)
+	if socket != "" {
+		logger.Infof("Connecting to the server through %s", socket)
+	} else if opts.TokenFile != "" {
+		logger.Infof("Authenticating with the bearer token in %s", opts.TokenFile)
+	} else if cert, err := loadClientCertificate(certFile, keyFile); err == nil {
+		logger.Infof("Using client certificate %s", describeChain(cert))
+	}
 
-	atomic.StorePointer(&httpClient, unsafe.Pointer(initial))
+	conn := unsafe.Pointer(&clientConn{initial, serverURL, params})
+	client = Client{
+		Logger:      logger,
+		conn:        &conn,
+		failCount:   failCount,
+		lastSuccess: lastSuccess,
+		corrupt:     corrupt,
+		unsigned:    unsigned,
+		status:      &statusCache{},
+		large:       make(chan struct{}, largeResponses),
+		reauths:     reauths,
+		lastReauth:  new(int64),
+		registry:    metricsHandle.Registry,
+		clockSkew:   clockSkew,
+		succeededAt: new(int64),
+	}
 
 	// Asynchronously updates client and updates atomic reference
 	go func() {
 		for t := range time.Tick(clientRefresh) {
-			if client, err := params.buildClient(); err == nil {
+			current := client.current()
+			if httpClient, err := current.params.buildClient(); err == nil {
 				logger.Infof("Updating http client at %v", t)
-				atomic.StorePointer(&httpClient, unsafe.Pointer(client))
+				// Lose to a concurrent Reload, which built a client with newer settings.
+				atomic.CompareAndSwapPointer(client.conn, unsafe.Pointer(current),
+					unsafe.Pointer(&clientConn{httpClient, current.url, current.params}))
 			} else {
 				logger.Errorf("Error refreshing http client: %v", err)
 			}
 		}
 	}()
 
-	return Client{logger, getClient, serverURL, params, failCount, lastSuccess}
+	return client
+}
+
+// current returns the connection in use.
+func (c Client) current() *clientConn {
+	return (*clientConn)(atomic.LoadPointer(c.conn))
+}
+
+// http returns the HTTP client in use.
+func (c Client) http() *http.Client {
+	return c.current().http
+}
+
+// Reload switches to new certificate files, server URL and timeout, e.g. after the config file
+// changed. The current settings are kept if the new certificate files can't be loaded.
+func (c Client) Reload(certFile, keyFile, caFile string, serverURL *url.URL, timeout time.Duration) error {
+	socket, err := socketPath(serverURL)
+	if err != nil {
+		return err
+	}
+	options := c.current().params.ClientOptions
+	if err := checkTokenURL(serverURL, options.TokenFile); err != nil {
+		return err
+	}
+	params := httpClientParams{certFile, keyFile, caFile, socket, serverHost(serverURL, socket), timeout, options}
+	httpClient, err := params.buildClient()
+	if err != nil {
+		return err
+	}
+	atomic.StorePointer(c.conn, unsafe.Pointer(&clientConn{httpClient, serverURL, params}))
+
+	c.status.lock.Lock()
+	c.status.fetched = time.Time{}
+	c.status.lock.Unlock()
+	return nil
 }
 
-// ServerStatus returns raw JSON from the server's _status endpoint
+// ServerStatus returns raw JSON from the server's _status endpoint. The response is returned
+// whatever its status code, so that a degraded server can report its problems, and is cached
+// for statusCacheTTL to keep repeated stat and read calls from hitting the server.
 func (c Client) ServerStatus() (data []byte, err error) {
+	c.status.lock.Lock()
+	defer c.status.lock.Unlock()
+
+	if time.Since(c.status.fetched) < statusCacheTTL {
+		return c.status.data, c.status.err
+	}
+	data, err = c.rawServerStatus()
+	c.status.data, c.status.err, c.status.fetched = data, err, time.Now()
+	return data, err
+}
+
+func (c Client) rawServerStatus() (data []byte, err error) {
 	now := time.Now()
-	t := *c.url
-	t.Path = path.Join(c.url.Path, "_status")
-	resp, err := c.http().Get(t.String())
+	conn := c.current()
+	t := conn.endpoint("_status")
+	resp, err := c.get(t.String())
 	if err != nil {
 		c.Errorf("Error retrieving server status: %v", err)
 		return nil, err
 	}
-	c.Infof("GET /_status %d %v", resp.StatusCode, time.Since(now))
+	duration := time.Since(now)
+	c.logRequest("GET /_status", "", "", resp.StatusCode, duration, "GET /_status %d %v", resp.StatusCode, duration)
 	defer resp.Body.Close()
 
 	data, err = ioutil.ReadAll(resp.Body)
@@ -134,28 +387,58 @@ func (c Client) ServerStatus() (data []byte, err error) {
 		c.Errorf("Error reading response body for server status %v", err)
 		return nil, err
 	}
+	switch {
+	case resp.StatusCode == 404:
+		return nil, errors.New("server has no status endpoint")
+	case resp.StatusCode != 200:
+		c.Warnf("Server reports degraded status: (status=%v)", resp.StatusCode)
+	}
 	return data, nil
 }
 
-// RawSecret returns raw JSON from requesting a secret.
+// RawSecret returns raw JSON from requesting a secret. With a VerifyKey, it is only returned if
+// its content is signed.
 func (c Client) RawSecret(name string) (data []byte, err error) {
+	data, err = c.rawSecret(name, nil)
+	if err != nil || c.current().params.VerifyKey == nil {
+		return data, err
+	}
+	if _, err := c.parseSecret(name, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c Client) rawSecret(name string, span *Span) (data []byte, err error) {
 	now := time.Now()
 	// note: path.Join does not know how to properly escape for URLs!
-	t := *c.url
-	t.Path = path.Join(c.url.Path, "secret", name)
-	resp, err := c.http().Get(t.String())
+	conn := c.current()
+	t := conn.endpoint("secret", name)
+	req, err := http.NewRequest("GET", t.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	requestID := span.RequestID()
+	if requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+	resp, err := c.do(req.WithContext(withSpan(req.Context(), span)))
 	if err != nil {
 		c.Errorf("Error retrieving secret %v: %v", name, err)
 		c.failCountInc()
 		return nil, err
 	}
-	c.Infof("GET /secret/%v %d %v", name, resp.StatusCode, time.Since(now))
+	duration := time.Since(now)
+	c.logRequest("GET /secret", name, requestID, resp.StatusCode, duration, "GET /secret/%v %d %v", name, resp.StatusCode, duration)
 	defer resp.Body.Close()
 
-	data, err = ioutil.ReadAll(resp.Body)
+	data, err = c.readSecret(name, resp, conn.params.MaxSecretSize)
 	if err != nil {
 		c.Errorf("Error reading response body for secret %v: %v", name, err)
-		c.failCountInc()
+		// The server is fine, the secret is just too big for this client.
+		if _, ok := err.(SecretTooLarge); !ok {
+			c.failCountInc()
+		}
 		return nil, err
 	}
 
@@ -167,21 +450,74 @@ func (c Client) RawSecret(name string) (data []byte, err error) {
 		c.Warnf("Secret %v not found", name)
 		return nil, SecretDeleted{}
 	default:
-		msg := strings.Join(strings.Split(string(data), "\n"), " ")
+		msg := responseMessage(data)
 		c.Errorf("Bad response code getting secret %v: (status=%v, msg='%s')", name, resp.StatusCode, msg)
 		c.failCountInc()
-		return nil, errors.New(msg)
+		return nil, BackendStatus{resp.StatusCode, msg}
+	}
+}
+
+// readSecret reads a secret response of at most limit bytes, if limit isn't zero. The buffer is
+// sized from the Content-Length up front rather than grown as the body is read, and large
+// responses are only read largeResponses at a time.
+func (c Client) readSecret(name string, resp *http.Response, limit int64) ([]byte, error) {
+	if limit > 0 && resp.ContentLength > limit {
+		return nil, SecretTooLarge{name, limit}
+	}
+	body := io.Reader(resp.Body)
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+
+	var buf bytes.Buffer
+	if resp.ContentLength > 0 {
+		buf.Grow(int(resp.ContentLength))
+	}
+	n, err := buf.ReadFrom(io.LimitReader(body, largeResponseSize))
+	if err == nil && n == largeResponseSize {
+		c.large <- struct{}{}
+		defer func() { <-c.large }()
+		_, err = buf.ReadFrom(body)
 	}
+	if err == nil && limit > 0 && int64(buf.Len()) > limit {
+		err = SecretTooLarge{name, limit}
+	}
+	if err != nil {
+		wipeBytes(buf.Bytes())
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-// Secret returns an unmarshalled Secret struct after requesting a secret.
-func (c Client) Secret(name string) (secret *Secret, err error) {
-	data, err := c.RawSecret(name)
+// Fetch returns an unmarshalled Secret struct after requesting a secret.
+func (c Client) Fetch(name string) (secret *Secret, err error) {
+	return c.TracedFetch(name, nil)
+}
+
+// TracedFetch is like Fetch, recording the server request as a child of span.
+func (c Client) TracedFetch(name string, span *Span) (secret *Secret, err error) {
+	data, err := c.rawSecret(name, span)
 	if err != nil {
 		return nil, err
 	}
+	// The response holds the undecoded content, which parsing copies.
+	defer wipeBytes(data)
+	return c.parseSecret(name, data)
+}
 
+// parseSecret parses a secret fetched from the server, checking its digest and, with a
+// VerifyKey, its signature.
+func (c Client) parseSecret(name string, data []byte) (secret *Secret, err error) {
 	secret, err = ParseSecret(data)
+	if verifyKey := c.current().params.VerifyKey; err == nil && verifyKey != nil {
+		err = secret.verifySignature(verifyKey)
+	}
+	switch err.(type) {
+	case ContentCorrupt:
+		c.corrupt.Inc(1)
+	case InvalidSignature:
+		c.unsigned.Inc(1)
+	}
 	if err != nil {
 		c.Errorf("Error decoding retrieved secret %v: %v", name, err)
 		return nil, err
@@ -190,40 +526,170 @@ func (c Client) Secret(name string) (secret *Secret, err error) {
 	return secret, nil
 }
 
-// RawSecretList returns raw JSON from requesting a listing of secrets.
+// maxListPages bounds the number of pages followed when the server paginates secret listings.
+const maxListPages = 1000
+
+// RawSecretList returns raw JSON from requesting a listing of secrets. If the server paginates
+// the listing (using a Link header with rel="next"), all pages are fetched and stitched into a
+// single JSON array. With a VerifyKey, it is only returned if all content in it is signed.
 func (c Client) RawSecretList() (data []byte, ok bool) {
+	data, ok = c.rawSecretList()
+	verifyKey := c.current().params.VerifyKey
+	if !ok || verifyKey == nil {
+		return data, ok
+	}
+	secrets, err := ParseSecretList(data)
+	if err != nil {
+		c.Errorf("Error decoding retrieved secrets: %v", err)
+		return nil, false
+	}
+	for _, s := range secrets {
+		if err := s.verifySignature(verifyKey); !s.Content.Empty() && err != nil {
+			c.unsigned.Inc(1)
+			c.Errorf("Error decoding retrieved secrets: %v", err)
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func (c Client) rawSecretList() (data []byte, ok bool) {
+	conn := c.current()
+	t := conn.endpoint("secrets")
+
+	data, next, ok := c.rawSecretListPage(&t)
+	if !ok || next == nil {
+		return data, ok
+	}
+
+	var secrets []json.RawMessage
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		c.Errorf("Error decoding paginated secrets: %v", err)
+		return nil, false
+	}
+
+	seen := map[string]bool{t.String(): true}
+	for pages := 1; next != nil; pages++ {
+		if pages >= maxListPages || seen[next.String()] {
+			c.Errorf("Aborting paginated secrets listing after %d pages at %v", pages, next)
+			return nil, false
+		}
+		seen[next.String()] = true
+
+		var page []json.RawMessage
+		data, next, ok = c.rawSecretListPage(next)
+		if !ok {
+			return nil, false
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			c.Errorf("Error decoding paginated secrets: %v", err)
+			return nil, false
+		}
+		secrets = append(secrets, page...)
+	}
+
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		c.Errorf("Error encoding paginated secrets: %v", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// rawSecretListPage requests a single page of a secrets listing. The URL of the next page is
+// returned if the server indicated there is one, on the same scheme and host as u.
+func (c Client) rawSecretListPage(u *url.URL) (data []byte, next *url.URL, ok bool) {
 	now := time.Now()
-	t := *c.url
-	t.Path = path.Join(c.url.Path, "secrets")
-	resp, err := c.http().Get(t.String())
+	resp, err := c.get(u.String())
 	if err != nil {
 		c.Errorf("Error retrieving secrets: %v", err)
 		c.failCountInc()
-		return nil, false
+		return nil, nil, false
 	}
-	c.Infof("GET /secrets %d %v", resp.StatusCode, time.Since(now))
+	duration := time.Since(now)
+	c.logRequest("GET /secrets", "", "", resp.StatusCode, duration, "GET %s %d %v", u.RequestURI(), resp.StatusCode, duration)
 	defer resp.Body.Close()
 
 	data, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
 		c.Errorf("Error reading response body for secrets: %v", err)
 		c.failCountInc()
-		return nil, false
+		return nil, nil, false
 	}
 
 	if resp.StatusCode != 200 {
-		msg := strings.Join(strings.Split(string(data), "\n"), " ")
+		msg := responseMessage(data)
 		c.Errorf("Bad response code getting secrets: (status=%v, msg='%s')", resp.StatusCode, msg)
 		c.failCountInc()
-		return nil, false
+		return nil, nil, false
 	}
 	c.markSuccess()
-	return data, true
+
+	if link := nextLink(resp.Header["Link"]); link != "" {
+		next, err = u.Parse(link)
+		if err != nil {
+			c.Errorf("Invalid next page link in secrets listing '%s': %v", link, err)
+			return nil, nil, false
+		}
+		// Following a link elsewhere would present the client's credentials to another server.
+		if next.Scheme != u.Scheme || next.Host != u.Host {
+			c.Errorf("Refusing next page link in secrets listing to another server: %s://%s", next.Scheme, next.Host)
+			return nil, nil, false
+		}
+	}
+	return data, next, true
+}
+
+// responseMessage describes an error response for logs and errors without including its body,
+// which may echo secret content: only the message of a JSON error response is kept.
+func responseMessage(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var response struct {
+		Message string
+		Error   string
+		Errors  []string
+	}
+	if json.Unmarshal(body, &response) == nil {
+		switch {
+		case response.Message != "":
+			return response.Message
+		case response.Error != "":
+			return response.Error
+		case len(response.Errors) > 0:
+			return strings.Join(response.Errors, "; ")
+		}
+	}
+	return fmt.Sprintf("%d bytes", len(body))
+}
+
+// nextLink extracts the target of a rel="next" link from Link header values (RFC 5988).
+func nextLink(headers []string) string {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.Replace(strings.TrimSpace(param), " ", "", -1)
+				if param == `rel="next"` || param == "rel=next" {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
 }
 
-// SecretList returns a slice of unmarshalled Secret structs after requesting a listing of secrets.
-func (c Client) SecretList() (secrets []Secret, ok bool) {
-	data, ok := c.RawSecretList()
+// Invalidate does nothing, since the client holds nothing per secret.
+func (c Client) Invalidate(name string) {}
+
+// List returns a slice of unmarshalled Secret structs after requesting a listing of secrets.
+func (c Client) List() (secrets []Secret, ok bool) {
+	data, ok := c.rawSecretList()
 	if !ok {
 		return nil, false
 	}
@@ -233,30 +699,292 @@ func (c Client) SecretList() (secrets []Secret, ok bool) {
 		c.Errorf("Error decoding retrieved secrets: %v", err)
 		return nil, false
 	}
+	// Content not matching its digest is dropped, to be fetched again on use.
+	for i, s := range secrets {
+		if err := s.verifyDigest(); err != nil {
+			if _, ok := err.(ContentCorrupt); ok {
+				c.corrupt.Inc(1)
+			}
+			c.Errorf("Ignoring content of %v in listing: %v", s.Name, err)
+			secrets[i].Content = content{}
+		}
+	}
+	// Unsigned content in a listing is dropped, to be fetched and verified on use.
+	if verifyKey := c.current().params.VerifyKey; verifyKey != nil {
+		for i, s := range secrets {
+			if err := s.verifySignature(verifyKey); !s.Content.Empty() && err != nil {
+				c.unsigned.Inc(1)
+				c.Errorf("Ignoring content of %v in listing: %v", s.Name, err)
+				secrets[i].Content = content{}
+			}
+		}
+	}
 	return secrets, true
 }
 
-// buildClient constructs a new TLS client.
-func (p httpClientParams) buildClient() (client *http.Client, err error) {
-	keyPair, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+// RawGroupList returns raw JSON from requesting the groups the client belongs to, including
+// the secrets each group grants.
+func (c Client) RawGroupList() (data []byte, ok bool) {
+	data, err := c.rawGet("groups")
+	return data, err == nil
+}
+
+// RawGroup returns raw JSON from requesting a single group.
+func (c Client) RawGroup(name string) (data []byte, err error) {
+	return c.rawGet("group", name)
+}
+
+// GroupNames returns the names of the groups the client belongs to.
+func (c Client) GroupNames() (names []string, ok bool) {
+	data, ok := c.RawGroupList()
+	if !ok {
+		return nil, false
+	}
+
+	var groups []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &groups); err != nil {
+		c.Errorf("Error decoding retrieved groups: %v", err)
+		return nil, false
+	}
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	return names, true
+}
+
+// rawGet returns the raw response body of a GET request for the path formed by elements. A
+// 404 response results in a SecretDeleted error.
+func (c Client) rawGet(elements ...string) (data []byte, err error) {
+	now := time.Now()
+	conn := c.current()
+	t := conn.endpoint(elements...)
+	p := "/" + path.Join(elements...)
+	resp, err := c.get(t.String())
+	if err != nil {
+		c.Errorf("Error retrieving %v: %v", p, err)
+		c.failCountInc()
+		return nil, err
+	}
+	duration := time.Since(now)
+	c.logRequest("GET /"+elements[0], "", "", resp.StatusCode, duration, "GET %v %d %v", p, resp.StatusCode, duration)
+	defer resp.Body.Close()
+
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.Errorf("Error reading response body for %v: %v", p, err)
+		c.failCountInc()
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		c.markSuccess()
+		return data, nil
+	case 404:
+		c.Warnf("%v not found", p)
+		return nil, SecretDeleted{}
+	default:
+		msg := responseMessage(data)
+		c.Errorf("Bad response code getting %v: (status=%v, msg='%s')", p, resp.StatusCode, msg)
+		c.failCountInc()
+		return nil, errors.New(msg)
+	}
+}
+
+// WriteSecret replaces the content of a secret through the automation API. The client certificate
+// must be authorized for automation access.
+func (c Client) WriteSecret(name string, content []byte) error {
+	body := struct {
+		Content string `json:"content"`
+	}{base64.StdEncoding.EncodeToString(content)}
+
+	_, err := c.automationRequest("POST", "writing secret "+name, body, "secrets", name)
+	return err
+}
+
+// CreateSecret creates a secret assigned to the given groups through the automation API. It
+// returns SecretExists if a secret with the same name already exists.
+func (c Client) CreateSecret(name string, content []byte, metadata map[string]string, groups []string) error {
+	body := struct {
+		Name     string            `json:"name"`
+		Content  string            `json:"content"`
+		Metadata map[string]string `json:"metadata,omitempty"`
+		Groups   []string          `json:"groups,omitempty"`
+	}{name, base64.StdEncoding.EncodeToString(content), metadata, groups}
+
+	status, err := c.automationRequest("POST", "creating secret "+name, body, "secrets")
+	if status == http.StatusConflict {
+		return SecretExists{}
+	}
+	return err
+}
+
+// CreateGroup creates a group through the automation API. Existing groups are not an error.
+func (c Client) CreateGroup(name string) error {
+	body := struct {
+		Name string `json:"name"`
+	}{name}
+
+	status, err := c.automationRequest("POST", "creating group "+name, body, "groups")
+	if status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// automationRequest sends a JSON body to automation/v2/<elements>, returning the response
+// status code and an error unless the request succeeded.
+func (c Client) automationRequest(method, what string, payload interface{}, elements ...string) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	conn := c.current()
+	t := conn.endpoint(append([]string{"automation/v2"}, elements...)...)
+	req, err := http.NewRequest(method, t.String(), bytes.NewReader(body))
 	if err != nil {
-		return
+		return 0, err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	caCert, err := ioutil.ReadFile(p.CaBundle)
+	resp, err := c.do(req)
 	if err != nil {
-		return
+		c.Errorf("Error %s: %v", what, err)
+		c.failCountInc()
+		return 0, err
+	}
+	duration := time.Since(now)
+	c.logRequest(method+" /automation/v2/"+elements[0], "", "", resp.StatusCode, duration, "%s /automation/v2/%v %d %v", method, strings.Join(elements, "/"), resp.StatusCode, duration)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200, 201, 204:
+		c.markSuccess()
+		return resp.StatusCode, nil
+	default:
+		data, _ := ioutil.ReadAll(resp.Body)
+		msg := responseMessage(data)
+		c.Errorf("Bad response code %s: (status=%v, msg='%s')", what, resp.StatusCode, msg)
+		if resp.StatusCode != http.StatusConflict {
+			c.failCountInc()
+		}
+		return resp.StatusCode, errors.New(msg)
+	}
+}
+
+// buildClient constructs a new TLS client.
+func (p httpClientParams) buildClient() (client *http.Client, err error) {
+	if p.Socket != "" {
+		return p.wrapTransport(&http.Transport{DialContext: p.dialSocket}), nil
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
 
 	config := &tls.Config{
-		Certificates: []tls.Certificate{keyPair},
-		RootCAs:      caCertPool,
 		MinVersion:   tls.VersionTLS12, // TLSv1.2 and up is required
 		CipherSuites: ciphers,
 	}
+	// With a bearer token, no client certificate is presented, and the system roots verify the
+	// server unless a CA bundle is given.
+	if p.TokenFile == "" {
+		keyPair, err := loadClientCertificate(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{keyPair}
+	}
+	if p.TokenFile == "" || p.CaBundle != "" {
+		caCert, err := ioutil.ReadFile(p.CaBundle)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(caCert)
+	}
 	config.BuildNameToCertificate()
 	transport := &http.Transport{TLSClientConfig: config}
-	return &http.Client{Transport: transport, Timeout: p.timeout}, nil
+	if len(p.Resolvers) > 0 {
+		transport.DialContext = p.dialContext
+	}
+	return p.wrapTransport(transport), nil
+}
+
+// wrapTransport returns a client sending requests with transport, adding the user agent, the
+// bearer token and tracing.
+func (p httpClientParams) wrapTransport(transport *http.Transport) *http.Client {
+	var roundTripper http.RoundTripper = userAgentTransport{transport, currentBuildInfo().userAgent()}
+	if p.TokenFile != "" {
+		roundTripper = bearerTransport{roundTripper, newTokenSource(p.TokenFile), p.host}
+	}
+	if p.Tracer != nil {
+		return &http.Client{Transport: tracingTransport{roundTripper, p.Tracer}, Timeout: p.timeout}
+	}
+	return &http.Client{Transport: roundTripper, Timeout: p.timeout}
+}
+
+// serverHost returns the host of requests to serverURL, which is localhost through a socket.
+func serverHost(serverURL *url.URL, socket string) string {
+	switch {
+	case socket != "":
+		return "localhost"
+	case serverURL == nil:
+		return ""
+	}
+	return serverURL.Host
+}
+
+// dialSocket connects to the unix socket of the server, whatever the address of the request.
+func (p httpClientParams) dialSocket(ctx context.Context, _, _ string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	return dialer.DialContext(ctx, "unix", p.Socket)
+}
+
+// dialContext connects to addr, resolving its host with the configured DNS servers.
+func (p httpClientParams) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout, KeepAlive: 30 * time.Second}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := lookupHost(ctx, host, p.Resolvers)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// lookupHost resolves host with each of the given DNS servers in turn, returning the first
+// successful answer.
+func lookupHost(ctx context.Context, host string, servers []string) (ips []string, err error) {
+	for _, server := range servers {
+		if _, _, splitErr := net.SplitHostPort(server); splitErr != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+
+		lookupCtx, cancel := context.WithTimeout(ctx, resolverTimeout)
+		ips, err = resolver.LookupHost(lookupCtx, host)
+		cancel()
+		if err == nil {
+			return ips, nil
+		}
+	}
+	return nil, err
 }
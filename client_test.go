@@ -15,14 +15,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -50,9 +62,9 @@ func TestClientCallsServer(t *testing.T) {
 
 	serverURL, _ := url.Parse(server.URL)
 	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
-	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, logConfig, metricsHandle)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
 
-	secrets, ok := client.SecretList()
+	secrets, ok := client.List()
 	assert.True(ok)
 	assert.Len(secrets, 2)
 
@@ -60,7 +72,7 @@ func TestClientCallsServer(t *testing.T) {
 	assert.True(ok)
 	assert.Equal(fixture("secrets.json"), data)
 
-	secret, err := client.Secret("foo")
+	secret, err := client.Fetch("foo")
 	assert.Nil(err)
 	assert.Equal("Nobody_PgPass", secret.Name)
 
@@ -68,17 +80,107 @@ func TestClientCallsServer(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(fixture("secret.json"), data)
 
-	_, err = client.Secret("unexisting")
+	_, err = client.Fetch("unexisting")
 	_, deleted := err.(SecretDeleted)
 	assert.True(deleted)
 }
 
+func TestClientSendsRequestID(t *testing.T) {
+	assert := assert.New(t)
+
+	var requestID string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get("X-Request-Id")
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	span := newRequestSpan()
+	_, err := client.TracedFetch("foo", span)
+	assert.Nil(err)
+	assert.Equal(span.RequestID(), requestID)
+
+	_, err = client.Fetch("foo")
+	assert.Nil(err)
+	assert.Empty(requestID)
+}
+
+func TestClientUsesUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-socket")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "keywhiz.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(err)
+
+	var paths []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	serverURL, _ := url.Parse("unix://" + socket)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient("", "", "", serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	secret, err := client.Fetch("foo")
+	assert.Nil(err)
+	assert.Equal("Nobody_PgPass", secret.Name)
+	assert.Equal([]string{"/secret/foo"}, paths)
+	assert.Equal(socket, client.current().params.Socket)
+
+	badURL, _ := url.Parse("unix://relative/keywhiz.sock")
+	assert.Error(client.Reload("", "", "", badURL, time.Second))
+}
+
+func TestClientCountsStatuses(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/denied") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+	forbidden := metrics.GetOrRegisterCounter("runtime.server.status.403", metricsHandle.Registry)
+	unavailable := metrics.GetOrRegisterCounter("runtime.server.status.503", metricsHandle.Registry)
+	before403, before503 := forbidden.Count(), unavailable.Count()
+
+	_, err := client.Fetch("denied")
+	assert.True(accessDenied(err))
+	assert.True(forbidden.Count() > before403)
+
+	_, err = client.Fetch("other")
+	assert.Equal(BackendStatus{503, ""}, err)
+	assert.Equal(before503+1, unavailable.Count())
+}
+
 func TestClientRefresh(t *testing.T) {
 	clientRefresh = 1 * time.Second
 
 	serverURL, _ := url.Parse("http://dummy:8080")
 	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
-	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, logConfig, metricsHandle)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
 	http1 := client.http()
 	time.Sleep(5 * time.Second)
 	http2 := client.http()
@@ -107,16 +209,16 @@ func TestClientCallsServerErrors(t *testing.T) {
 
 	serverURL, _ := url.Parse(server.URL)
 	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
-	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, logConfig, metricsHandle)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
 
-	secrets, ok := client.SecretList()
+	secrets, ok := client.List()
 	assert.False(ok)
 	assert.Len(secrets, 0)
 
 	data, ok := client.RawSecretList()
 	assert.False(ok)
 
-	secret, err := client.Secret("bar")
+	secret, err := client.Fetch("bar")
 	assert.Nil(secret)
 	_, deleted := err.(SecretDeleted)
 	assert.True(deleted)
@@ -132,7 +234,7 @@ func TestClientCallsServerErrors(t *testing.T) {
 	_, deleted = err.(SecretDeleted)
 	assert.False(deleted)
 
-	_, err = client.Secret("non-existent")
+	_, err = client.Fetch("non-existent")
 	assert.Nil(data)
 	_, deleted = err.(SecretDeleted)
 	assert.True(deleted)
@@ -148,9 +250,327 @@ func TestClientParsingError(t *testing.T) {
 
 	serverURL, _ := url.Parse(server.URL)
 	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
-	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, logConfig, metricsHandle)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
 
-	secrets, ok := client.SecretList()
+	secrets, ok := client.List()
 	assert.False(ok)
 	assert.Len(secrets, 0)
 }
+
+func TestClientStitchesPaginatedSecretList(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", `</secrets?page=2>; rel="next"`)
+			fmt.Fprint(w, `[{"name":"one","secret":""}]`)
+		case "2":
+			w.Header().Set("Link", `</secrets?page=1>; rel="prev", </secrets?page=3>; rel="next"`)
+			fmt.Fprint(w, `[{"name":"two","secret":""}]`)
+		case "3":
+			fmt.Fprint(w, `[{"name":"three","secret":""}]`)
+		}
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	secrets, ok := client.List()
+	assert.True(ok)
+	assert.Len(secrets, 3)
+	assert.Equal("one", secrets[0].Name)
+	assert.Equal("three", secrets[2].Name)
+}
+
+func TestClientAbortsPaginationLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</secrets>; rel="next"`)
+		fmt.Fprint(w, `[]`)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	_, ok := client.RawSecretList()
+	assert.False(ok)
+}
+
+func TestClientRefusesPaginationToAnotherServer(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	other := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `[]`)
+	}))
+	other.TLS = testCerts(testCaFile)
+	other.StartTLS()
+	defer other.Close()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf(`<%s/secrets?page=2>; rel="next"`, other.URL))
+		fmt.Fprint(w, `[{"name":"one","secret":""}]`)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	_, ok := client.RawSecretList()
+	assert.False(ok)
+	assert.Equal(0, requests, "other server not contacted")
+}
+
+func TestClientUsesConfiguredResolvers(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	panicOnError(err)
+	defer dns.Close()
+	go serveDNS(dns, net.IPv4(127, 0, 0, 1))
+
+	// The test certificate is valid for example.com, which only the fake DNS server resolves
+	// to the test server. The first resolver is not listening and must be skipped.
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	serverURL, _ := url.Parse("https://example.com:" + port)
+	opts := ClientOptions{Resolvers: []string{"127.0.0.1:1", dns.LocalAddr().String()}}
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, opts, logConfig, metricsHandle)
+
+	secret, err := client.Fetch("foo")
+	assert.NoError(err)
+	assert.EqualValues("asddas", secret.Content.Bytes())
+}
+
+// serveDNS answers A queries with ip, and any other query with an empty response.
+func serveDNS(conn net.PacketConn, ip net.IP) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+
+		// Find the end of the question: name labels, then type and class.
+		end := 12
+		for end < n && query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		end += 5
+		if end > n {
+			continue
+		}
+		qtype := binary.BigEndian.Uint16(query[end-4:])
+
+		resp := append([]byte{}, query[:end]...)
+		resp[2], resp[3] = 0x81, 0x80            // response, recursion available
+		binary.BigEndian.PutUint16(resp[6:], 0)  // answers
+		binary.BigEndian.PutUint16(resp[8:], 0)  // authority records
+		binary.BigEndian.PutUint16(resp[10:], 0) // additional records
+		if qtype == 1 {
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			resp = append(resp, ip.To4()...)
+		}
+		conn.WriteTo(resp, addr)
+	}
+}
+
+func TestClientServerStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(503)
+		fmt.Fprint(w, `{"healthy":false}`)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	// A degraded server's response is passed through.
+	data, err := client.ServerStatus()
+	assert.NoError(err)
+	assert.Equal(`{"healthy":false}`, string(data))
+
+	// Repeated calls are served from the cache.
+	data, err = client.ServerStatus()
+	assert.NoError(err)
+	assert.Equal(`{"healthy":false}`, string(data))
+	assert.Equal(int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestClientVerifiesSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	signed := func(key ed25519.PrivateKey, name string) string {
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, signedMessage(name, []byte("hello"))))
+		return fmt.Sprintf(`{"name": "%s", "secret": "aGVsbG8=", "signature": "%s"}`, name, signature)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secrets":
+			fmt.Fprintf(w, `[%s, %s, {"name": "listed", "secret": ""}]`, signed(private, "good"), signed(other, "bad"))
+		case "/secret/good":
+			fmt.Fprint(w, signed(private, "good"))
+		case "/secret/bad":
+			fmt.Fprint(w, signed(other, "bad"))
+		case "/secret/unsigned":
+			fmt.Fprint(w, `{"name": "unsigned", "secret": "aGVsbG8="}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{VerifyKey: public}, logConfig, metricsHandle)
+
+	secret, err := client.Fetch("good")
+	assert.NoError(err)
+	assert.Equal("hello", string(secret.Content.Bytes()))
+
+	_, err = client.Fetch("bad")
+	assert.Equal(InvalidSignature{"bad"}, err)
+	_, err = client.Fetch("unsigned")
+	assert.Equal(InvalidSignature{"unsigned"}, err)
+
+	_, err = client.RawSecret("good")
+	assert.NoError(err)
+	_, err = client.RawSecret("bad")
+	assert.Equal(InvalidSignature{"bad"}, err)
+
+	// Unsigned content in listings is dropped, leaving the secret to be fetched on use.
+	secrets, ok := client.List()
+	assert.True(ok)
+	assert.Len(secrets, 3)
+	assert.Equal("hello", string(secrets[0].Content.Bytes()))
+	assert.True(secrets[1].Content.Empty())
+
+	_, ok = client.RawSecretList()
+	assert.False(ok)
+}
+
+func TestClientDropsCorruptListingContent(t *testing.T) {
+	assert := assert.New(t)
+
+	// sha256("hello")
+	digest := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"name": "good", "secret": "aGVsbG8=", "digest": "%s"}, {"name": "bad", "secret": "aGVsbA==", "digest": "%s"}]`, digest, digest)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	// Only the mismatched content is dropped, leaving the secret to be fetched on use.
+	secrets, ok := client.List()
+	assert.True(ok)
+	assert.Len(secrets, 2)
+	assert.Equal("hello", string(secrets[0].Content.Bytes()))
+	assert.True(secrets[1].Content.Empty())
+	assert.EqualValues(1, client.corrupt.Count())
+}
+
+func TestClientLimitsSecretSize(t *testing.T) {
+	assert := assert.New(t)
+
+	content := bytes.Repeat([]byte("large secret "), 250000)
+	body := fmt.Sprintf(`{"name":"large","secret":"%s"}`, base64.StdEncoding.EncodeToString(content))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/secret/chunked" {
+			// Flushing first sends the body chunked, without a Content-Length.
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		fmt.Fprint(w, body)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{MaxSecretSize: 8 << 20}, logConfig, metricsHandle)
+	for _, name := range []string{"sized", "chunked"} {
+		secret, err := client.Fetch(name)
+		assert.NoError(err, name)
+		assert.Equal(content, secret.Content.Bytes(), name)
+	}
+	assert.Len(client.large, 0)
+
+	client = NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{MaxSecretSize: 2 << 20}, logConfig, metricsHandle)
+	for _, name := range []string{"sized", "chunked"} {
+		_, err := client.Fetch(name)
+		assert.Equal(SecretTooLarge{name, 2 << 20}, err, name)
+	}
+	assert.Len(client.large, 0)
+}
+
+func TestClientDoesNotEchoResponseBodies(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/json") {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"code":500,"message":"database unavailable","secret":"c2VjcmV0"}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("upstream echoed c2VjcmV0\n"))
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	_, err := client.Fetch("json")
+	assert.Equal(BackendStatus{500, "database unavailable"}, err)
+
+	_, err = client.Fetch("text")
+	assert.Equal(BackendStatus{502, "25 bytes"}, err)
+
+	assert.Equal("", responseMessage(nil))
+	assert.Equal("permission denied; token expired", responseMessage([]byte(`{"errors":["permission denied","token expired"]}`)))
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// maxClockSkew is the difference between the server's clock and ours past which the skew is
+// logged and reported by .health. It is well above the one second resolution of Date headers.
+var maxClockSkew = 30 * time.Second
+
+// recordClockSkew compares the Date header of resp, received at received, with the local clock
+// and records the difference in the runtime.server.clock_skew metric, in seconds, positive when
+// the server is ahead. Skew silently breaks expiry times and certificate validation, so crossing
+// maxClockSkew either way is logged. Responses without a valid Date header are ignored.
+func (c Client) recordClockSkew(resp *http.Response, received time.Time) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	skew := date.Sub(received.Truncate(time.Second)) / time.Second
+	previous := c.clockSkew.Value()
+	c.clockSkew.Update(int64(skew))
+
+	switch was, is := significantSkew(previous), significantSkew(int64(skew)); {
+	case is && !was:
+		c.Warnf("Server clock differs from the local clock by %ds, expiry times and certificate validation may be wrong", skew)
+	case was && !is:
+		c.Infof("Server clock is within %v of the local clock again", maxClockSkew)
+	}
+}
+
+// ClockSkew returns how far the server's clock was ahead of ours at the last response, negative
+// if it is behind, and whether that exceeds maxClockSkew.
+func (c Client) ClockSkew() (skew time.Duration, significant bool) {
+	seconds := c.clockSkew.Value()
+	return time.Duration(seconds) * time.Second, significantSkew(seconds)
+}
+
+// significantSkew returns true if a skew in seconds exceeds maxClockSkew.
+func significantSkew(seconds int64) bool {
+	if seconds < 0 {
+		seconds = -seconds
+	}
+	return time.Duration(seconds)*time.Second > maxClockSkew
+}
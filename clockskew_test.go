@@ -0,0 +1,85 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientRecordsClockSkew(t *testing.T) {
+	assert := assert.New(t)
+
+	offset := time.Hour
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+	defer client.clockSkew.Update(0)
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	kwfs, _, _ := NewKeywhizFs(&client, MapBackend{}, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+
+	client.Fetch("secret")
+	skew, significant := client.ClockSkew()
+	assert.True(significant)
+	assert.InDelta(float64(time.Hour), float64(skew), float64(2*time.Second))
+	data, ok := kwfs.health()
+	assert.True(ok)
+	assert.Contains(string(data), "\nclock_skew=1h0m")
+
+	offset = -time.Minute
+	client.Fetch("secret")
+	skew, significant = client.ClockSkew()
+	assert.True(significant)
+	assert.True(skew < 0)
+
+	// Skew within the threshold isn't reported.
+	offset = 0
+	client.Fetch("secret")
+	skew, significant = client.ClockSkew()
+	assert.False(significant)
+	assert.True(skew >= -time.Second && skew <= time.Second)
+	data, _ = kwfs.health()
+	assert.False(strings.Contains(string(data), "clock_skew"))
+}
+
+func TestClockSkewIgnoresMissingDate(t *testing.T) {
+	assert := assert.New(t)
+
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	serverURL, _ := url.Parse("http://dummy:8080")
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+	defer client.clockSkew.Update(0)
+
+	client.clockSkew.Update(120)
+	client.recordClockSkew(&http.Response{Header: http.Header{}}, time.Now())
+	client.recordClockSkew(&http.Response{Header: http.Header{"Date": {"yesterday"}}}, time.Now())
+	skew, significant := client.ClockSkew()
+	assert.Equal(2*time.Minute, skew)
+	assert.True(significant)
+}
@@ -0,0 +1,201 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/go-sq-metrics"
+	"github.com/square/keywhiz-fs/log"
+)
+
+// NamedBackend is a backend participating in a CompositeBackend.
+type NamedBackend struct {
+	Name    string
+	Backend SecretBackend
+	// Flatten exposes the secrets of this backend at the top level instead of under a
+	// directory named after the backend.
+	Flatten bool
+}
+
+// CompositeBackend combines several backends into one. Secrets of each backend are namespaced
+// as "<backend name>/<secret name>", which KeywhizFs exposes as a top-level directory per
+// backend. Secrets of flattened backends keep their plain names; if several flattened backends
+// provide the same name, the backend listed first wins and the conflict is reported.
+type CompositeBackend struct {
+	*log.Logger
+	backends  []NamedBackend
+	conflicts metrics.Gauge
+
+	// owners maps flattened names to the backend providing them, as of the last listing.
+	lock   sync.Mutex
+	owners map[string]SecretBackend
+	seen   map[string]bool
+}
+
+// NewCompositeBackend combines the given backends, which must have distinct names.
+func NewCompositeBackend(backends []NamedBackend, logConfig log.Config, metricsHandle *sqmetrics.SquareMetrics) (*CompositeBackend, error) {
+	names := map[string]bool{}
+	for _, b := range backends {
+		if b.Name == "" || strings.HasPrefix(b.Name, ".") || strings.Contains(b.Name, "/") {
+			return nil, fmt.Errorf("invalid backend name '%s'", b.Name)
+		}
+		if names[b.Name] {
+			return nil, fmt.Errorf("duplicate backend name '%s'", b.Name)
+		}
+		names[b.Name] = true
+	}
+
+	logger := log.New("kwfs_composite", logConfig)
+	conflicts := metrics.GetOrRegisterGauge("runtime.composite.conflicts", metricsHandle.Registry)
+	return &CompositeBackend{
+		Logger:    logger,
+		backends:  backends,
+		conflicts: conflicts,
+		owners:    map[string]SecretBackend{},
+		seen:      map[string]bool{},
+	}, nil
+}
+
+// Fetch retrieves a secret by its namespaced or flattened name.
+func (b *CompositeBackend) Fetch(name string) (*Secret, error) {
+	if i := strings.Index(name, "/"); i > 0 {
+		for _, nb := range b.backends {
+			if !nb.Flatten && nb.Name == name[:i] {
+				secret, err := nb.Backend.Fetch(name[i+1:])
+				if err != nil {
+					return nil, err
+				}
+				namespaced := *secret
+				namespaced.Name = name
+				return &namespaced, nil
+			}
+		}
+		return nil, SecretDeleted{}
+	}
+
+	b.lock.Lock()
+	owner, ok := b.owners[name]
+	b.lock.Unlock()
+	if ok {
+		return owner.Fetch(name)
+	}
+
+	// Not seen in a listing yet; ask flattened backends in order.
+	var lastErr error = SecretDeleted{}
+	for _, nb := range b.backends {
+		if !nb.Flatten {
+			continue
+		}
+		secret, err := nb.Backend.Fetch(name)
+		if err == nil {
+			return secret, nil
+		}
+		if _, deleted := err.(SecretDeleted); !deleted {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// Invalidate passes a namespaced or flattened name on to the backend providing it. Flattened
+// names not seen in a listing yet are passed to all flattened backends.
+func (b *CompositeBackend) Invalidate(name string) {
+	if i := strings.Index(name, "/"); i > 0 {
+		for _, nb := range b.backends {
+			if !nb.Flatten && nb.Name == name[:i] {
+				nb.Backend.Invalidate(name[i+1:])
+				return
+			}
+		}
+		return
+	}
+
+	b.lock.Lock()
+	owner, ok := b.owners[name]
+	b.lock.Unlock()
+	if ok {
+		owner.Invalidate(name)
+		return
+	}
+	for _, nb := range b.backends {
+		if nb.Flatten {
+			nb.Backend.Invalidate(name)
+		}
+	}
+}
+
+// List lists the secrets of all backends. The listing fails if any backend fails, so
+// that a single unreachable backend does not cause the secrets of another to be removed.
+func (b *CompositeBackend) List() ([]Secret, bool) {
+	var all []Secret
+	owners := map[string]SecretBackend{}
+	ownerNames := map[string]string{}
+	var conflicts []string
+
+	for _, nb := range b.backends {
+		secrets, ok := nb.Backend.List()
+		if !ok {
+			b.Errorf("Failed to list secrets of backend '%s'", nb.Name)
+			return nil, false
+		}
+		for _, s := range secrets {
+			if !nb.Flatten {
+				s.Name = nb.Name + "/" + s.Name
+				all = append(all, s)
+				continue
+			}
+			if owner, ok := ownerNames[s.Name]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("'%s' provided by '%s' shadowed by '%s'", s.Name, nb.Name, owner))
+				continue
+			}
+			if b.isNamespace(s.Name) {
+				conflicts = append(conflicts, fmt.Sprintf("'%s' provided by '%s' conflicts with a backend directory", s.Name, nb.Name))
+				continue
+			}
+			owners[s.Name] = nb.Backend
+			ownerNames[s.Name] = nb.Name
+			all = append(all, s)
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.owners = owners
+	seen := map[string]bool{}
+	for _, conflict := range conflicts {
+		if !b.seen[conflict] {
+			b.Warnf("Secret name conflict: %s", conflict)
+		}
+		seen[conflict] = true
+	}
+	b.seen = seen
+	b.conflicts.Update(int64(len(conflicts)))
+
+	return all, true
+}
+
+// isNamespace returns true if name is the directory of a non-flattened backend.
+func (b *CompositeBackend) isNamespace(name string) bool {
+	for _, nb := range b.backends {
+		if !nb.Flatten && nb.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// MapBackend serves secrets from a map.
+type MapBackend map[string]string
+
+func (b MapBackend) Fetch(name string) (*Secret, error) {
+	data, ok := b[name]
+	if !ok {
+		return nil, SecretDeleted{}
+	}
+	return &Secret{Name: name, Content: decodedContent([]byte(data)), Length: uint64(len(data))}, nil
+}
+
+func (b MapBackend) List() ([]Secret, bool) {
+	var secrets []Secret
+	for name, data := range b {
+		secrets = append(secrets, Secret{Name: name, Length: uint64(len(data))})
+	}
+	return secrets, true
+}
+
+func (b MapBackend) Invalidate(name string) {}
+
+func TestCompositeBackendNamespaces(t *testing.T) {
+	assert := assert.New(t)
+
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	composite, err := NewCompositeBackend([]NamedBackend{
+		{"prod", MapBackend{"db": "prod-db", "shared": "prod-shared"}, false},
+		{"legacy", MapBackend{"shared": "legacy-shared", "old": "old"}, true},
+		{"other", MapBackend{"shared": "other-shared", "prod": "conflict"}, true},
+	}, logConfig, metricsHandle)
+	assert.NoError(err)
+
+	secrets, ok := composite.List()
+	assert.True(ok)
+	names := []string{}
+	for _, s := range secrets {
+		names = append(names, s.Name)
+	}
+	assert.Len(names, 4)
+	assert.Contains(names, "prod/db")
+	assert.Contains(names, "prod/shared")
+	assert.Contains(names, "shared")
+	assert.Contains(names, "old")
+	assert.EqualValues(2, composite.conflicts.Value())
+
+	secret, err := composite.Fetch("prod/shared")
+	assert.NoError(err)
+	assert.Equal("prod/shared", secret.Name)
+	assert.EqualValues("prod-shared", secret.Content.Bytes())
+
+	// The first flattened backend wins conflicts.
+	secret, err = composite.Fetch("shared")
+	assert.NoError(err)
+	assert.EqualValues("legacy-shared", secret.Content.Bytes())
+
+	_, err = composite.Fetch("unknown/db")
+	_, deleted := err.(SecretDeleted)
+	assert.True(deleted)
+}
+
+func TestCompositeBackendInvalidNames(t *testing.T) {
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	for _, names := range [][]string{{"a", "a"}, {"a/b"}, {".json"}, {""}} {
+		var backends []NamedBackend
+		for _, name := range names {
+			backends = append(backends, NamedBackend{name, MapBackend{}, false})
+		}
+		_, err := NewCompositeBackend(backends, logConfig, metricsHandle)
+		assert.Error(t, err, "Expected %v to be rejected", names)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// configFlag returns the value of --config in args, or "" if not given. It is looked up before
+// parsing, since the config file supplies defaults for the other flags.
+func configFlag(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return ""
+		case arg == "--config" && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return ""
+}
+
+// selectedCommand returns the command args select, which is the default command if they name
+// none, so that a config file applies to it. Like configFlag, it is looked up before parsing;
+// errors, e.g. for arguments the config file supplies, are left to the actual parse.
+func selectedCommand(app *kingpin.Application, args []string) *kingpin.CmdClause {
+	context, _ := app.ParseContext(args)
+	if context == nil {
+		return nil
+	}
+	return context.SelectedCommand
+}
+
+// loadConfig reads a YAML (or JSON) config file mapping the long names of flags, or "url" and
+// "mountpoint", to values, e.g.:
+//
+//	url: https://keywhiz.example.com:4444
+//	mountpoint: /run/secrets
+//	key: /etc/keywhiz-fs/client.pem
+//	timeout: 10s
+//	include: ["^app-", "^db-"]
+//
+// Lists are used for repeatable flags. Returns each name with its values as strings.
+func loadConfig(file string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", file, err)
+	}
+
+	config := map[string][]string{}
+	for name, value := range raw {
+		switch v := value.(type) {
+		case nil:
+			config[name] = nil
+		case []interface{}:
+			values := []string{}
+			for _, item := range v {
+				s, err := configScalar(item)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value for %s in %s: %v", name, file, err)
+				}
+				values = append(values, s)
+			}
+			config[name] = values
+		default:
+			s, err := configScalar(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s in %s: %v", name, file, err)
+			}
+			config[name] = []string{s}
+		}
+	}
+	return config, nil
+}
+
+// configScalar converts a single config value to its command line form.
+func configScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("expected a string, number or boolean, got %v", value)
+	}
+}
+
+// applyConfig makes config values the defaults of the named flags of app and cmd, or of cmd's
+// arguments, so that flags given on the command line take precedence. Settings of other commands
+// are ignored, so that one file can serve e.g. both a mount and its control commands. Unknown
+// names are an error, to catch typos.
+func applyConfig(config map[string][]string, app *kingpin.Application, cmd *kingpin.CmdClause) error {
+	names := []string{}
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := config[name]
+		if name == "config" || name == "help" || name == "version" {
+			return fmt.Errorf("%s cannot be set in a config file", name)
+		}
+
+		flag := app.GetFlag(name)
+		if flag == nil && cmd != nil {
+			flag = cmd.GetFlag(name)
+		}
+		if flag != nil {
+			if len(values) > 1 && !isCumulative(flag.Model().Value) {
+				return fmt.Errorf("%s cannot be repeated", name)
+			}
+			flag.Default(values...)
+			continue
+		}
+
+		if arg := cmdArg(cmd, name); arg != nil {
+			if len(values) > 1 && !isCumulative(arg.Model().Value) {
+				return fmt.Errorf("%s cannot be repeated", name)
+			}
+			arg.Default(values...)
+			continue
+		}
+		if !isCommandSetting(app, name) {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+	}
+	return nil
+}
+
+// cmdArg returns the named argument of cmd, or nil if there is none or no command.
+func cmdArg(cmd *kingpin.CmdClause, name string) *kingpin.ArgClause {
+	if cmd == nil {
+		return nil
+	}
+	return cmd.GetArg(name)
+}
+
+// isCommandSetting returns true if name is a flag or argument of any command of app.
+func isCommandSetting(app *kingpin.Application, name string) bool {
+	for _, cmd := range app.Model().Commands {
+		for _, flag := range cmd.Flags {
+			if flag.Name == name {
+				return true
+			}
+		}
+		for _, arg := range cmd.Args {
+			if arg.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isCumulative returns true for the values of repeatable flags and arguments.
+func isCumulative(value kingpin.Value) bool {
+	v, ok := value.(interface {
+		IsCumulative() bool
+	})
+	return ok && v.IsCumulative()
+}
+
+// currentSettings returns the values of the flags of app and cmd, and of cmd's arguments, by the
+// names used in config files, e.g. to report the settings of a running mount. Repeatable
+// settings have a list of values. Credentials in URLs are redacted.
+func currentSettings(app *kingpin.Application, cmd *kingpin.CmdClause) map[string]interface{} {
+	settings := map[string]interface{}{}
+	flags := append(app.Model().Flags, cmd.Model().Flags...)
+	for _, flag := range flags {
+		if flag.Hidden || flag.Name == "help" || flag.Name == "version" {
+			continue
+		}
+		settings[flag.Name] = redactSetting(settingValue(flag.Value))
+	}
+	for _, arg := range cmd.Model().Args {
+		settings[arg.Name] = redactSetting(settingValue(arg.Value))
+	}
+	return settings
+}
+
+// redactSetting redacts credentials in the URLs of a setting value, as returned by settingValue.
+func redactSetting(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactURL(v)
+	case []string:
+		redacted := make([]string, len(v))
+		for i, s := range v {
+			redacted[i] = redactURL(s)
+		}
+		return redacted
+	}
+	return value
+}
+
+// sensitiveParams are substrings of the names of URL query parameters whose values are redacted.
+var sensitiveParams = []string{"token", "secret", "password", "passwd", "key", "signature", "credential", "auth"}
+
+// redactURL replaces the password and sensitive query parameters of a URL in s with "REDACTED".
+// The URL may follow a "NAME=" prefix, as in --vault. Other values are returned unchanged.
+func redactURL(s string) string {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return s
+	}
+	start := strings.LastIndex(s[:i], "=") + 1
+	u, err := url.Parse(s[start:])
+	if err != nil {
+		return s
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	query := u.Query()
+	redacted := false
+	for name := range query {
+		lower := strings.ToLower(name)
+		for _, sensitive := range sensitiveParams {
+			if strings.Contains(lower, sensitive) {
+				query.Set(name, "REDACTED")
+				redacted = true
+				break
+			}
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+	return s[:start] + u.String()
+}
+
+// settingValue returns the value of a flag or argument, as a list for repeatable ones. Values are
+// formatted from Get, since the String methods of some kingpin values are broken.
+func settingValue(value kingpin.Value) interface{} {
+	getter, ok := value.(kingpin.Getter)
+	if !ok {
+		return value.String()
+	}
+	v := getter.Get()
+	switch values := v.(type) {
+	case []string:
+		return values
+	case *[]string:
+		return *values
+	}
+	if r := reflect.ValueOf(v); !r.IsValid() || (r.Kind() == reflect.Ptr && r.IsNil()) {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
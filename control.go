@@ -0,0 +1,344 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// controlTimeout bounds requests of control commands to a running mount.
+const controlTimeout = 30 * time.Second
+
+// controlPeerKey is the context key of the credentials of the process connected to the control
+// socket.
+type controlPeerKey struct{}
+
+// ControlStatus is the response of the control socket's /status.
+type ControlStatus struct {
+	Mountpoint string          `json:"mountpoint"`
+	Pid        int             `json:"pid"`
+	Health     HealthStatus    `json:"health"`
+	Info       json.RawMessage `json:"info"`
+}
+
+// ControlServer serves the admin API of a mount on a unix socket, used by the control commands
+// and by other tooling as an alternative to the control files of the mount. The API is HTTP,
+// with JSON responses except for the content of secrets:
+//
+//	GET  /status            ControlStatus
+//	GET  /config            the settings of the mount, by name
+//	GET  /secrets           a CacheEntry for each cached secret
+//	GET  /secret/NAME       the content of a secret
+//	POST /evict/NAME        drops a secret from the cache
+//	POST /refresh[/NAME]    re-fetches the listing and cached secrets, or a single secret
+//	POST /snapshot?dir=DIR  writes the secrets to DIR, see WriteSnapshot
+//	POST /clear-cache       empties the cache
+//	POST /unmount           unmounts, as on SIGTERM
+//
+// Callers are authenticated by the credentials of the connected process: root, the user running
+// keywhiz-fs, and members of Group are allowed. Fetching a secret is additionally subject to the
+// same file mode, ownership and process policy checks, and audited the same way, as opening its
+// file.
+// Snapshots are written wherever the caller asks, so they are limited to root and the user
+// running keywhiz-fs.
+type ControlServer struct {
+	kwfs       *KeywhizFs
+	health     *HealthHandler
+	mountpoint string
+	// unmount starts unmounting, as on SIGTERM.
+	unmount func()
+	// Group, if set, is the gid of a group whose members may use the socket.
+	Group *uint32
+	// Settings are reported by /config.
+	Settings map[string]interface{}
+}
+
+// NewControlServer creates a server controlling the mount of kwfs at mountpoint.
+func NewControlServer(kwfs *KeywhizFs, health *HealthHandler, mountpoint string, unmount func()) *ControlServer {
+	return &ControlServer{kwfs: kwfs, health: health, mountpoint: mountpoint, unmount: unmount}
+}
+
+// Listen serves requests on a unix socket at file until the returned listener is closed. A stale
+// socket left by a crashed process is replaced, but not one another running mount listens on.
+func (s *ControlServer) Listen(file string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", file); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use by another keywhiz-fs", file)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	os.Remove(file)
+
+	// Created inaccessible to others, rather than changing its mode after binding.
+	mask := 0077
+	if s.Group != nil {
+		mask = 0007
+	}
+	mask = unix.Umask(mask)
+	listener, err := net.Listen("unix", file)
+	unix.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+	if s.Group != nil {
+		if err := os.Chown(file, -1, int(*s.Group)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	server := &http.Server{Handler: s, ConnContext: controlPeer}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Errorf("Control socket server exited: %v", err)
+		}
+	}()
+	return listener, nil
+}
+
+// controlPeer records the credentials of the process connected to the control socket.
+func controlPeer(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+	var caller *fuse.Context
+	raw.Control(func(fd uintptr) {
+		caller, err = peerCredentials(int(fd))
+	})
+	if err != nil || caller == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, controlPeerKey{}, caller)
+}
+
+// authorized returns true if the caller may use the socket. Supplementary groups are read from
+// /proc, since the socket only reports the primary group.
+func (s *ControlServer) authorized(caller *fuse.Context) bool {
+	if caller == nil {
+		return false
+	}
+	if privileged(caller) {
+		return true
+	}
+	if s.Group == nil {
+		return false
+	}
+	if caller.Gid == *s.Group {
+		return true
+	}
+	for _, gid := range processGroups(caller.Pid) {
+		if gid == *s.Group {
+			return true
+		}
+	}
+	return false
+}
+
+// privileged returns true if the caller is root or the user running keywhiz-fs, who could
+// already do anything keywhiz-fs does.
+func privileged(caller *fuse.Context) bool {
+	return caller != nil && (caller.Uid == 0 || caller.Uid == uint32(os.Geteuid()))
+}
+
+// readable returns true if the caller may read a file with attr, as the kernel would check on
+// the mount. Privileged callers may read anything, as they may write snapshots.
+func readable(caller *fuse.Context, attr *fuse.Attr) bool {
+	if privileged(caller) {
+		return true
+	}
+	if caller == nil {
+		return false
+	}
+	if caller.Uid == attr.Uid {
+		return attr.Mode&0400 != 0
+	}
+	member := caller.Gid == attr.Gid
+	for _, gid := range processGroups(caller.Pid) {
+		member = member || gid == attr.Gid
+	}
+	if member {
+		return attr.Mode&0040 != 0
+	}
+	return attr.Mode&0004 != 0
+}
+
+// processGroups returns the supplementary groups of a process, or nil if unknown.
+func processGroups(pid uint32) []uint32 {
+	data, err := ioutil.ReadFile(filepath.Join(procDir, strconv.FormatUint(uint64(pid), 10), "status"))
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var gids []uint32
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			if gid, err := strconv.ParseUint(field, 10, 32); err == nil {
+				gids = append(gids, uint32(gid))
+			}
+		}
+		return gids
+	}
+	return nil
+}
+
+// writeJSON responds with value as JSON.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	caller, _ := r.Context().Value(controlPeerKey{}).(*fuse.Context)
+	if !s.authorized(caller) {
+		s.kwfs.Warnf("Denied control socket request %s %s by %s", r.Method, r.URL.Path, prettyContext(caller))
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/status" && r.Method == "GET":
+		writeJSON(w, ControlStatus{s.mountpoint, os.Getpid(), s.health.Status(), s.kwfs.statusJSON()})
+	case r.URL.Path == "/config" && r.Method == "GET":
+		writeJSON(w, s.Settings)
+	case r.URL.Path == "/secrets" && r.Method == "GET":
+		writeJSON(w, s.kwfs.Cache.Entries())
+	case strings.HasPrefix(r.URL.Path, "/evict/") && r.Method == "POST":
+		name := strings.TrimPrefix(r.URL.Path, "/evict/")
+		if !s.kwfs.Cache.Evict(name) {
+			http.Error(w, fmt.Sprintf("%s is not cached", name), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/refresh" && r.Method == "POST":
+		if err := s.kwfs.Cache.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/refresh/") && r.Method == "POST":
+		name := strings.TrimPrefix(r.URL.Path, "/refresh/")
+		if err := s.kwfs.Cache.Refresh(name); err != nil {
+			http.Error(w, fmt.Sprintf("unable to refresh %s: %v", name, err), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/snapshot" && r.Method == "POST":
+		if !privileged(caller) {
+			s.kwfs.Warnf("Denied snapshot by %s", prettyContext(caller))
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		dir := r.URL.Query().Get("dir")
+		count, err := WriteSnapshot(s.kwfs, dir, caller)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to write snapshot: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"dir": dir, "secrets": count})
+	case r.URL.Path == "/clear-cache" && r.Method == "POST":
+		s.kwfs.Cache.Clear()
+		s.kwfs.Infof("Cleared cache through the control socket")
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/secret/") && r.Method == "GET":
+		s.fetch(w, caller, strings.TrimPrefix(r.URL.Path, "/secret/"))
+	case r.URL.Path == "/unmount" && r.Method == "POST":
+		s.kwfs.Infof("Unmount requested through the control socket")
+		s.unmount()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fetch responds with the content of a secret, as opening its file would.
+func (s *ControlServer) fetch(w http.ResponseWriter, caller *fuse.Context, name string) {
+	secret, ok := s.kwfs.Cache.Secret(name)
+	if !ok && s.kwfs.Cache.Corrupt(name) {
+		http.Error(w, fmt.Sprintf("content of %s failed verification", name), http.StatusBadGateway)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("no secret %s", name), http.StatusNotFound)
+		return
+	}
+	if !s.kwfs.allowed(secret, caller) || !readable(caller, s.kwfs.secretAttr(secret)) {
+		s.kwfs.Warnf("Denied access to %s through the control socket", name)
+		s.kwfs.Audit.Record(name, caller, false, false)
+		http.Error(w, fmt.Sprintf("access to %s denied", name), http.StatusForbidden)
+		return
+	}
+	s.kwfs.Audit.Record(name, caller, false, true)
+	s.kwfs.Opens.Record(name)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(secret.Content.Bytes())
+}
+
+// controlRequest sends a request to the control socket of a running mount, returning the body of
+// a successful response.
+func controlRequest(socket, method, path string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: controlTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://keywhiz-fs"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach keywhiz-fs on %s: %v", socket, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControlServer(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_control")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "control.sock")
+
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	backend := MapBackend{"db": "password", "prod/api": "token"}
+	kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: 12345, Gid: 12345}, timeouts, metricsHandle, logConfig)
+	var audit bytes.Buffer
+	kwfs.Audit = NewAuditLog(&audit)
+
+	unmounts := 0
+	control := NewControlServer(kwfs, NewHealthHandler(kwfs), "/run/secrets", func() { unmounts++ })
+	listener, err := control.Listen(socket)
+	assert.NoError(err)
+	defer listener.Close()
+
+	info, err := os.Stat(socket)
+	assert.NoError(err)
+	assert.EqualValues(0, info.Mode().Perm()&0077, "inaccessible to others")
+	_, err = control.Listen(socket)
+	assert.Error(err, "in use")
+
+	body, err := controlRequest(socket, "GET", "/status")
+	assert.NoError(err)
+	var status ControlStatus
+	assert.NoError(json.Unmarshal(body, &status))
+	assert.Equal("/run/secrets", status.Mountpoint)
+	assert.Equal(os.Getpid(), status.Pid)
+	assert.Contains(string(status.Info), "runtime_version")
+
+	body, err = controlRequest(socket, "GET", "/secret/db")
+	assert.NoError(err)
+	assert.Equal("password", string(body))
+	body, err = controlRequest(socket, "GET", "/secret/prod%2Fapi")
+	assert.NoError(err)
+	assert.Equal("token", string(body))
+	_, err = controlRequest(socket, "GET", "/secret/missing")
+	assert.EqualError(err, "no secret missing")
+
+	// Fetches are audited with the caller's credentials.
+	var event AuditEvent
+	assert.NoError(json.Unmarshal(bytes.Split(audit.Bytes(), []byte("\n"))[0], &event))
+	assert.Equal("db", event.Secret)
+	assert.EqualValues(os.Getuid(), event.Uid)
+	assert.EqualValues(os.Getpid(), event.Pid)
+	assert.True(event.Allowed)
+
+	// Ownership is enforced against the caller, who doesn't own the secret.
+	kwfs.EnforceOwnership = true
+	_, err = controlRequest(socket, "GET", "/secret/db")
+	assert.EqualError(err, "access to db denied")
+	kwfs.EnforceOwnership = false
+
+	control.Settings = map[string]interface{}{"timeout": "20s"}
+	body, err = controlRequest(socket, "GET", "/config")
+	assert.NoError(err)
+	assert.JSONEq(`{"timeout": "20s"}`, string(body))
+
+	body, err = controlRequest(socket, "GET", "/secrets")
+	assert.NoError(err)
+	var entries []CacheEntry
+	assert.NoError(json.Unmarshal(body, &entries))
+	if assert.Len(entries, 2) {
+		assert.Equal("db", entries[0].Name)
+		assert.EqualValues(len("password"), entries[0].Length)
+		assert.True(entries[0].Content)
+		assert.Nil(entries[0].Expires)
+		assert.Equal("prod/api", entries[1].Name)
+	}
+
+	_, err = controlRequest(socket, "POST", "/evict/db")
+	assert.NoError(err)
+	_, err = controlRequest(socket, "POST", "/evict/db")
+	assert.EqualError(err, "db is not cached")
+	_, err = controlRequest(socket, "POST", "/refresh/db")
+	assert.NoError(err)
+	_, err = controlRequest(socket, "POST", "/refresh")
+	assert.NoError(err)
+	body, err = controlRequest(socket, "GET", "/secrets")
+	assert.NoError(err)
+	assert.Contains(string(body), `"name":"db"`, "fetched again")
+
+	_, err = controlRequest(socket, "POST", "/clear-cache")
+	assert.NoError(err)
+	assert.Equal(0, kwfs.Cache.Len())
+
+	_, err = controlRequest(socket, "POST", "/unmount")
+	assert.NoError(err)
+	assert.Equal(1, unmounts)
+
+	_, err = controlRequest(socket, "GET", "/unknown")
+	assert.Error(err)
+	_, err = controlRequest(filepath.Join(dir, "missing.sock"), "GET", "/status")
+	assert.Error(err)
+}
+
+func TestControlAuthorization(t *testing.T) {
+	assert := assert.New(t)
+	dir, cleanup := fakeProc()
+	defer cleanup()
+	panicOnError(ioutil.WriteFile(filepath.Join(dir, "100", "status"), []byte("Name:\tapp\nGroups:\t10 20 \n"), 0644))
+
+	control := NewControlServer(nil, nil, "/run/secrets", func() {})
+	euid := uint32(os.Geteuid())
+	caller := func(uid, gid, pid uint32) *fuse.Context {
+		return &fuse.Context{Owner: fuse.Owner{Uid: uid, Gid: gid}, Pid: pid}
+	}
+
+	assert.False(control.authorized(nil), "unknown caller")
+	assert.True(control.authorized(caller(0, 0, 100)))
+	assert.True(control.authorized(caller(euid, euid, 100)))
+	assert.False(control.authorized(caller(5000, 20, 100)))
+
+	gid := uint32(20)
+	control.Group = &gid
+	assert.True(control.authorized(caller(5000, 20, 300)), "primary group")
+	assert.True(control.authorized(caller(5000, 30, 100)), "supplementary group")
+	assert.False(control.authorized(caller(5000, 30, 200)))
+
+	// Group members may not write snapshots.
+	assert.True(privileged(caller(0, 0, 100)))
+	assert.True(privileged(caller(euid, euid, 100)))
+	assert.False(privileged(caller(5000, 20, 300)))
+	assert.False(privileged(nil))
+}
+
+func TestControlFetchChecksMode(t *testing.T) {
+	assert := assert.New(t)
+	dir, cleanup := fakeProc()
+	defer cleanup()
+	panicOnError(ioutil.WriteFile(filepath.Join(dir, "100", "status"), []byte("Name:\tapp\nGroups:\t10 20 \n"), 0644))
+
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	backend := MapBackend{"db": "password", "shared": "token"}
+	kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: 12345, Gid: 20}, timeouts, metricsHandle, logConfig)
+	overrides, err := NewOwnershipOverrides([]OwnershipRule{{Secrets: []string{"db"}, Mode: "0400"}})
+	assert.NoError(err)
+	kwfs.Overrides = overrides
+	gid := uint32(20)
+	control := NewControlServer(kwfs, nil, "/run/secrets", func() {})
+	control.Group = &gid
+
+	fetch := func(name string, uid, gid uint32) int {
+		w := httptest.NewRecorder()
+		control.fetch(w, &fuse.Context{Owner: fuse.Owner{Uid: uid, Gid: gid}, Pid: 100}, name)
+		return w.Code
+	}
+
+	// A group member can't read a 0400 secret owned by someone else, as on the mount.
+	assert.Equal(http.StatusForbidden, fetch("db", 5000, 30))
+	assert.Equal(http.StatusOK, fetch("shared", 5000, 30), "group readable")
+	assert.Equal(http.StatusOK, fetch("db", 12345, 30), "owner")
+	assert.Equal(http.StatusOK, fetch("db", 0, 0), "root")
+
+	assert.False(readable(nil, &fuse.Attr{Mode: 0444}))
+	assert.True(readable(&fuse.Context{Owner: fuse.Owner{Uid: 5000, Gid: 5000}, Pid: 200}, &fuse.Attr{Uid: 12345, Gid: 20, Mode: 0404}))
+	assert.False(readable(&fuse.Context{Owner: fuse.Owner{Uid: 12345, Gid: 20}, Pid: 200}, &fuse.Attr{Uid: 12345, Gid: 20, Mode: 0044}), "owner bits apply to the owner")
+}
@@ -0,0 +1,30 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// peerCredentials fails where the credentials of the connected process aren't known, so that
+// all callers of the control socket are denied.
+func peerCredentials(fd int) (*fuse.Context, error) {
+	return nil, errors.New("peer credentials are only supported on Linux")
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// ControlFileAccess restricts the control files which make the cache do work: .clear_cache and
+// .reload, which drop or reload the whole cache, and the files in .refresh/, which refresh a
+// secret from the backend. On allow_other mounts, any local user can otherwise use them to churn
+// the cache or send requests to the backend. The zero value lets everyone use them.
+type ControlFileAccess struct {
+	// Disabled hides the control files.
+	Disabled bool
+	// Restricted only lets Uid use them. They are still visible to other users.
+	Restricted bool
+	Uid        uint32
+}
+
+// isCacheControl returns true for the control files governed by ControlFileAccess.
+func isCacheControl(name string) bool {
+	return name == ".clear_cache" || name == ".reload" || name == ".refresh" || strings.HasPrefix(name, ".refresh/")
+}
+
+// Allowed returns true if the caller may use the control files.
+func (a ControlFileAccess) Allowed(context *fuse.Context) bool {
+	if a.Disabled {
+		return false
+	}
+	return !a.Restricted || context != nil && context.Uid == a.Uid
+}
+
+// String describes the access for .json/config: enabled, disabled or uid=N.
+func (a ControlFileAccess) String() string {
+	switch {
+	case a.Disabled:
+		return "disabled"
+	case a.Restricted:
+		return fmt.Sprintf("uid=%d", a.Uid)
+	}
+	return "enabled"
+}
+
+// NewControlFileAccess returns the access to control files for the --control-files and
+// --control-user flags. The user may be given by name or uid, and must exist, since falling back
+// to another user would silently change who can use the control files.
+func NewControlFileAccess(enabled bool, username string) (ControlFileAccess, error) {
+	if !enabled {
+		return ControlFileAccess{Disabled: true}, nil
+	}
+	if username == "" {
+		return ControlFileAccess{}, nil
+	}
+	id := username
+	if _, err := strconv.ParseUint(username, 10, 32); err != nil {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return ControlFileAccess{}, err
+		}
+		id = u.Uid
+	}
+	uid, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return ControlFileAccess{}, fmt.Errorf("invalid uid %q for %s", id, username)
+	}
+	return ControlFileAccess{Restricted: true, Uid: uint32(uid)}, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewControlFileAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	access, err := NewControlFileAccess(true, "")
+	assert.NoError(err)
+	assert.Equal(ControlFileAccess{}, access)
+	assert.Equal("enabled", access.String())
+
+	access, err = NewControlFileAccess(false, "1000")
+	assert.NoError(err)
+	assert.True(access.Disabled)
+	assert.Equal("disabled", access.String())
+
+	access, err = NewControlFileAccess(true, "1000")
+	assert.NoError(err)
+	assert.Equal(ControlFileAccess{Restricted: true, Uid: 1000}, access)
+	assert.Equal("uid=1000", access.String())
+
+	access, err = NewControlFileAccess(true, "root")
+	assert.NoError(err)
+	assert.Equal(ControlFileAccess{Restricted: true, Uid: 0}, access)
+
+	_, err = NewControlFileAccess(true, "no-such-user-kwfs")
+	assert.Error(err)
+}
+
+func TestControlFileAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	kwfs, _, _ := NewKeywhizFs(nil, MapBackend{"secret": "content"}, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	owner := &fuse.Context{Owner: fuse.Owner{Uid: 1000}}
+	other := &fuse.Context{Owner: fuse.Owner{Uid: 1001}}
+	kwfs.Cache.SecretList()
+
+	// Restricted, the files are visible but only the configured user may use them.
+	kwfs.ControlFiles = ControlFileAccess{Restricted: true, Uid: 1000}
+	for _, name := range []string{".clear_cache", ".reload", ".refresh/secret"} {
+		_, status := kwfs.GetAttr(name, other)
+		assert.Equal(fuse.OK, status, name)
+		assert.Equal(fuse.EACCES, kwfs.Unlink(name, other), name)
+		assert.Equal(fuse.OK, kwfs.Unlink(name, owner), name)
+	}
+	assert.Equal(fuse.EACCES, kwfs.Unlink(".clear_cache", nil))
+
+	// Disabled, they don't exist for anyone.
+	kwfs.ControlFiles = ControlFileAccess{Disabled: true}
+	for _, name := range []string{".clear_cache", ".reload", ".refresh", ".refresh/secret"} {
+		_, status := kwfs.GetAttr(name, owner)
+		assert.Equal(fuse.ENOENT, status, name)
+		_, status = kwfs.Open(name, 0, owner)
+		assert.Equal(fuse.ENOENT, status, name)
+		assert.Equal(fuse.ENOENT, kwfs.Unlink(name, owner), name)
+	}
+	_, status := kwfs.OpenDir(".refresh", owner)
+	assert.Equal(fuse.ENOENT, status)
+	entries, _ := kwfs.OpenDir("", owner)
+	for _, entry := range entries {
+		assert.False(isCacheControl(entry.Name), entry.Name)
+	}
+	_, status = kwfs.Open("secret", 0, owner)
+	assert.Equal(fuse.OK, status)
+}
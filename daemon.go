@@ -0,0 +1,108 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// daemonEnv is set in the environment of the background process started by --daemon.
+const daemonEnv = "KEYWHIZ_FS_DAEMON"
+
+// daemonReadyFd is the file descriptor on which the background process reports that it is
+// mounted, the first of exec.Cmd.ExtraFiles.
+const daemonReadyFd = 3
+
+// daemonReadyMsg is written to daemonReadyFd once mounted.
+const daemonReadyMsg = "ready"
+
+// isDaemon returns true in the background process started by --daemon.
+func isDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonize starts keywhiz-fs again in the background, in a new session, and waits until it is
+// mounted. Errors until then are printed to stderr as if running in the foreground, and reflected
+// in the returned exit code for the launching process.
+func daemonize() int {
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to start daemon: %v\n", err)
+		return 1
+	}
+	defer r.Close()
+
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to start daemon: %v\n", err)
+		return 1
+	}
+
+	// Read until the daemon reports it is mounted, or exits.
+	msg, _ := ioutil.ReadAll(r)
+	if string(msg) == daemonReadyMsg {
+		return 0
+	}
+	if err := cmd.Wait(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+			return exit.ExitCode()
+		}
+	}
+	return 1
+}
+
+// daemonReady tells the launching process that the background process is mounted, letting it
+// exit. Does nothing when not running as a daemon.
+func daemonReady() {
+	if !isDaemon() {
+		return
+	}
+	f := os.NewFile(daemonReadyFd, "daemon")
+	f.Write([]byte(daemonReadyMsg))
+	f.Close()
+}
+
+// writePidFile writes the process ID to file, replacing it atomically so that readers never see
+// a partial file.
+func writePidFile(file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".pid")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
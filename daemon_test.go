@@ -0,0 +1,50 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePidFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_pidfile")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "keywhiz-fs.pid")
+	assert.NoError(ioutil.WriteFile(file, []byte("stale\n"), 0600))
+	assert.NoError(writePidFile(file))
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(err)
+	assert.Equal(strconv.Itoa(os.Getpid())+"\n", string(data))
+
+	info, err := os.Stat(file)
+	assert.NoError(err)
+	assert.EqualValues(0644, info.Mode().Perm())
+
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(entries, 1, "no temporary files left")
+
+	assert.Error(writePidFile(filepath.Join(dir, "missing", "keywhiz-fs.pid")))
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// serveDebugVars serves the standard expvar variables, as expvar.Handler does, so that Go
+// debugging tools work against keywhiz-fs. URLs in the command line are redacted as in
+// .json/config, and the metrics of registry, if any, are added under "keywhizfs".
+func serveDebugVars(w http.ResponseWriter, registry metrics.Registry) {
+	vars := map[string]json.RawMessage{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	cmdline, err := json.Marshal(redactSetting(os.Args))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	vars["cmdline"] = cmdline
+	if registry != nil {
+		data, err := json.Marshal(registryVars(registry))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		vars["keywhizfs"] = data
+	}
+
+	data, err := json.Marshal(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
+
+// registryVars returns the values of the counters and gauges of registry by name, and the
+// count and quantiles of its histograms and timers.
+func registryVars(registry metrics.Registry) map[string]interface{} {
+	vars := map[string]interface{}{}
+	summary := func(count int64, quantiles []float64) map[string]interface{} {
+		s := map[string]interface{}{"count": count}
+		for i, q := range pushQuantiles {
+			s[strconv.FormatFloat(q, 'g', -1, 64)] = quantiles[i]
+		}
+		return s
+	}
+	registry.Each(func(name string, metric interface{}) {
+		switch metric := metric.(type) {
+		case metrics.Counter:
+			vars[name] = metric.Count()
+		case metrics.Gauge:
+			vars[name] = metric.Value()
+		case metrics.GaugeFloat64:
+			vars[name] = metric.Value()
+		case metrics.Histogram:
+			h := metric.Snapshot()
+			vars[name] = summary(h.Count(), h.Percentiles(pushQuantiles))
+		case metrics.Timer:
+			t := metric.Snapshot()
+			vars[name] = summary(t.Count(), t.Percentiles(pushQuantiles))
+		}
+	})
+	return vars
+}
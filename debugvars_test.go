@@ -0,0 +1,51 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugVars(t *testing.T) {
+	assert := assert.New(t)
+
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"keywhiz-fs", "--vault=prod=https://vault:8200/secret?token=s.abc", "https://keywhiz:4444", "/run/secrets"}
+
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	kwfs, _, _ := NewKeywhizFs(nil, MapBackend{}, Ownership{Uid: 12345, Gid: 12345}, timeouts, metricsHandle, logConfig)
+
+	recorder := httptest.NewRecorder()
+	NewHealthHandler(kwfs).ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/vars", nil))
+	assert.Equal(200, recorder.Code)
+	assert.Equal("application/json; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+	var vars struct {
+		Cmdline   []string               `json:"cmdline"`
+		Memstats  map[string]interface{} `json:"memstats"`
+		Keywhizfs map[string]interface{} `json:"keywhizfs"`
+	}
+	assert.NoError(json.Unmarshal(recorder.Body.Bytes(), &vars))
+	assert.Equal([]string{"keywhiz-fs", "--vault=prod=https://vault:8200/secret?token=REDACTED", "https://keywhiz:4444", "/run/secrets"}, vars.Cmdline)
+	assert.Contains(vars.Memstats, "HeapAlloc")
+	assert.Contains(vars.Keywhizfs, "runtime.cache.stale_served")
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+// DevBackend serves secrets from a local directory of JSON files, each a secret as returned by
+// the Keywhiz server (the format of GET /secret/NAME, with base64 content), so that applications
+// can be developed against a mount without certificates or a Keywhiz deployment. A secret
+// without a name is named after its file, without the .json extension. Files are read on every
+// request, so edits show up as soon as the cache refreshes.
+type DevBackend struct {
+	*log.Logger
+	dir string
+}
+
+// NewDevBackend returns a backend serving the secret files in dir.
+func NewDevBackend(dir string, logConfig log.Config) (*DevBackend, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &DevBackend{log.New("kwfs_dev", logConfig), dir}, nil
+}
+
+// List returns the secrets in the directory, without content, as the server does.
+func (b *DevBackend) List() ([]Secret, bool) {
+	secrets, err := b.secrets()
+	if err != nil {
+		b.Errorf("Error listing secrets in %s: %v", b.dir, err)
+		return nil, false
+	}
+	listing := make([]Secret, 0, len(secrets))
+	for _, secret := range secrets {
+		secret.Content = content{}
+		listing = append(listing, secret)
+	}
+	return listing, true
+}
+
+// Fetch returns the named secret, or SecretDeleted if no file in the directory holds it.
+func (b *DevBackend) Fetch(name string) (*Secret, error) {
+	secrets, err := b.secrets()
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range secrets {
+		if secret.Name == name {
+			return &secret, nil
+		}
+	}
+	return nil, SecretDeleted{}
+}
+
+// Invalidate does nothing, since files are read on every request.
+func (b *DevBackend) Invalidate(name string) {}
+
+// secrets reads every secret file in the directory. Files which aren't a secret are skipped.
+func (b *DevBackend) secrets() ([]Secret, error) {
+	paths, err := filepath.Glob(filepath.Join(b.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var secrets []Secret
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := ParseSecret(data)
+		if err != nil {
+			b.Warnf("Skipping %s: %v", path, err)
+			continue
+		}
+		if secret.Name == "" {
+			secret.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+		}
+		if secret.Length == 0 {
+			secret.Length = uint64(len(secret.Content.Bytes()))
+		}
+		secrets = append(secrets, *secret)
+	}
+	return secrets, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_dev")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "pgpass.json"), fixture("secret.json"), 0600))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "greeting.json"), []byte(`{"secret":"aGVsbG8="}`), 0600))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "list.json"), fixture("secrets.json"), 0600))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0600))
+
+	backend, err := NewDevBackend(dir, logConfig)
+	assert.NoError(err)
+
+	secrets, ok := backend.List()
+	assert.True(ok)
+	if assert.Len(secrets, 2) {
+		assert.Equal("greeting", secrets[0].Name)
+		assert.EqualValues(5, secrets[0].Length)
+		assert.True(secrets[0].Content.Empty())
+		assert.Equal("Nobody_PgPass", secrets[1].Name)
+	}
+
+	secret, err := backend.Fetch("Nobody_PgPass")
+	assert.NoError(err)
+	assert.EqualValues("asddas", secret.Content.Bytes())
+	assert.Equal("0400", secret.Mode)
+
+	_, err = backend.Fetch("pgpass")
+	assert.Equal(SecretDeleted{}, err)
+
+	_, err = NewDevBackend(filepath.Join(dir, "notes.txt"), logConfig)
+	assert.Error(err)
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// dirAttrTTL is how long attributes gathered when listing a directory answer GetAttr. It covers
+// the burst of stat() calls which follows a readdir, from ls -l or find, without serving the
+// attributes of a listing much longer than that.
+const dirAttrTTL = 5 * time.Second
+
+// dirAttrCache holds the attributes of the secrets in directories recently opened, computed from
+// the listing metadata the directory entries came from. GetAttr answers from it first, so that
+// stat'ing every entry of a directory doesn't send a request per file to the backend, even when
+// the listing is no longer fresh, e.g. while stale content is served or the backend is degraded.
+type dirAttrCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]dirAttr
+}
+
+type dirAttr struct {
+	attr    fuse.Attr
+	expires time.Time
+}
+
+// newDirAttrCache returns a cache keeping attributes for ttl. now defaults to time.Now if nil.
+func newDirAttrCache(ttl time.Duration, now func() time.Time) *dirAttrCache {
+	if now == nil {
+		now = time.Now
+	}
+	return &dirAttrCache{ttl: ttl, now: now, entries: map[string]dirAttr{}}
+}
+
+// Fill records the attributes of secrets by name, and drops expired attributes.
+func (c *dirAttrCache) Fill(attrs map[string]*fuse.Attr) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	for name, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, name)
+		}
+	}
+	expires := now.Add(c.ttl)
+	for name, attr := range attrs {
+		c.entries[name] = dirAttr{*attr, expires}
+	}
+}
+
+// Get returns a copy of the attributes of the named secret, if recorded and not expired.
+func (c *dirAttrCache) Get(name string) (*fuse.Attr, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[name]
+	if !ok || !c.now().Before(entry.expires) {
+		return nil, false
+	}
+	attr := entry.attr
+	return &attr, true
+}
+
+// Forget drops the attributes of a secret, e.g. when its content changed.
+func (c *dirAttrCache) Forget(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, name)
+}
+
+// Clear drops all attributes.
+func (c *dirAttrCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = map[string]dirAttr{}
+}
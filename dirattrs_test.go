@@ -0,0 +1,82 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirAttrCache(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := time.Now()
+	cache := newDirAttrCache(5*time.Second, func() time.Time { return clock })
+	cache.Fill(map[string]*fuse.Attr{"a": {Size: 1}, "b": {Size: 2}})
+
+	attr, ok := cache.Get("a")
+	assert.True(ok)
+	assert.EqualValues(1, attr.Size)
+	attr.Size = 10
+	attr, _ = cache.Get("a")
+	assert.EqualValues(1, attr.Size)
+
+	cache.Forget("a")
+	_, ok = cache.Get("a")
+	assert.False(ok)
+
+	clock = clock.Add(5 * time.Second)
+	_, ok = cache.Get("b")
+	assert.False(ok)
+	cache.Fill(map[string]*fuse.Attr{"c": {Size: 3}})
+	assert.Len(cache.entries, 1)
+	cache.Clear()
+	_, ok = cache.Get("c")
+	assert.False(ok)
+}
+
+func TestOpenDirPrefetchesAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	// Nothing is ever fresh, so without the attributes gathered by OpenDir every GetAttr would
+	// fetch the secret.
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	calls := new(int32)
+	backend := ListingBackend{[]Secret{{Name: "a", Length: 3, Mode: "0440"}, {Name: "ns/b", Length: 5}}, calls}
+	kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	context := &fuse.Context{}
+
+	_, status := kwfs.OpenDir("", context)
+	assert.Equal(fuse.OK, status)
+	attr, status := kwfs.GetAttr("a", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(3, attr.Size)
+	assert.EqualValues(fuse.S_IFREG|0440, attr.Mode)
+
+	_, status = kwfs.OpenDir("ns", context)
+	assert.Equal(fuse.OK, status)
+	attr, status = kwfs.GetAttr("ns/b", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(5, attr.Size)
+	assert.EqualValues(0, *calls)
+
+	// Once forgotten, e.g. when the secret changed, attributes come from the backend again.
+	kwfs.dirAttrs.Forget("a")
+	kwfs.GetAttr("a", context)
+	assert.EqualValues(1, *calls)
+}
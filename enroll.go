@@ -0,0 +1,204 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	klog "github.com/square/keywhiz-fs/log"
+)
+
+// enrollCheck is how often a mount checks whether the enrolled certificate must be renewed.
+var enrollCheck = time.Hour
+
+// maxEnrollResponse limits the size of the certificate chain returned by the enrollment server.
+const maxEnrollResponse = 1 << 20
+
+// EnrollOptions are settings of certificate enrollment.
+type EnrollOptions struct {
+	// URL receives certificate signing requests.
+	URL string
+	// TokenFile, if set, holds a bearer token proving the identity of the host to the CA.
+	TokenFile string
+	// Name is the common name and DNS name requested for the certificate.
+	Name string
+	// CaFile verifies the enrollment server instead of the system roots, if set.
+	CaFile string
+	// RenewBefore is how long before it expires the certificate is renewed.
+	RenewBefore time.Duration
+	// Timeout limits enrollment requests.
+	Timeout time.Duration
+}
+
+// Enroller obtains the client certificate from an internal CA, so that it needn't be provisioned
+// before the first mount. A new key is generated for every enrollment, and a certificate
+// signing request for it is POSTed (PEM-encoded, as application/pkcs10) to the enrollment URL,
+// which responds with the PEM-encoded certificate, optionally followed by intermediates.
+type Enroller struct {
+	*klog.Logger
+	options  EnrollOptions
+	certFile string
+	keyFile  string
+	http     *http.Client
+}
+
+// NewEnroller returns an Enroller writing the certificate and key to the given files, which may
+// be the same.
+func NewEnroller(certFile, keyFile string, options EnrollOptions, logConfig klog.Config) (*Enroller, error) {
+	if !strings.HasPrefix(options.URL, "https://") && !strings.HasPrefix(options.URL, "http://") {
+		return nil, fmt.Errorf("invalid enrollment URL %s", options.URL)
+	}
+	if options.Name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		options.Name = hostname
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, CipherSuites: ciphers}
+	if options.CaFile != "" {
+		caCert, err := ioutil.ReadFile(options.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(caCert)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: options.Timeout}
+	return &Enroller{klog.New("kwfs_enroll", logConfig), options, certFile, keyFile, client}, nil
+}
+
+// Ensure enrolls unless the files hold a certificate matching the key which doesn't expire
+// within RenewBefore.
+func (e *Enroller) Ensure() error {
+	cert, err := loadClientCertificate(e.certFile, e.keyFile)
+	switch {
+	case err != nil:
+		e.Infof("Enrolling for a client certificate: %v", err)
+	case time.Until(cert.Leaf.NotAfter) <= e.options.RenewBefore:
+		e.Infof("Renewing client certificate expiring at %v", cert.Leaf.NotAfter.Format(time.RFC3339))
+	default:
+		return nil
+	}
+	return e.enroll()
+}
+
+// Renew calls Ensure every interval, so that the certificate is renewed before it expires.
+// Clients pick up the new files when they refresh.
+func (e *Enroller) Renew(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := e.Ensure(); err != nil {
+			e.Errorf("Unable to renew client certificate: %v", err)
+		}
+	}
+}
+
+// enroll obtains a certificate for a new key and writes both.
+func (e *Enroller) enroll() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: e.options.Name}, DNSNames: []string{e.options.Name}}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.options.URL, bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Accept", "application/x-pem-file")
+	req.Header.Set("User-Agent", currentBuildInfo().userAgent())
+	if e.options.TokenFile != "" {
+		token, err := newTokenSource(e.options.TokenFile).Token()
+		if err != nil {
+			return fmt.Errorf("reading enrollment token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxEnrollResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg := responseMessage(body)
+		return fmt.Errorf("bad response code %d from %s: %s", resp.StatusCode, e.options.URL, msg)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	cert, err := parseClientCertificate(body, keyPEM, e.options.URL, "the generated key")
+	if err != nil {
+		return err
+	}
+
+	if e.certFile == e.keyFile {
+		err = writeFileAtomic(e.keyFile, append(keyPEM, body...), 0600)
+	} else if err = writeFileAtomic(e.keyFile, keyPEM, 0600); err == nil {
+		err = writeFileAtomic(e.certFile, body, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	e.Infof("Enrolled client certificate %s, expiring at %v", describeChain(cert), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// writeFileAtomic replaces file with data, so that readers never see partial content.
+func writeFileAtomic(file string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
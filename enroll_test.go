@@ -0,0 +1,136 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testEnrollServer signs certificate requests authenticated with the token "hunter2" with an
+// intermediate CA, counting requests.
+func testEnrollServer(t *testing.T, requests *int) *httptest.Server {
+	root := newTestCert(t, "root", true, nil)
+	intermediate := newTestCert(t, "intermediate", true, root)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.Header.Get("Authorization") != "Bearer hunter2" {
+			http.Error(w, "unknown host", http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		block, _ := pem.Decode(body)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		assert.NoError(t, err)
+		assert.NoError(t, csr.CheckSignature())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, intermediate.cert, csr.PublicKey, intermediate.key)
+		assert.NoError(t, err)
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		w.Write(intermediate.certPEM())
+	}))
+}
+
+func TestEnrollerEnrollsAndRenews(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-enroll")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(ioutil.WriteFile(tokenFile, []byte("hunter2\n"), 0600))
+
+	requests := 0
+	server := testEnrollServer(t, &requests)
+	defer server.Close()
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	options := EnrollOptions{URL: server.URL, TokenFile: tokenFile, Name: "host.example.com", RenewBefore: time.Hour, Timeout: time.Second}
+	enroller, err := NewEnroller(certFile, keyFile, options, logConfig)
+	assert.NoError(err)
+
+	assert.NoError(enroller.Ensure())
+	assert.Equal(1, requests)
+	cert, err := loadClientCertificate(certFile, keyFile)
+	assert.NoError(err)
+	assert.Equal("host.example.com", cert.Leaf.Subject.CommonName)
+	assert.Len(cert.Certificate, 2)
+	info, err := os.Stat(keyFile)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// A valid certificate is kept.
+	assert.NoError(enroller.Ensure())
+	assert.Equal(1, requests)
+
+	// One expiring within RenewBefore is renewed, with a new key.
+	enroller.options.RenewBefore = 48 * time.Hour
+	assert.NoError(enroller.Ensure())
+	assert.Equal(2, requests)
+	renewed, err := loadClientCertificate(certFile, keyFile)
+	assert.NoError(err)
+	assert.NotEqual(cert.Certificate[0], renewed.Certificate[0])
+}
+
+func TestEnrollerSingleFileAndErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-enroll")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(ioutil.WriteFile(tokenFile, []byte("wrong\n"), 0600))
+
+	requests := 0
+	server := testEnrollServer(t, &requests)
+	defer server.Close()
+
+	keyFile := filepath.Join(dir, "client.pem")
+	options := EnrollOptions{URL: server.URL, TokenFile: tokenFile, Name: "host", Timeout: time.Second}
+	enroller, err := NewEnroller(keyFile, keyFile, options, logConfig)
+	assert.NoError(err)
+
+	err = enroller.Ensure()
+	assert.Contains(err.Error(), "bad response code 403")
+	_, err = os.Stat(keyFile)
+	assert.True(os.IsNotExist(err))
+
+	assert.NoError(ioutil.WriteFile(tokenFile, []byte("hunter2\n"), 0600))
+	assert.NoError(enroller.Ensure())
+	cert, err := loadClientCertificate(keyFile, keyFile)
+	assert.NoError(err)
+	assert.Equal("host", cert.Leaf.Subject.CommonName)
+
+	_, err = NewEnroller(keyFile, keyFile, EnrollOptions{URL: "ftp://ca"}, logConfig)
+	assert.EqualError(err, "invalid enrollment URL ftp://ca")
+}
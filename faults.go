@@ -0,0 +1,117 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault describes failures injected into access to a secret, so that applications can test
+// their error handling against a real mount.
+type Fault struct {
+	// Delay is how long opening the secret, or reading its attributes, takes.
+	Delay time.Duration
+	// EIO makes opening the secret fail with EIO.
+	EIO bool
+	// Stale serves the cached secret, however old, without asking the backend, as when the
+	// server is unreachable.
+	Stale bool
+}
+
+// ParseFault parses a fault written to a file under .faults/: any of "delay=DURATION", "eio" and
+// "stale", separated by spaces or newlines. "none", or nothing, clears faults.
+func ParseFault(spec string) (Fault, error) {
+	var fault Fault
+	for _, field := range strings.Fields(spec) {
+		switch {
+		case field == "none":
+		case field == "eio":
+			fault.EIO = true
+		case field == "stale":
+			fault.Stale = true
+		case strings.HasPrefix(field, "delay="):
+			delay, err := time.ParseDuration(field[len("delay="):])
+			if err != nil || delay < 0 {
+				return Fault{}, fmt.Errorf("invalid delay '%s'", field)
+			}
+			fault.Delay = delay
+		default:
+			return Fault{}, fmt.Errorf("unknown fault '%s'", field)
+		}
+	}
+	return fault, nil
+}
+
+// String formats a fault as accepted by ParseFault.
+func (f Fault) String() string {
+	var fields []string
+	if f.Delay > 0 {
+		fields = append(fields, "delay="+f.Delay.String())
+	}
+	if f.EIO {
+		fields = append(fields, "eio")
+	}
+	if f.Stale {
+		fields = append(fields, "stale")
+	}
+	if len(fields) == 0 {
+		return "none"
+	}
+	return strings.Join(fields, " ")
+}
+
+// Faults holds the faults injected per secret. A nil Faults injects none.
+type Faults struct {
+	lock   sync.Mutex
+	faults map[string]Fault
+}
+
+// NewFaults creates an empty set of faults.
+func NewFaults() *Faults {
+	return &Faults{faults: make(map[string]Fault)}
+}
+
+// Get returns the faults injected for a secret.
+func (f *Faults) Get(name string) Fault {
+	if f == nil {
+		return Fault{}
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.faults[name]
+}
+
+// Set replaces the faults injected for a secret.
+func (f *Faults) Set(name string, fault Fault) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if fault == (Fault{}) {
+		delete(f.faults, name)
+	} else {
+		f.faults[name] = fault
+	}
+}
+
+// Apply waits for the injected delay, if any, and returns the fault.
+func (f *Faults) Apply(name string) Fault {
+	fault := f.Get(name)
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	return fault
+}
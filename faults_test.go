@@ -0,0 +1,57 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFault(t *testing.T) {
+	assert := assert.New(t)
+
+	fault, err := ParseFault("delay=1.5s\nstale eio")
+	assert.NoError(err)
+	assert.Equal(Fault{Delay: 1500 * time.Millisecond, EIO: true, Stale: true}, fault)
+	assert.Equal("delay=1.5s eio stale", fault.String())
+
+	for _, spec := range []string{"", " none\n"} {
+		fault, err = ParseFault(spec)
+		assert.NoError(err)
+		assert.Equal(Fault{}, fault)
+		assert.Equal("none", fault.String())
+	}
+
+	for _, spec := range []string{"delay=soon", "delay=-1s", "enoent"} {
+		_, err = ParseFault(spec)
+		assert.Error(err, spec)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	assert := assert.New(t)
+
+	var none *Faults
+	assert.Equal(Fault{}, none.Apply("secret"))
+
+	faults := NewFaults()
+	faults.Set("secret", Fault{EIO: true})
+	assert.Equal(Fault{EIO: true}, faults.Apply("secret"))
+	assert.Equal(Fault{}, faults.Get("other"))
+	faults.Set("secret", Fault{})
+	assert.Empty(faults.faults)
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// secretFile serves reads from the snapshot of secret content taken when the file was opened.
+// Reads on an open handle never touch the cache, and slices of the snapshot are handed to FUSE
+// directly since the content is never modified in place. Reads may start at any offset, so
+// content larger than the kernel's read size is served in as many reads as it takes; reads at
+// or past the end return no data. It also serves the content of special files, unlike
+// nodefs.NewDataFile which panics on reads past the end.
+type secretFile struct {
+	nodefs.File
+	data []byte
+}
+
+// newSecretFile creates a read-only file serving the given content.
+func newSecretFile(data []byte) nodefs.File {
+	return &secretFile{File: nodefs.NewDefaultFile(), data: data}
+}
+
+func (f *secretFile) String() string {
+	return fmt.Sprintf("secretFile(%d bytes)", len(f.data))
+}
+
+func (f *secretFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if off < 0 {
+		return nil, fuse.EINVAL
+	}
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	end := off + int64(len(buf))
+	if end > int64(len(f.data)) || end < off {
+		end = int64(len(f.data))
+	}
+	return fuse.ReadResultData(f.data[off:end]), fuse.OK
+}
+
+func (f *secretFile) GetAttr(out *fuse.Attr) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(f.data))
+	return fuse.OK
+}
+
+// writableFile buffers writes to a secret in memory. The buffered content is committed when
+// the file is flushed, i.e. on every close(2) of a file descriptor which modified it.
+//
+// The buffer is copied on write: it starts out as the cached content, and once handed out by a
+// read or a commit it is treated as immutable, so neither the cache nor read results are ever
+// modified in place and reads don't need to copy.
+type writableFile struct {
+	nodefs.File
+	name   string
+	attr   fuse.Attr
+	data   []byte
+	dirty  bool
+	shared bool
+	commit func(name string, data []byte) fuse.Status
+	lock   sync.Mutex
+}
+
+// newWritableFile creates a writable file for a secret, seeded with its current content.
+func newWritableFile(name string, data []byte, attr *fuse.Attr, commit func(string, []byte) fuse.Status) nodefs.File {
+	return &writableFile{File: nodefs.NewDefaultFile(), name: name, attr: *attr, data: data, shared: true, commit: commit}
+}
+
+// unshare makes data a private buffer of at least size bytes, copying it if it is shared or too
+// short. Must be called with lock held, before modifying data.
+func (f *writableFile) unshare(size int64) {
+	if !f.shared && size <= int64(len(f.data)) {
+		return
+	}
+	if size < int64(len(f.data)) {
+		size = int64(len(f.data))
+	}
+	buf := make([]byte, size)
+	copy(buf, f.data)
+	f.data = buf
+	f.shared = false
+}
+
+func (f *writableFile) String() string {
+	return fmt.Sprintf("writableFile(%s)", f.name)
+}
+
+func (f *writableFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	end := off + int64(len(buf))
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	// A concurrent write copies data before modifying it, so the result can't change before
+	// it is sent.
+	f.shared = true
+	return fuse.ReadResultData(f.data[off:end]), fuse.OK
+}
+
+func (f *writableFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.unshare(off + int64(len(data)))
+	copy(f.data[off:], data)
+	f.dirty = true
+	return uint32(len(data)), fuse.OK
+}
+
+func (f *writableFile) Truncate(size uint64) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if size <= uint64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.unshare(int64(size))
+	}
+	f.dirty = true
+	return fuse.OK
+}
+
+func (f *writableFile) Flush() fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.dirty {
+		return fuse.OK
+	}
+	// The committed content may be cached, so later writes must not modify it.
+	f.shared = true
+	status := f.commit(f.name, f.data)
+	if status == fuse.OK {
+		f.dirty = false
+	}
+	return status
+}
+
+func (f *writableFile) Fsync(flags int) fuse.Status {
+	return f.Flush()
+}
+
+func (f *writableFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	*out = f.attr
+	out.Size = uint64(len(f.data))
+	return fuse.OK
+}
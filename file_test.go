@@ -0,0 +1,158 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenPinsContent(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	backend := MapBackend{"secret": "first part|second part"}
+	kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	context := &fuse.Context{}
+	kwfs.Cache.SecretList()
+
+	file, status := kwfs.Open("secret", 0, context)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 11)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("first part|", string(data))
+
+	// The secret is rotated while the handle is being read.
+	backend["secret"] = "rotated"
+	assert.Nil(kwfs.Cache.Refresh("secret"))
+	attr, status := kwfs.GetAttr("secret", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(len("rotated"), attr.Size)
+
+	res, _ = file.Read(buf, 11)
+	data, _ = res.Bytes(buf)
+	assert.Equal("second part", string(data))
+	var fileAttr fuse.Attr
+	assert.Equal(fuse.OK, file.GetAttr(&fileAttr))
+	assert.EqualValues(len("first part|second part"), fileAttr.Size)
+
+	// The next open sees the new content.
+	file, status = kwfs.Open("secret", 0, context)
+	assert.Equal(fuse.OK, status)
+	res, _ = file.Read(buf, 0)
+	data, _ = res.Bytes(buf)
+	assert.Equal("rotated", string(data))
+}
+
+// StatusBackend fails fetches of the secrets it maps to an error, and serves the others from
+// MapBackend.
+type StatusBackend struct {
+	MapBackend
+	errors map[string]error
+}
+
+func (b StatusBackend) Fetch(name string) (*Secret, error) {
+	if err := b.errors[name]; err != nil {
+		return nil, err
+	}
+	return b.MapBackend.Fetch(name)
+}
+
+func TestOpenErrorCodes(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	backend := StatusBackend{MapBackend{"revoked": "content"}, map[string]error{
+		"denied":      BackendStatus{403, "forbidden"},
+		"unavailable": BackendStatus{503, "unavailable"},
+	}}
+	kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	context := &fuse.Context{}
+
+	_, status := kwfs.Open("revoked", 0, context)
+	assert.Equal(fuse.OK, status)
+	backend.errors["revoked"] = BackendStatus{401, "unauthorized"}
+
+	for name, expected := range map[string]fuse.Status{
+		"denied":      fuse.EACCES,
+		"revoked":     fuse.EACCES,
+		"unavailable": fuse.EIO,
+		"missing":     fuse.ENOENT,
+	} {
+		_, status = kwfs.Open(name, 0, context)
+		assert.Equal(expected, status, name)
+		_, status = kwfs.GetAttr(name, context)
+		assert.Equal(expected, status, name)
+	}
+
+	// Once the backend answers, the secret is served again.
+	delete(backend.errors, "revoked")
+	_, status = kwfs.Open("revoked", 0, context)
+	assert.Equal(fuse.OK, status)
+}
+
+func TestOperationTimeoutsByClass(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 3 * time.Second, 4 * time.Second}
+	kwfs, _, _ := NewKeywhizFs(nil, MapBackend{}, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+
+	assert.Equal(4*time.Second, kwfs.opTimeout("secret"))
+	assert.Equal(8*time.Second, kwfs.opTimeout(".json/status"))
+	assert.Equal(6*time.Second, kwfs.dirTimeout(""))
+	assert.Equal(8*time.Second, kwfs.dirTimeout(".json"))
+}
+
+func TestHideJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	kwfs, _, _ := NewKeywhizFs(nil, MapBackend{"secret": "content"}, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	context := &fuse.Context{}
+	kwfs.HideJSON = true
+
+	for _, name := range []string{".json", ".json/status", ".json/config", ".json/secret", ".json/secret/secret"} {
+		_, status := kwfs.GetAttr(name, context)
+		assert.Equal(fuse.ENOENT, status, name)
+		_, status = kwfs.Open(name, 0, context)
+		assert.Equal(fuse.ENOENT, status, name)
+	}
+	_, status := kwfs.OpenDir(".json", context)
+	assert.Equal(fuse.ENOENT, status)
+
+	entries, status := kwfs.OpenDir("", context)
+	assert.Equal(fuse.OK, status)
+	names := map[string]bool{}
+	for _, entry := range entries {
+		names[entry.Name] = true
+	}
+	assert.False(names[".json"])
+	assert.True(names["secret"])
+	assert.True(names[".version"])
+
+	// Content files and other control files are still there.
+	_, status = kwfs.Open("secret", 0, context)
+	assert.Equal(fuse.OK, status)
+	_, status = kwfs.GetAttr(".version", context)
+	assert.Equal(fuse.OK, status)
+
+	var config ConfigInfo
+	assert.NoError(json.Unmarshal(kwfs.configJSON(), &config))
+	assert.False(config.Runtime.JSONDir)
+}
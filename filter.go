@@ -0,0 +1,130 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// SecretFilter restricts the secrets exposed by a mount to a subset of those the client is
+// entitled to. A name is allowed if it matches any include pattern (or there are none) and no
+// exclude pattern. Patterns are regular expressions matched against the whole name.
+type SecretFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// NewSecretFilter compiles include and exclude patterns. It returns nil, which allows every
+// name, if there are no patterns.
+func NewSecretFilter(include, exclude []string) (*SecretFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &SecretFilter{}
+	var err error
+	if f.include, err = compilePatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func compilePatterns(patterns []string) (compiled []*regexp.Regexp, err error) {
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Allowed returns true if the secret name may be exposed.
+func (f *SecretFilter) Allowed(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterRawList removes disallowed secrets from a raw JSON secret listing.
+func (f *SecretFilter) FilterRawList(data []byte) ([]byte, error) {
+	if f == nil {
+		return data, nil
+	}
+	var secrets []json.RawMessage
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, err
+	}
+	allowed := []json.RawMessage{}
+	for _, raw := range secrets {
+		var s struct{ Name string }
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		if f.Allowed(s.Name) {
+			allowed = append(allowed, raw)
+		}
+	}
+	return json.Marshal(allowed)
+}
+
+// FilteredBackend hides the secrets of a backend which a filter does not allow. Hidden secrets
+// are reported as deleted.
+type FilteredBackend struct {
+	SecretBackend
+	filter *SecretFilter
+}
+
+// Fetch retrieves a secret if it is allowed.
+func (b FilteredBackend) Fetch(name string) (*Secret, error) {
+	if !b.filter.Allowed(name) {
+		return nil, SecretDeleted{}
+	}
+	return b.SecretBackend.Fetch(name)
+}
+
+// List lists the allowed secrets.
+func (b FilteredBackend) List() ([]Secret, bool) {
+	secrets, ok := b.SecretBackend.List()
+	if !ok {
+		return nil, false
+	}
+	var allowed []Secret
+	for _, s := range secrets {
+		if b.filter.Allowed(s.Name) {
+			allowed = append(allowed, s)
+		}
+	}
+	return allowed, true
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretFilterAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	filter, err := NewSecretFilter(nil, nil)
+	assert.Nil(err)
+	assert.Nil(filter)
+	assert.True(filter.Allowed("anything"))
+
+	filter, err = NewSecretFilter([]string{"app\\..*", "shared"}, []string{".*\\.admin"})
+	assert.Nil(err)
+	assert.True(filter.Allowed("app.db"))
+	assert.True(filter.Allowed("shared"))
+	assert.False(filter.Allowed("app.admin"))
+	assert.False(filter.Allowed("shared.key"), "patterns match whole names")
+	assert.False(filter.Allowed("other"))
+
+	filter, err = NewSecretFilter(nil, []string{"secret"})
+	assert.Nil(err)
+	assert.True(filter.Allowed("other"))
+	assert.False(filter.Allowed("secret"))
+
+	_, err = NewSecretFilter([]string{"("}, nil)
+	assert.NotNil(err)
+}
+
+func TestSecretFilterRawList(t *testing.T) {
+	assert := assert.New(t)
+
+	filter, _ := NewSecretFilter([]string{"a.*"}, nil)
+	data, err := filter.FilterRawList([]byte(`[{"name":"a1","secret":""},{"name":"b1"},{"name":"a2"}]`))
+	assert.Nil(err)
+
+	var secrets []struct{ Name string }
+	assert.Nil(json.Unmarshal(data, &secrets))
+	assert.Len(secrets, 2)
+	assert.Equal("a1", secrets[0].Name)
+	assert.Equal("a2", secrets[1].Name)
+
+	_, err = filter.FilterRawList([]byte("not json"))
+	assert.NotNil(err)
+}
+
+func TestFilteredBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	filter, _ := NewSecretFilter(nil, []string{"hidden"})
+	backend := FilteredBackend{MapBackend{"visible": "v", "hidden": "h"}, filter}
+
+	secret, err := backend.Fetch("visible")
+	assert.Nil(err)
+	assert.EqualValues("v", secret.Content.Bytes())
+
+	_, err = backend.Fetch("hidden")
+	assert.IsType(SecretDeleted{}, err)
+
+	secrets, ok := backend.List()
+	assert.True(ok)
+	assert.Len(secrets, 1)
+	assert.Equal("visible", secrets[0].Name)
+}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -38,8 +39,12 @@ const (
 	fuseEISDIR = fuse.Status(unix.EISDIR)
 )
 
+// defaultHealthThreshold is how long the server may be unreachable before .health fails.
+const defaultHealthThreshold = 5 * time.Minute
+
 // Initialized via ldflags
 var (
+	buildVersion  = "unknown"
 	buildRevision = "unknown"
 	buildTime     = "0"
 	buildMachine  = "unknown"
@@ -47,6 +52,7 @@ var (
 
 // StatusInfo contains debug info accessible via `.json/status`.
 type StatusInfo struct {
+	BuildVersion   string           `json:"build_version"`
 	BuildRevision  string           `json:"build_revision"`
 	BuildMachine   string           `json:"build_machine"`
 	BuildTime      time.Time        `json:"build_time"`
@@ -56,6 +62,42 @@ type StatusInfo struct {
 	ClientParams   httpClientParams `json:"client_params"`
 }
 
+// ConfigInfo is the effective configuration reported by .json/config: the settings the mount was
+// started with, and the current values of those which change at runtime.
+type ConfigInfo struct {
+	Settings map[string]interface{} `json:"settings"`
+	Runtime  RuntimeConfig          `json:"runtime"`
+}
+
+// RuntimeConfig holds the current configuration of a mount, reflecting reloads and control files.
+type RuntimeConfig struct {
+	ServerURL        string   `json:"server_url,omitempty"`
+	Timeout          string   `json:"timeout"`
+	ContentDeadline  string   `json:"content_deadline"`
+	ListDeadline     string   `json:"list_deadline"`
+	ListTimeout      string   `json:"list_timeout"`
+	ControlTimeout   string   `json:"control_timeout"`
+	CacheTimeout     string   `json:"cache_timeout"`
+	MaxStale         string   `json:"max_stale"`
+	OnBackendError   string   `json:"on_backend_error"`
+	CacheMode        string   `json:"cache_mode"`
+	Uid              uint32   `json:"uid"`
+	Gid              uint32   `json:"gid"`
+	WriteThrough     bool     `json:"write_through"`
+	DirectIO         bool     `json:"direct_io"`
+	EnforceOwnership bool     `json:"enforce_ownership"`
+	ProcessPolicy    bool     `json:"process_policy"`
+	AuditLog         bool     `json:"audit_log"`
+	Filter           bool     `json:"filter"`
+	Faults           bool     `json:"faults"`
+	JSONFields       bool     `json:"json_fields"`
+	JSONDir          bool     `json:"json_dir"`
+	ControlFiles     string   `json:"control_files"`
+	Templates        []string `json:"templates"`
+	HealthThreshold  string   `json:"health_threshold"`
+	Debug            bool     `json:"debug"`
+}
+
 // KeywhizFs is the central struct for dispatching filesystem operations.
 type KeywhizFs struct {
 	pathfs.FileSystem
@@ -65,7 +107,56 @@ type KeywhizFs struct {
 	Metrics   *sqmetrics.SquareMetrics
 	StartTime time.Time
 	Ownership Ownership
-	Timeout   time.Duration
+	// Timeout bounds operations on secrets, ListTimeout directory listings and ControlTimeout
+	// operations on control files.
+	Timeout        time.Duration
+	ListTimeout    time.Duration
+	ControlTimeout time.Duration
+	// WriteThrough allows secret files to be written, sending new content to the server.
+	WriteThrough bool
+	// DirectIO bypasses the kernel page cache, so every read reaches the filesystem.
+	DirectIO bool
+	// EnforceOwnership denies access to secrets unless the caller's uid or gid is the secret's.
+	EnforceOwnership bool
+	// Policy restricts access to secrets by the executable of the calling process.
+	Policy *ProcessPolicy
+	// Audit records every open of a secret.
+	Audit *AuditLog
+	// Opens counts the opens of each secret.
+	Opens *AccessStats
+	// Tracer records spans for FUSE operations, if set.
+	Tracer *Tracer
+	// HealthThreshold is how long the server may be unreachable before .health reports it.
+	HealthThreshold time.Duration
+	// Templates are rendered into files in the base directory, taking precedence over secrets
+	// of the same name.
+	Templates map[string]*Template
+	// Filter restricts the secrets exposed, including through .json/.
+	Filter *SecretFilter
+	// Tuning exposes the kernel's request queue limits under .fuse/ once mounted.
+	Tuning *FuseTuning
+	// Faults, if set, exposes .faults/ for injecting failures into access to secrets.
+	Faults *Faults
+	// IDs caches the ids of the owners and groups of secrets, if set.
+	IDs *IDCache
+	// Overrides replaces the owner, group and mode recorded by the server for matching secrets.
+	Overrides *OwnershipOverrides
+	// JSONFields exposes the fields of secrets holding JSON objects or arrays as files in a
+	// directory named after the secret, e.g. db.json.d/password.
+	JSONFields bool
+	// HideJSON hides the .json directory, so that the raw secret JSON and metadata aren't
+	// exposed, only the content of secrets.
+	HideJSON bool
+	// ControlFiles restricts .clear_cache, .reload and .refresh/.
+	ControlFiles ControlFileAccess
+	// StableInodes reports inode numbers derived from each path, which survive remounts, rather
+	// than the order in which files happened to be looked up.
+	StableInodes bool
+	// Settings are the settings the mount was started with, reported by .json/config.
+	Settings map[string]interface{}
+	nodeFs   *pathfs.PathNodeFs
+	// dirAttrs holds the attributes of the secrets in directories recently opened.
+	dirAttrs *dirAttrCache
 }
 
 // prettyContext pretty-prints a FUSE context for log output.
@@ -82,23 +173,86 @@ func (kwfs KeywhizFs) statusJSON() []byte {
 	seconds, err := strconv.ParseInt(buildTime, 10, 64)
 	panicOnError(err)
 
-	status, err := json.Marshal(
-		StatusInfo{
-			BuildRevision:  buildRevision,
-			BuildMachine:   buildMachine,
-			BuildTime:      time.Unix(seconds, 0),
-			StartTime:      kwfs.StartTime,
-			RuntimeVersion: runtime.Version(),
-			ServerURL:      kwfs.Client.url.String(),
-			ClientParams:   kwfs.Client.params,
-		})
+	info := StatusInfo{
+		BuildVersion:   buildVersion,
+		BuildRevision:  buildRevision,
+		BuildMachine:   buildMachine,
+		BuildTime:      time.Unix(seconds, 0),
+		StartTime:      kwfs.StartTime,
+		RuntimeVersion: runtime.Version(),
+	}
+	if kwfs.Client != nil {
+		conn := kwfs.Client.current()
+		info.ServerURL, info.ClientParams = conn.url.String(), conn.params
+	}
+	status, err := json.Marshal(info)
 	panicOnError(err)
 	return status
 }
 
+// configJSON returns the effective configuration, with credentials in URLs redacted.
+func (kwfs KeywhizFs) configJSON() []byte {
+	info := ConfigInfo{
+		Settings: kwfs.Settings,
+		Runtime: RuntimeConfig{
+			Timeout:          kwfs.Timeout.String(),
+			ContentDeadline:  kwfs.Cache.timeouts.BackendDeadline.String(),
+			ListDeadline:     kwfs.Cache.timeouts.listDeadline().String(),
+			ListTimeout:      kwfs.ListTimeout.String(),
+			ControlTimeout:   kwfs.ControlTimeout.String(),
+			CacheTimeout:     kwfs.Cache.freshThreshold().String(),
+			MaxStale:         kwfs.Cache.MaxStale().String(),
+			OnBackendError:   string(kwfs.Cache.errorPolicy),
+			CacheMode:        kwfs.Cache.Mode(),
+			Uid:              kwfs.Ownership.Uid,
+			Gid:              kwfs.Ownership.Gid,
+			WriteThrough:     kwfs.WriteThrough,
+			DirectIO:         kwfs.DirectIO,
+			EnforceOwnership: kwfs.EnforceOwnership,
+			ProcessPolicy:    kwfs.Policy != nil,
+			AuditLog:         kwfs.Audit != nil,
+			Filter:           kwfs.Filter != nil,
+			Faults:           kwfs.Faults != nil,
+			JSONFields:       kwfs.JSONFields,
+			JSONDir:          !kwfs.HideJSON,
+			ControlFiles:     kwfs.ControlFiles.String(),
+			Templates:        []string{},
+			HealthThreshold:  kwfs.HealthThreshold.String(),
+			Debug:            kwfs.DebugEnabled(),
+		},
+	}
+	if info.Settings == nil {
+		info.Settings = map[string]interface{}{}
+	}
+	if kwfs.Client != nil {
+		conn := kwfs.Client.current()
+		info.Runtime.ServerURL = redactURL(conn.url.String())
+		info.Runtime.Timeout = conn.params.timeout.String()
+	}
+	for name := range kwfs.Templates {
+		info.Runtime.Templates = append(info.Runtime.Templates, name)
+	}
+	sort.Strings(info.Runtime.Templates)
+
+	config, err := json.Marshal(info)
+	panicOnError(err)
+	return config
+}
+
+// metricsJSON returns the process metrics followed by per-secret access statistics.
 func (kwfs KeywhizFs) metricsJSON() []byte {
 	if kwfs.Metrics != nil {
 		metrics := kwfs.Metrics.SerializeMetrics()
+
+		var names []string
+		for _, s := range kwfs.Cache.SecretList() {
+			names = append(names, s.Name)
+		}
+		// Serialized like the process metrics, with the same prefix and hostname.
+		access := *kwfs.Metrics
+		access.Registry = kwfs.Opens.Registry(names)
+		metrics = append(metrics, access.SerializeMetrics()...)
+
 		data, err := json.Marshal(metrics)
 		if err == nil {
 			return data
@@ -118,20 +272,97 @@ func (kwfs KeywhizFs) profile(name string) []byte {
 	return b.Bytes()
 }
 
-// NewKeywhizFs readies a KeywhizFs struct and its parent filesystem objects.
-func NewKeywhizFs(client *Client, ownership Ownership, timeouts Timeouts, metrics *sqmetrics.SquareMetrics, logConfig log.Config) (kwfs *KeywhizFs, root nodefs.Node, err error) {
+// NewKeywhizFs readies a KeywhizFs struct and its parent filesystem objects. Secrets are served
+// from backend, which is usually the client itself. The client also serves the control files
+// which are specific to a Keywhiz server, such as .health and .json/groups, and may be nil for
+// other backends, in which case those files don't exist.
+func NewKeywhizFs(client *Client, backend SecretBackend, ownership Ownership, timeouts Timeouts, metrics *sqmetrics.SquareMetrics, logConfig log.Config) (kwfs *KeywhizFs, root nodefs.Node, err error) {
 	logger := log.New("kwfs", logConfig)
-	cache := NewCache(client, timeouts, logConfig, nil)
+	cache := NewCache(backend, timeouts, logConfig, nil)
+	if metrics != nil {
+		cache.SetMetrics(metrics.Registry)
+	}
 
 	defaultfs := pathfs.NewDefaultFileSystem()            // Returns ENOSYS by default
 	readonlyfs := pathfs.NewReadonlyFileSystem(defaultfs) // R/W calls return EPERM
 
-	kwfs = &KeywhizFs{readonlyfs, logger, client, cache, metrics, time.Now(), ownership, 2 * timeouts.MaxWait}
+	kwfs = &KeywhizFs{
+		FileSystem:      readonlyfs,
+		Logger:          logger,
+		Client:          client,
+		Cache:           cache,
+		Metrics:         metrics,
+		StartTime:       time.Now(),
+		Ownership:       ownership,
+		Timeout:         2 * timeouts.MaxWait,
+		ListTimeout:     2 * timeouts.listWait(),
+		ControlTimeout:  2 * timeouts.controlWait(),
+		Opens:           NewAccessStats(),
+		HealthThreshold: defaultHealthThreshold,
+		dirAttrs:        newDirAttrCache(dirAttrTTL, nil),
+	}
+	cache.OnChange(func(change SecretChange) { kwfs.dirAttrs.Forget(change.Name) })
 	nfs := pathfs.NewPathNodeFs(kwfs, nil)
 	nfs.SetDebug(logConfig.Debug)
+	kwfs.nodeFs = nfs
 	return kwfs, nfs.Root(), nil
 }
 
+// NotifyChanges makes the kernel drop cached attributes and content of secrets when a refresh
+// detects they changed, so readers see new content without a remount. Must only be called once
+// the filesystem is mounted.
+func (kwfs KeywhizFs) NotifyChanges() {
+	kwfs.Cache.OnChange(kwfs.invalidate)
+}
+
+// invalidate notifies the kernel that a secret changed.
+func (kwfs KeywhizFs) invalidate(change SecretChange) {
+	var status fuse.Status
+	if change.Deleted {
+		status = notifyDeleted(kwfs.nodeFs, change.Name)
+	} else {
+		status = kwfs.nodeFs.Notify(change.Name)
+	}
+	kwfs.Debugf("Invalidated kernel cache for '%v': %v", change.Name, status)
+}
+
+// notifyDeleted tells the kernel that name was removed. When the kernel knows the file, it is
+// unlinked rather than merely forgotten, so open directories behave and inotify watchers on
+// the directory see it deleted; otherwise its entry is invalidated.
+func notifyDeleted(nfs *pathfs.PathNodeFs, name string) fuse.Status {
+	dir, base := "", name
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		dir, base = name[:i], name[i+1:]
+	}
+	parent, child := nfs.Node(dir), nfs.Node(name)
+	if parent == nil || child == nil {
+		return nfs.EntryNotify(dir, base)
+	}
+	return nfs.Connector().DeleteNotify(parent, child, base)
+}
+
+// isControlFile returns true for the control files and directories, such as .json/status, which
+// are named with a leading dot.
+func isControlFile(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// opTimeout returns how long an operation on the named file may take.
+func (kwfs KeywhizFs) opTimeout(name string) time.Duration {
+	if isControlFile(name) {
+		return kwfs.ControlTimeout
+	}
+	return kwfs.Timeout
+}
+
+// dirTimeout returns how long listing the named directory may take.
+func (kwfs KeywhizFs) dirTimeout(name string) time.Duration {
+	if isControlFile(name) {
+		return kwfs.ControlTimeout
+	}
+	return kwfs.ListTimeout
+}
+
 // GetAttr is a FUSE function which tells FUSE which files and directories exist.
 //
 // name is empty when getting information on the base directory
@@ -140,85 +371,187 @@ func (kwfs KeywhizFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, f
 		*fuse.Attr
 		fuse.Status
 	})
+	op := kwfs.startOp("GetAttr", name, context)
 	go func() {
-		attr, status := kwfs.getAttr(name, context)
-		ret <- struct {
+		var out struct {
 			*fuse.Attr
 			fuse.Status
-		}{attr, status}
+		}
+		defer func() { ret <- out }()
+		defer kwfs.recoverPanic("GetAttr", name, &out.Status)
+		out.Attr, out.Status = kwfs.getAttr(name, context, op.span)
 	}()
 	select {
 	case out := <-ret:
+		kwfs.endOp(op, out.Status)
+		if out.Status == fuse.OK {
+			kwfs.withInode(name, out.Attr)
+		}
 		return out.Attr, out.Status
-	case <-time.After(kwfs.Timeout):
+	case <-time.After(kwfs.opTimeout(name)):
 		kwfs.Errorf("Operation timed out: GetAttr(\"%s\", %s)", name, prettyContext(context))
 		kwfs.logGoroutines()
+		kwfs.endOp(op, fuse.EIO)
 		return nil, fuse.EIO
 	}
 }
 
-func (kwfs KeywhizFs) getAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+func (kwfs KeywhizFs) getAttr(name string, context *fuse.Context, span *Span) (*fuse.Attr, fuse.Status) {
 	kwfs.Debugf("GetAttr called with '%v'", name)
 
 	var attr *fuse.Attr
 	switch {
+	case kwfs.hidden(name):
+		return nil, fuse.ENOENT
 	case name == "": // Base directory
 		attr = kwfs.directoryAttr(1, 0755) // Writability necessary for .clear_cache
 	case name == ".version":
 		size := uint64(len(fsVersion))
 		attr = kwfs.fileAttr(size, 0444)
-	case name == ".clear_cache":
+	case name == ".buildinfo":
+		size := uint64(len(buildInfoJSON()))
+		attr = kwfs.fileAttr(size, 0444)
+	case name == ".clear_cache", name == ".reload":
 		attr = kwfs.fileAttr(0, 0440)
 	case name == ".running":
 		size := uint64(len(running()))
 		attr = kwfs.fileAttr(size, 0444)
+	case name == ".health" && kwfs.Client != nil:
+		data, ok := kwfs.health()
+		if !ok {
+			return nil, fuse.EIO
+		}
+		attr = kwfs.fileAttr(uint64(len(data)), 0444)
 	case name == ".json":
-		attr = kwfs.directoryAttr(1, 0700)
+		attr = kwfs.directoryAttr(2, 0700)
+	case name == ".fuse" && kwfs.Tuning != nil:
+		attr = kwfs.directoryAttr(0, 0755)
+	case name == ".refresh":
+		attr = kwfs.directoryAttr(0, 0755) // Writability necessary for unlinking
+	case strings.HasPrefix(name, ".refresh/"):
+		sname := name[len(".refresh/"):]
+		if kwfs.Cache.IsDirectory(sname) {
+			attr = kwfs.directoryAttr(0, 0755)
+		} else if _, ok := kwfs.Cache.Secret(sname); ok {
+			attr = kwfs.fileAttr(0, 0440)
+		}
+	case strings.HasPrefix(name, ".fuse/"):
+		data, ok := kwfs.tuningValue(name)
+		if ok {
+			attr = kwfs.fileAttr(uint64(len(data)), 0644)
+		}
+	case name == ".faults" && kwfs.Faults != nil:
+		attr = kwfs.directoryAttr(0, 0755)
+	case strings.HasPrefix(name, ".faults/") && kwfs.Faults != nil:
+		sname := name[len(".faults/"):]
+		if kwfs.Cache.IsDirectory(sname) {
+			attr = kwfs.directoryAttr(0, 0755)
+		} else if _, ok := kwfs.Cache.Secret(sname); ok {
+			attr = kwfs.fileAttr(uint64(len(kwfs.faultValue(name))), 0644)
+		}
+	case name == ".loglevel":
+		attr = kwfs.fileAttr(uint64(len(kwfs.logLevel())), 0644)
 	case name == ".json/status":
 		size := uint64(len(kwfs.statusJSON()))
 		attr = kwfs.fileAttr(size, 0444)
 	case name == ".json/metrics":
 		size := uint64(len(kwfs.metricsJSON()))
 		attr = kwfs.fileAttr(size, 0444)
-	case name == ".json/secret":
+	case name == ".json/config":
+		size := uint64(len(kwfs.configJSON()))
+		attr = kwfs.fileAttr(size, 0400)
+	case name == ".json/cert_status" && kwfs.Client != nil:
+		size := uint64(len(kwfs.certStatusJSON()))
+		attr = kwfs.fileAttr(size, 0444)
+	case name == ".json/changes":
+		size := uint64(len(kwfs.changesJSON()))
+		attr = kwfs.fileAttr(size, 0400)
+	case name == ".json/secret" && kwfs.online():
 		attr = kwfs.directoryAttr(0, 0700)
-	case name == ".json/secrets":
-		data, ok := kwfs.Client.RawSecretList()
+	case name == ".json/secrets" && kwfs.online():
+		data, ok := kwfs.rawSecretList()
 		if ok {
 			size := uint64(len(data))
 			attr = kwfs.fileAttr(size, 0400)
 		}
-	case name == ".json/server_status":
+	case name == ".json/server_status" && kwfs.online():
 		data, err := kwfs.Client.ServerStatus()
 		if err == nil {
 			size := uint64(len(data))
 			attr = kwfs.fileAttr(size, 0444)
 		}
-	case strings.HasPrefix(name, ".json/secret/"):
+	case name == ".json/group" && kwfs.online():
+		attr = kwfs.directoryAttr(0, 0700)
+	case name == ".json/groups" && kwfs.online():
+		data, ok := kwfs.Client.RawGroupList()
+		if ok {
+			size := uint64(len(data))
+			attr = kwfs.fileAttr(size, 0400)
+		}
+	case strings.HasPrefix(name, ".json/group/") && kwfs.online():
+		gname := name[len(".json/group/"):]
+		data, err := kwfs.Client.RawGroup(gname)
+		if err == nil {
+			size := uint64(len(data))
+			attr = kwfs.fileAttr(size, 0400)
+		}
+	case strings.HasPrefix(name, ".json/secret/") && kwfs.online():
 		sname := name[len(".json/secret/"):]
-		data, err := kwfs.Client.RawSecret(sname)
+		data, err := kwfs.rawSecret(sname)
 		if err == nil {
 			size := uint64(len(data))
 			attr = kwfs.fileAttr(size, 0400)
 		}
 	case name == ".pprof":
 		attr = kwfs.directoryAttr(1, 0700)
-	case name == ".pprof/heap":
-		size := uint64(len(kwfs.profile("heap")))
-		attr = kwfs.fileAttr(size, 0444)
-	case name == ".pprof/goroutine":
-		size := uint64(len(kwfs.profile("goroutine")))
-		attr = kwfs.fileAttr(size, 0444)
-	case name == ".pprof/threadcreate":
-		size := uint64(len(kwfs.profile("threadcreate")))
-		attr = kwfs.fileAttr(size, 0444)
-	case name == ".pprof/block":
-		size := uint64(len(kwfs.profile("block")))
-		attr = kwfs.fileAttr(size, 0444)
+	case strings.HasPrefix(name, ".pprof/"):
+		// Profiles are only collected when read, so their size is unknown.
+		if _, _, ok := profileRequest(name[len(".pprof/"):]); ok {
+			attr = kwfs.fileAttr(0, 0444)
+		}
+	case kwfs.Templates[name] != nil:
+		data, status := kwfs.render(name, context)
+		if status != fuse.OK {
+			return nil, status
+		}
+		attr = kwfs.fileAttr(uint64(len(data)), kwfs.Templates[name].Mode)
 	default:
-		secret, ok := kwfs.Cache.Secret(name)
+		if secretName, path, ok := kwfs.jsonFieldPath(name); ok {
+			secret, value, status := kwfs.field(secretName, path, context)
+			if status != fuse.OK {
+				return nil, status
+			}
+			return kwfs.fieldAttr(secret, value), fuse.OK
+		}
+		if kwfs.Cache.IsDirectory(name) {
+			attr = kwfs.directoryAttr(0, 0755)
+			break
+		}
+		if target, ok := kwfs.Cache.Alias(name); ok {
+			attr = kwfs.symlinkAttr(target)
+			break
+		}
+		// Attributes come from the listing when possible, so that listing a directory with
+		// attributes doesn't fetch every secret in it: first those gathered when the directory
+		// was opened, then those of a fresh listing.
+		if listed, ok := kwfs.dirAttrs.Get(name); ok {
+			span.SetAttribute("keywhiz.cache.listing", true)
+			attr = listed
+			break
+		}
+		fault := kwfs.Faults.Apply(name)
+		secret, ok := kwfs.Cache.ListedSecret(name)
+		if ok {
+			span.SetAttribute("keywhiz.cache.listing", true)
+		} else if fault.Stale {
+			secret, ok = kwfs.Cache.CachedSecret(name)
+		} else {
+			secret, ok = kwfs.Cache.TracedSecret(name, span)
+		}
 		if ok {
 			attr = kwfs.secretAttr(secret)
+		} else if status := kwfs.unavailableStatus(name); status != fuse.ENOENT {
+			return nil, status
 		}
 	}
 
@@ -228,76 +561,291 @@ func (kwfs KeywhizFs) getAttr(name string, context *fuse.Context) (*fuse.Attr, f
 	return nil, fuse.ENOENT
 }
 
+// hidden returns true for files which don't exist by configuration: the .json directory and
+// everything in it with HideJSON, and the control files of the cache when disabled.
+func (kwfs KeywhizFs) hidden(name string) bool {
+	if kwfs.ControlFiles.Disabled && isCacheControl(name) {
+		return true
+	}
+	return kwfs.HideJSON && (name == ".json" || strings.HasPrefix(name, ".json/"))
+}
+
+// unavailableStatus returns the error for a secret which couldn't be served: EACCES if the
+// backend refused access to it, EIO if it failed (see Cache.Failed), and ENOENT otherwise.
+func (kwfs KeywhizFs) unavailableStatus(name string) fuse.Status {
+	switch {
+	case kwfs.Cache.Denied(name):
+		return fuse.EACCES
+	case kwfs.Cache.Failed(name):
+		return fuse.EIO
+	}
+	return fuse.ENOENT
+}
+
+// Readlink is a FUSE function which resolves secret aliases to the canonical secret file.
+func (kwfs KeywhizFs) Readlink(name string, context *fuse.Context) (target string, status fuse.Status) {
+	defer kwfs.recoverPanic("Readlink", name, &status)
+	kwfs.Debugf("Readlink called with '%v'", name)
+	if target, ok := kwfs.Cache.Alias(name); ok {
+		return target, fuse.OK
+	}
+	return "", fuse.ENOENT
+}
+
+// Extended attributes describing the content of secret files.
+const (
+	xattrEncoding    = "user.keywhiz.encoding"
+	xattrContentType = "user.keywhiz.content_type"
+)
+
+// GetXAttr is a FUSE function called to read an extended attribute. Secrets report how their
+// content was encoded by the server and the type detected from the decoded content.
+func (kwfs KeywhizFs) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, status fuse.Status) {
+	defer kwfs.recoverPanic("GetXAttr", name, &status)
+	kwfs.Debugf("GetXAttr called with '%v', '%v'", name, attribute)
+	secret, status := kwfs.xattrSecret(name)
+	if status != fuse.OK {
+		return nil, status
+	}
+	switch attribute {
+	case xattrEncoding:
+		return []byte(secret.Content.Encoding()), fuse.OK
+	case xattrContentType:
+		return []byte(secret.Content.ContentType()), fuse.OK
+	}
+	return nil, fuse.ENOATTR
+}
+
+// ListXAttr is a FUSE function called to list extended attributes.
+func (kwfs KeywhizFs) ListXAttr(name string, context *fuse.Context) (attributes []string, status fuse.Status) {
+	defer kwfs.recoverPanic("ListXAttr", name, &status)
+	kwfs.Debugf("ListXAttr called with '%v'", name)
+	if _, status := kwfs.xattrSecret(name); status != fuse.OK {
+		return nil, status
+	}
+	return []string{xattrEncoding, xattrContentType}, fuse.OK
+}
+
+// xattrSecret returns the secret whose attributes are requested. Special files, directories
+// and aliases have no extended attributes.
+func (kwfs KeywhizFs) xattrSecret(name string) (*Secret, fuse.Status) {
+	if name == "" || strings.HasPrefix(name, ".") || kwfs.Cache.IsDirectory(name) {
+		return nil, fuse.ENOATTR
+	}
+	if _, ok := kwfs.Cache.Alias(name); ok {
+		return nil, fuse.ENOATTR
+	}
+	secret, ok := kwfs.Cache.Secret(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return secret, fuse.OK
+}
+
 // Open is a FUSE function where an in-memory open file struct is constructed.
 func (kwfs KeywhizFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	ret := make(chan struct {
 		nodefs.File
 		fuse.Status
 	})
+	op := kwfs.startOp("Open", name, context)
 	go func() {
-		file, status := kwfs.open(name, flags, context)
-		ret <- struct {
+		var out struct {
 			nodefs.File
 			fuse.Status
-		}{file, status}
+		}
+		defer func() { ret <- out }()
+		defer kwfs.recoverPanic("Open", name, &out.Status)
+		out.File, out.Status = kwfs.open(name, flags, context, op.span)
 	}()
 	select {
 	case out := <-ret:
-		return out.File, out.Status
-	case <-time.After(kwfs.Timeout):
+		kwfs.endOp(op, out.Status)
+		if out.Status != fuse.OK {
+			return nil, out.Status
+		}
+		return kwfs.withOpenFlags(kwfs.withFileInode(name, kwfs.withRecovery(name, out.File))), fuse.OK
+	case <-time.After(kwfs.opTimeout(name)):
 		kwfs.Errorf("Operation timed out: Open(\"%s\", %d, %s)", name, flags, prettyContext(context))
 		kwfs.logGoroutines()
+		kwfs.endOp(op, fuse.EIO)
 		return nil, fuse.EIO
 	}
 }
 
-func (kwfs KeywhizFs) open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+// withOpenFlags sets the FUSE flags for an opened file.
+func (kwfs KeywhizFs) withOpenFlags(file nodefs.File) nodefs.File {
+	if !kwfs.DirectIO {
+		return file
+	}
+	return &nodefs.WithFlags{File: file, FuseFlags: fuse.FOPEN_DIRECT_IO}
+}
+
+func (kwfs KeywhizFs) open(name string, flags uint32, context *fuse.Context, span *Span) (nodefs.File, fuse.Status) {
 	kwfs.Debugf("Open called with '%v'", name)
 
+	if kwfs.hidden(name) {
+		return nil, fuse.ENOENT
+	}
+	if flags&fuse.O_ANYWRITE != 0 {
+		if strings.HasPrefix(name, ".fuse/") {
+			return kwfs.openTuning(name, flags, context)
+		}
+		if strings.HasPrefix(name, ".faults/") && kwfs.Faults != nil {
+			return kwfs.openFault(name, flags, context)
+		}
+		if name == ".loglevel" {
+			return kwfs.openLogLevel(name, flags, context)
+		}
+		if kwfs.WriteThrough {
+			return kwfs.openForWrite(name, flags, context, span)
+		}
+	}
+
 	var file nodefs.File
 	switch {
-	case name == "", name == ".json", name == ".json/secret", name == ".pprof":
+	case name == "", name == ".json", name == ".json/secret", name == ".json/group", name == ".pprof":
 		return nil, fuseEISDIR
+	case name == ".fuse" && kwfs.Tuning != nil, name == ".refresh", name == ".faults" && kwfs.Faults != nil:
+		return nil, fuseEISDIR
+	case strings.HasPrefix(name, ".faults/") && kwfs.Faults != nil:
+		attr, status := kwfs.getAttr(name, context, nil)
+		if status != fuse.OK {
+			return nil, status
+		}
+		if attr.IsDir() {
+			return nil, fuseEISDIR
+		}
+		file = newSecretFile(kwfs.faultValue(name))
+	case strings.HasPrefix(name, ".refresh/"):
+		attr, status := kwfs.getAttr(name, context, nil)
+		if status != fuse.OK {
+			return nil, status
+		}
+		if attr.IsDir() {
+			return nil, fuseEISDIR
+		}
+		file = nodefs.NewDevNullFile()
+	case strings.HasPrefix(name, ".fuse/"):
+		data, ok := kwfs.tuningValue(name)
+		if ok {
+			file = newSecretFile(data)
+		}
 	case name == ".version":
-		file = nodefs.NewDataFile([]byte(fsVersion))
+		file = newSecretFile([]byte(fsVersion))
+	case name == ".buildinfo":
+		file = newSecretFile(buildInfoJSON())
+	case name == ".loglevel":
+		file = newSecretFile(kwfs.logLevel())
 	case name == ".json/status":
-		file = nodefs.NewDataFile(kwfs.statusJSON())
+		file = newSecretFile(kwfs.statusJSON())
 	case name == ".json/metrics":
-		file = nodefs.NewDataFile(kwfs.metricsJSON())
-	case name == ".clear_cache":
+		file = newSecretFile(kwfs.metricsJSON())
+	case name == ".json/config":
+		file = newSecretFile(kwfs.configJSON())
+	case name == ".json/cert_status" && kwfs.Client != nil:
+		file = newSecretFile(kwfs.certStatusJSON())
+	case name == ".json/changes":
+		file = newSecretFile(kwfs.changesJSON())
+	case name == ".clear_cache", name == ".reload":
 		file = nodefs.NewDevNullFile()
 	case name == ".running":
-		file = nodefs.NewDataFile(running())
-	case name == ".json/secrets":
-		data, ok := kwfs.Client.RawSecretList()
+		file = newSecretFile(running())
+	case name == ".health" && kwfs.Client != nil:
+		data, _ := kwfs.health()
+		file = newSecretFile(data)
+	case name == ".json/secrets" && kwfs.online():
+		data, ok := kwfs.rawSecretList()
 		if ok {
-			file = nodefs.NewDataFile(data)
+			file = newSecretFile(data)
 		}
-	case name == ".json/server_status":
+	case name == ".json/server_status" && kwfs.online():
 		data, err := kwfs.Client.ServerStatus()
 		if err == nil {
-			file = nodefs.NewDataFile(data)
+			file = newSecretFile(data)
+		}
+	case name == ".json/groups" && kwfs.online():
+		data, ok := kwfs.Client.RawGroupList()
+		if ok {
+			file = newSecretFile(data)
+		}
+	case strings.HasPrefix(name, ".json/group/") && kwfs.online():
+		data, err := kwfs.Client.RawGroup(name[len(".json/group/"):])
+		if err == nil {
+			file = newSecretFile(data)
 		}
-	case strings.HasPrefix(name, ".json/secret/"):
+	case strings.HasPrefix(name, ".json/secret/") && kwfs.online():
 		sname := name[len(".json/secret/"):]
-		data, err := kwfs.Client.RawSecret(sname)
+		if !kwfs.secretAllowed(sname, context) {
+			kwfs.Warnf("Denied access to %s by uid %d, with gid %d", sname, context.Uid, context.Gid)
+			kwfs.Audit.RecordRequest(sname, context, span.RequestID(), false, false)
+			return nil, fuse.EACCES
+		}
+		data, err := kwfs.rawSecret(sname)
 		if err == nil {
-			file = nodefs.NewDataFile(data)
+			file = newSecretFile(data)
 			kwfs.Debugf("Access to %s by uid %d, with gid %d", sname, context.Uid, context.Gid)
+			kwfs.Audit.RecordRequest(sname, context, span.RequestID(), false, true)
+		}
+	case strings.HasPrefix(name, ".pprof/"):
+		return kwfs.openProfile(name, context)
+	case kwfs.Templates[name] != nil:
+		// Rendered once, so that attributes match the content served.
+		data, status := kwfs.render(name, context)
+		if status != fuse.OK {
+			return nil, status
 		}
-	case name == ".pprof/heap":
-		file = nodefs.NewDataFile(kwfs.profile("heap"))
-	case name == ".pprof/goroutine":
-		file = nodefs.NewDataFile(kwfs.profile("goroutine"))
-	case name == ".pprof/threadcreate":
-		file = nodefs.NewDataFile(kwfs.profile("threadcreate"))
-	case name == ".pprof/block":
-		file = nodefs.NewDataFile(kwfs.profile("block"))
+		return NewAttrFile(nodefs.NewReadOnlyFile(newSecretFile(data)), kwfs.fileAttr(uint64(len(data)), kwfs.Templates[name].Mode)), fuse.OK
 	default:
-		secret, ok := kwfs.Cache.Secret(name)
+		if secretName, path, ok := kwfs.jsonFieldPath(name); ok {
+			secret, value, status := kwfs.field(secretName, path, context)
+			if status != fuse.OK {
+				return nil, status
+			}
+			if isFieldDirectory(value) {
+				return nil, fuseEISDIR
+			}
+			kwfs.Debugf("Access to %s by uid %d, with gid %d", secretName, context.Uid, context.Gid)
+			kwfs.Audit.RecordRequest(secretName, context, span.RequestID(), false, true)
+			kwfs.Opens.Record(secretName)
+			return NewAttrFile(nodefs.NewReadOnlyFile(newSecretFile(fieldContent(value))), kwfs.fieldAttr(secret, value)), fuse.OK
+		}
+		if kwfs.Cache.IsDirectory(name) {
+			return nil, fuseEISDIR
+		}
+		fault := kwfs.Faults.Apply(name)
+		if fault.EIO {
+			return nil, fuse.EIO
+		}
+		var secret *Secret
+		var ok bool
+		if fault.Stale {
+			secret, ok = kwfs.Cache.CachedSecret(name)
+		} else {
+			secret, ok = kwfs.Cache.TracedSecret(name, span)
+		}
+		if !ok {
+			if status := kwfs.unavailableStatus(name); status != fuse.ENOENT {
+				return nil, status
+			}
+		}
+		if ok && !kwfs.allowed(secret, context) {
+			kwfs.Warnf("Denied access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+			kwfs.Audit.RecordRequest(name, context, span.RequestID(), false, false)
+			return nil, fuse.EACCES
+		}
 		if ok {
-			file = nodefs.NewDataFile(secret.Content)
 			kwfs.Debugf("Access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+			kwfs.Audit.RecordRequest(name, context, span.RequestID(), false, true)
+			kwfs.Opens.Record(name)
+			// The handle is pinned to the content as of now, with attributes to match, so a
+			// refresh while it is read can't change its length or bytes. The next open sees
+			// the new content.
+			data := secret.Content.Bytes()
+			kwfs.Cache.recordServed(len(data))
+			attr := kwfs.secretAttr(secret)
+			attr.Size = uint64(len(data))
+			return NewAttrFile(nodefs.NewReadOnlyFile(newSecretFile(data)), attr), fuse.OK
 		}
 	}
 
@@ -314,29 +862,228 @@ func (kwfs KeywhizFs) open(name string, flags uint32, context *fuse.Context) (no
 	return nil, fuse.ENOENT
 }
 
+// openForWrite opens a secret file whose content is sent to the server when flushed. Only
+// secrets may be written; special files are always read-only.
+func (kwfs KeywhizFs) openForWrite(name string, flags uint32, context *fuse.Context, span *Span) (nodefs.File, fuse.Status) {
+	if strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		return nil, fuse.EPERM
+	}
+
+	secret, ok := kwfs.Cache.Secret(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	if !kwfs.allowed(secret, context) {
+		kwfs.Warnf("Denied write access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+		kwfs.Audit.RecordRequest(name, context, span.RequestID(), true, false)
+		return nil, fuse.EACCES
+	}
+
+	content := secret.Content.Bytes()
+	if flags&uint32(os.O_TRUNC) != 0 {
+		content = nil
+	}
+	kwfs.Infof("Write access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+	kwfs.Audit.RecordRequest(name, context, span.RequestID(), true, true)
+	kwfs.Opens.Record(name)
+	return newWritableFile(name, content, kwfs.secretAttr(secret), kwfs.writeSecret), fuse.OK
+}
+
+// openTuning opens a file under .fuse/ for writing. A number written to it is applied to the
+// corresponding kernel setting when the file is flushed.
+func (kwfs KeywhizFs) openTuning(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	attr, status := kwfs.getAttr(name, context, nil)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	content, _ := kwfs.tuningValue(name)
+	if flags&uint32(os.O_TRUNC) != 0 {
+		content = nil
+	}
+	return newWritableFile(name, content, attr, kwfs.setTuning), fuse.OK
+}
+
+// openFault opens a file under .faults/ for writing. Faults written to it, as parsed by
+// ParseFault, are injected into access to the secret of the same name when the file is flushed.
+func (kwfs KeywhizFs) openFault(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	attr, status := kwfs.getAttr(name, context, nil)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if attr.IsDir() {
+		return nil, fuseEISDIR
+	}
+
+	content := kwfs.faultValue(name)
+	if flags&uint32(os.O_TRUNC) != 0 {
+		content = nil
+	}
+	return newWritableFile(name, content, attr, kwfs.setFault), fuse.OK
+}
+
+// faultValue returns the faults injected for a secret as the content of its file under .faults/.
+func (kwfs KeywhizFs) faultValue(name string) []byte {
+	return []byte(kwfs.Faults.Get(name[len(".faults/"):]).String() + "\n")
+}
+
+// setFault applies faults written to a file under .faults/.
+func (kwfs KeywhizFs) setFault(name string, content []byte) fuse.Status {
+	fault, err := ParseFault(string(content))
+	if err != nil {
+		kwfs.Warnf("Invalid fault for %s: %v", name, err)
+		return fuse.EINVAL
+	}
+	sname := name[len(".faults/"):]
+	kwfs.Faults.Set(sname, fault)
+	kwfs.Warnf("Injecting faults into access to %s: %s", sname, fault)
+	return fuse.OK
+}
+
+// openLogLevel opens .loglevel for writing. "debug" or "info" written to it changes the log
+// verbosity of the whole process when the file is flushed.
+func (kwfs KeywhizFs) openLogLevel(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	attr, status := kwfs.getAttr(name, context, nil)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	content := kwfs.logLevel()
+	if flags&uint32(os.O_TRUNC) != 0 {
+		content = nil
+	}
+	return newWritableFile(name, content, attr, kwfs.setLogLevel), fuse.OK
+}
+
+// logLevel returns the current log verbosity as the content of .loglevel.
+func (kwfs KeywhizFs) logLevel() []byte {
+	if kwfs.DebugEnabled() {
+		return []byte(log.LevelDebug + "\n")
+	}
+	return []byte(log.LevelInfo + "\n")
+}
+
+// setLogLevel applies a log verbosity written to .loglevel.
+func (kwfs KeywhizFs) setLogLevel(name string, content []byte) fuse.Status {
+	switch level := strings.TrimSpace(string(content)); level {
+	case log.LevelDebug, log.LevelInfo:
+		log.SetDebug(level == log.LevelDebug)
+		kwfs.Infof("Log level set to %s", level)
+	default:
+		return fuse.EINVAL
+	}
+	return fuse.OK
+}
+
+// tuningValue returns the current value of a FUSE setting under .fuse/ as file content.
+func (kwfs KeywhizFs) tuningValue(name string) ([]byte, bool) {
+	if kwfs.Tuning == nil {
+		return nil, false
+	}
+	value, err := kwfs.Tuning.Get(name[len(".fuse/"):])
+	if err != nil {
+		kwfs.Debugf("Unable to read %s: %v", name, err)
+		return nil, false
+	}
+	return []byte(strconv.Itoa(value) + "\n"), true
+}
+
+// setTuning applies a value written to a file under .fuse/.
+func (kwfs KeywhizFs) setTuning(name string, content []byte) fuse.Status {
+	value, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || value <= 0 || value > 65535 {
+		return fuse.EINVAL
+	}
+	if err := kwfs.Tuning.Set(name[len(".fuse/"):], value); err != nil {
+		kwfs.Errorf("Error setting %s: %v", name, err)
+		return fuse.EIO
+	}
+	kwfs.Infof("Set %s to %d", name, value)
+	return fuse.OK
+}
+
+// writeSecret sends new secret content to the server and updates the cache on success.
+func (kwfs KeywhizFs) writeSecret(name string, content []byte) fuse.Status {
+	if kwfs.Client == nil {
+		return fuse.EPERM
+	}
+	if !kwfs.Cache.Online() {
+		return fuse.EROFS
+	}
+	if err := kwfs.Client.WriteSecret(name, content); err != nil {
+		return fuse.EIO
+	}
+	kwfs.Cache.Update(name, content)
+	kwfs.dirAttrs.Forget(name)
+	return fuse.OK
+}
+
 // OpenDir is a FUSE function called when performing a directory listing.
 func (kwfs KeywhizFs) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
 	ret := make(chan struct {
 		Stream []fuse.DirEntry
 		Status fuse.Status
 	})
+	op := kwfs.startOp("OpenDir", name, context)
 	go func() {
-		stream, status := kwfs.openDir(name, context)
-		ret <- struct {
+		var out struct {
 			Stream []fuse.DirEntry
 			Status fuse.Status
-		}{stream, status}
+		}
+		defer func() { ret <- out }()
+		defer kwfs.recoverPanic("OpenDir", name, &out.Status)
+		out.Stream, out.Status = kwfs.openDir(name, context)
 	}()
 	select {
 	case out := <-ret:
+		kwfs.endOp(op, out.Status)
 		return out.Stream, out.Status
-	case <-time.After(kwfs.Timeout):
+	case <-time.After(kwfs.dirTimeout(name)):
 		kwfs.Errorf("Operation timed out: OpenDir(\"%s\", %s)", name, prettyContext(context))
 		kwfs.logGoroutines()
+		kwfs.endOp(op, fuse.EIO)
 		return nil, fuse.EIO
 	}
 }
 
+// fsOp is a FUSE operation in progress.
+type fsOp struct {
+	op, name string
+	uid      uint32
+	start    time.Time
+	span     *Span
+}
+
+// startOp starts a FUSE operation, with a span recording it if tracing, and otherwise one
+// carrying its request ID only. Names are hashed in spans, since traces are exported.
+func (kwfs KeywhizFs) startOp(op, name string, context *fuse.Context) fsOp {
+	o := fsOp{op: op, name: name, start: time.Now()}
+	if context != nil {
+		o.uid = context.Uid
+	}
+	if kwfs.Tracer != nil {
+		o.span = kwfs.Tracer.StartSpan(nil, "fuse."+op)
+		o.span.SetAttribute("fuse.op", op)
+		o.span.SetAttribute("keywhiz.name_hash", traceHash(name))
+	} else {
+		o.span = newRequestSpan()
+	}
+	return o
+}
+
+// endOp logs a FUSE operation at debug level and finishes its span with the result.
+func (kwfs KeywhizFs) endOp(o fsOp, status fuse.Status) {
+	duration := time.Since(o.start)
+	fields := log.Fields{"op": o.op, "secret": o.name, "status": status.String(), "duration": duration, "request_id": o.span.RequestID(), "uid": o.uid}
+	kwfs.Log(log.LevelDebug, fields, "%s('%v') %v %v [%s]", o.op, o.name, status, duration, o.span.RequestID())
+
+	o.span.SetAttribute("fuse.status", status.String())
+	if status != fuse.OK && status != fuse.ENOENT {
+		o.span.SetError(status.String())
+	}
+	o.span.End()
+}
+
 func (kwfs KeywhizFs) logGoroutines() {
 	var buffer bytes.Buffer
 	profile := pprof.Lookup("goroutine")
@@ -355,31 +1102,108 @@ func (kwfs KeywhizFs) logGoroutines() {
 func (kwfs KeywhizFs) openDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
 	kwfs.Debugf("OpenDir called with '%v'", name)
 
+	if kwfs.hidden(name) {
+		return nil, fuse.ENOENT
+	}
 	var entries []fuse.DirEntry
 	switch name {
 	case "": // Base directory
-		entries = kwfs.secretsDirListing(
-			fuse.DirEntry{Name: ".clear_cache", Mode: fuse.S_IFREG},
-			fuse.DirEntry{Name: ".json", Mode: fuse.S_IFDIR},
-			fuse.DirEntry{Name: ".pprof", Mode: fuse.S_IFDIR},
-			fuse.DirEntry{Name: ".running", Mode: fuse.S_IFREG},
-			fuse.DirEntry{Name: ".version", Mode: fuse.S_IFREG})
+		extras := []fuse.DirEntry{
+			{Name: ".buildinfo", Mode: fuse.S_IFREG},
+			{Name: ".loglevel", Mode: fuse.S_IFREG},
+			{Name: ".pprof", Mode: fuse.S_IFDIR},
+			{Name: ".running", Mode: fuse.S_IFREG},
+			{Name: ".version", Mode: fuse.S_IFREG},
+		}
+		if !kwfs.ControlFiles.Disabled {
+			extras = append(extras,
+				fuse.DirEntry{Name: ".clear_cache", Mode: fuse.S_IFREG},
+				fuse.DirEntry{Name: ".refresh", Mode: fuse.S_IFDIR},
+				fuse.DirEntry{Name: ".reload", Mode: fuse.S_IFREG})
+		}
+		if kwfs.Client != nil {
+			extras = append(extras, fuse.DirEntry{Name: ".health", Mode: fuse.S_IFREG})
+		}
+		if !kwfs.HideJSON {
+			extras = append(extras, fuse.DirEntry{Name: ".json", Mode: fuse.S_IFDIR})
+		}
+		if kwfs.Tuning != nil {
+			extras = append(extras, fuse.DirEntry{Name: ".fuse", Mode: fuse.S_IFDIR})
+		}
+		if kwfs.Faults != nil {
+			extras = append(extras, fuse.DirEntry{Name: ".faults", Mode: fuse.S_IFDIR})
+		}
+		for name := range kwfs.Templates {
+			extras = append(extras, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+		}
+		entries = kwfs.secretsDirListing(true, extras...)
 	case ".json":
 		entries = []fuse.DirEntry{
+			{Name: "changes", Mode: fuse.S_IFREG},
+			{Name: "config", Mode: fuse.S_IFREG},
 			{Name: "metrics", Mode: fuse.S_IFREG},
-			{Name: "secret", Mode: fuse.S_IFDIR},
-			{Name: "secrets", Mode: fuse.S_IFREG},
 			{Name: "status", Mode: fuse.S_IFREG},
-			{Name: "server_status", Mode: fuse.S_IFREG},
+		}
+		if kwfs.Client != nil {
+			entries = append(entries, fuse.DirEntry{Name: "cert_status", Mode: fuse.S_IFREG})
+		}
+		if kwfs.online() {
+			entries = append(entries,
+				fuse.DirEntry{Name: "group", Mode: fuse.S_IFDIR},
+				fuse.DirEntry{Name: "groups", Mode: fuse.S_IFREG},
+				fuse.DirEntry{Name: "secret", Mode: fuse.S_IFDIR},
+				fuse.DirEntry{Name: "secrets", Mode: fuse.S_IFREG},
+				fuse.DirEntry{Name: "server_status", Mode: fuse.S_IFREG})
 		}
 	case ".json/secret":
-		entries = kwfs.secretsDirListing()
+		entries = kwfs.secretsDirListing(false)
+	case ".refresh", ".faults":
+		if name == ".faults" && kwfs.Faults == nil {
+			break
+		}
+		// Like the base directory, without aliases: refreshing is by actual secret name.
+		for _, entry := range kwfs.secretsDirListing(true) {
+			if entry.Mode != fuse.S_IFLNK {
+				entries = append(entries, entry)
+			}
+		}
+	case ".fuse":
+		if kwfs.Tuning != nil {
+			for _, name := range fuseTunables {
+				entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+			}
+		}
+	case ".json/group":
+		if !kwfs.online() {
+			break
+		}
+		names, _ := kwfs.Client.GroupNames()
+		for _, name := range names {
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+		}
 	case ".pprof":
-		entries = []fuse.DirEntry{
-			fuse.DirEntry{Name: "heap", Mode: fuse.S_IFREG},
-			fuse.DirEntry{Name: "goroutine", Mode: fuse.S_IFREG},
-			fuse.DirEntry{Name: "threadcreate", Mode: fuse.S_IFREG},
-			fuse.DirEntry{Name: "block", Mode: fuse.S_IFREG},
+		entries = []fuse.DirEntry{{Name: "profile", Mode: fuse.S_IFREG}}
+		for _, profile := range runtimeProfiles {
+			entries = append(entries, fuse.DirEntry{Name: profile, Mode: fuse.S_IFREG})
+		}
+	default:
+		if secretName, path, ok := kwfs.jsonFieldPath(name); ok {
+			_, value, status := kwfs.field(secretName, path, context)
+			if status != fuse.OK {
+				return nil, status
+			}
+			if !isFieldDirectory(value) {
+				return nil, fuse.ENOTDIR
+			}
+			return fieldEntries(value), fuse.OK
+		}
+		if strings.HasPrefix(name, ".refresh/") {
+			name = name[len(".refresh/"):]
+		} else if strings.HasPrefix(name, ".faults/") && kwfs.Faults != nil {
+			name = name[len(".faults/"):]
+		}
+		if kwfs.Cache.IsDirectory(name) {
+			entries = kwfs.namespaceDirListing(name)
 		}
 	}
 
@@ -390,43 +1214,120 @@ func (kwfs KeywhizFs) openDir(name string, context *fuse.Context) (stream []fuse
 }
 
 // Unlink is a FUSE function called when an object is deleted.
-func (kwfs KeywhizFs) Unlink(name string, context *fuse.Context) fuse.Status {
+func (kwfs KeywhizFs) Unlink(name string, context *fuse.Context) (status fuse.Status) {
+	defer kwfs.recoverPanic("Unlink", name, &status)
 	kwfs.Debugf("Unlink called with '%v'", name)
-	if name == ".clear_cache" {
+	if kwfs.hidden(name) {
+		return fuse.ENOENT
+	}
+	if isCacheControl(name) && !kwfs.ControlFiles.Allowed(context) {
+		kwfs.Warnf("Denied unlinking %s with %s, control files are restricted to uid %d", name, prettyContext(context), kwfs.ControlFiles.Uid)
+		return fuse.EACCES
+	}
+	switch name {
+	case ".clear_cache":
 		kwfs.Cache.Clear()
+		kwfs.dirAttrs.Clear()
+		return fuse.OK
+	case ".reload":
+		kwfs.dirAttrs.Clear()
+		if err := kwfs.Cache.Reload(); err != nil {
+			kwfs.Errorf("Reload failed: %v", err)
+			return fuse.EIO
+		}
+		return fuse.OK
+	}
+	if strings.HasPrefix(name, ".refresh/") {
+		sname := name[len(".refresh/"):]
+		kwfs.dirAttrs.Forget(sname)
+		if err := kwfs.Cache.Refresh(sname); err != nil {
+			kwfs.Errorf("Refresh of '%s' failed: %v", sname, err)
+			return fuse.EIO
+		}
+		kwfs.Infof("Refreshed '%s' by uid %d", sname, context.Uid)
 		return fuse.OK
 	}
 	return fuse.EACCES
 }
 
 // StatFs is a FUSE function called to provide information about the filesystem
-// We return zeros, which makes "df" think this is a dummy fs, which it is.
+// We return zeros, which makes "df" think this is a dummy fs, which it is. A panic returns nil,
+// which fails the call.
 func (kwfs KeywhizFs) StatFs(name string) *fuse.StatfsOut {
+	status := fuse.OK
+	defer kwfs.recoverPanic("StatFs", name, &status)
 	kwfs.Debugf("StatFs called with '%v'", name)
 	return &fuse.StatfsOut{}
 }
 
-// secretsDirListing produces directory entries containing all secret files. Extra entries passed
-// to this function are included.
-func (kwfs KeywhizFs) secretsDirListing(extraEntries ...fuse.DirEntry) []fuse.DirEntry {
+// secretsDirListing produces directory entries containing all secret files. For the root
+// directory, namespaced secrets are represented by their directory and symlinks are added for
+// aliases; otherwise namespaced secrets are skipped. Extra entries passed to this function are
+// included. The attributes of the secrets listed are kept for the stat() calls which follow.
+func (kwfs KeywhizFs) secretsDirListing(root bool, extraEntries ...fuse.DirEntry) []fuse.DirEntry {
 	secrets := kwfs.Cache.SecretList()
 	entries := make([]fuse.DirEntry, 0, len(secrets)+len(extraEntries))
-	for _, s := range secrets {
+	names := make(map[string]bool, len(secrets))
+	attrs := make(map[string]*fuse.Attr, len(secrets))
+	for i, s := range secrets {
+		if i := strings.Index(s.Name, "/"); i >= 0 {
+			if root && !names[s.Name[:i]] {
+				entries = append(entries, fuse.DirEntry{Name: s.Name[:i], Mode: fuse.S_IFDIR})
+				names[s.Name[:i]] = true
+			}
+			continue
+		}
+		if root && kwfs.Templates[s.Name] != nil {
+			continue // Listed with the extra entries
+		}
 		entries = append(entries, fuse.DirEntry{Name: s.Name, Mode: fuse.S_IFREG})
+		names[s.Name] = true
+		attrs[s.Name] = kwfs.secretAttr(&secrets[i])
+	}
+	if root {
+		for _, s := range secrets {
+			for _, alias := range s.Aliases {
+				// Aliases never shadow secrets or special files.
+				if names[alias] || !listedAlias(alias) {
+					continue
+				}
+				entries = append(entries, fuse.DirEntry{Name: alias, Mode: fuse.S_IFLNK})
+				names[alias] = true
+			}
+		}
 	}
 	entries = append(entries, extraEntries...)
+	kwfs.dirAttrs.Fill(attrs)
+	return entries
+}
+
+// namespaceDirListing produces directory entries for the secrets within a namespace directory,
+// keeping their attributes like secretsDirListing.
+func (kwfs KeywhizFs) namespaceDirListing(namespace string) []fuse.DirEntry {
+	prefix := namespace + "/"
+	var entries []fuse.DirEntry
+	attrs := map[string]*fuse.Attr{}
+	secrets := kwfs.Cache.SecretList()
+	for i, s := range secrets {
+		if strings.HasPrefix(s.Name, prefix) {
+			entries = append(entries, fuse.DirEntry{Name: s.Name[len(prefix):], Mode: fuse.S_IFREG})
+			attrs[s.Name] = kwfs.secretAttr(&secrets[i])
+		}
+	}
+	kwfs.dirAttrs.Fill(attrs)
 	return entries
 }
 
 // secretAttr constructs a fuse.Attr based on a given Secret.
 func (kwfs KeywhizFs) secretAttr(s *Secret) *fuse.Attr {
 	created := uint64(s.CreatedAt.Unix())
+	modified := uint64(s.ModifiedAt().Unix())
 	attr := &fuse.Attr{
 		Size: s.Length,
 		// The resolution for nsec time (uint32) is too small.
 		Atime: created,
-		Mtime: created,
-		Ctime: created,
+		Mtime: modified,
+		Ctime: modified,
 		Mode:  s.ModeValue(),
 		Nlink: 1,
 	}
@@ -435,14 +1336,34 @@ func (kwfs KeywhizFs) secretAttr(s *Secret) *fuse.Attr {
 	attr.Gid = kwfs.Ownership.Gid
 
 	if s.Owner != "" {
-		attr.Uid = lookupUid(s.Owner)
+		attr.Uid = kwfs.IDs.Uid(s.Owner)
 	}
 	if s.Group != "" {
-		attr.Gid = lookupGid(s.Group)
+		attr.Gid = kwfs.IDs.Gid(s.Group)
+	}
+	kwfs.Overrides.Apply(s.Name, attr)
+	if kwfs.WriteThrough {
+		attr.Mode |= 0200
 	}
 	return attr
 }
 
+// symlinkAttr constructs a fuse.Attr for a symlink pointing at target.
+func (kwfs KeywhizFs) symlinkAttr(target string) *fuse.Attr {
+	created := uint64(kwfs.StartTime.Unix())
+	attr := fuse.Attr{
+		Size:  uint64(len(target)),
+		Atime: created,
+		Mtime: created,
+		Ctime: created,
+		Mode:  fuse.S_IFLNK | 0777,
+		Nlink: 1,
+	}
+	attr.Uid = kwfs.Ownership.Uid
+	attr.Gid = kwfs.Ownership.Gid
+	return &attr
+}
+
 // fileAttr constructs a generic file fuse.Attr with the given parameters.
 func (kwfs KeywhizFs) fileAttr(size uint64, mode uint32) *fuse.Attr {
 	created := uint64(kwfs.StartTime.Unix())
@@ -501,6 +1422,98 @@ func (f *attrFile) GetAttr(out *fuse.Attr) fuse.Status {
 	return fuse.OK
 }
 
+// online returns true if requests may be sent to the Keywhiz server: there is one, and the cache
+// is neither offline nor degraded. Control files which need the server don't exist otherwise.
+func (kwfs KeywhizFs) online() bool {
+	return kwfs.Client != nil && kwfs.Cache.Online()
+}
+
+// rawSecretList returns the server's JSON secret listing, without secrets hidden by the filter.
+func (kwfs KeywhizFs) rawSecretList() ([]byte, bool) {
+	data, ok := kwfs.Client.RawSecretList()
+	if !ok {
+		return nil, false
+	}
+	data, err := kwfs.Filter.FilterRawList(data)
+	if err != nil {
+		kwfs.Errorf("Error filtering secret list: %v", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// rawSecret returns the server's JSON for a secret, unless it is hidden by the filter.
+func (kwfs KeywhizFs) rawSecret(name string) ([]byte, error) {
+	if !kwfs.Filter.Allowed(name) {
+		return nil, SecretDeleted{}
+	}
+	return kwfs.Client.RawSecret(name)
+}
+
+// render renders a template with secrets from the cache. Rendering fails with EACCES if the
+// template references a secret which the caller may not access.
+func (kwfs KeywhizFs) render(name string, context *fuse.Context) ([]byte, fuse.Status) {
+	denied := false
+	lookup := func(secretName string) (*Secret, bool) {
+		secret, ok := kwfs.Cache.Secret(secretName)
+		if ok && !kwfs.allowed(secret, context) {
+			denied = true
+			return nil, false
+		}
+		return secret, ok
+	}
+	data, err := kwfs.Templates[name].Render(lookup)
+	if denied {
+		return nil, fuse.EACCES
+	}
+	if err != nil {
+		kwfs.Errorf("Error rendering template %s: %v", name, err)
+		return nil, fuse.EIO
+	}
+	return data, fuse.OK
+}
+
+// allowed returns true if the caller may access a secret. Without EnforceOwnership or a Policy,
+// access is left to the kernel's checks of the file mode.
+func (kwfs KeywhizFs) allowed(secret *Secret, context *fuse.Context) bool {
+	if context == nil {
+		return true
+	}
+	if kwfs.EnforceOwnership {
+		attr := kwfs.secretAttr(secret)
+		if context.Uid != attr.Uid && context.Gid != attr.Gid {
+			return false
+		}
+	}
+	return kwfs.Policy == nil || kwfs.Policy.Allowed(secret.Name, context.Pid)
+}
+
+// secretAllowed returns true if the caller may access the named secret. A secret which can't be
+// resolved is denied, since its ownership can't be checked.
+func (kwfs KeywhizFs) secretAllowed(name string, context *fuse.Context) bool {
+	if !kwfs.EnforceOwnership && kwfs.Policy == nil {
+		return true
+	}
+	secret, ok := kwfs.Cache.Secret(name)
+	return ok && kwfs.allowed(secret, context)
+}
+
+// health reports the state of the server, and false if it has been unreachable for longer than
+// the health threshold. A clock skew with the server past maxClockSkew is reported as a warning,
+// without failing.
+func (kwfs KeywhizFs) health() ([]byte, bool) {
+	state, lastSuccess, failures := kwfs.Client.Health(kwfs.HealthThreshold, kwfs.StartTime)
+	success := "never"
+	if !lastSuccess.IsZero() {
+		success = lastSuccess.UTC().Format(time.RFC3339)
+	}
+	data := fmt.Sprintf("%s\nlast_success=%s\nfailures=%d\n", state, success, failures)
+	if skew, significant := kwfs.Client.ClockSkew(); significant {
+		data += fmt.Sprintf("clock_skew=%v\n", skew)
+	}
+	return []byte(data), state != healthUnreachable
+}
+
 // running provides a formatted string with the current process ID.
 func running() []byte {
 	return []byte(fmt.Sprintf("pid=%d", os.Getpid()))
@@ -17,16 +17,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/square/keywhiz-fs/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -43,11 +49,11 @@ type FsTestSuite struct {
 }
 
 func (suite *FsTestSuite) SetupTest() {
-	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour}
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
 	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
-	client := NewClient(clientFile, clientFile, testCaFile, suite.url, timeouts.MaxWait, logConfig, metricsHandle)
+	client := NewClient(clientFile, clientFile, testCaFile, suite.url, timeouts.MaxWait, ClientOptions{}, logConfig, metricsHandle)
 	ownership := Ownership{Uid: _SomeUID, Gid: _SomeUID}
-	kwfs, _, _ := NewKeywhizFs(&client, ownership, timeouts, metricsHandle, logConfig)
+	kwfs, _, _ := NewKeywhizFs(&client, &client, ownership, timeouts, metricsHandle, logConfig)
 	suite.fs = kwfs
 }
 
@@ -62,13 +68,19 @@ func (suite *FsTestSuite) TestSpecialFileAttrs() {
 	}{
 		{"", 4096, 0755 | fuse.S_IFDIR, false},
 		{".version", len(fsVersion), 0444 | fuse.S_IFREG, true},
+		{".buildinfo", len(buildInfoJSON()), 0444 | fuse.S_IFREG, true},
 		{".json/status", len(suite.fs.statusJSON()), 0444 | fuse.S_IFREG, true},
+		{".json/config", len(suite.fs.configJSON()), 0400 | fuse.S_IFREG, true},
+		{".json/cert_status", len(suite.fs.certStatusJSON()), 0444 | fuse.S_IFREG, true},
 		{".running", -1, 0444 | fuse.S_IFREG, true},
 		{".clear_cache", 0, 0440 | fuse.S_IFREG, false},
+		{".reload", 0, 0440 | fuse.S_IFREG, false},
 		{".json", 4096, 0700 | fuse.S_IFDIR, false},
 		{".pprof", 4096, 0700 | fuse.S_IFDIR, false},
 		{".json/secret", 4096, 0700 | fuse.S_IFDIR, false},
 		{".json/secrets", -1, 0400 | fuse.S_IFREG, true},
+		{".json/group", 4096, 0700 | fuse.S_IFDIR, false},
+		{".json/groups", -1, 0400 | fuse.S_IFREG, true},
 	}
 
 	for _, c := range cases {
@@ -107,11 +119,14 @@ func (suite *FsTestSuite) TestFileAttrs() {
 		content  []byte
 		mode     uint32
 	}{
-		{"hmac.key", hmacSecret.Content, 0440 | fuse.S_IFREG},
-		{"Nobody_PgPass", nobodySecret.Content, 0400 | fuse.S_IFREG},
+		{"hmac.key", hmacSecret.Content.Bytes(), 0440 | fuse.S_IFREG},
+		{"Nobody_PgPass", nobodySecret.Content.Bytes(), 0400 | fuse.S_IFREG},
 		{".json/secret/hmac.key", hmacSecretData, 0400 | fuse.S_IFREG},
 		{".json/secret/Nobody_PgPass", nobodySecretData, 0400 | fuse.S_IFREG},
 		{".json/secrets", secretListData, 0400 | fuse.S_IFREG},
+		{".json/groups", fixture("groups.json"), 0400 | fuse.S_IFREG},
+		{".json/group/Database", fixture("group.json"), 0400 | fuse.S_IFREG},
+		{".json/server_status", []byte(`{"healthy":false}`), 0444 | fuse.S_IFREG},
 	}
 
 	for _, c := range cases {
@@ -175,6 +190,15 @@ func (suite *FsTestSuite) TestSpecialFileOpen() {
 	assert.Equal(fuse.OK, status)
 	assert.EqualValues(suite.fs.statusJSON(), read(file))
 
+	file, status = suite.fs.Open(".json/config", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	var config ConfigInfo
+	assert.NoError(json.Unmarshal(read(file), &config))
+	assert.Equal(suite.fs.Cache.Mode(), config.Runtime.CacheMode)
+	assert.Equal(_SomeUID, config.Runtime.Uid)
+	assert.Equal(suite.url.String(), config.Runtime.ServerURL)
+	assert.NotNil(config.Settings)
+
 	file, status = suite.fs.Open(".clear_cache", 0, fuseContext)
 	assert.Equal(fuse.OK, status)
 	assert.Empty(read(file))
@@ -204,11 +228,13 @@ func (suite *FsTestSuite) TestOpen() {
 		filename string
 		content  []byte
 	}{
-		{"hmac.key", hmacSecret.Content},
-		{"Nobody_PgPass", nobodySecret.Content},
+		{"hmac.key", hmacSecret.Content.Bytes()},
+		{"Nobody_PgPass", nobodySecret.Content.Bytes()},
 		{".json/secret/hmac.key", hmacSecretData},
 		{".json/secret/Nobody_PgPass", nobodySecretData},
 		{".json/secrets", secretListData},
+		{".json/groups", fixture("groups.json")},
+		{".json/group/Database", fixture("group.json")},
 	}
 
 	for _, c := range cases {
@@ -229,6 +255,8 @@ func (suite *FsTestSuite) TestOpenBadFiles() {
 		{"non-existent", fuse.ENOENT},
 		{".json/secret/non-existent", fuse.ENOENT},
 		{".json/secret", fuseEISDIR},
+		{".json/group", fuseEISDIR},
+		{".json/group/non-existent", fuse.ENOENT},
 	}
 
 	for _, c := range cases {
@@ -248,9 +276,14 @@ func (suite *FsTestSuite) TestOpenDir() {
 			"",
 			map[string]bool{
 				".version":     true,
+				".buildinfo":   true,
 				".running":     true,
 				".clear_cache": true,
+				".health":      true,
+				".refresh":     false,
+				".reload":      true,
 				".json":        false,
+				".loglevel":    true,
 				".pprof":       false,
 				"General_Password..0be68f903f8b7d86": true,
 				"Nobody_PgPass":                      true,
@@ -259,6 +292,11 @@ func (suite *FsTestSuite) TestOpenDir() {
 		{
 			".json",
 			map[string]bool{
+				"cert_status":   true,
+				"changes":       true,
+				"config":        true,
+				"group":         false,
+				"groups":        true,
 				"metrics":       true,
 				"status":        true,
 				"server_status": true,
@@ -273,6 +311,13 @@ func (suite *FsTestSuite) TestOpenDir() {
 				"Nobody_PgPass":                      true,
 			},
 		},
+		{
+			".json/group",
+			map[string]bool{
+				"Web":      true,
+				"Database": true,
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -302,6 +347,19 @@ func TestFsTestSuite(t *testing.T) {
 			fmt.Fprint(w, string(fixture("secretNormalOwner.json")))
 		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/Nobody_PgPass"):
 			fmt.Fprint(w, string(fixture("secret.json")))
+		case r.Method == "GET" && r.URL.Path == "/groups":
+			fmt.Fprint(w, string(fixture("groups.json")))
+		case r.Method == "GET" && r.URL.Path == "/group/Database":
+			fmt.Fprint(w, string(fixture("group.json")))
+		case r.Method == "GET" && r.URL.Path == "/_status":
+			w.WriteHeader(503)
+			fmt.Fprint(w, `{"healthy":false}`)
+		case r.URL.Path == "/automation/v2/secrets/hmac.key":
+			if r.Method != "POST" {
+				w.WriteHeader(405)
+				return
+			}
+			w.WriteHeader(201)
 		default:
 			w.WriteHeader(404)
 		}
@@ -327,6 +385,695 @@ func (suite *FsTestSuite) TestUnlink() {
 	status = suite.fs.Unlink(".clear_cache", fuseContext)
 	assert.Equal(fuse.OK, status, "Unlink on .clear_cache should give OK")
 	assert.Equal(suite.fs.Cache.Len(), 0, "Should clear cache")
+
+	status = suite.fs.Unlink(".reload", fuseContext)
+	assert.Equal(fuse.OK, status, "Unlink on .reload should give OK")
+	assert.Equal(suite.fs.Cache.Len(), 2, "Should reload secret listing")
+}
+
+func (suite *FsTestSuite) TestWriteThrough() {
+	assert := suite.assert
+
+	// Writes are rejected unless write-through is enabled.
+	file, status := suite.fs.Open("hmac.key", fuse.O_ANYWRITE, fuseContext)
+	assert.Equal(fuse.OK, status)
+	_, status = file.Write([]byte("new"), 0)
+	assert.Equal(fuse.EPERM, status)
+
+	suite.fs.WriteThrough = true
+	defer func() { suite.fs.WriteThrough = false }()
+
+	attr, status := suite.fs.GetAttr("hmac.key", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0640|fuse.S_IFREG, attr.Mode)
+
+	file, status = suite.fs.Open("hmac.key", uint32(os.O_WRONLY|os.O_TRUNC), fuseContext)
+	assert.Equal(fuse.OK, status)
+	written, status := file.Write([]byte("new"), 0)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(3, written)
+	assert.Equal(fuse.OK, file.Flush())
+
+	cached, ok := suite.fs.Cache.secretMap.Get("hmac.key")
+	assert.True(ok)
+	assert.EqualValues("new", cached.Secret.Content.Bytes())
+
+	// Further writes on the handle don't modify the committed content, nor earlier reads.
+	buf := make([]byte, 16)
+	read, _ := file.Read(buf, 0)
+	before, _ := read.Bytes(buf)
+	file.Write([]byte("old"), 0)
+	assert.EqualValues("new", before)
+	assert.EqualValues("new", cached.Secret.Content.Bytes())
+
+	_, status = suite.fs.Open(".version", fuse.O_ANYWRITE, fuseContext)
+	assert.Equal(fuse.EPERM, status)
+	_, status = suite.fs.Open("non-existent", fuse.O_ANYWRITE, fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	// Secrets without automation access fail to commit.
+	file, status = suite.fs.Open("Nobody_PgPass", fuse.O_ANYWRITE, fuseContext)
+	assert.Equal(fuse.OK, status)
+	file.Write([]byte("new"), 0)
+	assert.Equal(fuse.EIO, file.Flush())
+}
+
+func (suite *FsTestSuite) TestAliasSymlinks() {
+	assert := suite.assert
+
+	suite.fs.Cache.Add(Secret{Name: "new_name", Content: decodedContent([]byte("data")), Aliases: []string{"old_name", "new_name", ".hidden"}})
+
+	attr, status := suite.fs.GetAttr("old_name", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFLNK|0777, attr.Mode)
+	assert.EqualValues(len("new_name"), attr.Size)
+
+	target, status := suite.fs.Readlink("old_name", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("new_name", target)
+
+	// A secret is never an alias of itself.
+	_, status = suite.fs.Readlink("new_name", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	_, status = suite.fs.Readlink("invalid", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	// Aliases which aren't listed can't be looked up either.
+	_, status = suite.fs.GetAttr(".hidden", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+	_, status = suite.fs.Readlink(".hidden", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+}
+
+func (suite *FsTestSuite) TestNamespaceDirectories() {
+	assert := suite.assert
+
+	suite.fs.Cache.Add(Secret{Name: "ns/secret", Content: decodedContent([]byte("data")), Length: 4})
+
+	attr, status := suite.fs.GetAttr("ns", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(fuse.S_IFDIR|0755, attr.Mode)
+
+	_, status = suite.fs.Open("ns", 0, fuseContext)
+	assert.Equal(fuseEISDIR, status)
+
+	attr, status = suite.fs.GetAttr("ns/secret", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(4, attr.Size)
+}
+
+func (suite *FsTestSuite) TestFuseTuning() {
+	assert := suite.assert
+	defer fakeFusectl()()
+
+	// Not exposed until mounted.
+	_, status := suite.fs.GetAttr(".fuse", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	suite.fs.Tuning = NewFuseTuning("/mnt/key whiz")
+	attr, status := suite.fs.GetAttr(".fuse/max_background", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0644|fuse.S_IFREG, attr.Mode)
+
+	entries, status := suite.fs.OpenDir(".fuse", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Len(entries, 2)
+
+	file, status := suite.fs.Open(".fuse/max_background", uint32(os.O_WRONLY|os.O_TRUNC), fuseContext)
+	assert.Equal(fuse.OK, status)
+	file.Write([]byte("64\n"), 0)
+	assert.Equal(fuse.OK, file.Flush())
+
+	file, status = suite.fs.Open(".fuse/max_background", uint32(os.O_RDWR), fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 16)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("64\n", string(data))
+
+	file.Truncate(0)
+	file.Write([]byte("lots"), 0)
+	assert.Equal(fuse.EINVAL, file.Flush())
+}
+
+func (suite *FsTestSuite) TestFaults() {
+	assert := suite.assert
+
+	// Not exposed unless enabled.
+	_, status := suite.fs.GetAttr(".faults", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	suite.fs.Faults = NewFaults()
+	defer func() { suite.fs.Faults = nil }()
+	attr, status := suite.fs.GetAttr(".faults/hmac.key", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0644|fuse.S_IFREG, attr.Mode)
+	_, status = suite.fs.GetAttr(".faults/non-existent", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	entries, status := suite.fs.OpenDir(".faults", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.NotEmpty(entries)
+
+	setFault := func(spec string) fuse.Status {
+		file, status := suite.fs.Open(".faults/hmac.key", uint32(os.O_WRONLY|os.O_TRUNC), fuseContext)
+		assert.Equal(fuse.OK, status)
+		file.Write([]byte(spec), 0)
+		return file.Flush()
+	}
+
+	assert.Equal(fuse.OK, setFault("eio delay=20ms\n"))
+	file, status := suite.fs.Open(".faults/hmac.key", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 64)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("delay=20ms eio\n", string(data))
+
+	start := time.Now()
+	_, status = suite.fs.Open("hmac.key", 0, fuseContext)
+	assert.Equal(fuse.EIO, status)
+	assert.True(time.Since(start) >= 20*time.Millisecond)
+
+	// Stale secrets are served from the cache without asking the server.
+	assert.Equal(fuse.OK, setFault("stale"))
+	suite.fs.Cache.Add(Secret{Name: "hmac.key", Content: decodedContent([]byte("cached")), Mode: "0440"})
+	file, status = suite.fs.Open("hmac.key", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	res, _ = file.Read(buf, 0)
+	data, _ = res.Bytes(buf)
+	assert.Equal("cached", string(data))
+
+	assert.Equal(fuse.EINVAL, setFault("explode"))
+	assert.Equal(fuse.OK, setFault("none"))
+	assert.Equal(Fault{}, suite.fs.Faults.Get("hmac.key"))
+}
+
+func (suite *FsTestSuite) TestAccessMetrics() {
+	assert := suite.assert
+	defer func(opens *AccessStats) { suite.fs.Opens = opens }(suite.fs.Opens)
+	suite.fs.Opens = NewAccessStats()
+
+	_, status := suite.fs.Open("Nobody_PgPass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+
+	file, status := suite.fs.Open(".json/metrics", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 1<<20)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+
+	var entries []map[string]interface{}
+	assert.NoError(json.Unmarshal(data, &entries))
+	value := func(name string) interface{} {
+		for _, entry := range entries {
+			if strings.HasSuffix(entry["metric"].(string), "."+name) {
+				return entry["value"]
+			}
+		}
+		return nil
+	}
+	assert.EqualValues(1, value("secret.Nobody_PgPass.opens"))
+	assert.NotZero(value("secret.Nobody_PgPass.last_access"))
+	assert.EqualValues(0, value("secret.General_Password..0be68f903f8b7d86.opens"))
+}
+
+func (suite *FsTestSuite) TestProfiles() {
+	assert := suite.assert
+
+	entries, status := suite.fs.OpenDir(".pprof", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Len(entries, len(runtimeProfiles)+1)
+
+	_, status = suite.fs.GetAttr(".pprof/profile?seconds=1", fuseContext)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.GetAttr(".pprof/profile?seconds=-1", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	read := func(name string) ([]byte, fuse.Status) {
+		file, status := suite.fs.Open(name, 0, fuseContext)
+		assert.Equal(fuse.OK, status)
+		buf := make([]byte, 1<<20)
+		res, status := file.Read(buf, 0)
+		if status != fuse.OK {
+			return nil, status
+		}
+		data, _ := res.Bytes(buf)
+		return data, status
+	}
+
+	data, status := read(".pprof/heap")
+	assert.Equal(fuse.OK, status)
+	assert.Contains(string(data), "heap profile")
+
+	// Only one CPU profile at a time.
+	done := make(chan []byte)
+	go func() {
+		data, _ := read(".pprof/profile?seconds=1")
+		done <- data
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, status = read(".pprof/profile?seconds=1")
+	assert.EqualValues(syscall.EBUSY, status)
+	assert.NotEmpty(<-done)
+}
+
+func (suite *FsTestSuite) TestLogLevel() {
+	assert := suite.assert
+	defer log.SetDebug(false)
+
+	attr, status := suite.fs.GetAttr(".loglevel", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0644|fuse.S_IFREG, attr.Mode)
+
+	file, status := suite.fs.Open(".loglevel", uint32(os.O_WRONLY|os.O_TRUNC), fuseContext)
+	assert.Equal(fuse.OK, status)
+	file.Write([]byte("debug\n"), 0)
+	assert.Equal(fuse.OK, file.Flush())
+	assert.True(suite.fs.DebugEnabled())
+
+	file, status = suite.fs.Open(".loglevel", uint32(os.O_RDONLY), fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 16)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("debug\n", string(data))
+
+	file, status = suite.fs.Open(".loglevel", uint32(os.O_WRONLY|os.O_TRUNC), fuseContext)
+	assert.Equal(fuse.OK, status)
+	file.Write([]byte("verbose"), 0)
+	assert.Equal(fuse.EINVAL, file.Flush())
+	assert.True(suite.fs.DebugEnabled())
+
+	file.Truncate(0)
+	file.Write([]byte("info"), 0)
+	assert.Equal(fuse.OK, file.Flush())
+	assert.False(suite.fs.DebugEnabled())
+}
+
+func (suite *FsTestSuite) TestContentXAttrs() {
+	assert := suite.assert
+
+	attrs, status := suite.fs.ListXAttr("hmac.key", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]string{"user.keywhiz.encoding", "user.keywhiz.content_type"}, attrs)
+
+	data, status := suite.fs.GetXAttr("hmac.key", "user.keywhiz.encoding", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("base64", string(data))
+
+	data, status = suite.fs.GetXAttr("Nobody_PgPass", "user.keywhiz.content_type", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Equal("text/plain; charset=utf-8", string(data))
+
+	_, status = suite.fs.GetXAttr("hmac.key", "user.other", fuseContext)
+	assert.Equal(fuse.ENOATTR, status)
+	_, status = suite.fs.GetXAttr(".version", "user.keywhiz.encoding", fuseContext)
+	assert.Equal(fuse.ENOATTR, status)
+	_, status = suite.fs.ListXAttr("nonexistent", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+}
+
+func (suite *FsTestSuite) TestHealth() {
+	assert := suite.assert
+	client := suite.fs.Client
+	defer client.failCount.Clear()
+
+	read := func() string {
+		file, status := suite.fs.Open(".health", 0, fuseContext)
+		assert.Equal(fuse.OK, status)
+		buf := make([]byte, 256)
+		res, _ := file.Read(buf, 0)
+		data, _ := res.Bytes(buf)
+		return string(data)
+	}
+
+	client.failCount.Clear()
+	client.lastSuccess.Update(time.Date(2016, time.June, 29, 20, 5, 21, 0, time.UTC).Unix())
+	assert.Equal("OK\nlast_success=2016-06-29T20:05:21Z\nfailures=0\n", read())
+
+	// Failing, but the mount is younger than the threshold.
+	client.failCount.Inc(2)
+	assert.Equal("DEGRADED\nlast_success=2016-06-29T20:05:21Z\nfailures=2\n", read())
+
+	suite.fs.HealthThreshold = 0
+	_, status := suite.fs.GetAttr(".health", fuseContext)
+	assert.Equal(fuse.EIO, status)
+}
+
+func (suite *FsTestSuite) TestHealthHandler() {
+	assert := suite.assert
+	client := suite.fs.Client
+	defer client.failCount.Clear()
+	handler := NewHealthHandler(suite.fs)
+
+	get := func(path string) (int, HealthStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var status HealthStatus
+		if w.Code != http.StatusNotFound {
+			assert.NoError(json.Unmarshal(w.Body.Bytes(), &status))
+		}
+		return w.Code, status
+	}
+
+	code, status := get("/healthz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.False(status.Mounted)
+
+	handler.SetMounted(true)
+	code, _ = get("/healthz")
+	assert.Equal(http.StatusOK, code)
+
+	suite.fs.Cache.SecretList()
+	code, status = get("/readyz")
+	assert.Equal(http.StatusOK, code)
+	assert.True(status.Ready)
+	assert.NotNil(status.ListedAt)
+	assert.Equal(healthOK, status.Server)
+
+	client.failCount.Inc(1)
+	suite.fs.HealthThreshold = 0
+	code, status = get("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(healthUnreachable, status.Server)
+	code, _ = get("/healthz")
+	assert.Equal(http.StatusOK, code)
+
+	code, _ = get("/metrics")
+	assert.Equal(http.StatusNotFound, code)
+}
+
+func (suite *FsTestSuite) TestMirror() {
+	assert := suite.assert
+	suite.fs.WriteThrough = true
+	mirror, _ := NewMirrorFs(suite.fs, logConfig)
+	suite.fs.Cache.Add(Secret{Name: "new_name", Content: decodedContent([]byte("data")), Mode: "0644", Aliases: []string{"old_name"}})
+
+	entries, status := mirror.OpenDir("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	assert.Equal(map[string]bool{"Nobody_PgPass": true, "General_Password..0be68f903f8b7d86": true, "new_name": true}, names)
+
+	attr, status := mirror.GetAttr("hmac.key", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0440|fuse.S_IFREG, attr.Mode)
+	attr, status = mirror.GetAttr("new_name", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0440|fuse.S_IFREG, attr.Mode)
+
+	file, status := mirror.Open("hmac.key", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	fattr := new(fuse.Attr)
+	file.GetAttr(fattr)
+	assert.EqualValues(0440|fuse.S_IFREG, fattr.Mode)
+
+	for _, name := range []string{".version", ".json/secrets", ".clear_cache", "old_name"} {
+		_, status = mirror.GetAttr(name, fuseContext)
+		assert.Equal(fuse.ENOENT, status, name)
+	}
+	_, status = mirror.Open("hmac.key", uint32(os.O_WRONLY), fuseContext)
+	assert.Equal(fuse.EPERM, status)
+	assert.Equal(fuse.EPERM, mirror.Unlink(".clear_cache", fuseContext))
+}
+
+func (suite *FsTestSuite) TestRefresh() {
+	assert := suite.assert
+	suite.fs.Cache.Add(Secret{Name: "Nobody_PgPass", Content: decodedContent([]byte("stale"))})
+
+	attr, status := suite.fs.GetAttr(".refresh", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.True(attr.IsDir())
+	attr, status = suite.fs.GetAttr(".refresh/Nobody_PgPass", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0440|fuse.S_IFREG, attr.Mode)
+	_, status = suite.fs.GetAttr(".refresh/nonexistent", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+
+	entries, status := suite.fs.OpenDir(".refresh", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Contains(entries, fuse.DirEntry{Name: "Nobody_PgPass", Mode: fuse.S_IFREG})
+
+	assert.Equal(fuse.OK, suite.fs.Unlink(".refresh/Nobody_PgPass", fuseContext))
+	cached, _ := suite.fs.Cache.secretMap.Get("Nobody_PgPass")
+	assert.EqualValues("asddas", cached.Secret.Content.Bytes())
+}
+
+func (suite *FsTestSuite) TestTemplateFiles() {
+	assert := suite.assert
+
+	dir := writeTemplates(map[string]string{"pgpass.tmpl": "*:*:*:nobody:{{ secret \"Nobody_PgPass\" }}"})
+	defer os.RemoveAll(dir)
+	templates, err := LoadTemplates(dir)
+	assert.NoError(err)
+	suite.fs.Templates = templates
+
+	rendered := "*:*:*:nobody:asddas"
+	attr, status := suite.fs.GetAttr("pgpass", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0440|fuse.S_IFREG, attr.Mode)
+	assert.EqualValues(len(rendered), attr.Size)
+
+	file, status := suite.fs.Open("pgpass", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 64)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal(rendered, string(data))
+
+	entries, _ := suite.fs.OpenDir("", fuseContext)
+	assert.Contains(entries, fuse.DirEntry{Name: "pgpass", Mode: fuse.S_IFREG})
+
+	suite.fs.Templates["pgpass"].text = "{{ secret \"missing\" }}"
+	_, status = suite.fs.GetAttr("pgpass", fuseContext)
+	assert.Equal(fuse.EIO, status)
+}
+
+func (suite *FsTestSuite) TestLargeRead() {
+	assert := suite.assert
+
+	// Larger than the kernel's maximum read size, and not a multiple of it.
+	content := make([]byte, 3<<20+12345)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	suite.fs.Cache.Add(Secret{Name: "keystore", Content: decodedContent(content)})
+
+	file, status := suite.fs.Open("keystore", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+
+	var read []byte
+	buf := make([]byte, 128<<10)
+	for {
+		res, status := file.Read(buf, int64(len(read)))
+		assert.Equal(fuse.OK, status)
+		data, _ := res.Bytes(buf)
+		if len(data) == 0 {
+			break
+		}
+		read = append(read, data...)
+	}
+	assert.Equal(content, read)
+
+	res, status := file.Read(buf, 1<<20+7)
+	assert.Equal(fuse.OK, status)
+	data, _ := res.Bytes(buf)
+	assert.Equal(content[1<<20+7:1<<20+7+len(buf)], data)
+
+	res, status = file.Read(buf, int64(len(content)+4096))
+	assert.Equal(fuse.OK, status)
+	data, _ = res.Bytes(buf)
+	assert.Empty(data)
+
+	// Special files don't fail on reads past the end either.
+	file, status = suite.fs.Open(".version", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	res, status = file.Read(buf, int64(len(fsVersion)+1))
+	assert.Equal(fuse.OK, status)
+	data, _ = res.Bytes(buf)
+	assert.Empty(data)
+}
+
+func (suite *FsTestSuite) TestDirectIO() {
+	assert := suite.assert
+
+	file, status := suite.fs.Open("hmac.key", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	_, ok := file.(*nodefs.WithFlags)
+	assert.False(ok)
+
+	suite.fs.DirectIO = true
+	defer func() { suite.fs.DirectIO = false }()
+	file, status = suite.fs.Open("hmac.key", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	withFlags, ok := file.(*nodefs.WithFlags)
+	if assert.True(ok) {
+		assert.EqualValues(fuse.FOPEN_DIRECT_IO, withFlags.FuseFlags)
+	}
+}
+
+func (suite *FsTestSuite) TestListingAttrs() {
+	assert := suite.assert
+
+	listing, _ := ParseSecretList(fixture("secretsWithoutContent.json"))
+	var calls int32
+	fresh := Timeouts{time.Hour, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	fs := *suite.fs
+	fs.Cache = NewCache(ListingBackend{listing, &calls}, fresh, logConfig, nil)
+	assert.True(fs.Cache.Warmup())
+
+	// As for READDIRPLUS or ls -l: attributes of every listed secret, without fetching them.
+	entries, status := fs.OpenDir("", fuseContext)
+	assert.Equal(fuse.OK, status)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name, ".") {
+			continue
+		}
+		attr, status := fs.GetAttr(entry.Name, fuseContext)
+		assert.Equal(fuse.OK, status, "Expected %v attr status to be fuse.OK", entry.Name)
+		assert.EqualValues(6, attr.Size)
+	}
+	assert.EqualValues(0, calls)
+
+	attr, _ := fs.GetAttr("Nobody_PgPass", fuseContext)
+	assert.EqualValues(0400|fuse.S_IFREG, attr.Mode)
+}
+
+func (suite *FsTestSuite) TestEnforceOwnership() {
+	assert := suite.assert
+
+	attr, status := suite.fs.GetAttr("Nobody_PgPass", fuseContext)
+	assert.Equal(fuse.OK, status)
+	owner := &fuse.Context{Owner: fuse.Owner{Uid: attr.Uid, Gid: 12345}}
+	group := &fuse.Context{Owner: fuse.Owner{Uid: 12345, Gid: attr.Gid}}
+	stranger := &fuse.Context{Owner: fuse.Owner{Uid: 12345, Gid: 12345}}
+
+	// Without enforcement, access is left to the kernel.
+	_, status = suite.fs.Open("Nobody_PgPass", 0, stranger)
+	assert.Equal(fuse.OK, status)
+
+	suite.fs.EnforceOwnership = true
+	defer func() { suite.fs.EnforceOwnership = false }()
+
+	_, status = suite.fs.Open("Nobody_PgPass", 0, owner)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.Open("Nobody_PgPass", 0, group)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.Open("Nobody_PgPass", 0, stranger)
+	assert.Equal(fuse.EACCES, status)
+	_, status = suite.fs.Open(".json/secret/Nobody_PgPass", 0, stranger)
+	assert.Equal(fuse.EACCES, status)
+	_, status = suite.fs.Open(".json/secret/non-existent", 0, owner)
+	assert.Equal(fuse.EACCES, status)
+
+	// Attributes stay visible.
+	_, status = suite.fs.GetAttr("Nobody_PgPass", stranger)
+	assert.Equal(fuse.OK, status)
+
+	// Templates can't be used to read secrets the caller can't access.
+	dir := writeTemplates(map[string]string{"pgpass.tmpl": "{{ secret \"Nobody_PgPass\" }}"})
+	defer os.RemoveAll(dir)
+	templates, err := LoadTemplates(dir)
+	assert.NoError(err)
+	suite.fs.Templates = templates
+	defer func() { suite.fs.Templates = nil }()
+	_, status = suite.fs.Open("pgpass", 0, owner)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.Open("pgpass", 0, stranger)
+	assert.Equal(fuse.EACCES, status)
+}
+
+func (suite *FsTestSuite) TestProcessPolicy() {
+	assert := suite.assert
+	dir, cleanup := fakeProc()
+	defer cleanup()
+
+	policy, err := NewProcessPolicy([]ProcessRule{
+		{Secrets: []string{"Nobody_PgPass"}, Exe: filepath.Join(dir, "bin", "app")},
+	}, logConfig)
+	assert.NoError(err)
+	suite.fs.Policy = policy
+	defer func() { suite.fs.Policy = nil }()
+
+	app := &fuse.Context{Owner: fuseContext.Owner, Pid: 100}
+	other := &fuse.Context{Owner: fuseContext.Owner, Pid: 200}
+	_, status := suite.fs.Open("Nobody_PgPass", 0, app)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.Open("Nobody_PgPass", 0, other)
+	assert.Equal(fuse.EACCES, status)
+	_, status = suite.fs.Open("hmac.key", 0, app)
+	assert.Equal(fuse.EACCES, status)
+
+	// Special files aren't covered by the policy.
+	_, status = suite.fs.Open(".version", 0, other)
+	assert.Equal(fuse.OK, status)
+}
+
+func (suite *FsTestSuite) TestAuditLog() {
+	assert := suite.assert
+
+	var out bytes.Buffer
+	suite.fs.Audit = NewAuditLog(&out)
+	defer func() { suite.fs.Audit = nil }()
+
+	_, status := suite.fs.Open("hmac.key", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.Open(".version", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	suite.fs.EnforceOwnership = true
+	defer func() { suite.fs.EnforceOwnership = false }()
+	_, status = suite.fs.Open(".json/secret/Nobody_PgPass", 0, &fuse.Context{Owner: fuse.Owner{Uid: 12345, Gid: 12345}})
+	assert.Equal(fuse.EACCES, status)
+
+	// Only secrets are audited.
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(lines, 2) {
+		assert.Contains(lines[0], `"secret":"hmac.key"`)
+		assert.Contains(lines[0], `"allowed":true`)
+		assert.Contains(lines[1], `"secret":"Nobody_PgPass"`)
+		assert.Contains(lines[1], `"uid":12345`)
+		assert.Contains(lines[1], `"allowed":false`)
+	}
+}
+
+func (suite *FsTestSuite) TestTracing() {
+	assert := suite.assert
+	collector := newFakeCollector()
+	defer collector.Close()
+
+	suite.fs.Tracer = NewTracer(collector.URL, logConfig)
+	defer func() { suite.fs.Tracer = nil }()
+
+	_, status := suite.fs.Open("hmac.key", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	_, status = suite.fs.GetAttr("non-existent", fuseContext)
+	assert.Equal(fuse.ENOENT, status)
+	suite.fs.Tracer.Flush()
+
+	span, ok := collector.span("fuse.Open")
+	if assert.True(ok) {
+		assert.Equal("Open", span.attribute("fuse.op"))
+		assert.Equal(traceHash("hmac.key"), span.attribute("keywhiz.name_hash"))
+		assert.NotEmpty(span.attribute("keywhiz.cache.hit"))
+		assert.Equal(fuse.OK.String(), span.attribute("fuse.status"))
+	}
+	// Not found isn't an error.
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	found := false
+	for _, span := range collector.spans {
+		if span.attribute("keywhiz.name_hash") == traceHash("non-existent") {
+			found = true
+			assert.Equal("fuse.GetAttr", span.Name)
+			assert.Equal(fuse.ENOENT.String(), span.attribute("fuse.status"))
+			assert.Equal(spanStatusOK, span.Status.Code)
+		}
+	}
+	assert.True(found)
 }
 
 func (suite *FsTestSuite) TestStat() {
@@ -339,3 +1086,37 @@ func (suite *FsTestSuite) TestString() {
 	assert := suite.assert
 	assert.Equal(suite.fs.String(), "keywhiz-fs")
 }
+
+func TestFsWithoutClient(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	backend := MapBackend{"db": "password"}
+	kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: _SomeUID, Gid: _SomeUID}, timeouts, metricsHandle, logConfig)
+
+	attr, status := kwfs.GetAttr("db", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(len("password"), attr.Size)
+
+	file, status := kwfs.Open("db", 0, fuseContext)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 100)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("password", string(data))
+
+	// Control files which need a Keywhiz server don't exist.
+	for _, name := range []string{".health", ".json/secrets", ".json/secret/db", ".json/groups", ".json/server_status", ".json/cert_status"} {
+		_, status := kwfs.GetAttr(name, fuseContext)
+		assert.Equal(fuse.ENOENT, status, name)
+	}
+	_, status = kwfs.GetAttr(".json/status", fuseContext)
+	assert.Equal(fuse.OK, status)
+	_, status = kwfs.GetAttr(".json/config", fuseContext)
+	assert.Equal(fuse.OK, status)
+
+	entries, status := kwfs.OpenDir(".json", fuseContext)
+	assert.Equal(fuse.OK, status)
+	assert.Len(entries, 4)
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+// gcpMetadataURL is the GCE metadata server, which GCE_METADATA_HOST overrides.
+var gcpMetadataURL = "http://metadata.google.internal"
+
+// GCPBackend serves secrets from GCP Secret Manager. Secrets whose name starts with a prefix are
+// served under their name without it. The latest enabled version of a secret is its content.
+// Access tokens of the workload's service account are taken from the metadata server.
+type GCPBackend struct {
+	*log.Logger
+	http     *http.Client
+	project  string
+	prefix   string
+	endpoint string
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gcpSecret is a secret as described by the Secret Manager API.
+type gcpSecret struct {
+	// Name is "projects/<project>/secrets/<name>".
+	Name       string            `json:"name"`
+	CreateTime time.Time         `json:"createTime"`
+	Labels     map[string]string `json:"labels"`
+}
+
+// NewGCPBackend returns a backend for the secrets of project whose name starts with prefix.
+func NewGCPBackend(project, prefix string, timeout time.Duration, logConfig log.Config) (*GCPBackend, error) {
+	if project == "" {
+		return nil, errors.New("no GCP project")
+	}
+	return &GCPBackend{
+		Logger:   log.New("kwfs_gcp", logConfig),
+		http:     &http.Client{Timeout: timeout},
+		project:  project,
+		prefix:   prefix,
+		endpoint: "https://secretmanager.googleapis.com",
+	}, nil
+}
+
+// List lists the secrets with the prefix. Listings don't include content or its length, which
+// file attributes need, so each secret's latest version is also read.
+func (b *GCPBackend) List() ([]Secret, bool) {
+	var described []gcpSecret
+	query := url.Values{"pageSize": {"250"}}
+	for {
+		var response struct {
+			Secrets       []gcpSecret `json:"secrets"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		if err := b.get(fmt.Sprintf("/v1/projects/%s/secrets?%s", b.project, query.Encode()), &response); err != nil {
+			b.Errorf("Error listing GCP secrets: %v", err)
+			return nil, false
+		}
+		described = append(described, response.Secrets...)
+		if response.NextPageToken == "" {
+			break
+		}
+		query.Set("pageToken", response.NextPageToken)
+	}
+
+	secrets := []Secret{}
+	for _, d := range described {
+		name := d.Name[strings.LastIndex(d.Name, "/")+1:]
+		if !strings.HasPrefix(name, b.prefix) || name == b.prefix {
+			continue
+		}
+		secret, err := b.secret(d)
+		if _, deleted := err.(SecretDeleted); deleted {
+			continue
+		} else if err != nil {
+			b.Errorf("Error listing GCP secrets: %v", err)
+			return nil, false
+		}
+		secrets = append(secrets, *secret)
+	}
+	return secrets, true
+}
+
+// Fetch reads the latest version of a secret.
+func (b *GCPBackend) Fetch(name string) (*Secret, error) {
+	var d gcpSecret
+	if err := b.get(fmt.Sprintf("/v1/projects/%s/secrets/%s", b.project, url.PathEscape(b.prefix+name)), &d); err != nil {
+		if _, deleted := err.(SecretDeleted); !deleted {
+			b.Errorf("Error retrieving GCP secret %v: %v", name, err)
+		}
+		return nil, err
+	}
+	return b.secret(d)
+}
+
+// Invalidate does nothing, since the backend holds nothing per secret.
+func (b *GCPBackend) Invalidate(name string) {}
+
+// secret reads the latest version of a described secret.
+func (b *GCPBackend) secret(d gcpSecret) (*Secret, error) {
+	var version struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+	}
+	if err := b.get("/v1/"+d.Name+"/versions/latest:access", &version); err != nil {
+		return nil, err
+	}
+	data := version.Payload.Data
+	return &Secret{
+		Name:      strings.TrimPrefix(d.Name[strings.LastIndex(d.Name, "/")+1:], b.prefix),
+		Content:   decodedContent(data),
+		Length:    uint64(len(data)),
+		CreatedAt: d.CreateTime,
+		Mode:      d.Labels[cloudModeTag],
+		Owner:     d.Labels[cloudOwnerTag],
+		Group:     d.Labels[cloudGroupTag],
+	}, nil
+}
+
+// get makes a Secret Manager API request and decodes its response into v. Secrets which don't
+// exist, or have no enabled version, are reported as SecretDeleted.
+func (b *GCPBackend) get(apiPath string, v interface{}) error {
+	token, err := b.accessToken()
+	if err != nil {
+		return fmt.Errorf("no GCP access token: %v", err)
+	}
+	req, err := http.NewRequest("GET", b.endpoint+apiPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	now := time.Now()
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b.Infof("GET %s %d %v", apiPath, resp.StatusCode, time.Since(now))
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.Unmarshal(data, v)
+	case http.StatusNotFound:
+		return SecretDeleted{}
+	default:
+		var failure struct {
+			Error struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(data, &failure)
+		if failure.Error.Status == "FAILED_PRECONDITION" {
+			// The latest version is disabled or destroyed.
+			return SecretDeleted{}
+		}
+		return fmt.Errorf("status %d: %s %s", resp.StatusCode, failure.Error.Status, failure.Error.Message)
+	}
+}
+
+// accessToken returns an access token of the default service account, refreshing it shortly
+// before it expires.
+func (b *GCPBackend) accessToken() (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.token != "" && time.Now().Add(time.Minute).Before(b.expires) {
+		return b.token, nil
+	}
+
+	metadata := gcpMetadataURL
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		metadata = "http://" + host
+	}
+	req, err := http.NewRequest("GET", metadata+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server responded with status %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	b.token, b.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second)
+	return b.token, nil
+}
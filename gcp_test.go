@@ -0,0 +1,82 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCPBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(403)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "ya29.token", "expires_in": 3599, "token_type": "Bearer"}`)
+	}))
+	defer metadata.Close()
+	defer func(u string) { gcpMetadataURL = u }(gcpMetadataURL)
+	gcpMetadataURL = metadata.URL
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ya29.token" {
+			w.WriteHeader(401)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v1/projects/proj/secrets" && r.URL.Query().Get("pageToken") == "":
+			fmt.Fprint(w, `{"secrets": [{"name": "projects/proj/secrets/app-db", "createTime": "2019-01-01T00:00:00Z", "labels": {"kwfs-mode": "0400"}}], "nextPageToken": "2"}`)
+		case r.URL.Path == "/v1/projects/proj/secrets":
+			fmt.Fprint(w, `{"secrets": [{"name": "projects/proj/secrets/other"}, {"name": "projects/proj/secrets/app-disabled"}]}`)
+		case r.URL.Path == "/v1/projects/proj/secrets/app-db":
+			fmt.Fprint(w, `{"name": "projects/proj/secrets/app-db", "labels": {"kwfs-owner": "db"}}`)
+		case r.URL.Path == "/v1/projects/proj/secrets/app-db/versions/latest:access":
+			fmt.Fprint(w, `{"payload": {"data": "cGFzc3dvcmQ="}}`)
+		case r.URL.Path == "/v1/projects/proj/secrets/app-disabled/versions/latest:access":
+			w.WriteHeader(400)
+			fmt.Fprint(w, `{"error": {"code": 400, "status": "FAILED_PRECONDITION", "message": "disabled"}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	backend, err := NewGCPBackend("proj", "app-", time.Second, logConfig)
+	assert.NoError(err)
+	backend.endpoint = server.URL
+
+	secrets, ok := backend.List()
+	assert.True(ok)
+	assert.Len(secrets, 1)
+	assert.Equal("db", secrets[0].Name)
+	assert.Equal("0400", secrets[0].Mode)
+	assert.Equal(2019, secrets[0].CreatedAt.Year())
+
+	secret, err := backend.Fetch("db")
+	assert.NoError(err)
+	assert.Equal("password", string(secret.Content.Bytes()))
+	assert.Equal("db", secret.Owner)
+
+	_, err = backend.Fetch("missing")
+	assert.Equal(SecretDeleted{}, err)
+}
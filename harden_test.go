@@ -0,0 +1,33 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestDisableCoreDumps(t *testing.T) {
+	assert := assert.New(t)
+
+	// Also keeps the test binary from dumping core, which is harmless.
+	assert.NoError(disableCoreDumps())
+
+	var limit unix.Rlimit
+	assert.NoError(unix.Getrlimit(unix.RLIMIT_CORE, &limit))
+	assert.Equal(unix.Rlimit{Cur: 0, Max: 0}, limit)
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// HealthStatus is the state of the mount reported by HealthHandler.
+type HealthStatus struct {
+	Mounted     bool       `json:"mounted"`
+	Mode        string     `json:"mode"`
+	Server      string     `json:"server,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Failures    int64      `json:"failures"`
+	ListedAt    *time.Time `json:"listed_at,omitempty"`
+	Secrets     int        `json:"secrets"`
+	Ready       bool       `json:"ready"`
+}
+
+// HealthHandler serves /healthz and /readyz, so that systemd, Kubernetes or monitoring agents can
+// check the daemon without stat'ing the mountpoint. /healthz succeeds while the filesystem is
+// mounted. /readyz additionally requires secrets to be available, from a listing or an offline
+// bundle, and the server not to be unreachable (see .health). Both respond with a HealthStatus.
+// /debug/vars serves the expvar variables, along with the metrics of the mount.
+type HealthHandler struct {
+	kwfs    *KeywhizFs
+	mounted int32
+}
+
+// NewHealthHandler creates a handler reporting on kwfs, initially unmounted.
+func NewHealthHandler(kwfs *KeywhizFs) *HealthHandler {
+	return &HealthHandler{kwfs: kwfs}
+}
+
+// SetMounted records whether the filesystem is mounted.
+func (h *HealthHandler) SetMounted(mounted bool) {
+	var value int32
+	if mounted {
+		value = 1
+	}
+	atomic.StoreInt32(&h.mounted, value)
+}
+
+// Status returns the current state of the mount.
+func (h *HealthHandler) Status() HealthStatus {
+	status := HealthStatus{Mounted: atomic.LoadInt32(&h.mounted) == 1, Mode: h.kwfs.Cache.Mode()}
+
+	// Without a Keywhiz server, only the availability of secrets is reported.
+	if h.kwfs.Client != nil {
+		var lastSuccess time.Time
+		status.Server, lastSuccess, status.Failures = h.kwfs.Client.Health(h.kwfs.HealthThreshold, h.kwfs.StartTime)
+		if !lastSuccess.IsZero() {
+			status.LastSuccess = &lastSuccess
+		}
+	}
+	listedAt := h.kwfs.Cache.ListedAt()
+	if !listedAt.IsZero() {
+		status.ListedAt = &listedAt
+	}
+	status.Secrets = h.kwfs.Cache.Len()
+
+	available := !listedAt.IsZero() || status.Secrets > 0
+	// Offline, the server isn't needed.
+	reachable := status.Server != healthUnreachable || h.kwfs.Cache.Offline()
+	status.Ready = status.Mounted && available && reachable
+	return status
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := h.Status()
+
+	var ok bool
+	switch r.URL.Path {
+	case "/healthz":
+		ok = status.Mounted
+	case "/readyz":
+		ok = status.Ready
+	case "/debug/vars":
+		var registry metrics.Registry
+		if h.kwfs.Metrics != nil {
+			registry = h.kwfs.Metrics.Registry
+		}
+		serveDebugVars(w, registry)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
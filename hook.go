@@ -0,0 +1,97 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+// changeHookQueue bounds the changes waiting for the hook. Further changes are dropped, with a
+// warning, until it catches up.
+const changeHookQueue = 1024
+
+// ChangeHook runs a command whenever a refresh finds that a secret changed or was deleted, e.g.
+// to reload a service using it. The name of the secret is passed in KEYWHIZ_SECRET, and
+// KEYWHIZ_EVENT is "changed" or "deleted". Commands run one at a time, in the order changes were
+// found, so a burst of rotations doesn't start many reloads at once.
+type ChangeHook struct {
+	*log.Logger
+	command    []string
+	timeout    time.Duration
+	mountpoint string
+	changes    chan SecretChange
+}
+
+// NewChangeHook returns a hook running command, split into its arguments on spaces, and killing
+// it if it takes longer than timeout.
+func NewChangeHook(command string, timeout time.Duration, mountpoint string, logConfig log.Config) (*ChangeHook, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	h := &ChangeHook{log.New("kwfs_hook", logConfig), args, timeout, mountpoint, make(chan SecretChange, changeHookQueue)}
+	go h.run()
+	return h, nil
+}
+
+// Changed queues a run of the hook for change. It never blocks, so it may be registered with
+// Cache.OnChange.
+func (h *ChangeHook) Changed(change SecretChange) {
+	select {
+	case h.changes <- change:
+	default:
+		h.Warnf("Too many changes waiting for the hook, not running it for %s", change.Name)
+	}
+}
+
+func (h *ChangeHook) run() {
+	for change := range h.changes {
+		h.exec(change)
+	}
+}
+
+// exec runs the command for change and logs its outcome, with its output if it failed.
+func (h *ChangeHook) exec(change SecretChange) error {
+	event := "changed"
+	if change.Deleted {
+		event = "deleted"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Env = append(os.Environ(), "KEYWHIZ_SECRET="+change.Name, "KEYWHIZ_EVENT="+event, "KEYWHIZ_MOUNTPOINT="+h.mountpoint)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", h.timeout)
+	}
+	if err != nil {
+		h.Warnf("Hook for %s of %s failed: %v: %s", event, change.Name, err, bytes.TrimSpace(output.Bytes()))
+		return err
+	}
+	h.Infof("Ran hook for %s of %s in %v", event, change.Name, time.Since(start))
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeHook(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_hook")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "hook.sh")
+	out := filepath.Join(dir, "out")
+	assert.NoError(ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$1 $KEYWHIZ_EVENT $KEYWHIZ_SECRET $KEYWHIZ_MOUNTPOINT\" >> \"$2\"\n"), 0755))
+
+	_, err = NewChangeHook("  ", time.Second, "/mnt", logConfig)
+	assert.Error(err)
+
+	hook, err := NewChangeHook(script+" reload "+out, time.Second, "/mnt", logConfig)
+	assert.NoError(err)
+	hook.Changed(SecretChange{Name: "db.pem"})
+	hook.Changed(SecretChange{Name: "old.pem", Deleted: true})
+	expected := "reload changed db.pem /mnt\nreload deleted old.pem /mnt\n"
+	waitFor(func() bool {
+		data, _ := ioutil.ReadFile(out)
+		return string(data) == expected
+	})
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(err)
+	assert.Equal(expected, string(data))
+
+	hook, err = NewChangeHook("sleep 10", 50*time.Millisecond, "/mnt", logConfig)
+	assert.NoError(err)
+	assert.EqualError(hook.exec(SecretChange{Name: "db.pem"}), "timed out after 50ms")
+	hook, err = NewChangeHook("false", time.Second, "/mnt", logConfig)
+	assert.NoError(err)
+	assert.Error(hook.exec(SecretChange{Name: "db.pem"}))
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var passwdFile = "/etc/passwd"
+
+// IDCache caches the ids of the owner and group names of secrets, so that file attributes don't
+// wait on the user database, which may block on LDAP or sssd. Ids older than the refresh interval
+// are served while resolved again in the background; without a refresh interval, nothing is
+// cached. Names which can't be resolved map to the effective uid or gid, like lookupUid and
+// lookupGid, until the next refresh. Names which resolved once keep their id if resolving them
+// again fails.
+type IDCache struct {
+	refresh      time.Duration
+	resolveUser  func(string) (uint32, error)
+	resolveGroup func(string) (uint32, error)
+	now          func() time.Time
+
+	lock   sync.Mutex
+	users  map[string]*cachedID
+	groups map[string]*cachedID
+}
+
+type cachedID struct {
+	id         uint32
+	ok         bool
+	resolved   time.Time
+	refreshing bool
+}
+
+// NewIDCache creates a cache refreshing ids after the given interval. Users are resolved from
+// passwdFile if fromFiles is set, and otherwise from the system's user database. Groups are always
+// resolved from groupFile.
+func NewIDCache(refresh time.Duration, fromFiles bool) *IDCache {
+	resolveUser := resolveUid
+	if fromFiles {
+		resolveUser = resolveUidFromFile
+	}
+	return &IDCache{
+		refresh:      refresh,
+		resolveUser:  resolveUser,
+		resolveGroup: resolveGid,
+		now:          time.Now,
+		users:        map[string]*cachedID{},
+		groups:       map[string]*cachedID{},
+	}
+}
+
+// Uid returns the id of the named user. Without a cache, it is looked up every time.
+func (c *IDCache) Uid(name string) uint32 {
+	if c == nil {
+		return lookupUid(name)
+	}
+	return c.lookup(c.users, name, c.resolveUser, uint32(os.Geteuid()))
+}
+
+// Gid returns the id of the named group. Without a cache, it is looked up every time.
+func (c *IDCache) Gid(name string) uint32 {
+	if c == nil {
+		return lookupGid(name)
+	}
+	return c.lookup(c.groups, name, c.resolveGroup, uint32(os.Getegid()))
+}
+
+// Resolve resolves the owners and groups of secrets which aren't cached yet, e.g. after a listing,
+// so that their attributes never wait on the user database.
+func (c *IDCache) Resolve(secrets []Secret) {
+	for _, s := range secrets {
+		if s.Owner != "" && !c.cached(c.users, s.Owner) {
+			c.resolve(c.users, s.Owner, c.resolveUser)
+		}
+		if s.Group != "" && !c.cached(c.groups, s.Group) {
+			c.resolve(c.groups, s.Group, c.resolveGroup)
+		}
+	}
+}
+
+func (c *IDCache) cached(ids map[string]*cachedID, name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := ids[name]
+	return ok
+}
+
+func (c *IDCache) lookup(ids map[string]*cachedID, name string, resolve func(string) (uint32, error), fallback uint32) uint32 {
+	if c.refresh <= 0 {
+		id, err := resolve(name)
+		if err != nil {
+			log.Printf("Error resolving id of %v: %v\n", name, err)
+			return fallback
+		}
+		return id
+	}
+
+	c.lock.Lock()
+	entry, cached := ids[name]
+	var id uint32
+	var ok bool
+	if cached {
+		id, ok = entry.id, entry.ok
+		if c.now().Sub(entry.resolved) >= c.refresh && !entry.refreshing {
+			entry.refreshing = true
+			go c.resolve(ids, name, resolve)
+		}
+	}
+	c.lock.Unlock()
+
+	if !cached {
+		id, ok = c.resolve(ids, name, resolve)
+	}
+	if !ok {
+		return fallback
+	}
+	return id
+}
+
+// resolve resolves a name and caches the result, which it returns.
+func (c *IDCache) resolve(ids map[string]*cachedID, name string, resolve func(string) (uint32, error)) (uint32, bool) {
+	id, err := resolve(name)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := &cachedID{id: id, ok: err == nil, resolved: c.now()}
+	if err != nil {
+		log.Printf("Error resolving id of %v: %v\n", name, err)
+		if previous, ok := ids[name]; ok && previous.ok {
+			entry.id, entry.ok = previous.id, true
+		}
+	}
+	ids[name] = entry
+	return entry.id, entry.ok
+}
+
+// resolveUidFromFile resolves a user name or numeric uid from passwdFile, without consulting the
+// system's user database.
+func resolveUidFromFile(owner string) (uint32, error) {
+	if uid, err := strconv.ParseUint(owner, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	file, err := os.Open(passwdFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := strings.Split(scanner.Text(), ":")
+		if entry[0] == owner && len(entry) >= 3 {
+			uid, err := strconv.ParseUint(entry[2], 10, 32)
+			if err != nil {
+				return 0, err
+			}
+			return uint32(uid), nil
+		}
+	}
+	return 0, errors.New("no such user")
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDCache(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls, failing, next int32 = 0, 0, 1000
+	resolve := func(name string) (uint32, error) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 || name == "unknown" {
+			return 0, errors.New("unavailable")
+		}
+		return uint32(atomic.LoadInt32(&next)), nil
+	}
+	clock := time.Now()
+	var clockLock sync.Mutex
+	ids := NewIDCache(time.Minute, false)
+	ids.resolveUser, ids.resolveGroup = resolve, resolve
+	ids.now = func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return clock
+	}
+
+	// Resolved once, then cached.
+	assert.EqualValues(1000, ids.Uid("app"))
+	assert.EqualValues(1000, ids.Uid("app"))
+	assert.EqualValues(1, atomic.LoadInt32(&calls))
+	assert.EqualValues(os.Geteuid(), ids.Uid("unknown"))
+	assert.EqualValues(os.Geteuid(), ids.Uid("unknown"))
+	assert.EqualValues(2, atomic.LoadInt32(&calls))
+
+	// Once stale, the cached id is served while resolved again in the background.
+	atomic.StoreInt32(&next, 1001)
+	clockLock.Lock()
+	clock = clock.Add(time.Minute)
+	clockLock.Unlock()
+	assert.EqualValues(1000, ids.Uid("app"))
+	waitFor(func() bool { return ids.Uid("app") == 1001 })
+	assert.EqualValues(1001, ids.Uid("app"))
+
+	// Failures keep the id resolved before.
+	atomic.StoreInt32(&failing, 1)
+	clockLock.Lock()
+	clock = clock.Add(time.Minute)
+	clockLock.Unlock()
+	ids.Uid("app")
+	waitFor(func() bool { return atomic.LoadInt32(&calls) == 4 })
+	assert.EqualValues(1001, ids.Uid("app"))
+
+	// Listed owners and groups are resolved ahead of time.
+	atomic.StoreInt32(&failing, 0)
+	ids.Resolve([]Secret{{Name: "db", Owner: "postgres", Group: "postgres"}})
+	resolved := atomic.LoadInt32(&calls)
+	assert.EqualValues(1001, ids.Uid("postgres"))
+	assert.EqualValues(1001, ids.Gid("postgres"))
+	assert.EqualValues(resolved, atomic.LoadInt32(&calls))
+
+	// Without a refresh interval, nothing is cached.
+	ids.refresh = 0
+	ids.Uid("app")
+	ids.Uid("app")
+	assert.EqualValues(resolved+2, atomic.LoadInt32(&calls))
+}
+
+func TestResolveUidFromFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-ids")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	passwdFile = filepath.Join(dir, "passwd")
+	defer func() { passwdFile = "/etc/passwd" }()
+	assert.NoError(ioutil.WriteFile(passwdFile, []byte("root:x:0:0::/root:/bin/sh\napp:x:1234:1234::/home/app:/bin/sh\n"), 0644))
+
+	uid, err := resolveUidFromFile("app")
+	assert.NoError(err)
+	assert.EqualValues(1234, uid)
+	uid, err = resolveUidFromFile("42")
+	assert.NoError(err)
+	assert.EqualValues(42, uid)
+	_, err = resolveUidFromFile("missing")
+	assert.Error(err)
+}
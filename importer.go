@@ -0,0 +1,120 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DirSecret is a secret read from a directory of secret files, such as one previously
+// populated by hand or by configuration management under /etc/secrets.
+type DirSecret struct {
+	Name    string
+	Content []byte
+	// Mode, Owner and Group are taken from the file and stored as secret metadata, so that
+	// keywhiz-fs presents the secret the same way.
+	Mode  string
+	Owner string
+	Group string
+}
+
+// Metadata returns the Keywhiz metadata describing how the secret file is presented.
+func (s DirSecret) Metadata() map[string]string {
+	metadata := map[string]string{"mode": s.Mode}
+	if s.Owner != "" {
+		metadata["owner"] = s.Owner
+	}
+	if s.Group != "" {
+		metadata["group"] = s.Group
+	}
+	return metadata
+}
+
+// Secret returns the secret as served by keywhiz-fs.
+func (s DirSecret) Secret() Secret {
+	return Secret{
+		Name:    s.Name,
+		Content: decodedContent(s.Content),
+		Length:  uint64(len(s.Content)),
+		Mode:    s.Mode,
+		Owner:   s.Owner,
+		Group:   s.Group,
+	}
+}
+
+// ReadSecretsDir reads the regular files directly inside dir as secrets. Hidden files and
+// subdirectories are skipped.
+func ReadSecretsDir(dir string) (secrets []DirSecret, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") || !info.Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		secret := DirSecret{
+			Name:    info.Name(),
+			Content: content,
+			Mode:    fmt.Sprintf("0%o", info.Mode().Perm()),
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if u, err := user.LookupId(strconv.Itoa(int(stat.Uid))); err == nil {
+				secret.Owner = u.Username
+			}
+			if g, err := user.LookupGroupId(strconv.Itoa(int(stat.Gid))); err == nil {
+				secret.Group = g.Name
+			}
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// ImportSecrets creates the given secrets on the server through the automation API, assigned
+// to groups, which are created first if necessary. Secrets which already exist on the server
+// are left untouched and reported as skipped.
+func ImportSecrets(client *Client, secrets []DirSecret, groups []string) (created, skipped []string, err error) {
+	for _, group := range groups {
+		if err := client.CreateGroup(group); err != nil {
+			return nil, nil, fmt.Errorf("unable to create group %v: %v", group, err)
+		}
+	}
+
+	for _, s := range secrets {
+		err := client.CreateSecret(s.Name, s.Content, s.Metadata(), groups)
+		switch err.(type) {
+		case nil:
+			created = append(created, s.Name)
+		case SecretExists:
+			skipped = append(skipped, s.Name)
+		default:
+			return created, skipped, fmt.Errorf("unable to create secret %v: %v", s.Name, err)
+		}
+	}
+	return created, skipped, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "secrets")
+	panicOnError(err)
+	defer os.RemoveAll(dir)
+	panicOnError(ioutil.WriteFile(filepath.Join(dir, "db.password"), []byte("hunter2"), 0400))
+	panicOnError(ioutil.WriteFile(filepath.Join(dir, "existing"), []byte("old"), 0440))
+	panicOnError(ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("x"), 0400))
+	panicOnError(os.Mkdir(filepath.Join(dir, "subdir"), 0700))
+
+	secrets, err := ReadSecretsDir(dir)
+	assert.NoError(err)
+	assert.Len(secrets, 2)
+	assert.Equal("db.password", secrets[0].Name)
+	assert.Equal("0400", secrets[0].Mode)
+	assert.Equal("0440", secrets[1].Mode)
+
+	var groups []string
+	bodies := map[string]map[string]interface{}{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		name := body["name"].(string)
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/automation/v2/groups":
+			groups = append(groups, name)
+			if name == "Existing" {
+				w.WriteHeader(409)
+				return
+			}
+			w.WriteHeader(201)
+		case r.Method == "POST" && r.URL.Path == "/automation/v2/secrets":
+			bodies[name] = body
+			if name == "existing" {
+				w.WriteHeader(409)
+				return
+			}
+			w.WriteHeader(201)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+
+	created, skipped, err := ImportSecrets(&client, secrets, []string{"Web", "Existing"})
+	assert.NoError(err)
+	assert.Equal([]string{"db.password"}, created)
+	assert.Equal([]string{"existing"}, skipped)
+	assert.Equal([]string{"Web", "Existing"}, groups)
+
+	body := bodies["db.password"]
+	assert.Equal("aHVudGVyMg==", body["content"])
+	assert.Equal([]interface{}{"Web", "Existing"}, body["groups"])
+	assert.Equal("0400", body["metadata"].(map[string]interface{})["mode"])
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"hash/fnv"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// stableInode derives the inode number reported for a path from the path alone, so a secret
+// keeps its inode number across remounts and restarts whatever order files are looked up in.
+// Inode 1 is left to the root directory.
+func stableInode(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	ino := h.Sum64()
+	if ino <= 1 {
+		ino += 2
+	}
+	return ino
+}
+
+// withInode sets the stable inode number of name in attr, unless stable inodes are disabled.
+func (kwfs KeywhizFs) withInode(name string, attr *fuse.Attr) {
+	if kwfs.StableInodes && name != "" && attr != nil {
+		attr.Ino = stableInode(name)
+	}
+}
+
+// inodeFile reports the stable inode number of an open file, so fstat agrees with stat.
+type inodeFile struct {
+	nodefs.File
+	kwfs KeywhizFs
+	name string
+}
+
+// withFileInode wraps an opened file so its attributes carry the stable inode number of name.
+// As with withRecovery, the wrapper goes inside any nodefs.WithFlags.
+func (kwfs KeywhizFs) withFileInode(name string, file nodefs.File) nodefs.File {
+	if !kwfs.StableInodes {
+		return file
+	}
+	if flags, ok := file.(*nodefs.WithFlags); ok {
+		wrapped := *flags
+		wrapped.File = kwfs.withFileInode(name, flags.File)
+		return &wrapped
+	}
+	return &inodeFile{File: file, kwfs: kwfs, name: name}
+}
+
+func (f *inodeFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *inodeFile) GetAttr(out *fuse.Attr) fuse.Status {
+	status := f.File.GetAttr(out)
+	if status == fuse.OK {
+		f.kwfs.withInode(f.name, out)
+	}
+	return status
+}
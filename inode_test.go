@@ -0,0 +1,98 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStableInode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(stableInode("secret"), stableInode("secret"))
+	assert.NotEqual(stableInode("secret"), stableInode("secret2"))
+	assert.NotEqual(stableInode("secret"), stableInode(".json/secret/secret"))
+	assert.True(stableInode("") > 1)
+}
+
+func TestStableInodeAttrs(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	backend := MapBackend{"secret": "content"}
+	context := &fuse.Context{}
+	mount := func() *KeywhizFs {
+		kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+		kwfs.Cache.SecretList()
+		return kwfs
+	}
+
+	// Without StableInodes, inode numbers are left to go-fuse.
+	kwfs := mount()
+	attr, status := kwfs.GetAttr("secret", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0, attr.Ino)
+
+	kwfs.StableInodes = true
+	attr, status = kwfs.GetAttr("secret", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal(stableInode("secret"), attr.Ino)
+	attr, status = kwfs.GetAttr("", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(0, attr.Ino)
+
+	file, status := kwfs.Open("secret", 0, context)
+	assert.Equal(fuse.OK, status)
+	var fileAttr fuse.Attr
+	assert.Equal(fuse.OK, file.GetAttr(&fileAttr))
+	assert.Equal(stableInode("secret"), fileAttr.Ino)
+
+	// A new mount reports the same inode numbers.
+	remount := mount()
+	remount.StableInodes = true
+	attr, status = remount.GetAttr("secret", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal(stableInode("secret"), attr.Ino)
+}
+
+func TestStableInodeProfileFile(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	kwfs, _, _ := NewKeywhizFs(nil, MapBackend{}, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	kwfs.StableInodes = true
+
+	// Profiles are served with direct I/O, which go-fuse only sees on the outermost file.
+	file, status := kwfs.Open(".pprof/heap", 0, &fuse.Context{})
+	assert.Equal(fuse.OK, status)
+	flags, ok := file.(*nodefs.WithFlags)
+	if assert.True(ok, "flags outermost") {
+		assert.NotZero(flags.FuseFlags & fuse.FOPEN_DIRECT_IO)
+	}
+
+	var attr fuse.Attr
+	assert.Equal(fuse.OK, file.GetAttr(&attr))
+	assert.Equal(stableInode(".pprof/heap"), attr.Ino)
+
+	buf := make([]byte, 4096)
+	res, status := file.Read(buf, 0)
+	assert.Equal(fuse.OK, status)
+	data, _ := res.Bytes(buf)
+	assert.NotEmpty(data, "profile readable")
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// fieldsSuffix is appended to the name of a secret holding a JSON object or array to name the
+// directory exposing its fields, e.g. db.json.d/password.
+const fieldsSuffix = ".d"
+
+// jsonFieldPath splits name into the name of a secret and the key path of a field within its
+// JSON content, if JSONFields is set and name is the fields directory of a known secret or is
+// within it. The key path is empty for the directory itself.
+func (kwfs KeywhizFs) jsonFieldPath(name string) (secret string, path []string, ok bool) {
+	if !kwfs.JSONFields {
+		return "", nil, false
+	}
+	for i := 0; i < len(name); i++ {
+		j := strings.Index(name[i:], fieldsSuffix)
+		if j < 0 {
+			break
+		}
+		end := i + j + len(fieldsSuffix)
+		if j > 0 && (end == len(name) || name[end] == '/') && kwfs.Cache.Known(name[:i+j]) {
+			if end < len(name) {
+				path = strings.Split(name[end+1:], "/")
+			}
+			return name[:i+j], path, true
+		}
+		i += j
+	}
+	return "", nil, false
+}
+
+// jsonField returns the value at path in JSON content. Objects are indexed by key and arrays by
+// position.
+func jsonField(content []byte, path []string) (interface{}, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false
+	}
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			field, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = field
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) || strconv.Itoa(i) != key {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// isFieldDirectory returns true for JSON objects and arrays, which are exposed as directories.
+func isFieldDirectory(value interface{}) bool {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+// fieldContent returns the content of the file of a scalar JSON value: strings as they are, so
+// that passwords can be read without unquoting, and other values as JSON.
+func fieldContent(value interface{}) []byte {
+	if s, ok := value.(string); ok {
+		return []byte(s)
+	}
+	data, _ := json.Marshal(value)
+	return data
+}
+
+// fieldEntries lists the fields of a JSON object or array. Keys which can't be file names are
+// left out.
+func fieldEntries(value interface{}) []fuse.DirEntry {
+	entries := []fuse.DirEntry{}
+	add := func(name string, field interface{}) {
+		mode := uint32(fuse.S_IFREG)
+		if isFieldDirectory(field) {
+			mode = fuse.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: mode})
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var keys []string
+		for key := range v {
+			if key != "" && key != "." && key != ".." && !strings.ContainsAny(key, "/\x00") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			add(key, v[key])
+		}
+	case []interface{}:
+		for i, field := range v {
+			add(strconv.Itoa(i), field)
+		}
+	}
+	return entries
+}
+
+// field looks up the field of a secret's JSON content at path, checking that the caller may
+// access the secret.
+func (kwfs KeywhizFs) field(name string, path []string, context *fuse.Context) (*Secret, interface{}, fuse.Status) {
+	secret, ok := kwfs.Cache.Secret(name)
+	if !ok {
+		return nil, nil, kwfs.unavailableStatus(name)
+	}
+	if !kwfs.allowed(secret, context) {
+		kwfs.Warnf("Denied access to %s by uid %d, with gid %d", name, context.Uid, context.Gid)
+		kwfs.Audit.Record(name, context, false, false)
+		return nil, nil, fuse.EACCES
+	}
+	value, ok := jsonField(secret.Content.Bytes(), path)
+	if !ok || len(path) == 0 && !isFieldDirectory(value) {
+		return nil, nil, fuse.ENOENT
+	}
+	return secret, value, fuse.OK
+}
+
+// fieldAttr returns the attributes of a field of a secret: those of the secret, with the size
+// of the field, and directories searchable by those who may read the secret.
+func (kwfs KeywhizFs) fieldAttr(secret *Secret, value interface{}) *fuse.Attr {
+	attr := kwfs.secretAttr(secret)
+	mode := attr.Mode & 07777 &^ 0222
+	if isFieldDirectory(value) {
+		attr.Mode = fuse.S_IFDIR | mode | (mode&0444)>>2
+		attr.Size = 4096
+		attr.Nlink = 2
+	} else {
+		attr.Mode = fuse.S_IFREG | mode
+		attr.Size = uint64(len(fieldContent(value)))
+	}
+	return attr
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONField(t *testing.T) {
+	assert := assert.New(t)
+
+	content := []byte(`{"user": "app", "port": 5432, "tls": true, "hosts": ["a", "b"], "opts": {"ssl": {"mode": "verify"}}}`)
+	cases := []struct {
+		path    []string
+		content string
+		ok      bool
+	}{
+		{[]string{"user"}, "app", true},
+		{[]string{"port"}, "5432", true},
+		{[]string{"tls"}, "true", true},
+		{[]string{"hosts", "1"}, "b", true},
+		{[]string{"opts", "ssl", "mode"}, "verify", true},
+		{[]string{"hosts", "2"}, "", false},
+		{[]string{"hosts", "01"}, "", false},
+		{[]string{"user", "name"}, "", false},
+		{[]string{"missing"}, "", false},
+	}
+	for _, c := range cases {
+		value, ok := jsonField(content, c.path)
+		assert.Equal(c.ok, ok, "%v", c.path)
+		if ok {
+			assert.Equal(c.content, string(fieldContent(value)), "%v", c.path)
+		}
+	}
+
+	value, ok := jsonField(content, nil)
+	assert.True(ok)
+	assert.Equal([]fuse.DirEntry{
+		{Name: "hosts", Mode: fuse.S_IFDIR},
+		{Name: "opts", Mode: fuse.S_IFDIR},
+		{Name: "port", Mode: fuse.S_IFREG},
+		{Name: "tls", Mode: fuse.S_IFREG},
+		{Name: "user", Mode: fuse.S_IFREG},
+	}, fieldEntries(value))
+
+	_, ok = jsonField([]byte("not json"), nil)
+	assert.False(ok)
+}
+
+func TestJSONFieldFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	backend := MapBackend{"db.json": `{"username": "app", "password": "hunter2", "replicas": ["r1"]}`, "plain": "text"}
+	kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: 12345, Gid: 12345}, timeouts, nil, logConfig)
+	context := &fuse.Context{}
+	kwfs.Cache.SecretList()
+
+	// Without JSONFields, there are no field files.
+	_, status := kwfs.GetAttr("db.json.d/password", context)
+	assert.Equal(fuse.ENOENT, status)
+
+	kwfs.JSONFields = true
+	attr, status := kwfs.GetAttr("db.json.d", context)
+	assert.Equal(fuse.OK, status)
+	assert.True(attr.IsDir())
+	entries, status := kwfs.OpenDir("db.json.d", context)
+	assert.Equal(fuse.OK, status)
+	assert.Len(entries, 3)
+
+	attr, status = kwfs.GetAttr("db.json.d/password", context)
+	assert.Equal(fuse.OK, status)
+	assert.EqualValues(len("hunter2"), attr.Size)
+	assert.EqualValues(12345, attr.Uid)
+	file, status := kwfs.Open("db.json.d/password", 0, context)
+	assert.Equal(fuse.OK, status)
+	buf := make([]byte, 100)
+	res, _ := file.Read(buf, 0)
+	data, _ := res.Bytes(buf)
+	assert.Equal("hunter2", string(data))
+
+	entries, status = kwfs.OpenDir("db.json.d/replicas", context)
+	assert.Equal(fuse.OK, status)
+	assert.Equal([]fuse.DirEntry{{Name: "0", Mode: fuse.S_IFREG}}, entries)
+
+	_, status = kwfs.Open("db.json.d/replicas", 0, context)
+	assert.Equal(fuseEISDIR, status)
+	for _, name := range []string{"db.json.d/missing", "plain.d", "plain.d/x", "other.d"} {
+		_, status = kwfs.GetAttr(name, context)
+		assert.Equal(fuse.ENOENT, status, name)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keyringPrefix marks key arguments which name a key in the kernel keyring rather than a file,
+// as keyring:KEYRING:NAME.
+const keyringPrefix = "keyring:"
+
+// Special IDs of the keyrings keys can be read from and stored in.
+const (
+	keySpecSessionKeyring = -3
+	keySpecUserKeyring    = -4
+)
+
+// keyringKey is a "user" key in the kernel keyring, such as the key of the offline bundle, which
+// is then never written to disk next to the bundle.
+type keyringKey struct {
+	// Keyring is session, for the keyring of the login session, or user, for the keyring shared
+	// by all processes of the user.
+	Keyring string
+	Name    string
+}
+
+// KeyNotFound is returned when the keyring doesn't contain the key.
+type KeyNotFound struct {
+	Key keyringKey
+}
+
+func (e KeyNotFound) Error() string {
+	return fmt.Sprintf("no key %s in the %s keyring", e.Key.Name, e.Key.Keyring)
+}
+
+// isKeyringKey returns true if a key argument names a key in the kernel keyring.
+func isKeyringKey(arg string) bool {
+	return strings.HasPrefix(arg, keyringPrefix)
+}
+
+// parseKeyringKey parses a keyring:KEYRING:NAME key argument.
+func parseKeyringKey(arg string) (keyringKey, error) {
+	parts := strings.SplitN(strings.TrimPrefix(arg, keyringPrefix), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return keyringKey{}, fmt.Errorf("invalid key %q, expected keyring:session:NAME or keyring:user:NAME", arg)
+	}
+	key := keyringKey{parts[0], parts[1]}
+	if _, err := key.ring(); err != nil {
+		return keyringKey{}, err
+	}
+	return key, nil
+}
+
+// ring returns the special ID of the keyring holding the key.
+func (k keyringKey) ring() (int, error) {
+	switch k.Keyring {
+	case "session":
+		return keySpecSessionKeyring, nil
+	case "user":
+		return keySpecUserKeyring, nil
+	}
+	return 0, fmt.Errorf("unknown keyring %q, expected session or user", k.Keyring)
+}
+
+// Read returns the payload of the key.
+func (k keyringKey) Read() ([]byte, error) {
+	ring, err := k.ring()
+	if err != nil {
+		return nil, err
+	}
+	id, err := keyringSearch(ring, k.Name)
+	if err == errNoKey {
+		return nil, KeyNotFound{k}
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to find key %s in the %s keyring: %v", k.Name, k.Keyring, err)
+	}
+	data, err := keyringRead(id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key %s from the %s keyring: %v", k.Name, k.Keyring, err)
+	}
+	return data, nil
+}
+
+// Store adds the key to its keyring, replacing the payload of an existing key with the same name.
+func (k keyringKey) Store(payload []byte) error {
+	ring, err := k.ring()
+	if err != nil {
+		return err
+	}
+	if err := keyringAdd(ring, k.Name, payload); err != nil {
+		return fmt.Errorf("unable to store key %s in the %s keyring: %v", k.Name, k.Keyring, err)
+	}
+	return nil
+}
+
+// readKeyringKey reads the key named by a keyring:KEYRING:NAME argument.
+func readKeyringKey(arg string) ([]byte, error) {
+	key, err := parseKeyringKey(arg)
+	if err != nil {
+		return nil, err
+	}
+	return key.Read()
+}
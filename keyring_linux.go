@@ -0,0 +1,88 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// keyctl(2) operations.
+const (
+	keyctlSearch = 10
+	keyctlRead   = 11
+)
+
+// errNoKey is returned by keyringSearch when the keyring doesn't contain the key.
+var errNoKey error = syscall.ENOKEY
+
+// keyringSearch returns the ID of the "user" key with the given description in a keyring, or in
+// the keyrings linked from it.
+func keyringSearch(ring int, description string) (int, error) {
+	keyType, desc, err := keyStrings(description)
+	if err != nil {
+		return 0, err
+	}
+	id, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlSearch, uintptr(ring), uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(desc)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(id), nil
+}
+
+// keyringRead returns the payload of a key.
+func keyringRead(id int) ([]byte, error) {
+	size := 64
+	for {
+		buf := make([]byte, size)
+		n, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, uintptr(id), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+		if errno != 0 {
+			return nil, errno
+		}
+		// The payload length is returned even if it didn't fit.
+		if int(n) <= len(buf) {
+			return buf[:n], nil
+		}
+		size = int(n)
+	}
+}
+
+// keyringAdd adds a "user" key with the given description and payload to a keyring.
+func keyringAdd(ring int, description string, payload []byte) error {
+	keyType, desc, err := keyStrings(description)
+	if err != nil {
+		return err
+	}
+	var data unsafe.Pointer
+	if len(payload) > 0 {
+		data = unsafe.Pointer(&payload[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_ADD_KEY, uintptr(unsafe.Pointer(keyType)), uintptr(unsafe.Pointer(desc)), uintptr(data), uintptr(len(payload)), uintptr(ring), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// keyStrings returns the key type and description as C strings.
+func keyStrings(description string) (keyType, desc *byte, err error) {
+	if keyType, err = syscall.BytePtrFromString("user"); err != nil {
+		return nil, nil, err
+	}
+	if desc, err = syscall.BytePtrFromString(description); err != nil {
+		return nil, nil, err
+	}
+	return keyType, desc, nil
+}
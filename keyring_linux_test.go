@@ -0,0 +1,97 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testKeyringKey returns a key in the session keyring which is unlinked when the test ends. The
+// test is skipped where the keyring can't be used, e.g. in containers which filter keyctl(2).
+func testKeyringKey(t *testing.T) keyringKey {
+	key := keyringKey{"session", fmt.Sprintf("keywhiz-fs-test-%d", time.Now().UnixNano())}
+	if err := key.Store([]byte("probe")); err != nil {
+		t.Skipf("kernel keyring unavailable: %v", err)
+	}
+	t.Cleanup(func() { unlinkSessionKey(key.Name) })
+	return key
+}
+
+// unlinkSessionKey removes a key from the session keyring, if it is there.
+func unlinkSessionKey(name string) {
+	if id, err := keyringSearch(keySpecSessionKeyring, name); err == nil {
+		ring := keySpecSessionKeyring
+		syscall.Syscall(syscall.SYS_KEYCTL, 9, uintptr(id), uintptr(ring)) // KEYCTL_UNLINK
+	}
+}
+
+func TestKeyringKeyRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	key := testKeyringKey(t)
+	data, err := key.Read()
+	assert.NoError(err)
+	assert.Equal("probe", string(data))
+
+	// Storing again replaces the payload.
+	long := make([]byte, 200)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	assert.NoError(key.Store(long))
+	data, err = key.Read()
+	assert.NoError(err)
+	assert.Equal(long, data)
+
+	_, err = keyringKey{"session", key.Name + "-missing"}.Read()
+	assert.Equal(KeyNotFound{keyringKey{"session", key.Name + "-missing"}}, err)
+}
+
+func TestBundleKeyFromKeyring(t *testing.T) {
+	assert := assert.New(t)
+
+	key := testKeyringKey(t)
+	missing := keyringKey{"session", key.Name + "-generated"}
+	arg := keyringPrefix + "session:" + missing.Name
+	t.Cleanup(func() { unlinkSessionKey(missing.Name) })
+
+	// Reading a missing key fails, while sealing generates and stores it.
+	_, err := readBundleKey(arg)
+	assert.IsType(KeyNotFound{}, err)
+	sealing, generated, err := sealingBundleKey(arg)
+	assert.NoError(err)
+	assert.True(generated)
+	assert.Len(sealing, 32)
+
+	opening, err := readBundleKey(arg)
+	assert.NoError(err)
+	assert.Equal(sealing, opening)
+	again, generated, err := sealingBundleKey(arg)
+	assert.NoError(err)
+	assert.False(generated)
+	assert.Equal(sealing, again)
+
+	// Keys hold the same hex-encoded payload as key files.
+	assert.NoError(key.Store([]byte(hex.EncodeToString(sealing) + "\n")))
+	fromKey, err := readBundleKey(keyringPrefix + "session:" + key.Name)
+	assert.NoError(err)
+	assert.Equal(sealing, fromKey)
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyringKey(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isKeyringKey("keyring:user:bundle"))
+	assert.False(isKeyringKey("bundle.key"))
+
+	key, err := parseKeyringKey("keyring:session:keywhiz:bundle")
+	assert.NoError(err)
+	assert.Equal(keyringKey{"session", "keywhiz:bundle"}, key)
+
+	_, err = parseKeyringKey("keyring:user:")
+	assert.Error(err)
+	_, err = parseKeyringKey("keyring:user")
+	assert.Error(err)
+	_, err = parseKeyringKey("keyring:thread:bundle")
+	assert.EqualError(err, `unknown keyring "thread", expected session or user`)
+}
+
+func TestBundleKeyBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	backup := bundleKeyBackup("keyring:user:bundle")
+	assert.Contains(backup, `"keyctl pipe %user:bundle > FILE"`)
+	assert.Contains(backup, `"keyctl padd user bundle @u < FILE"`)
+	assert.Equal("", bundleKeyBackup("bundle.key"))
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// errNoKey is never returned where the kernel keyring isn't supported.
+var errNoKey = errors.New("no such key")
+
+var errKeyringUnsupported = errors.New("the kernel keyring is only supported on Linux")
+
+func keyringSearch(ring int, description string) (int, error) {
+	return 0, errKeyringUnsupported
+}
+
+func keyringRead(id int) ([]byte, error) {
+	return nil, errKeyringUnsupported
+}
+
+func keyringAdd(ring int, description string, payload []byte) error {
+	return errKeyringUnsupported
+}
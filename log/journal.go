@@ -0,0 +1,133 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// journalSocket is where journald receives messages in its native protocol.
+var journalSocket = "/run/systemd/journal/socket"
+
+// journalIdentifier is the SYSLOG_IDENTIFIER of messages, for journalctl -t.
+const journalIdentifier = "keywhiz-fs"
+
+// journalPriorities are the syslog priorities of levels.
+var journalPriorities = map[string]int{
+	LevelError: 3,
+	LevelWarn:  4,
+	LevelInfo:  6,
+	LevelDebug: 7,
+}
+
+// journalLog sends messages to the systemd journal, with their fields as journal fields, so
+// that journalctl can filter on them, e.g. journalctl OP=Open UID=1000.
+type journalLog struct {
+	conn       *net.UnixConn
+	component  string
+	mountpoint string
+}
+
+// newJournalLog connects to the journal.
+func newJournalLog(component, mountpoint string) (*journalLog, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalLog{conn, component, mountpoint}, nil
+}
+
+// format encodes a message in the journal's native protocol. Field names are upper-cased, the
+// secret field becomes SECRET_NAME, holding a hash of the name like traces do, and durations
+// become DURATION_MS, in milliseconds.
+func (j *journalLog) format(level, msg string, fields Fields) []byte {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", msg)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(journalPriorities[level]))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", journalIdentifier)
+	writeJournalField(&buf, "COMPONENT", j.component)
+	writeJournalField(&buf, "MOUNTPOINT", j.mountpoint)
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name, value := journalFieldName(k), fields[k]
+		switch v := value.(type) {
+		case time.Duration:
+			name, value = name+"_MS", float64(v)/float64(time.Millisecond)
+		}
+		if name == "SECRET" {
+			name, value = "SECRET_NAME", hashName(fmt.Sprint(value))
+		}
+		if name != "" {
+			writeJournalField(&buf, name, fmt.Sprint(value))
+		}
+	}
+	return buf.Bytes()
+}
+
+// write sends a formatted message.
+func (j *journalLog) write(data []byte) error {
+	_, err := j.conn.Write(data)
+	return err
+}
+
+// journalFieldName turns a field name into a journal field name, made of upper-case letters,
+// digits and underscores, not starting with an underscore, which journald reserves.
+func journalFieldName(name string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+	return strings.TrimLeft(mapped, "_0123456789")
+}
+
+// writeJournalField appends a field. Values with newlines are length-prefixed.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// hashName returns the first 8 bytes of the SHA-256 of a name, hex-encoded, so that messages
+// about a secret can be found without recording its name.
+func hashName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	j := &journalLog{component: "kwfs", mountpoint: "/tmp/mnt"}
+	data := j.format(LevelWarn, "Open('db.pem') EACCES", Fields{
+		"op":         "Open",
+		"secret":     "db.pem",
+		"uid":        uint32(1000),
+		"duration":   1500 * time.Microsecond,
+		"request_id": "abc",
+		"_hidden":    "x",
+	})
+	assert.Equal("MESSAGE=Open('db.pem') EACCES\n"+
+		"PRIORITY=4\n"+
+		"SYSLOG_IDENTIFIER=keywhiz-fs\n"+
+		"COMPONENT=kwfs\n"+
+		"MOUNTPOINT=/tmp/mnt\n"+
+		"HIDDEN=x\n"+
+		"DURATION_MS=1.5\n"+
+		"OP=Open\n"+
+		"REQUEST_ID=abc\n"+
+		"SECRET_NAME="+hashName("db.pem")+"\n"+
+		"UID=1000\n", string(data))
+
+	// Values spanning lines are length-prefixed.
+	data = j.format(LevelError, "two\nlines", nil)
+	assert.True(strings.HasPrefix(string(data), "MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\nPRIORITY=3\n"))
+}
+
+func TestJournalFieldName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("REQUEST_ID", journalFieldName("request_id"))
+	assert.Equal("OP", journalFieldName("op"))
+	assert.Equal("A_B", journalFieldName("a.b"))
+	assert.Equal("X", journalFieldName("_1x"))
+}
+
+func TestJournalLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_journal")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func(socket string) { journalSocket = socket }(journalSocket)
+	journalSocket = filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	assert.NoError(err)
+	defer conn.Close()
+
+	logger := New("kwfs_test", Config{Mountpoint: "/tmp/mnt", Journal: true})
+	defer logger.Close()
+	assert.NotNil(logger.journal)
+	logger.Log(LevelInfo, Fields{"op": "GET /secret"}, "GET /secret/%s 200", "foo")
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	assert.NoError(err)
+	assert.Contains(string(buf[:n]), "MESSAGE=GET /secret/foo 200\nPRIORITY=6\n")
+	assert.Contains(string(buf[:n]), "OP=GET /secret\n")
+}
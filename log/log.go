@@ -15,10 +15,13 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/syslog"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,15 +33,67 @@ const (
 	workQueueMaxBacklog = 25
 )
 
+// Log formats.
+const (
+	// FormatText emits free text lines prefixed with level and component (the default).
+	FormatText = "text"
+	// FormatJSON emits a JSON object per line, for ingestion by centralized logging.
+	FormatJSON = "json"
+)
+
+// Levels of log messages.
+const (
+	LevelError = "error"
+	LevelWarn  = "warn"
+	LevelInfo  = "info"
+	LevelDebug = "debug"
+)
+
+// debugOverride overrides the debug setting of all loggers at runtime: debugOn enables and
+// debugOff disables debugging output. Zero keeps the configured setting.
+var debugOverride int32
+
+const (
+	debugOn  = 1
+	debugOff = 2
+)
+
+// SetDebug enables or disables debugging output of all loggers, regardless of their configuration.
+func SetDebug(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&debugOverride, debugOn)
+	} else {
+		atomic.StoreInt32(&debugOverride, debugOff)
+	}
+}
+
+// Fields are structured values attached to a log message, such as op, secret, status and
+// duration. They are only emitted in JSON format and to the journal; text messages are expected
+// to include them.
+type Fields map[string]interface{}
+
 // Logger maintains state of log emitters for different severity levels.
 type Logger struct {
-	syslog   *syslog.Writer
+	syslog   syslogWriter
 	errorLog *log.Logger
 	warnLog  *log.Logger
 	infoLog  *log.Logger
 	debugLog *log.Logger
 	queue    chan func()
 	debug    bool
+	json     *jsonLog
+	journal  *journalLog
+	// syslogPrefix is prepended to text messages sent to syslog with a configured tag, so that
+	// the component remains visible.
+	syslogPrefix string
+}
+
+// jsonLog holds what is needed to emit JSON lines.
+type jsonLog struct {
+	component  string
+	mountpoint string
+	stdout     io.Writer
+	stderr     io.Writer
 }
 
 // Config contains values necessary for configurating a logger.
@@ -46,6 +101,18 @@ type Config struct {
 	Debug      bool
 	Mountpoint string
 	Syslog     bool
+	// SyslogFacility is the name of the syslog facility, e.g. daemon or local0. Empty means user.
+	SyslogFacility string
+	// SyslogTag replaces the component and mountpoint as syslog tag, which then prefix messages.
+	SyslogTag string
+	// SyslogAddress sends syslog messages to a remote server instead of the local one, as
+	// udp://, tcp:// or tls://HOST:PORT. SyslogCA verifies a TLS server instead of system roots.
+	SyslogAddress string
+	SyslogCA      string
+	// Format is FormatText or FormatJSON. Empty means FormatText.
+	Format string
+	// Journal sends messages to the systemd journal, with structured fields, instead.
+	Journal bool
 }
 
 // New initializes a Logger for a given component and with debugging output on/off.
@@ -58,18 +125,40 @@ func New(component string, config Config) *Logger {
 	infoLog := log.New(os.Stdout, fmt.Sprintf("INFO %v: ", name), flags)
 	debugLog := log.New(os.Stdout, fmt.Sprintf("DEBUG %v: ", name), flags)
 
-	var syslogWriter *syslog.Writer
-	if config.Syslog {
+	var syslogWriter syslogWriter
+	if config.Syslog || config.SyslogAddress != "" {
+		tag := name
+		if config.SyslogTag != "" {
+			tag = config.SyslogTag
+		}
 		var err error
-		syslogWriter, err = syslog.New(syslog.LOG_NOTICE|defaultSyslogFacility, name)
+		syslogWriter, err = newSyslog(config, tag)
 		if err != nil {
 			errorLog.Printf("Error starting syslog logging, continuing: %v\n", err)
 			syslogWriter = nil
 		}
 	}
 
+	var journal *journalLog
+	if config.Journal {
+		var err error
+		journal, err = newJournalLog(component, config.Mountpoint)
+		if err != nil {
+			errorLog.Printf("Error starting journal logging, continuing: %v\n", err)
+			journal = nil
+		}
+	}
+
+	var jsonLogger *jsonLog
+	if config.Format == FormatJSON {
+		jsonLogger = &jsonLog{component, config.Mountpoint, os.Stdout, os.Stderr}
+	}
+
 	queue := make(chan func(), workQueueMaxBacklog)
-	logger := &Logger{syslogWriter, errorLog, warnLog, infoLog, debugLog, queue, config.Debug}
+	logger := &Logger{syslogWriter, errorLog, warnLog, infoLog, debugLog, queue, config.Debug, jsonLogger, journal, ""}
+	if config.SyslogTag != "" {
+		logger.syslogPrefix = name + ": "
+	}
 	go logger.process()
 	return logger
 }
@@ -101,61 +190,128 @@ func (l Logger) process() {
 
 // Errorf emits messages at ERROR level with a printf style interface.
 func (l Logger) Errorf(format string, v ...interface{}) {
-	worker := func() {
-		msg := fmt.Sprintf(format, v...)
-		if l.syslog != nil {
-			l.syslog.Err(msg)
-		} else {
-			l.errorLog.Println(msg)
-		}
-	}
-	l.nonBlockingEnqueue(worker)
+	l.Log(LevelError, nil, format, v...)
 }
 
 // Warnf emits messages at WARN level with a printf style interface.
 func (l Logger) Warnf(format string, v ...interface{}) {
-	worker := func() {
-		msg := fmt.Sprintf(format, v...)
-		if l.syslog != nil {
-			l.syslog.Warning(msg)
-		} else {
-			l.warnLog.Println(msg)
-		}
-	}
-	l.nonBlockingEnqueue(worker)
+	l.Log(LevelWarn, nil, format, v...)
 }
 
 // Infof emits messages at INFO level with a printf style interface.
 func (l Logger) Infof(format string, v ...interface{}) {
+	l.Log(LevelInfo, nil, format, v...)
+}
+
+// Debugf emits messages at DEBUG level with a printf style interface if debugging was enabled.
+func (l Logger) Debugf(format string, v ...interface{}) {
+	l.Log(LevelDebug, nil, format, v...)
+}
+
+// Log emits a message with structured fields at the given level (LevelError, LevelWarn,
+// LevelInfo or LevelDebug). Debug messages are only emitted if debugging was enabled.
+func (l Logger) Log(level string, fields Fields, format string, v ...interface{}) {
 	worker := func() {
-		msg := fmt.Sprintf(format, v...)
+		if level == LevelDebug && !l.DebugEnabled() {
+			return
+		}
+		msg := Redact(fmt.Sprintf(format, v...))
+		fields = redactFields(fields)
+		// Messages the journal refuses, e.g. for their size, are logged as without it.
+		if l.journal != nil && l.journal.write(l.journal.format(level, msg, fields)) == nil {
+			return
+		}
+		if l.json != nil {
+			msg = l.json.format(level, msg, fields)
+		}
+
 		if l.syslog != nil {
-			l.syslog.Info(msg)
+			if l.json == nil {
+				msg = l.syslogPrefix + msg
+			}
+			l.toSyslog(level, msg)
+		} else if l.json != nil {
+			l.json.write(level, msg)
 		} else {
-			l.infoLog.Println(msg)
+			l.textLog(level).Println(msg)
 		}
 	}
 	l.nonBlockingEnqueue(worker)
 }
 
-// Debugf emits messages at DEBUG level with a printf style interface if debugging was enabled.
-func (l Logger) Debugf(format string, v ...interface{}) {
-	worker := func() {
-		if l.debug {
-			msg := fmt.Sprintf(format, v...)
-			if l.syslog != nil {
-				l.syslog.Debug(msg)
-			} else {
-				l.debugLog.Println(msg)
-			}
+// DebugEnabled returns true if debug messages are emitted.
+func (l Logger) DebugEnabled() bool {
+	switch atomic.LoadInt32(&debugOverride) {
+	case debugOn:
+		return true
+	case debugOff:
+		return false
+	}
+	return l.debug
+}
+
+func (l Logger) toSyslog(level, msg string) {
+	switch level {
+	case LevelError:
+		l.syslog.Err(msg)
+	case LevelWarn:
+		l.syslog.Warning(msg)
+	case LevelInfo:
+		l.syslog.Info(msg)
+	default:
+		l.syslog.Debug(msg)
+	}
+}
+
+func (l Logger) textLog(level string) *log.Logger {
+	switch level {
+	case LevelError:
+		return l.errorLog
+	case LevelWarn:
+		return l.warnLog
+	case LevelInfo:
+		return l.infoLog
+	default:
+		return l.debugLog
+	}
+}
+
+// format encodes a message as a JSON object. Durations are encoded in milliseconds.
+func (j *jsonLog) format(level, msg string, fields Fields) string {
+	entry := make(map[string]interface{}, len(fields)+5)
+	for k, v := range fields {
+		if d, ok := v.(time.Duration); ok {
+			v = float64(d) / float64(time.Millisecond)
 		}
+		entry[k] = v
 	}
-	l.nonBlockingEnqueue(worker)
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["component"] = j.component
+	entry["mountpoint"] = j.mountpoint
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"level": level, "msg": msg})
+	}
+	return string(data)
+}
+
+func (j *jsonLog) write(level, line string) {
+	out := j.stdout
+	if level == LevelError || level == LevelWarn {
+		out = j.stderr
+	}
+	fmt.Fprintln(out, line)
 }
 
 // Close closes any internal writers.
 func (l Logger) Close() error {
 	close(l.queue)
+	if l.journal != nil {
+		l.journal.conn.Close()
+	}
 	if l.syslog != nil {
 		return l.syslog.Close()
 	}
@@ -0,0 +1,63 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	j := &jsonLog{component: "kwfs_test", mountpoint: "/tmp/mnt"}
+	line := j.format(LevelInfo, "GET /secret/foo 200", Fields{
+		"op":       "GET /secret",
+		"secret":   "foo",
+		"status":   200,
+		"duration": 1500 * time.Microsecond,
+	})
+
+	var entry map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(line), &entry))
+	assert.Equal("info", entry["level"])
+	assert.Equal("kwfs_test", entry["component"])
+	assert.Equal("/tmp/mnt", entry["mountpoint"])
+	assert.Equal("GET /secret/foo 200", entry["msg"])
+	assert.Equal("GET /secret", entry["op"])
+	assert.Equal("foo", entry["secret"])
+	assert.EqualValues(200, entry["status"])
+	assert.EqualValues(1.5, entry["duration"])
+
+	ts, err := time.Parse(time.RFC3339Nano, entry["ts"].(string))
+	assert.NoError(err)
+	assert.WithinDuration(time.Now(), ts, time.Minute)
+}
+
+func TestJSONWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	var stdout, stderr bytes.Buffer
+	j := &jsonLog{stdout: &stdout, stderr: &stderr}
+	j.write(LevelDebug, `{"level":"debug"}`)
+	j.write(LevelError, `{"level":"error"}`)
+
+	assert.Equal("{\"level\":\"debug\"}\n", stdout.String())
+	assert.Equal("{\"level\":\"error\"}\n", stderr.String())
+}
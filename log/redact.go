@@ -0,0 +1,89 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"regexp"
+	"unicode"
+)
+
+// redacted replaces what is scrubbed from log messages.
+const redacted = "REDACTED"
+
+// redactions rewrite parts of log messages which may be secret content or credentials. They
+// are applied in order.
+var redactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// PEM blocks, such as private keys, and what follows a BEGIN line if the block was cut short.
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]+-----.*?-----END [A-Z0-9 ]+-----`), "[" + redacted + " PEM]"},
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]+-----.*`), "[" + redacted + " PEM]"},
+	// Sensitive string fields of JSON objects, e.g. the content of a secret in a response.
+	{regexp.MustCompile(`(?i)("(?:secret|content|password|passwd|token|private_?key|secret_?key|api_?key|value)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `$1"` + redacted + `"`},
+	// Credentials in HTTP headers, query strings and URLs.
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`), "$1 " + redacted},
+	{regexp.MustCompile(`(?i)\b(password|passwd|token|secret|api_?key)=[^\s&'"]+`), "$1=" + redacted},
+	{regexp.MustCompile(`([A-Za-z][A-Za-z0-9+.-]*://[^/\s:@]*:)[^@\s/]+@`), "${1}" + redacted + "@"},
+}
+
+// encodedRun matches runs of characters which may be base64-encoded data.
+var encodedRun = regexp.MustCompile(`[A-Za-z0-9+/_-]{32,}={0,2}`)
+
+// Redact scrubs anything resembling secret content from a log message: PEM blocks, sensitive
+// JSON fields, credentials in headers, query strings and URLs, and long runs of base64 which mix
+// upper and lower case letters and digits, as keys and tokens do. Hex digests and identifiers are
+// kept. All messages are redacted by Logger, whatever their level, so that debugging output can
+// be enabled during an incident without leaking credentials.
+func Redact(msg string) string {
+	for _, r := range redactions {
+		msg = r.pattern.ReplaceAllString(msg, r.replacement)
+	}
+	return encodedRun.ReplaceAllStringFunc(msg, func(run string) string {
+		if looksEncoded(run) {
+			return "[" + redacted + "]"
+		}
+		return run
+	})
+}
+
+// looksEncoded returns true for runs mixing upper and lower case letters and digits, or padded.
+func looksEncoded(run string) bool {
+	if run[len(run)-1] == '=' {
+		return true
+	}
+	var upper, lower, digit bool
+	for _, r := range run {
+		upper = upper || unicode.IsUpper(r)
+		lower = lower || unicode.IsLower(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+	return upper && lower && digit
+}
+
+// redactFields returns fields with their string values redacted.
+func redactFields(fields Fields) Fields {
+	if len(fields) == 0 {
+		return fields
+	}
+	redacted := make(Fields, len(fields))
+	for k, v := range fields {
+		if s, ok := v.(string); ok {
+			v = Redact(s)
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// syslogDialTimeout bounds connecting to a remote syslog server.
+const syslogDialTimeout = 10 * time.Second
+
+// SyslogFacilities are the syslog facilities messages may be logged to, by name.
+var SyslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogWriter is where syslog messages are written: a *syslog.Writer, or a tlsSyslog.
+type syslogWriter interface {
+	Err(msg string) error
+	Warning(msg string) error
+	Info(msg string) error
+	Debug(msg string) error
+	Close() error
+}
+
+// Validate checks the syslog settings of a configuration.
+func (c Config) Validate() error {
+	if _, err := c.facility(); err != nil {
+		return err
+	}
+	if c.SyslogAddress != "" {
+		if _, _, err := parseSyslogAddress(c.SyslogAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// facility returns the syslog facility to log to, user by default.
+func (c Config) facility() (syslog.Priority, error) {
+	if c.SyslogFacility == "" {
+		return defaultSyslogFacility, nil
+	}
+	facility, ok := SyslogFacilities[c.SyslogFacility]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", c.SyslogFacility)
+	}
+	return facility, nil
+}
+
+// parseSyslogAddress splits an address such as tcp://host:514 into network and host:port.
+func parseSyslogAddress(address string) (network, hostport string, err error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid syslog address %q: %v", address, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return "", "", fmt.Errorf("invalid syslog address %q: expected udp://, tcp:// or tls://HOST:PORT", address)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", "", fmt.Errorf("invalid syslog address %q: %v", address, err)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// newSyslog connects to the local syslog daemon, or to the remote one configured, logging with
+// tag.
+func newSyslog(config Config, tag string) (syslogWriter, error) {
+	facility, err := config.facility()
+	if err != nil {
+		return nil, err
+	}
+	priority := syslog.LOG_NOTICE | facility
+	if config.SyslogAddress == "" {
+		return syslog.New(priority, tag)
+	}
+	network, hostport, err := parseSyslogAddress(config.SyslogAddress)
+	if err != nil {
+		return nil, err
+	}
+	if network != "tls" {
+		return syslog.Dial(network, hostport, priority, tag)
+	}
+	roots, err := syslogRoots(config.SyslogCA)
+	if err != nil {
+		return nil, err
+	}
+	w := &tlsSyslog{hostport: hostport, config: &tls.Config{RootCAs: roots}, facility: facility, tag: tag}
+	w.hostname, _ = os.Hostname()
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// syslogRoots reads the CA certificates verifying a remote syslog server. Without a file, the
+// system roots are used.
+func syslogRoots(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return roots, nil
+}
+
+// tlsSyslog sends messages to a remote syslog server over TLS (RFC 5425), with octet-counting
+// framing, reconnecting when the connection is lost.
+type tlsSyslog struct {
+	hostport string
+	config   *tls.Config
+	facility syslog.Priority
+	tag      string
+	hostname string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (w *tlsSyslog) connect() error {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", w.hostport, w.config)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// Err logs a message with severity LOG_ERR.
+func (w *tlsSyslog) Err(msg string) error { return w.write(syslog.LOG_ERR, msg) }
+
+// Warning logs a message with severity LOG_WARNING.
+func (w *tlsSyslog) Warning(msg string) error { return w.write(syslog.LOG_WARNING, msg) }
+
+// Info logs a message with severity LOG_INFO.
+func (w *tlsSyslog) Info(msg string) error { return w.write(syslog.LOG_INFO, msg) }
+
+// Debug logs a message with severity LOG_DEBUG.
+func (w *tlsSyslog) Debug(msg string) error { return w.write(syslog.LOG_DEBUG, msg) }
+
+// Close closes the connection.
+func (w *tlsSyslog) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// write sends a message, trying once more on a new connection if sending fails.
+func (w *tlsSyslog) write(severity syslog.Priority, msg string) error {
+	frame := w.format(severity, msg, time.Now())
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.conn != nil {
+		if _, err := w.conn.Write(frame); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	if err := w.connect(); err != nil {
+		return err
+	}
+	_, err := w.conn.Write(frame)
+	return err
+}
+
+// format frames a message as an RFC 5424 message preceded by its length.
+func (w *tlsSyslog) format(severity syslog.Priority, msg string, now time.Time) []byte {
+	hostname := w.hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", w.facility|severity, now.Format(time.RFC3339Nano), hostname, w.tag, os.Getpid(), msg)
+	return []byte(fmt.Sprintf("%d %s", len(line), line))
+}
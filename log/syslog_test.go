@@ -0,0 +1,144 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(Config{}.Validate())
+	assert.NoError(Config{SyslogFacility: "local3", SyslogAddress: "tls://logs.example.com:6514"}.Validate())
+	assert.EqualError(Config{SyslogFacility: "local9"}.Validate(), `unknown syslog facility "local9"`)
+	assert.Error(Config{SyslogAddress: "logs.example.com:514"}.Validate())
+	assert.Error(Config{SyslogAddress: "tcp://logs.example.com"}.Validate())
+
+	facility, err := Config{SyslogFacility: "daemon"}.facility()
+	assert.NoError(err)
+	assert.Equal(syslog.LOG_DAEMON, facility)
+}
+
+func TestTLSSyslogFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	w := &tlsSyslog{facility: syslog.LOG_LOCAL0, tag: "keywhiz-fs", hostname: "host"}
+	now := time.Date(2016, time.June, 29, 20, 5, 21, 0, time.UTC)
+	line := "<131>1 2016-06-29T20:05:21Z host keywhiz-fs " + strconv.Itoa(os.Getpid()) + " - - failed"
+	assert.Equal(strconv.Itoa(len(line))+" "+line, string(w.format(syslog.LOG_ERR, "failed", now)))
+}
+
+func TestRemoteSyslogTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer listener.Close()
+
+	logger := New("kwfs_test", Config{Mountpoint: "/mnt", SyslogAddress: "tcp://" + listener.Addr().String(), SyslogFacility: "local1", SyslogTag: "keywhiz-fs"})
+	defer logger.Close()
+	conn, err := listener.Accept()
+	assert.NoError(err)
+	defer conn.Close()
+	logger.Warnf("access denied")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(err)
+	// LOG_LOCAL1|LOG_WARNING
+	assert.True(strings.HasPrefix(line, "<140>"), line)
+	assert.Contains(line, " keywhiz-fs[")
+	assert.True(strings.HasSuffix(line, ": kwfs_test[/mnt]: access denied\n"), line)
+}
+
+func TestRemoteSyslogTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	config := &tls.Config{Certificates: server.TLS.Certificates}
+	dir, err := ioutil.TempDir("", "kwfs_syslog")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+	server.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	assert.NoError(err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Untrusted attempts fail the handshake.
+			if conn.(*tls.Conn).Handshake() == nil {
+				accepted <- conn
+			}
+		}
+	}()
+
+	address := "tls://" + listener.Addr().String()
+	_, err = newSyslog(Config{SyslogAddress: address}, "keywhiz-fs")
+	assert.Error(err, "server not trusted without its CA")
+
+	w, err := newSyslog(Config{SyslogAddress: address, SyslogCA: caFile}, "keywhiz-fs")
+	if !assert.NoError(err) {
+		return
+	}
+	defer w.Close()
+	assert.NoError(w.Info("mounted"))
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		assert.Fail("no connection")
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	length, err := reader.ReadString(' ')
+	assert.NoError(err)
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	assert.NoError(err)
+	frame := make([]byte, n)
+	_, err = io.ReadFull(reader, frame)
+	assert.NoError(err)
+	// LOG_USER|LOG_INFO
+	assert.True(strings.HasPrefix(string(frame), "<14>1 "), string(frame))
+	assert.Contains(string(frame), " keywhiz-fs ")
+	assert.True(strings.HasSuffix(string(frame), " - - mounted"), string(frame))
+}
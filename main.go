@@ -15,10 +15,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -37,9 +45,16 @@ import (
 var (
 	app = kingpin.New("keywhiz-fs", "A FUSE based file-system client for Keywhiz.")
 
-	certFile      = app.Flag("cert", "PEM-encoded certificate file").PlaceHolder("FILE").Default("").String()
-	keyFile       = app.Flag("key", "PEM-encoded private key file").PlaceHolder("FILE").Required().String()
-	caFile        = app.Flag("ca", "PEM-encoded CA certificates file").PlaceHolder("FILE").Required().String()
+	certFile      = app.Flag("cert", "PEM-encoded certificate file, optionally followed by intermediates").PlaceHolder("FILE").Default("").String()
+	keyFile       = app.Flag("key", "PEM-encoded private key file").PlaceHolder("FILE").String()
+	caFile        = app.Flag("ca", "PEM-encoded CA certificates file").PlaceHolder("FILE").String()
+	enrollURL     = app.Flag("enroll-url", "Obtain the client certificate by sending a certificate signing request to this URL of an internal CA when --cert and --key don't hold a valid one, and renew it before it expires.").PlaceHolder("URL").String()
+	enrollToken   = app.Flag("enroll-token-file", "File holding a bearer token proving the identity of the host to the enrollment URL.").PlaceHolder("FILE").String()
+	enrollName    = app.Flag("enroll-name", "Common name requested for the enrolled certificate. Defaults to the hostname.").PlaceHolder("NAME").String()
+	enrollRenew   = app.Flag("enroll-renew-before", "How long before it expires the enrolled certificate is renewed.").Default("72h").Duration()
+	certWarning   = app.Flag("cert-expiry-warning", "Log warnings when the client or CA certificates expire within this long.").Default("336h").Duration()
+	refuseExpired = app.Flag("refuse-expired-cert", "Refuse to mount with an expired or not yet valid client certificate, rather than failing on every request.").Default("false").Bool()
+	tokenFile     = app.Flag("token-file", "File holding a bearer token to authenticate with instead of a client certificate, read again when it changes.").PlaceHolder("FILE").String()
 	asuser        = app.Flag("asuser", "Default user to own files").Default("keywhiz").String()
 	asgroup       = app.Flag("group", "Default group to own files").Default("keywhiz").String()
 	debug         = app.Flag("debug", "Enable debugging output").Default("false").Bool()
@@ -47,78 +62,860 @@ var (
 	cacheTimeout  = app.Flag("cache-timeout", "Timeout for cache eviction. Useful for testing.").Default("1h").Duration()
 	metricsURL    = app.Flag("metrics-url", "Collect metrics and POST them periodically to the given URL (via HTTP/JSON).").PlaceHolder("URL").String()
 	metricsPrefix = app.Flag("metrics-prefix", "Override the default metrics prefix used for reporting metrics.").PlaceHolder("PREFIX").String()
+	pushgateway   = app.Flag("metrics-pushgateway", "Push metrics of the mount periodically to this Prometheus Pushgateway, e.g. http://pushgateway:9091.").PlaceHolder("URL").String()
+	pushInterval  = app.Flag("metrics-push-interval", "How often metrics are pushed to the Pushgateway.").Default("30s").Duration()
+	otlpEndpoint  = app.Flag("otlp-endpoint", "Export traces of filesystem operations and server requests to this OpenTelemetry collector (OTLP/HTTP, JSON), e.g. http://localhost:4318/v1/traces.").PlaceHolder("URL").String()
 	syslog        = app.Flag("syslog", "Send logs to syslog instead of stderr.").Default("false").Bool()
+	logFacility   = app.Flag("syslog-facility", "Syslog facility to log to, e.g. daemon or local0.").Default("user").String()
+	syslogTag     = app.Flag("syslog-tag", "Syslog tag of messages, instead of the component and mount point, which then prefix messages.").PlaceHolder("TAG").String()
+	syslogAddress = app.Flag("syslog-address", "Send logs to this remote syslog server instead of the local one, as udp://, tcp:// or tls://HOST:PORT. Implies --syslog.").PlaceHolder("URL").String()
+	syslogCa      = app.Flag("syslog-ca", "CA certificates verifying a tls:// syslog server instead of the system roots.").PlaceHolder("FILE").String()
+	journal       = app.Flag("journal", "Send logs to the systemd journal, with structured fields for journalctl, instead of stderr.").Default("false").Bool()
+	logFormat     = app.Flag("log-format", "Format of log lines: text, or json for one JSON object per line.").Default(klog.FormatText).Enum(klog.FormatText, klog.FormatJSON)
 	disableMlock  = app.Flag("disable-mlock", "Do not call mlockall on process memory.").Default("false").Bool()
-	serverURL     = app.Arg("url", "server url").Required().URL()
-	mountpoint    = app.Arg("mountpoint", "mountpoint").Required().String()
-	logger        *klog.Logger
+	coreDumps     = app.Flag("allow-core-dumps", "Leave core dumps and ptrace by processes of the same user enabled, e.g. for debugging. Both expose all cached secrets.").Default("false").Bool()
+	extraServers  = app.Flag("extra-server", "Additional server whose secrets are exposed in a directory named after it, as NAME=URL. The URL may be of a secret manager, like the mount url. Repeatable.").PlaceHolder("NAME=URL").Strings()
+	serverName    = app.Flag("server-name", "Directory name for the secrets of the main server when extra servers are configured.").Default("keywhiz").String()
+	flatten       = app.Flag("flatten", "Expose the secrets of the named server at the top level instead of in its directory. Repeatable.").PlaceHolder("NAME").Strings()
+	include       = app.Flag("include", "Only expose secrets whose name matches this regular expression. Repeatable.").PlaceHolder("REGEX").Strings()
+	exclude       = app.Flag("exclude", "Never expose secrets whose name matches this regular expression. Repeatable.").PlaceHolder("REGEX").Strings()
+	maxSecretSize = app.Flag("max-secret-size", "Maximum size of a secret response from the server, content included. Larger secrets aren't served. 0 disables the limit.").Default("64MiB").Bytes()
+	dnsResolvers  = app.Flag("dns-resolver", "DNS server (HOST[:PORT]) used to resolve server hostnames instead of the system resolver. Repeatable; later servers are fallbacks.").PlaceHolder("ADDR").Strings()
+	configFile    = app.Flag("config", "YAML file setting flags and arguments of the command by name, e.g. \"timeout: 10s\". Flags given on the command line take precedence.").PlaceHolder("FILE").String()
+	writeThrough  = app.Flag("write-through", "Allow writing to secret files, sending new content to the server. Requires automation access.").Default("false").Bool()
+	vaults        = app.Flag("vault", "HashiCorp Vault KV secrets engine whose secrets are exposed in a directory named after it, as NAME=URL where the path of URL is the engine's mount point and an optional prefix. Repeatable.").PlaceHolder("NAME=URL").Strings()
+	vaultToken    = app.Flag("vault-token-file", "File holding the Vault token, re-read on every request. VAULT_TOKEN is used if not given.").PlaceHolder("FILE").String()
+	vaultCa       = app.Flag("vault-ca", "CA bundle used to verify Vault servers instead of the system roots.").PlaceHolder("FILE").String()
+	vaultField    = app.Flag("vault-field", "Key of Vault KV entries holding the content of secrets.").Default("value").String()
+	vaultKV       = app.Flag("vault-kv-version", "Version of the Vault KV secrets engine, 1 or 2.").Default("2").Int()
+	secretVerify  = app.Flag("secret-verify-key", "PEM-encoded ed25519 public key which must have signed the content of secrets. Unsigned content is never used.").PlaceHolder("FILE").String()
+	controlSocket = app.Flag("control-socket", "Unix socket on which a mount serves its admin API, used by control commands such as status. Empty to disable.").Default("/run/keywhiz-fs/control.sock").String()
+	controlGroup  = app.Flag("control-group", "Group whose members may use the control socket, in addition to root and the user running keywhiz-fs.").PlaceHolder("GROUP").String()
+
+	mountCmd        = app.Command("mount", "Mount a keywhiz-fs filesystem (default).").Default()
+	templateDir     = mountCmd.Flag("template-dir", "Directory of <name>.tmpl files (Go text/template, with {{ secret \"NAME\" }}) rendered into files named <name> in the mount.").PlaceHolder("DIR").ExistingDir()
+	mirrorPoint     = mountCmd.Flag("mirror", "Also mount a read-only view with secrets only (no control files, no aliases, modes masked to 0440) at this path, e.g. for bind-mounting into containers.").PlaceHolder("PATH").String()
+	healthThreshold = mountCmd.Flag("health-threshold", "Time without a successful server request after which .health reports the server unreachable and fails to stat.").Default("5m").Duration()
+	daemon          = mountCmd.Flag("daemon", "Run in the background once mounted. Errors until then are reported before returning.").Default("false").Bool()
+	seccomp         = mountCmd.Flag("seccomp", "Once mounted, restrict keywhiz-fs to the system calls it needs with a seccomp filter. Root only, and not with commands run on changes.").Default("false").Bool()
+	pidFile         = mountCmd.Flag("pidfile", "Write the process ID to this file once mounted.").PlaceHolder("FILE").String()
+	fallbackDir     = mountCmd.Flag("fallback-dir", "Directory of secret files served when a secret is neither cached nor available from the server, e.g. the host's own certificates.").PlaceHolder("DIR").ExistingDir()
+	prefetchWorkers = mountCmd.Flag("prefetch-concurrency", "Number of secrets whose content is fetched in parallel after a listing reports them changed or not yet cached. 0 fetches secrets only when read.").Default("8").Int()
+	maxStale        = mountCmd.Flag("max-stale", "How long past --cache-timeout cached secrets are served right away while refreshed in the background, rather than waiting on the server. Can be changed with SIGHUP.").Default("0s").Duration()
+	errorPolicy     = mountCmd.Flag("on-backend-error", "What reading a cached secret does once it can't be refreshed from the server: stale serves the last content fetched, eio fails with EIO and enoent hides the secret.").Default(string(ServeStale)).Enum(string(ServeStale), string(FailEIO), string(FailENOENT))
+	onChange        = mountCmd.Flag("on-change", "Command, with arguments separated by spaces, run whenever a refresh finds that a secret changed or was deleted, e.g. to reload a service. The secret is passed in KEYWHIZ_SECRET.").PlaceHolder("COMMAND").String()
+	onChangeTimeout = mountCmd.Flag("on-change-timeout", "How long the --on-change command may run before it is killed.").Default("1m").Duration()
+	missBackoff     = mountCmd.Flag("miss-backoff", "Longest time a secret the server reported missing is answered from memory, backing off from 1s while an application keeps asking for it. 0 asks the server every time.").Default("30s").Duration()
+	contentDeadline = mountCmd.Flag("content-deadline", "How long reading a secret waits on the server for its content before falling back to cached content. Raise it for large secrets.").Default("5s").Duration()
+	listDeadline    = mountCmd.Flag("list-deadline", "How long a directory listing waits on the server before falling back to the cached listing.").Default("5s").Duration()
+	listTimeout     = mountCmd.Flag("list-timeout", "How long a directory listing may take in all, like --timeout does for secrets (default: --timeout).").PlaceHolder("DURATION").Duration()
+	controlWait     = mountCmd.Flag("control-timeout", "How long operations on control files, such as .json/status, may take (default: as long as for secrets).").PlaceHolder("DURATION").Duration()
+	deletionGrace   = mountCmd.Flag("deletion-grace", "How long secrets removed from the server, or from its listing, keep being served before they are deleted, to survive accidental de-provisioning.").Default("1h").Duration()
+	offline         = mountCmd.Flag("offline", "Serve only cached secrets, from --bundle, without ever contacting the server. Can be changed with SIGHUP.").Default("false").Bool()
+	shutdownTimeout = mountCmd.Flag("shutdown-timeout", "How long to wait on SIGINT or SIGTERM for open files to be closed before lazily unmounting.").Default("10s").Duration()
+	healthListen    = mountCmd.Flag("health-listen", "Serve /healthz, /readyz and /debug/vars over HTTP on this address, e.g. 127.0.0.1:9091.").PlaceHolder("ADDR").String()
+	maxBackground   = mountCmd.Flag("max-background", "Maximum number of background FUSE requests queued by the kernel. Adjustable at runtime via .fuse/max_background.").Default("12").Int()
+	congestion      = mountCmd.Flag("congestion-threshold", "Number of background FUSE requests past which the kernel throttles readers (default 3/4 of --max-background). Adjustable at runtime via .fuse/congestion_threshold.").PlaceHolder("N").Int()
+	allowOther      = mountCmd.Flag("allow-other", "Allow users other than the one running keywhiz-fs to access the mount.").Default("true").Bool()
+	defaultPerms    = mountCmd.Flag("default-permissions", "Have the kernel enforce file modes and ownership.").Default("true").Bool()
+	maxRead         = mountCmd.Flag("max-read", "Maximum size in bytes of read requests sent by the kernel (default: kernel default).").PlaceHolder("BYTES").Int()
+	directIO        = mountCmd.Flag("direct-io", "Bypass the kernel page cache, so every read is served from the keywhiz-fs cache.").Default("false").Bool()
+	attrTimeout     = mountCmd.Flag("attr-timeout", "How long the kernel caches attributes of secrets.").Default("0s").Duration()
+	entryTimeout    = mountCmd.Flag("entry-timeout", "How long the kernel caches name lookups of secrets.").Default("0s").Duration()
+	specialAttr     = mountCmd.Flag("special-attr-timeout", "How long the kernel caches attributes of special files and directories.").Default("0s").Duration()
+	specialEntry    = mountCmd.Flag("special-entry-timeout", "How long the kernel caches name lookups of special files and directories.").Default("0s").Duration()
+	enforceOwner    = mountCmd.Flag("enforce-ownership", "Deny access to secrets (EACCES) unless the caller's uid or gid is the secret's owner or group, regardless of file modes.").Default("false").Bool()
+	idRefresh       = mountCmd.Flag("id-refresh", "How long the ids of the owners and groups of secrets are cached before they are resolved again, in the background. 0 resolves them on every access.").Default("5m").Duration()
+	preresolveIDs   = mountCmd.Flag("preresolve-ids", "Resolve the owners and groups of secrets when they are listed, rather than when their attributes are first read.").Default("false").Bool()
+	idsFromFiles    = mountCmd.Flag("ids-from-files", "Resolve owners from /etc/passwd rather than the system's user database, which may block on LDAP or sssd. Groups are always resolved from /etc/group.").Default("false").Bool()
+	signalFile      = mountCmd.Flag("signal-file", "JSON file of rules naming, by PID file or systemd unit, processes sent SIGHUP (or another signal) when the secrets they match change, so they reload them.").PlaceHolder("FILE").ExistingFile()
+	ownershipFile   = mountCmd.Flag("ownership-file", "JSON file of rules overriding the owner, group and mode recorded by the server for the secrets they match.").PlaceHolder("FILE").ExistingFile()
+	policyFile      = mountCmd.Flag("process-policy", "JSON file of rules allowing executables (by path and/or SHA-256) to open secrets. All other opens of secrets are denied.").PlaceHolder("FILE").ExistingFile()
+	auditFile       = mountCmd.Flag("audit-log", "Append a JSON event (time, secret, uid, gid, pid, process) for every open of a secret to this file.").PlaceHolder("FILE").String()
+	auditAnchor     = mountCmd.Flag("audit-anchor-interval", "How often to log the sequence number and hash of the last audit log event, to detect truncation of the audit log.").Default("10m").Duration()
+	devBackend      = mountCmd.Flag("dev-backend", "Serve secrets from a local directory of secret JSON files, given as url, instead of a server. No certificates are needed. For developing applications.").Default("false").Bool()
+	jsonFields      = mountCmd.Flag("json-fields", "Expose the fields of secrets holding JSON objects as files in a directory named after the secret with .d appended, e.g. db.json.d/password.").Default("false").Bool()
+	stableInodes    = mountCmd.Flag("stable-inodes", "Derive inode numbers from the names of secrets, so they stay the same across remounts and restarts. Disable with --no-stable-inodes.").Default("true").Bool()
+	jsonDir         = mountCmd.Flag("json-dir", "Expose the raw JSON and metadata of secrets under .json/. Disable with --no-json-dir to only expose the content of secrets.").Default("true").Bool()
+	controlFiles    = mountCmd.Flag("control-files", "Expose .clear_cache, .reload and .refresh/, which drop, reload or refresh cached secrets. Disable with --no-control-files.").Default("true").Bool()
+	controlUser     = mountCmd.Flag("control-user", "Only let this user, by name or uid, use .clear_cache, .reload and .refresh/.").PlaceHolder("USER").String()
+	faults          = mountCmd.Flag("faults", "Expose .faults/ for injecting delays, EIO and stale content into access to secrets, to test applications. Not for production.").Default("false").Bool()
+	bundleFile      = mountCmd.Flag("bundle", "Offline bundle used to bootstrap the cache if the server is unreachable on startup.").PlaceHolder("FILE").String()
+	bundleKeyFile   = mountCmd.Flag("bundle-key", "Hex-encoded 256-bit key used to decrypt the offline bundle, or keyring:session:NAME or keyring:user:NAME to read it from the kernel keyring.").PlaceHolder("FILE").String()
+	bundleVerifyKey = mountCmd.Flag("bundle-verify-key", "PEM-encoded ed25519 public key used to verify the offline bundle.").PlaceHolder("FILE").String()
+	serverURL       = mountCmd.Arg("url", "server url, or unix:///PATH for a server behind a unix socket, or aws-sm://REGION[/PREFIX] for AWS Secrets Manager or gcp-sm://PROJECT[/PREFIX] for GCP Secret Manager, or a directory with --dev-backend").URL()
+	mountpoint      = mountCmd.Arg("mountpoint", "mountpoint").String()
+
+	bundleCmd        = app.Command("bundle", "Fetch all accessible secrets into a signed, encrypted offline bundle.")
+	bundleOutput     = bundleCmd.Flag("output", "File to write the bundle to").PlaceHolder("FILE").Required().String()
+	bundleSealKey    = bundleCmd.Flag("bundle-key", "Hex-encoded 256-bit key used to encrypt the bundle, or keyring:session:NAME or keyring:user:NAME to keep it in the kernel keyring, generated if missing.").PlaceHolder("FILE").Required().String()
+	bundleSigningKey = bundleCmd.Flag("signing-key", "PEM-encoded ed25519 private key used to sign the bundle.").PlaceHolder("FILE").Required().String()
+	bundleServerURL  = bundleCmd.Arg("url", "server url").Required().URL()
+
+	importCmd       = app.Command("import", "Create secrets on the server from a directory of secret files, using the automation API.")
+	importGroups    = importCmd.Flag("assign-group", "Group to assign imported secrets to, created if missing. Repeatable.").PlaceHolder("NAME").Strings()
+	importDryRun    = importCmd.Flag("dry-run", "Only list the secrets which would be imported.").Default("false").Bool()
+	importServerURL = importCmd.Arg("url", "server url").Required().URL()
+	importDir       = importCmd.Arg("dir", "directory containing one file per secret, e.g. /etc/secrets").Required().ExistingDir()
+
+	pluginCmd    = app.Command("plugin", "Serve the Docker volume plugin API, mounting a keywhiz-fs volume for containers using it. Volumes are created with -o url=URL and optionally cert, key, ca, asuser, group, timeout, cache-timeout, include and exclude.")
+	pluginSocket = pluginCmd.Flag("socket", "Unix socket on which to serve the plugin API.").Default("/run/docker/plugins/keywhiz-fs.sock").String()
+	pluginRoot   = pluginCmd.Flag("volume-root", "Directory holding the mountpoints of volumes, and the state of the plugin.").Default("/var/lib/keywhiz-fs/volumes").String()
+
+	statusCmd     = app.Command("status", "Show the status of a running mount.")
+	clearCacheCmd = app.Command("clear-cache", "Clear the cache of a running mount, like deleting .clear_cache.")
+	fetchCmd      = app.Command("fetch", "Print the content of a secret from a running mount.")
+	fetchSecret   = fetchCmd.Arg("secret", "secret name").Required().String()
+	unmountCmd    = app.Command("unmount", "Unmount a running mount, like SIGTERM.")
+	listCmd       = app.Command("list", "List the secrets cached by a running mount, with their metadata.")
+	evictCmd      = app.Command("evict", "Drop a secret from the cache of a running mount.")
+	evictSecret   = evictCmd.Arg("secret", "secret name").Required().String()
+	refreshCmd    = app.Command("refresh", "Re-fetch the listing and cached secrets of a running mount, like deleting .reload, or a single secret.")
+	refreshSecret = refreshCmd.Arg("secret", "secret name").String()
+	configCmd     = app.Command("config", "Show the settings of a running mount.")
+	snapshotCmd   = app.Command("snapshot", "Atomically write the secrets of a running mount to a directory on tmpfs, replacing a previous snapshot there.")
+	snapshotDir   = snapshotCmd.Arg("dir", "directory, created as a symlink to the latest snapshot").Required().String()
+
+	logger *klog.Logger
+	tracer *Tracer
+	// verifyKey is read from --secret-verify-key, if given.
+	verifyKey ed25519.PublicKey
+	// exitCode is the exit code of the process once main returns.
+	exitCode int
 )
 
 func main() {
-	app.Version(fmt.Sprintf("rev %s-%s on \"%s\"", buildRevision, buildTime, buildMachine))
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	// Deferred first, so that it runs after all other deferred cleanup.
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	app.Version(fmt.Sprintf("%s, rev %s-%s on \"%s\"", buildVersion, buildRevision, buildTime, buildMachine))
+	var config map[string][]string
+	if file := configFlag(os.Args[1:]); file != "" {
+		var err error
+		config, err = loadConfig(file)
+		if err == nil {
+			err = applyConfig(config, app, selectedCommand(app, os.Args[1:]))
+		}
+		if err != nil {
+			app.Fatalf("%v", err)
+		}
+	}
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+	// Checked after parsing rather than marked Required, since they may come from --config.
+	// Mounting from a secret manager needs no client certificate, volumes of the plugin may have
+	// their own, control commands only talk to a running mount, and a server behind a unix socket
+	// is reached without TLS. A bearer token replaces the key, and the CA defaults to the system
+	// roots.
+	keywhiz := command != mountCmd.FullCommand() || !*devBackend && (*serverURL == nil || !isSecretManagerURL(*serverURL))
+	var commandURL *url.URL
+	switch command {
+	case mountCmd.FullCommand():
+		commandURL = *serverURL
+	case bundleCmd.FullCommand():
+		commandURL = *bundleServerURL
+	case importCmd.FullCommand():
+		commandURL = *importServerURL
+	}
+	socket := commandURL != nil && commandURL.Scheme == "unix"
+	needsKey := keywhiz && !socket && *tokenFile == "" && command != pluginCmd.FullCommand() && !isControlCommand(command)
+	switch {
+	case *keyFile == "" && needsKey:
+		app.Fatalf("required flag --key not provided, try --help")
+	case *caFile == "" && needsKey:
+		app.Fatalf("required flag --ca not provided, try --help")
+	case command == mountCmd.FullCommand() && *serverURL == nil:
+		app.Fatalf("required argument 'url' not provided, try --help")
+	case command == mountCmd.FullCommand() && *mountpoint == "":
+		app.Fatalf("required argument 'mountpoint' not provided, try --help")
+	}
+	if err := checkTokenURL(commandURL, *tokenFile); keywhiz && err != nil {
+		app.Fatalf("%v", err)
+	}
+	if isControlCommand(command) {
+		exitCode = runControlCommand(command)
+		return
+	}
+	if command == mountCmd.FullCommand() && *daemon && !isDaemon() {
+		exitCode = daemonize()
+		return
+	}
 
-	logConfig := klog.Config{Debug: *debug, Mountpoint: *mountpoint, Syslog: *syslog}
+	logConfig := klog.Config{Debug: *debug, Mountpoint: *mountpoint, Syslog: *syslog, Format: *logFormat, Journal: *journal,
+		SyslogFacility: *logFacility, SyslogTag: *syslogTag, SyslogAddress: *syslogAddress, SyslogCA: *syslogCa}
+	if err := logConfig.Validate(); err != nil {
+		log.Fatalf("Invalid syslog settings: %v\n", err)
+	}
 	logger = klog.New("kwfs_main", logConfig)
 	defer logger.Close()
 
-	if *certFile == "" {
+	if !*coreDumps {
+		if err := disableCoreDumps(); err != nil {
+			log.Fatalf("Unable to disable core dumps: %v\n", err)
+		}
+	}
+
+	certIsKey := *certFile == ""
+	if certIsKey {
 		logger.Debugf("Certificate file not specified, assuming certificate also in %s", *keyFile)
 		certFile = keyFile
 	}
+	if *enrollURL != "" && needsKey {
+		options := EnrollOptions{URL: *enrollURL, TokenFile: *enrollToken, Name: *enrollName, CaFile: *caFile, RenewBefore: *enrollRenew, Timeout: *timeout}
+		enroller, err := NewEnroller(*certFile, *keyFile, options, logConfig)
+		if err == nil {
+			err = enroller.Ensure()
+		}
+		if err != nil {
+			log.Fatalf("Unable to enroll client certificate: %v\n", err)
+		}
+		go enroller.Renew(enrollCheck)
+	}
 
 	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	if *otlpEndpoint != "" {
+		tracer = NewTracer(*otlpEndpoint, logConfig)
+		defer tracer.Flush()
+	}
+	if *secretVerify != "" {
+		var err error
+		if verifyKey, err = readBundleVerifyKey(*secretVerify); err != nil {
+			log.Fatalf("Unable to read secret verify key: %v\n", err)
+		}
+	}
 
-	if !*disableMlock {
-		lockMemory()
+	if command == bundleCmd.FullCommand() {
+		writeBundle(logConfig, metricsHandle)
+		return
+	}
+	if command == importCmd.FullCommand() {
+		importDirectory(logConfig, metricsHandle)
+		return
+	}
+	if command == pluginCmd.FullCommand() {
+		servePlugin(logConfig)
+		return
+	}
+
+	if *pushgateway != "" {
+		pusher, err := NewMetricsPusher(*pushgateway, *pushInterval, metricsHandle.Registry, *mountpoint, logConfig)
+		if err != nil {
+			log.Fatalf("Invalid --metrics-pushgateway: %v\n", err)
+		}
+		defer pusher.Stop()
+	}
+
+	memoryLocked := metrics.GetOrRegisterGauge("runtime.memory.locked", metricsHandle.Registry)
+	if !*disableMlock && lockMemory() {
+		memoryLocked.Update(1)
 	}
 
 	// TODO: move time limit settings to config file?
 	// TODO: or at least make it consistent? some are set here, some are set above with app.Flag()
 	freshThreshold := *cacheTimeout
-	backendDeadline := 5 * time.Second
+	backendDeadline := *contentDeadline
 	maxWait := *timeout + backendDeadline
-	delayDeletion := 1 * time.Hour
-	timeouts := Timeouts{freshThreshold, backendDeadline, maxWait, delayDeletion}
+	delayDeletion := *deletionGrace
+	listWait := *timeout + *listDeadline
+	if *listTimeout > 0 {
+		listWait = *listTimeout + *listDeadline
+	}
+	timeouts := Timeouts{freshThreshold, backendDeadline, maxWait, delayDeletion, *listDeadline, listWait, *controlWait}
+
+	// Without a Keywhiz server, client is nil, and the control files which need one don't exist.
+	var client *Client
+	var backend SecretBackend
+	if keywhiz {
+		c := NewClient(*certFile, *keyFile, *caFile, *serverURL, *timeout, clientOptions(), logConfig, metricsHandle)
+		client, backend = &c, &c
+
+		certs := NewCertMonitor(client, *certWarning, logConfig, metricsHandle)
+		if err := certs.Check().Expired(time.Now()); err != nil && *refuseExpired {
+			log.Fatalf("Refusing to mount: %v\n", err)
+		}
+		go certs.Run(defaultCertCheck)
+	} else if *devBackend {
+		var err error
+		if backend, err = NewDevBackend((*serverURL).Path, logConfig); err != nil {
+			log.Fatalf("Invalid development backend: %v\n", err)
+		}
+		logger.Warnf("Serving secrets from %s, not from a server", (*serverURL).Path)
+	} else {
+		var err error
+		if backend, err = secretManagerBackend(*serverURL, logConfig); err != nil {
+			log.Fatalf("Invalid server configuration: %v\n", err)
+		}
+	}
+	var extraClients []*Client
+	if len(*extraServers) > 0 || len(*vaults) > 0 {
+		var err error
+		backend, extraClients, err = compositeBackend(backend, logConfig, metricsHandle)
+		if err != nil {
+			log.Fatalf("Invalid server configuration: %v\n", err)
+		}
+	}
+	filter, err := NewSecretFilter(*include, *exclude)
+	if err != nil {
+		log.Fatalf("Invalid secret filter: %v\n", err)
+	}
+	if filter != nil {
+		backend = FilteredBackend{backend, filter}
+	}
 
-	client := NewClient(*certFile, *keyFile, *caFile, *serverURL, *timeout, logConfig, metricsHandle)
+	mountConfig := MountConfig{
+		AllowOther:          *allowOther,
+		DefaultPermissions:  *defaultPerms,
+		MaxRead:             *maxRead,
+		MaxBackground:       *maxBackground,
+		DirectIO:            *directIO,
+		AttrTimeout:         *attrTimeout,
+		EntryTimeout:        *entryTimeout,
+		SpecialAttrTimeout:  *specialAttr,
+		SpecialEntryTimeout: *specialEntry,
+	}
+	if err := mountConfig.Validate(); err != nil {
+		log.Fatalf("Invalid mount options: %v\n", err)
+	}
 
 	ownership := NewOwnership(*asuser, *asgroup)
-	kwfs, root, err := NewKeywhizFs(&client, ownership, timeouts, metricsHandle, logConfig)
+	kwfs, root, err := NewKeywhizFs(client, backend, ownership, timeouts, metricsHandle, logConfig)
 	if err != nil {
 		log.Fatalf("KeywhizFs init fail: %v\n", err)
 	}
-	kwfs.Cache.Warmup()
+	kwfs.WriteThrough = *writeThrough
+	kwfs.DirectIO = mountConfig.DirectIO
+	kwfs.EnforceOwnership = *enforceOwner
+	kwfs.Tracer = tracer
+	kwfs.IDs = NewIDCache(*idRefresh, *idsFromFiles)
+	if *preresolveIDs && *idRefresh > 0 {
+		kwfs.Cache.OnListing(kwfs.IDs.Resolve)
+	}
+	if *ownershipFile != "" {
+		kwfs.Overrides, err = LoadOwnershipOverrides(*ownershipFile)
+		if err != nil {
+			log.Fatalf("Unable to load ownership file: %v\n", err)
+		}
+	}
+	if *policyFile != "" {
+		kwfs.Policy, err = LoadProcessPolicy(*policyFile, logConfig)
+		if err != nil {
+			log.Fatalf("Unable to load process policy: %v\n", err)
+		}
+	}
+	if *auditFile != "" {
+		kwfs.Audit, err = OpenAuditLog(*auditFile)
+		if err != nil {
+			log.Fatalf("Unable to open audit log: %v\n", err)
+		}
+		defer kwfs.Audit.Close()
+		defer logAuditAnchor(kwfs.Audit)
+		logAuditAnchor(kwfs.Audit)
+		go func() {
+			for range time.Tick(*auditAnchor) {
+				logAuditAnchor(kwfs.Audit)
+			}
+		}()
+	}
+	kwfs.Filter = filter
+	kwfs.HealthThreshold = *healthThreshold
+	if *templateDir != "" {
+		kwfs.Templates, err = LoadTemplates(*templateDir)
+		if err != nil {
+			log.Fatalf("Unable to load templates: %v\n", err)
+		}
+	}
+	if *fallbackDir != "" {
+		kwfs.Cache.SetFallbackDir(*fallbackDir)
+	}
+	if *faults {
+		logger.Warnf("Fault injection enabled, faults written to .faults/ affect access to secrets")
+		kwfs.Faults = NewFaults()
+	}
+	kwfs.JSONFields = *jsonFields
+	kwfs.StableInodes = *stableInodes
+	kwfs.HideJSON = !*jsonDir
+	kwfs.ControlFiles, err = NewControlFileAccess(*controlFiles, *controlUser)
+	if err != nil {
+		log.Fatalf("Unable to resolve control user: %v\n", err)
+	}
+	kwfs.Settings = currentSettings(app, mountCmd)
+	kwfs.Cache.SetPrefetch(*prefetchWorkers)
+	kwfs.Cache.SetMaxStale(*maxStale)
+	kwfs.Cache.SetMissBackoff(*missBackoff)
+	kwfs.Cache.SetErrorPolicy(ErrorPolicy(*errorPolicy))
+	if *onChange != "" {
+		if *seccomp {
+			log.Fatalf("--on-change can't be used with --seccomp, whose sandbox the command would inherit\n")
+		}
+		hook, err := NewChangeHook(*onChange, *onChangeTimeout, *mountpoint, logConfig)
+		if err != nil {
+			log.Fatalf("Invalid --on-change command: %v\n", err)
+		}
+		kwfs.Cache.OnChange(hook.Changed)
+	}
+	if *signalFile != "" {
+		signals, err := LoadReloadSignals(*signalFile, logConfig)
+		if err != nil {
+			log.Fatalf("Unable to load signal file: %v\n", err)
+		}
+		if *seccomp && signals.SignalsUnits() {
+			log.Fatalf("Rules signaling systemd units can't be used with --seccomp, whose sandbox systemctl would inherit\n")
+		}
+		kwfs.Cache.OnChange(signals.Changed)
+	}
+	if *bundleFile != "" {
+		if err := checkBundleKeys(*bundleKeyFile, *bundleVerifyKey); err != nil {
+			log.Fatalf("Invalid offline bundle settings: %v\n", err)
+		}
+	}
+	if *offline {
+		kwfs.Cache.SetOffline(true)
+		if *bundleFile == "" && *fallbackDir == "" {
+			logger.Warnf("Offline without --bundle or --fallback-dir, no secrets are served until going online")
+		}
+	}
+	if !kwfs.Cache.Warmup() && *bundleFile != "" {
+		bundle, err := ReadBundle(*bundleFile, *bundleKeyFile, *bundleVerifyKey)
+		if err != nil {
+			log.Fatalf("Unable to load offline bundle: %v\n", err)
+		}
+		if err := kwfs.Cache.Bootstrap(bundle); err != nil {
+			log.Fatalf("Unable to load offline bundle: %v\n", err)
+		}
+	}
 
-	mountOptions := &fuse.MountOptions{
-		AllowOther: true,
-		Name:       kwfs.String(),
-		Options:    []string{"default_permissions"},
+	points := []string{*mountpoint}
+	if *mirrorPoint != "" {
+		points = append(points, *mirrorPoint)
+	}
+	for _, point := range points {
+		if err := recoverStaleMount(point); err != nil {
+			log.Fatalf("Mount fail: %v\n", err)
+		}
+	}
+	// Users other than root mount with the setuid fusermount helper.
+	unprivileged := os.Geteuid() != 0
+	if unprivileged {
+		// no_new_privs, set by the sandbox, keeps fusermount from unmounting.
+		if *seccomp {
+			log.Fatalf("--seccomp can only be used by root\n")
+		}
+		if err := checkUnprivilegedMount(mountConfig, points); err != nil {
+			log.Fatalf("Mount fail: %v\n", err)
+		}
 	}
 
-	// Empty Options struct avoids setting a global uid/gid override.
-	conn := nodefs.NewFileSystemConnector(root, &nodefs.Options{})
-	server, err := fuse.NewServer(conn.RawFS(), *mountpoint, mountOptions)
+	health := NewHealthHandler(kwfs)
+	if *healthListen != "" {
+		listener, err := net.Listen("tcp", *healthListen)
+		if err != nil {
+			log.Fatalf("Unable to listen for health checks: %v\n", err)
+		}
+		go func() {
+			logger.Errorf("Health check server exited: %v", http.Serve(listener, health))
+		}()
+	}
+
+	conn := nodefs.NewFileSystemConnector(root, mountConfig.NodeOptions())
+	server, err := fuse.NewServer(mountConfig.RawFS(conn), *mountpoint, mountConfig.MountOptions(kwfs.String()))
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
 	}
+	health.SetMounted(true)
+	kwfs.NotifyChanges()
+	kwfs.Tuning = NewFuseTuning(*mountpoint)
+	if *congestion > 0 {
+		go setCongestionThreshold(kwfs.Tuning, *mountpoint, *congestion)
+	}
+
+	mounts := []mount{{server, *mountpoint}}
+	if *mirrorPoint != "" {
+		mirror, mirrorRoot := NewMirrorFs(kwfs, logConfig)
+		mirrorConn := nodefs.NewFileSystemConnector(mirrorRoot, mountConfig.NodeOptions())
+		mirrorServer, err := fuse.NewServer(mountConfig.RawFS(mirrorConn), *mirrorPoint, mountConfig.MountOptions(mirror.String()))
+		if err != nil {
+			log.Fatalf("Mount fail: %v\n", err)
+		}
+		mirror.NotifyChanges()
+		mounts = append(mounts, mount{mirrorServer, *mirrorPoint})
+		go mirrorServer.Serve()
+	}
+
+	if unprivileged {
+		if err := dropCapabilities(); err != nil {
+			logger.Warnf("Unable to drop capabilities: %v", err)
+		}
+	}
 
-	// Catch SIGINT and exit cleanly.
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			log.Fatalf("Unable to write pid file: %v\n", err)
+		}
+		defer os.Remove(*pidFile)
+	}
+
+	// On SIGINT or SIGTERM, unmount and exit cleanly rather than leaving a dead mountpoint.
+	// Mirrors are unmounted first, since the main server exits once unmounted. The unmount
+	// command sends SIGTERM through the control socket.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	if *controlSocket != "" {
+		control := NewControlServer(kwfs, health, *mountpoint, func() {
+			select {
+			case c <- unix.SIGTERM:
+			default:
+			}
+		})
+		control.Settings = kwfs.Settings
+		if *controlGroup != "" {
+			gid := lookupGid(*controlGroup)
+			control.Group = &gid
+		}
+		if listener, err := control.Listen(*controlSocket); err != nil {
+			logger.Warnf("Unable to listen on control socket: %v", err)
+		} else {
+			defer os.Remove(*controlSocket)
+			defer listener.Close()
+		}
+	}
+
+	// Last, so that setting up the control socket may still change the umask.
+	if *seccomp {
+		if err := enableSeccomp(); err != nil {
+			log.Fatalf("Unable to enable seccomp sandbox: %v\n", err)
+		}
+		logger.Infof("Enabled seccomp sandbox")
+	}
+	daemonReady()
+
+	signal.Notify(c, os.Interrupt, unix.SIGTERM)
+	detached := make(chan struct{})
+	go func() {
+		sig := <-c
+		// A second signal kills the process right away.
+		signal.Reset(os.Interrupt, unix.SIGTERM)
+		logger.Warnf("Got signal %s, unmounting", sig)
+		health.SetMounted(false)
+		sdNotify("STOPPING=1")
+		reversed := make([]mount, len(mounts))
+		for i, m := range mounts {
+			reversed[len(mounts)-1-i] = m
+		}
+		if !unmountAll(reversed, *shutdownTimeout) {
+			close(detached)
+		}
+	}()
+
+	// SIGUSR1 enables and SIGUSR2 disables debugging output.
+	levels := make(chan os.Signal, 1)
+	signal.Notify(levels, unix.SIGUSR1, unix.SIGUSR2)
+	go func() {
+		for sig := range levels {
+			klog.SetDebug(sig == unix.SIGUSR1)
+			logger.Infof("Got signal %s, debugging output enabled: %v", sig, sig == unix.SIGUSR1)
+		}
+	}()
+
+	// SIGHUP reloads the config file. Without one, it is ignored rather than killing the process.
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, unix.SIGHUP)
+	pinned, err := commandLineSettings(app, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Unable to parse command line: %v\n", err)
+	}
+	reloader := &ConfigReloader{*configFile, config, pinned, certIsKey, client, extraClients, kwfs.Cache}
+	go func() {
+		for sig := range hangups {
+			if *configFile == "" {
+				logger.Warnf("Got signal %s, but no config file to reload", sig)
+				continue
+			}
+			if err := reloader.Reload(); err != nil {
+				logger.Errorf("Got signal %s, unable to reload %s: %v", sig, *configFile, err)
+			}
+		}
+	}()
+
+	// Under systemd (Type=notify), report readiness and ping the watchdog.
+	if os.Getenv("NOTIFY_SOCKET") != "" {
+		go superviseMount(*mountpoint)
+	}
+
+	served := make(chan struct{})
 	go func() {
-		for {
-			sig := <-c
-			logger.Warnf("Got signal %s, unmounting", sig)
-			err := server.Unmount()
+		server.Serve()
+		close(served)
+	}()
+	select {
+	case <-served:
+		exitCode = exitUnmounted
+	case <-detached:
+		exitCode = exitDetached
+	}
+	health.SetMounted(false)
+	kwfs.Cache.Wipe()
+	logger.Infof("Exiting with code %d", exitCode)
+}
+
+// logAuditAnchor records the head of the audit log chain in the regular log, so that truncation
+// of the audit log can be detected.
+func logAuditAnchor(audit *AuditLog) {
+	seq, head := audit.Anchor()
+	logger.Infof("Audit log anchor: seq=%d hash=%s", seq, head)
+}
+
+// compositeBackend combines the main server with the servers given by --extra-server and the
+// Vault engines given by --vault. All Keywhiz servers are accessed with the same client
+// certificate. Also returns the clients of the extra Keywhiz servers.
+func compositeBackend(main SecretBackend, logConfig klog.Config, metricsHandle *sqmetrics.SquareMetrics) (SecretBackend, []*Client, error) {
+	flattened := map[string]bool{}
+	for _, name := range *flatten {
+		flattened[name] = true
+	}
+
+	backends := []NamedBackend{{*serverName, main, flattened[*serverName]}}
+	var extras []*Client
+	for _, server := range *extraServers {
+		parts := strings.SplitN(server, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("--extra-server should be NAME=URL, got '%s'", server)
+		}
+		u, err := url.Parse(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid url for server '%s': %v", parts[0], err)
+		}
+		if isSecretManagerURL(u) {
+			backend, err := secretManagerBackend(u, logConfig)
 			if err != nil {
-				logger.Warnf("Error while unmounting: %v", err)
+				return nil, nil, fmt.Errorf("invalid server '%s': %v", parts[0], err)
 			}
+			backends = append(backends, NamedBackend{parts[0], backend, flattened[parts[0]]})
+			continue
+		}
+		if *keyFile == "" || *caFile == "" {
+			return nil, nil, fmt.Errorf("--key and --ca are required for Keywhiz server '%s'", parts[0])
+		}
+		extra := NewClient(*certFile, *keyFile, *caFile, u, *timeout, clientOptions(), logConfig, metricsHandle)
+		backends = append(backends, NamedBackend{parts[0], &extra, flattened[parts[0]]})
+		extras = append(extras, &extra)
+	}
+	options := VaultOptions{TokenFile: *vaultToken, CaFile: *vaultCa, Field: *vaultField, KVVersion: *vaultKV, Timeout: *timeout}
+	for _, vault := range *vaults {
+		parts := strings.SplitN(vault, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("--vault should be NAME=URL, got '%s'", vault)
+		}
+		u, err := url.Parse(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid url for Vault '%s': %v", parts[0], err)
+		}
+		backend, err := NewVaultBackend(u, options, logConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid Vault '%s': %v", parts[0], err)
 		}
+		backends = append(backends, NamedBackend{parts[0], backend, flattened[parts[0]]})
+	}
+	backend, err := NewCompositeBackend(backends, logConfig, metricsHandle)
+	return backend, extras, err
+}
+
+// isSecretManagerURL returns true for the URLs of cloud secret managers, rather than of a
+// Keywhiz server.
+func isSecretManagerURL(u *url.URL) bool {
+	return u.Scheme == "aws-sm" || u.Scheme == "gcp-sm"
+}
+
+// secretManagerBackend returns the backend for a cloud secret manager URL, whose host is the AWS
+// region or GCP project and whose path is an optional prefix of secret names.
+func secretManagerBackend(u *url.URL, logConfig klog.Config) (SecretBackend, error) {
+	prefix := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "aws-sm":
+		return NewAWSBackend(u.Host, prefix, *timeout, logConfig)
+	case "gcp-sm":
+		return NewGCPBackend(u.Host, prefix, *timeout, logConfig)
+	}
+	return nil, fmt.Errorf("unsupported secret manager %s", u.Scheme)
+}
+
+// writeBundle fetches all accessible secrets and writes them to a sealed offline bundle.
+func writeBundle(logConfig klog.Config, metricsHandle *sqmetrics.SquareMetrics) {
+	key, generated, err := sealingBundleKey(*bundleSealKey)
+	if err != nil {
+		log.Fatalf("Unable to read bundle key: %v\n", err)
+	}
+	if generated {
+		logger.Warnf("%s", bundleKeyBackup(*bundleSealKey))
+	}
+	signingKey, err := readBundleSigningKey(*bundleSigningKey)
+	if err != nil {
+		log.Fatalf("Unable to read signing key: %v\n", err)
+	}
+
+	client := NewClient(*certFile, *keyFile, *caFile, *bundleServerURL, *timeout, clientOptions(), logConfig, metricsHandle)
+	bundle, err := FetchBundle(&client)
+	if err != nil {
+		log.Fatalf("Unable to fetch secrets: %v\n", err)
+	}
+
+	data, err := SealBundle(*bundle, key, signingKey)
+	if err != nil {
+		log.Fatalf("Unable to seal bundle: %v\n", err)
+	}
+	if err := ioutil.WriteFile(*bundleOutput, data, 0600); err != nil {
+		log.Fatalf("Unable to write bundle: %v\n", err)
+	}
+	logger.Infof("Wrote %d secrets to %s", len(bundle.Secrets), *bundleOutput)
+}
+
+// importDirectory implements the import command.
+func importDirectory(logConfig klog.Config, metricsHandle *sqmetrics.SquareMetrics) {
+	secrets, err := ReadSecretsDir(*importDir)
+	if err != nil {
+		log.Fatalf("Unable to read secrets: %v\n", err)
+	}
+	if *importDryRun {
+		for _, s := range secrets {
+			fmt.Printf("%s (%d bytes, mode %s, owner %q, group %q)\n", s.Name, len(s.Content), s.Mode, s.Owner, s.Group)
+		}
+		return
+	}
+
+	client := NewClient(*certFile, *keyFile, *caFile, *importServerURL, *timeout, clientOptions(), logConfig, metricsHandle)
+	created, skipped, err := ImportSecrets(&client, secrets, *importGroups)
+	for _, name := range skipped {
+		logger.Warnf("Secret %s already exists, skipped", name)
+	}
+	if err != nil {
+		log.Fatalf("Import failed after creating %d secrets: %v\n", len(created), err)
+	}
+	logger.Infof("Imported %d secrets, skipped %d existing", len(created), len(skipped))
+}
+
+// isControlCommand returns true for the commands sent to a running mount through its control
+// socket.
+func isControlCommand(command string) bool {
+	switch command {
+	case statusCmd.FullCommand(), clearCacheCmd.FullCommand(), fetchCmd.FullCommand(), unmountCmd.FullCommand(),
+		listCmd.FullCommand(), evictCmd.FullCommand(), refreshCmd.FullCommand(), configCmd.FullCommand(),
+		snapshotCmd.FullCommand():
+		return true
+	}
+	return false
+}
+
+// runControlCommand sends a control command to the running mount, printing its result, and
+// returns the exit code.
+func runControlCommand(command string) int {
+	var body []byte
+	var err error
+	indent := false
+	switch command {
+	case statusCmd.FullCommand():
+		body, err = controlRequest(*controlSocket, "GET", "/status")
+		indent = true
+	case configCmd.FullCommand():
+		body, err = controlRequest(*controlSocket, "GET", "/config")
+		indent = true
+	case listCmd.FullCommand():
+		body, err = controlRequest(*controlSocket, "GET", "/secrets")
+		indent = true
+	case evictCmd.FullCommand():
+		_, err = controlRequest(*controlSocket, "POST", "/evict/"+url.PathEscape(*evictSecret))
+	case refreshCmd.FullCommand():
+		path := "/refresh"
+		if *refreshSecret != "" {
+			path += "/" + url.PathEscape(*refreshSecret)
+		}
+		_, err = controlRequest(*controlSocket, "POST", path)
+	case snapshotCmd.FullCommand():
+		// Resolved here, since the mount has another working directory.
+		var dir string
+		if dir, err = filepath.Abs(*snapshotDir); err == nil {
+			body, err = controlRequest(*controlSocket, "POST", "/snapshot?dir="+url.QueryEscape(dir))
+			indent = true
+		}
+	case clearCacheCmd.FullCommand():
+		_, err = controlRequest(*controlSocket, "POST", "/clear-cache")
+	case fetchCmd.FullCommand():
+		body, err = controlRequest(*controlSocket, "GET", "/secret/"+url.PathEscape(*fetchSecret))
+	case unmountCmd.FullCommand():
+		_, err = controlRequest(*controlSocket, "POST", "/unmount")
+	}
+	if err == nil && indent {
+		var indented bytes.Buffer
+		if err = json.Indent(&indented, body, "", "  "); err == nil {
+			body = append(indented.Bytes(), '\n')
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keywhiz-fs: error: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(body)
+	return 0
+}
+
+// servePlugin implements the plugin command, serving until SIGINT or SIGTERM, which unmount all
+// volumes.
+func servePlugin(logConfig klog.Config) {
+	// Volumes without their own certificate use the plugin's, which is only given if set.
+	defaults := map[string]string{"key": *keyFile, "ca": *caFile}
+	if *keyFile != "" && *certFile != *keyFile {
+		defaults["cert"] = *certFile
+	}
+	args := []string{fmt.Sprintf("--log-format=%s", *logFormat)}
+	if *debug {
+		args = append(args, "--debug")
+	}
+	if *syslog {
+		args = append(args, "--syslog")
+	}
+	if *syslogAddress != "" {
+		args = append(args, fmt.Sprintf("--syslog-address=%s", *syslogAddress))
+	}
+	if *syslogCa != "" {
+		args = append(args, fmt.Sprintf("--syslog-ca=%s", *syslogCa))
+	}
+	if *syslogTag != "" {
+		args = append(args, fmt.Sprintf("--syslog-tag=%s", *syslogTag))
+	}
+	args = append(args, fmt.Sprintf("--syslog-facility=%s", *logFacility))
+	if *journal {
+		args = append(args, "--journal")
+	}
+	if *secretVerify != "" {
+		args = append(args, fmt.Sprintf("--secret-verify-key=%s", *secretVerify))
+	}
+
+	plugin, err := NewVolumePlugin(*pluginRoot, execMount(defaults, args), logConfig)
+	if err != nil {
+		log.Fatalf("Unable to start plugin: %v\n", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*pluginSocket), 0755); err != nil {
+		log.Fatalf("Unable to create plugin socket: %v\n", err)
+	}
+	os.Remove(*pluginSocket)
+	listener, err := net.Listen("unix", *pluginSocket)
+	if err != nil {
+		log.Fatalf("Unable to listen on plugin socket: %v\n", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, unix.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
 	}()
 
-	server.Serve()
-	logger.Infof("Exiting")
+	logger.Infof("Serving volume plugin on %s", *pluginSocket)
+	err = http.Serve(listener, plugin)
+	plugin.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Fatalf("Plugin stopped: %v\n", err)
+	}
 }
 
 // Setup metrics
@@ -142,18 +939,47 @@ func setupMetrics(metricsURL *string, metricsPrefix *string, mountpoint string)
 	return sqmetrics.NewMetrics(*metricsURL, prefix, http.DefaultClient, (30 * time.Second), metrics.DefaultRegistry, &log.Logger{})
 }
 
-// Locks memory, preventing memory from being written to disk as swap
-func lockMemory() {
-	err := unix.Mlockall(unix.MCL_FUTURE | unix.MCL_CURRENT)
+// Locks memory, preventing memory from being written to disk as swap. Returns true if memory is
+// locked.
+func lockMemory() bool {
+	limit, err := raiseMemlockLimit()
+	if err != nil {
+		logger.Warnf("Unable to raise RLIMIT_MEMLOCK: %v", err)
+	}
+
+	err = unix.Mlockall(unix.MCL_FUTURE | unix.MCL_CURRENT)
 	switch err {
 	case nil:
+		logger.Infof("Locked memory, RLIMIT_MEMLOCK is %s", formatMemlockLimit(limit))
+		return true
 	case unix.ENOSYS:
 		logger.Warnf("mlockall() not implemented on this system")
-	case unix.ENOMEM:
-		logger.Warnf("mlockall() failed with ENOMEM")
+	case unix.ENOMEM, unix.EPERM:
+		// Without CAP_IPC_LOCK, memory is limited by RLIMIT_MEMLOCK.
+		logger.Warnf("mlockall() failed with %v: RLIMIT_MEMLOCK of %s is too low, secrets may be swapped out. "+
+			"Grant CAP_IPC_LOCK or raise the limit, e.g. with LimitMEMLOCK=infinity", err, formatMemlockLimit(limit))
 	default:
 		log.Fatalf("Could not perform mlockall and prevent swapping memory: %v", err)
 	}
+	return false
+}
+
+// setCongestionThreshold overrides the congestion threshold the kernel derives from the max
+// background setting. The kernel applies its own value when the INIT request is answered, so
+// wait for that by stat'ing the mountpoint, which blocks until initialization is done.
+func setCongestionThreshold(tuning *FuseTuning, mountpoint string, value int) {
+	if _, err := os.Stat(mountpoint); err != nil {
+		logger.Errorf("Unable to set congestion threshold: %v", err)
+		return
+	}
+	if err := tuning.Set("congestion_threshold", value); err != nil {
+		logger.Errorf("Unable to set congestion threshold: %v", err)
+	}
+}
+
+// clientOptions returns the optional client settings given on the command line.
+func clientOptions() ClientOptions {
+	return ClientOptions{Resolvers: *dnsResolvers, Tracer: tracer, VerifyKey: verifyKey, MaxSecretSize: int64(*maxSecretSize), TokenFile: *tokenFile}
 }
 
 // Helper function to panic on error
@@ -0,0 +1,58 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Resource limit constants missing from golang.org/x/sys/unix.
+const (
+	rlimitMemlock = 8
+	rlimInfinity  = ^uint64(0)
+)
+
+// raiseMemlockLimit raises RLIMIT_MEMLOCK, which bounds how much memory a process without
+// CAP_IPC_LOCK may lock, so that mlockall can lock all of it. The limit becomes unlimited if the
+// process may raise the hard limit (CAP_SYS_RESOURCE), and the hard limit otherwise. Returns the
+// resulting soft limit.
+func raiseMemlockLimit() (uint64, error) {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(rlimitMemlock, &limit); err != nil {
+		return 0, err
+	}
+	unlimited := unix.Rlimit{Cur: rlimInfinity, Max: rlimInfinity}
+	if err := unix.Setrlimit(rlimitMemlock, &unlimited); err == nil {
+		return rlimInfinity, nil
+	}
+	if limit.Cur < limit.Max {
+		raised := unix.Rlimit{Cur: limit.Max, Max: limit.Max}
+		if err := unix.Setrlimit(rlimitMemlock, &raised); err != nil {
+			return limit.Cur, err
+		}
+		limit = raised
+	}
+	return limit.Cur, nil
+}
+
+// formatMemlockLimit formats an RLIMIT_MEMLOCK value for logging.
+func formatMemlockLimit(limit uint64) string {
+	if limit == rlimInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(limit, 10) + " bytes"
+}
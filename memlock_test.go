@@ -0,0 +1,45 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestRaiseMemlockLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	var before unix.Rlimit
+	assert.NoError(unix.Getrlimit(rlimitMemlock, &before))
+	defer unix.Setrlimit(rlimitMemlock, &before)
+
+	limit, err := raiseMemlockLimit()
+	assert.NoError(err)
+	assert.True(limit >= before.Max, "raised to at least the hard limit")
+
+	var after unix.Rlimit
+	assert.NoError(unix.Getrlimit(rlimitMemlock, &after))
+	assert.Equal(limit, after.Cur)
+}
+
+func TestFormatMemlockLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("unlimited", formatMemlockLimit(rlimInfinity))
+	assert.Equal("65536 bytes", formatMemlockLimit(65536))
+}
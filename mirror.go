@@ -0,0 +1,143 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/square/keywhiz-fs/log"
+)
+
+// mirrorModeMask restricts the permissions of secret files in a mirror: never writable, and
+// never readable by others.
+const mirrorModeMask = 0440
+
+// MirrorFs is a hardened, read-only view of a KeywhizFs meant to be bind-mounted into
+// containers. It serves the same secrets from the same cache, but exposes no special files or
+// alias symlinks and never grants write or other-user permissions.
+type MirrorFs struct {
+	pathfs.FileSystem
+	*log.Logger
+	kwfs   *KeywhizFs
+	nodeFs *pathfs.PathNodeFs
+}
+
+// NewMirrorFs creates a mirror of kwfs and its root node.
+func NewMirrorFs(kwfs *KeywhizFs, logConfig log.Config) (mirror *MirrorFs, root nodefs.Node) {
+	logger := log.New("kwfs_mirror", logConfig)
+	readonlyfs := pathfs.NewReadonlyFileSystem(pathfs.NewDefaultFileSystem())
+
+	mirror = &MirrorFs{readonlyfs, logger, kwfs, nil}
+	nfs := pathfs.NewPathNodeFs(mirror, nil)
+	nfs.SetDebug(logConfig.Debug)
+	mirror.nodeFs = nfs
+	return mirror, nfs.Root()
+}
+
+// NotifyChanges makes the kernel drop cached attributes and content of changed secrets. Must
+// only be called once the mirror is mounted.
+func (m *MirrorFs) NotifyChanges() {
+	m.kwfs.Cache.OnChange(func(change SecretChange) {
+		var status fuse.Status
+		if change.Deleted {
+			status = notifyDeleted(m.nodeFs, change.Name)
+		} else {
+			status = m.nodeFs.Notify(change.Name)
+		}
+		m.Debugf("Invalidated kernel cache for '%v': %v", change.Name, status)
+	})
+}
+
+// hidden returns true for names which the mirror does not expose.
+func (m *MirrorFs) hidden(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	_, alias := m.kwfs.Cache.Alias(name)
+	return alias
+}
+
+// GetAttr is a FUSE function which tells FUSE which files and directories exist.
+func (m *MirrorFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "" {
+		return m.kwfs.directoryAttr(1, 0555), fuse.OK
+	}
+	if m.hidden(name) {
+		return nil, fuse.ENOENT
+	}
+
+	attr, status := m.kwfs.GetAttr(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if attr.IsDir() {
+		attr.Mode = fuse.S_IFDIR | 0555
+	} else {
+		attr.Mode = fuse.S_IFREG | attr.Mode&mirrorModeMask
+	}
+	return attr, fuse.OK
+}
+
+// Open is a FUSE function where an in-memory open file struct is constructed.
+func (m *MirrorFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	attr, status := m.GetAttr(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	if attr.IsDir() {
+		return nil, fuseEISDIR
+	}
+
+	file, status := m.kwfs.Open(name, flags, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	return m.kwfs.withOpenFlags(NewAttrFile(file, attr)), fuse.OK
+}
+
+// OpenDir is a FUSE function called when performing a directory listing.
+func (m *MirrorFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if name != "" && m.hidden(name) {
+		return nil, fuse.ENOENT
+	}
+
+	entries, status := m.kwfs.OpenDir(name, context)
+	if status != fuse.OK {
+		return nil, status
+	}
+	var visible []fuse.DirEntry
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name, ".") || entry.Mode == fuse.S_IFLNK {
+			continue
+		}
+		visible = append(visible, entry)
+	}
+	return visible, fuse.OK
+}
+
+// StatFs is a FUSE function called to provide information about the filesystem.
+func (m *MirrorFs) StatFs(name string) *fuse.StatfsOut {
+	return &fuse.StatfsOut{}
+}
+
+func (m *MirrorFs) String() string {
+	return "keywhiz-fs-mirror"
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// initialMissBackoff is how long a name the backend reported missing is answered from
+	// memory after its first miss. Each further miss doubles it, up to the maximum backoff.
+	initialMissBackoff = 1 * time.Second
+	// maxTrackedMisses bounds the names tracked, so probing random names can't grow memory.
+	// Misses aren't tracked, and requests aren't suppressed, while it is reached.
+	maxTrackedMisses = 10000
+)
+
+// missTracker remembers names which the backend recently reported don't exist, so that an
+// application retrying a missing secret in a loop is answered from memory instead of sending a
+// request to the server every time. Names are forgotten once they stop being asked for.
+type missTracker struct {
+	lock    sync.Mutex
+	max     time.Duration
+	now     func() time.Time
+	entries map[string]*miss
+}
+
+type miss struct {
+	until   time.Time
+	backoff time.Duration
+}
+
+// newMissTracker returns a tracker backing off up to max. now defaults to time.Now if nil.
+func newMissTracker(max time.Duration, now func() time.Time) *missTracker {
+	if now == nil {
+		now = time.Now
+	}
+	return &missTracker{max: max, now: now, entries: map[string]*miss{}}
+}
+
+// SetMax sets the longest backoff. A backoff of 0 disables the tracking.
+func (t *missTracker) SetMax(max time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.max = max
+	if max <= 0 {
+		t.entries = map[string]*miss{}
+	}
+}
+
+// suppressed returns true if name was reported missing recently enough that the backend
+// shouldn't be asked again yet.
+func (t *missTracker) suppressed(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	m, ok := t.entries[name]
+	return ok && t.now().Before(m.until)
+}
+
+// missed records that the backend reported name missing. Misses in a row, each within the
+// longest backoff of the end of the previous backoff, back off exponentially.
+func (t *missTracker) missed(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.max <= 0 {
+		return
+	}
+	now := t.now()
+	m, ok := t.entries[name]
+	if !ok {
+		if len(t.entries) >= maxTrackedMisses {
+			t.prune(now)
+		}
+		if len(t.entries) >= maxTrackedMisses {
+			return
+		}
+		m = &miss{}
+		t.entries[name] = m
+	}
+	switch {
+	case m.backoff == 0 || now.After(m.until.Add(t.max)):
+		m.backoff = initialMissBackoff
+	case m.backoff < t.max:
+		m.backoff *= 2
+	}
+	if m.backoff > t.max {
+		m.backoff = t.max
+	}
+	m.until = now.Add(m.backoff)
+}
+
+// forget stops tracking name, once it exists.
+func (t *missTracker) forget(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.entries, name)
+}
+
+// Len returns the number of names tracked.
+func (t *missTracker) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.entries)
+}
+
+// prune drops names which haven't missed for longer than the longest backoff. Must be called
+// with lock held.
+func (t *missTracker) prune(now time.Time) {
+	for name, m := range t.entries {
+		if now.After(m.until.Add(t.max)) {
+			delete(t.entries, name)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// FetchCountingBackend is a MapBackend counting secret requests.
+type FetchCountingBackend struct {
+	MapBackend
+	calls *int32
+}
+
+func (b FetchCountingBackend) Fetch(name string) (*Secret, error) {
+	atomic.AddInt32(b.calls, 1)
+	return b.MapBackend.Fetch(name)
+}
+
+func TestMissTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	misses := newMissTracker(4*time.Second, func() time.Time { return now })
+	assert.False(misses.suppressed("missing"))
+
+	// Backoffs double while the name keeps missing, up to the maximum.
+	for _, backoff := range []time.Duration{1, 2, 4, 4} {
+		misses.missed("missing")
+		now = now.Add(backoff*time.Second - time.Millisecond)
+		assert.True(misses.suppressed("missing"), "%v", backoff)
+		now = now.Add(time.Millisecond)
+		assert.False(misses.suppressed("missing"), "%v", backoff)
+	}
+
+	// Once no longer asked for, a name starts over.
+	now = now.Add(5 * time.Second)
+	misses.missed("missing")
+	now = now.Add(time.Second)
+	assert.False(misses.suppressed("missing"))
+
+	misses.forget("missing")
+	assert.Equal(0, misses.Len())
+	misses.SetMax(0)
+	misses.missed("missing")
+	assert.False(misses.suppressed("missing"))
+}
+
+func TestCacheMissBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	backend := FetchCountingBackend{MapBackend{}, &calls}
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	now := time.Now()
+	cache := NewCache(backend, timeouts, logConfig, func() time.Time { return now })
+	registry := metrics.NewRegistry()
+	cache.SetMetrics(registry)
+
+	for i := 0; i < 100; i++ {
+		_, ok := cache.Secret("missing")
+		assert.False(ok)
+	}
+	assert.EqualValues(1, atomic.LoadInt32(&calls))
+	assert.EqualValues(99, registry.Get("runtime.cache.miss_suppressed").(metrics.Counter).Count())
+	assert.EqualValues(1, registry.Get("runtime.cache.miss_tracked").(metrics.Gauge).Value())
+
+	// Once the backoff expires, the backend is asked again.
+	now = now.Add(initialMissBackoff)
+	_, ok := cache.Secret("missing")
+	assert.False(ok)
+	assert.EqualValues(2, atomic.LoadInt32(&calls))
+
+	// A secret which shows up in a listing is asked for right away.
+	backend.MapBackend["missing"] = "created"
+	cache.SecretList()
+	secret, ok := cache.Secret("missing")
+	assert.True(ok)
+	assert.Equal("created", string(secret.Content.Bytes()))
+	assert.EqualValues(3, atomic.LoadInt32(&calls))
+	assert.EqualValues(0, registry.Get("runtime.cache.miss_tracked").(metrics.Gauge).Value())
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "time"
+
+// monotonicStart anchors readings of the monotonic clock. Go compares and subtracts times read
+// with time.Now on the monotonic clock, which NTP steps and manual changes to the system clock
+// don't affect, but times converted to numbers (e.g. with UnixNano), decoded or read from disk
+// only have a wall clock reading. Expiry and timeouts are kept on the monotonic clock, so that a
+// change of the system clock can't expire every cached secret at once or keep them forever.
+var monotonicStart = time.Now()
+
+// monotonic returns t, read with time.Now, as nanoseconds on the monotonic clock since the
+// process started, for storing in an int64 updated atomically, where zero stands for never.
+func monotonic(t time.Time) int64 {
+	return int64(t.Sub(monotonicStart))
+}
+
+// monotonicSince returns the time elapsed since a reading returned by monotonic.
+func monotonicSince(nanos int64) time.Duration {
+	return time.Duration(monotonic(time.Now()) - nanos)
+}
+
+// anchored returns t, a wall clock time such as a timestamp read from disk, with the monotonic
+// clock reading of now: its age is measured once, against the wall clock, and comparisons with
+// the result from then on are unaffected by changes to the system clock.
+func anchored(t, now time.Time) time.Time {
+	return now.Add(-now.Sub(t))
+}
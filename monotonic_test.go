@@ -0,0 +1,75 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonotonic(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	assert.True(monotonic(now) > 0)
+	assert.EqualValues(-time.Hour, monotonic(monotonicStart.Add(-time.Hour)))
+	assert.True(monotonicSince(monotonic(now.Add(-time.Minute))) >= time.Minute)
+
+	// A time decoded from disk has no monotonic clock reading, until anchored.
+	created := now.Add(-time.Hour).Round(0)
+	assert.NotContains(created.String(), " m=")
+	anchoredCreated := anchored(created, now)
+	assert.Contains(anchoredCreated.String(), " m=")
+	assert.Equal(time.Hour, now.Sub(anchoredCreated))
+	assert.True(anchoredCreated.Equal(created))
+}
+
+func TestBootstrapAnchorsBundleTime(t *testing.T) {
+	assert := assert.New(t)
+
+	var bundle Bundle
+	data, _ := json.Marshal(&Bundle{CreatedAt: time.Now().Add(-24 * time.Hour), Secrets: []json.RawMessage{fixture("secret.json")}})
+	assert.NoError(json.Unmarshal(data, &bundle))
+
+	cache := NewCache(FailingBackend{}, timeouts, logConfig, nil)
+	assert.NoError(cache.Bootstrap(&bundle))
+	entry, ok := cache.secretMap.Get("Nobody_PgPass")
+	assert.True(ok)
+	assert.Contains(entry.Time.String(), " m=")
+	assert.InDelta(float64(24*time.Hour), float64(time.Since(entry.Time)), float64(time.Second))
+}
+
+func TestHealthUsesMonotonicClock(t *testing.T) {
+	assert := assert.New(t)
+
+	client := Client{failCount: metrics.NewCounter(), lastSuccess: metrics.NewGauge(), succeededAt: new(int64)}
+	mounted := time.Now().Add(-time.Hour)
+
+	// A last success recorded with a wall clock set far back doesn't count against the server.
+	client.markSuccess()
+	client.lastSuccess.Update(time.Date(2016, time.June, 29, 20, 5, 21, 0, time.UTC).Unix())
+	client.failCount.Inc(1)
+	state, lastSuccess, _ := client.Health(time.Minute, mounted)
+	assert.Equal(healthDegraded, state)
+	assert.Equal(2016, lastSuccess.Year())
+
+	*client.succeededAt = 0
+	state, _, _ = client.Health(time.Minute, mounted)
+	assert.Equal(healthUnreachable, state)
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// MountConfig holds the FUSE mount options which can be tuned per deployment.
+type MountConfig struct {
+	// AllowOther lets users other than the one running keywhiz-fs access the mount.
+	AllowOther bool
+	// DefaultPermissions makes the kernel enforce file modes and ownership.
+	DefaultPermissions bool
+	// MaxRead limits the size of read requests sent by the kernel. Zero uses the kernel default.
+	MaxRead int
+	// MaxBackground is the number of background requests the kernel may queue.
+	MaxBackground int
+	// DirectIO bypasses the kernel page cache, so every read of a file reaches keywhiz-fs.
+	DirectIO bool
+	// AttrTimeout and EntryTimeout are how long the kernel caches attributes and name lookups of
+	// secrets.
+	AttrTimeout  time.Duration
+	EntryTimeout time.Duration
+	// SpecialAttrTimeout and SpecialEntryTimeout are the same for special files, directories and
+	// alias symlinks, whose attributes change whenever the cache does.
+	SpecialAttrTimeout  time.Duration
+	SpecialEntryTimeout time.Duration
+}
+
+// Validate checks that the options are acceptable to the kernel.
+func (c MountConfig) Validate() error {
+	if c.MaxRead != 0 && (c.MaxRead < 4096 || c.MaxRead > fuse.MAX_KERNEL_WRITE) {
+		return fmt.Errorf("max_read must be between 4096 and %d, got %d", fuse.MAX_KERNEL_WRITE, c.MaxRead)
+	}
+	if c.AttrTimeout < 0 || c.EntryTimeout < 0 || c.SpecialAttrTimeout < 0 || c.SpecialEntryTimeout < 0 {
+		return fmt.Errorf("attribute and entry timeouts must not be negative")
+	}
+	return nil
+}
+
+// MountOptions returns the options for mounting a filesystem with the given name.
+func (c MountConfig) MountOptions(name string) *fuse.MountOptions {
+	opts := &fuse.MountOptions{
+		AllowOther:    c.AllowOther,
+		Name:          name,
+		MaxBackground: c.MaxBackground,
+	}
+	if c.DefaultPermissions {
+		opts.Options = append(opts.Options, "default_permissions")
+	}
+	if c.MaxRead > 0 {
+		opts.Options = append(opts.Options, fmt.Sprintf("max_read=%d", c.MaxRead))
+	}
+	return opts
+}
+
+// NodeOptions returns the options for the filesystem connector. There is deliberately no uid or
+// gid override, since files carry their own ownership. The timeouts are those of special files,
+// see RawFS.
+func (c MountConfig) NodeOptions() *nodefs.Options {
+	return &nodefs.Options{AttrTimeout: c.SpecialAttrTimeout, EntryTimeout: c.SpecialEntryTimeout}
+}
+
+// RawFS returns the filesystem served for a connector created with NodeOptions, which applies the
+// timeouts of secrets.
+func (c MountConfig) RawFS(conn *nodefs.FileSystemConnector) fuse.RawFileSystem {
+	if c.AttrTimeout == c.SpecialAttrTimeout && c.EntryTimeout == c.SpecialEntryTimeout {
+		return conn.RawFS()
+	}
+	return newSecretTimeoutFS(conn.RawFS(), c.AttrTimeout, c.EntryTimeout)
+}
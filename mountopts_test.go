@@ -0,0 +1,63 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountConfigOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	config := MountConfig{
+		AllowOther:          true,
+		DefaultPermissions:  true,
+		MaxRead:             65536,
+		MaxBackground:       12,
+		AttrTimeout:         time.Second,
+		EntryTimeout:        2 * time.Second,
+		SpecialAttrTimeout:  100 * time.Millisecond,
+		SpecialEntryTimeout: 200 * time.Millisecond,
+	}
+	assert.NoError(config.Validate())
+
+	opts := config.MountOptions("keywhiz-fs")
+	assert.True(opts.AllowOther)
+	assert.Equal("keywhiz-fs", opts.Name)
+	assert.Equal(12, opts.MaxBackground)
+	assert.Equal([]string{"default_permissions", "max_read=65536"}, opts.Options)
+
+	nodeOpts := config.NodeOptions()
+	assert.Equal(100*time.Millisecond, nodeOpts.AttrTimeout)
+	assert.Equal(200*time.Millisecond, nodeOpts.EntryTimeout)
+	assert.Nil(nodeOpts.Owner)
+
+	opts = MountConfig{}.MountOptions("keywhiz-fs")
+	assert.False(opts.AllowOther)
+	assert.Empty(opts.Options)
+}
+
+func TestMountConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(MountConfig{}.Validate())
+	assert.Error(MountConfig{MaxRead: 100}.Validate())
+	assert.Error(MountConfig{MaxRead: 1 << 20}.Validate())
+	assert.Error(MountConfig{AttrTimeout: -time.Second}.Validate())
+	assert.Error(MountConfig{SpecialEntryTimeout: -time.Second}.Validate())
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// OwnershipRule overrides the owner, group and mode of the secrets it names, as recorded by the
+// server. Each of them may be omitted to keep the server's.
+type OwnershipRule struct {
+	// Secrets are regular expressions matched against whole secret names.
+	Secrets []string `json:"secrets"`
+	// Owner and Group are names or numeric ids.
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Mode holds octal permission bits, e.g. "0440".
+	Mode string `json:"mode,omitempty"`
+
+	secrets  []*regexp.Regexp
+	uid, gid *uint32
+	mode     *uint32
+}
+
+// OwnershipOverrides applies the first rule matching a secret to the attributes of its file, for
+// hosts whose accounts don't match those recorded by the server.
+type OwnershipOverrides struct {
+	rules []OwnershipRule
+}
+
+// LoadOwnershipOverrides reads an overrides file, a JSON list of rules such as:
+//
+//	[{"secrets": ["db\\..*"], "owner": "postgres", "group": "postgres", "mode": "0400"}]
+func LoadOwnershipOverrides(file string) (*OwnershipOverrides, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []OwnershipRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid ownership file %s: %v", file, err)
+	}
+	return NewOwnershipOverrides(rules)
+}
+
+// NewOwnershipOverrides validates rules, resolving owners and groups to ids.
+func NewOwnershipOverrides(rules []OwnershipRule) (*OwnershipOverrides, error) {
+	for i := range rules {
+		rule := &rules[i]
+		var err error
+		if rule.secrets, err = compilePatterns(rule.Secrets); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		if rule.Owner != "" {
+			uid, err := resolveUid(rule.Owner)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+			rule.uid = &uid
+		}
+		if rule.Group != "" {
+			gid, err := resolveGid(rule.Group)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+			rule.gid = &gid
+		}
+		if rule.Mode != "" {
+			mode, err := strconv.ParseUint(rule.Mode, 8, 32)
+			if err != nil || mode > 0777 {
+				return nil, fmt.Errorf("rule %d: invalid mode '%s'", i, rule.Mode)
+			}
+			m := uint32(mode)
+			rule.mode = &m
+		}
+	}
+	return &OwnershipOverrides{rules}, nil
+}
+
+// Apply overrides the owner, group and mode in the attributes of the named secret's file.
+func (o *OwnershipOverrides) Apply(name string, attr *fuse.Attr) {
+	if o == nil {
+		return
+	}
+	for _, rule := range o.rules {
+		if !rule.matchesSecret(name) {
+			continue
+		}
+		if rule.uid != nil {
+			attr.Uid = *rule.uid
+		}
+		if rule.gid != nil {
+			attr.Gid = *rule.gid
+		}
+		if rule.mode != nil {
+			attr.Mode = attr.Mode&^0777 | *rule.mode
+		}
+		return
+	}
+}
+
+func (rule OwnershipRule) matchesSecret(name string) bool {
+	for _, re := range rule.secrets {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
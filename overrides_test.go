@@ -0,0 +1,72 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwnershipOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-overrides")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	groupFile = filepath.Join(dir, "group")
+	defer func() { groupFile = "/etc/group" }()
+	assert.NoError(ioutil.WriteFile(groupFile, []byte("postgres:x:1234:\n"), 0644))
+
+	file := filepath.Join(dir, "ownership.json")
+	assert.NoError(ioutil.WriteFile(file, []byte(`[
+		{"secrets": ["db\\..*"], "owner": "1000", "group": "postgres", "mode": "0400"},
+		{"secrets": ["db\\.admin", "api"], "owner": "0"},
+		{"secrets": ["tls\\..*"], "mode": "0444"}
+	]`), 0644))
+	overrides, err := LoadOwnershipOverrides(file)
+	assert.NoError(err)
+
+	attr := func(name string) *fuse.Attr {
+		a := &fuse.Attr{Mode: fuse.S_IFREG | 0440, Uid: 1, Gid: 2}
+		overrides.Apply(name, a)
+		return a
+	}
+	// The first matching rule applies, keeping what it leaves out.
+	assert.Equal(&fuse.Attr{Mode: fuse.S_IFREG | 0400, Uid: 1000, Gid: 1234}, attr("db.admin"))
+	assert.Equal(&fuse.Attr{Mode: fuse.S_IFREG | 0440, Uid: 0, Gid: 2}, attr("api"))
+	assert.Equal(&fuse.Attr{Mode: fuse.S_IFREG | 0444, Uid: 1, Gid: 2}, attr("tls.key"))
+	assert.Equal(&fuse.Attr{Mode: fuse.S_IFREG | 0440, Uid: 1, Gid: 2}, attr("other"))
+
+	var none *OwnershipOverrides
+	a := &fuse.Attr{Mode: fuse.S_IFREG | 0440}
+	none.Apply("db.admin", a)
+	assert.EqualValues(fuse.S_IFREG|0440, a.Mode)
+
+	for _, rules := range [][]OwnershipRule{
+		{{Secrets: []string{"("}}},
+		{{Secrets: []string{"db"}, Group: "missing"}},
+		{{Secrets: []string{"db"}, Owner: "no-such-user-kwfs"}},
+		{{Secrets: []string{"db"}, Mode: "0999"}},
+		{{Secrets: []string{"db"}, Mode: "01777"}},
+	} {
+		_, err := NewOwnershipOverrides(rules)
+		assert.Error(err, "%v", rules)
+	}
+}
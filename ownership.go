@@ -17,6 +17,7 @@ package main
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/user"
@@ -90,3 +91,33 @@ func lookupGidInFile(groupname string, file *os.File) (uint32, error) {
 
 	return 0, errors.New("no such group")
 }
+
+// resolveUid resolves a user name or numeric uid. Unlike lookupUid, unknown users are an error.
+func resolveUid(owner string) (uint32, error) {
+	if uid, err := strconv.ParseUint(owner, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(uid), err
+}
+
+// resolveGid resolves a group name or numeric gid. Unlike lookupGid, unknown groups are an error.
+func resolveGid(group string) (uint32, error) {
+	if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	file, err := os.Open(groupFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	gid, err := lookupGidInFile(group, file)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group '%s'", group)
+	}
+	return gid, nil
+}
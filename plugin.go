@@ -0,0 +1,416 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+// pluginContentType is the media type of requests and responses of the Docker plugin API.
+const pluginContentType = "application/vnd.docker.plugins.v1+json"
+
+// pluginStopTimeout bounds how long a volume's mount process may take to exit once signalled.
+const pluginStopTimeout = 30 * time.Second
+
+// pluginVolumeOptions are the options of a volume (docker volume create -o NAME=VALUE), and the
+// flags of keywhiz-fs they set. "url" is the mount url.
+var pluginVolumeOptions = map[string]bool{
+	"url":           true,
+	"cert":          true,
+	"key":           true,
+	"ca":            true,
+	"asuser":        true,
+	"group":         true,
+	"timeout":       true,
+	"cache-timeout": true,
+	"include":       true,
+	"exclude":       true,
+}
+
+// pluginVolumeName restricts volume names to those safe as a directory name.
+var pluginVolumeName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// pluginMounter mounts a volume at mountpoint, returning a function which unmounts it.
+type pluginMounter func(name string, opts map[string]string, mountpoint string) (unmount func() error, err error)
+
+// VolumePlugin implements the Docker volume plugin API, so that containers can use keywhiz-fs
+// volumes by name. Each volume has its own server and client certificate, given as options when
+// it is created, and is mounted by a keywhiz-fs process while any container uses it. Volumes are
+// recorded in a state file, so that they survive restarts of the plugin.
+type VolumePlugin struct {
+	*log.Logger
+	// root is the directory containing the mountpoints of volumes and the state file.
+	root  string
+	mount pluginMounter
+
+	lock    sync.Mutex
+	volumes map[string]*pluginVolume
+}
+
+// pluginVolume is a volume created through the plugin.
+type pluginVolume struct {
+	Opts map[string]string `json:"opts"`
+	// users are the IDs of the mounts using the volume.
+	users   map[string]bool
+	unmount func() error
+}
+
+// pluginRequest is the body of volume requests.
+type pluginRequest struct {
+	Name string
+	Opts map[string]string
+	ID   string
+}
+
+// pluginVolumeInfo describes a volume in responses.
+type pluginVolumeInfo struct {
+	Name       string
+	Mountpoint string            `json:",omitempty"`
+	Status     map[string]string `json:",omitempty"`
+}
+
+// NewVolumePlugin returns a plugin mounting volumes under root, with volumes from its state file.
+func NewVolumePlugin(root string, mount pluginMounter, logConfig log.Config) (*VolumePlugin, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	p := &VolumePlugin{
+		Logger:  log.New("kwfs_plugin", logConfig),
+		root:    root,
+		mount:   mount,
+		volumes: map[string]*pluginVolume{},
+	}
+	data, err := ioutil.ReadFile(p.stateFile())
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.volumes); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", p.stateFile(), err)
+	}
+	for _, v := range p.volumes {
+		v.users = map[string]bool{}
+	}
+	return p, nil
+}
+
+func (p *VolumePlugin) stateFile() string {
+	return filepath.Join(p.root, "volumes.json")
+}
+
+func (p *VolumePlugin) mountpoint(name string) string {
+	return filepath.Join(p.root, name)
+}
+
+// saveState records the volumes, replacing the state file atomically.
+func (p *VolumePlugin) saveState() error {
+	data, err := json.Marshal(p.volumes)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(p.root, ".volumes")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.stateFile())
+}
+
+// ServeHTTP dispatches requests of the plugin API, which are all POSTs with JSON bodies.
+func (p *VolumePlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req pluginRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			p.respond(w, map[string]string{"Err": fmt.Sprintf("invalid request: %v", err)})
+			return
+		}
+	}
+
+	var response interface{}
+	switch r.URL.Path {
+	case "/Plugin.Activate":
+		response = map[string][]string{"Implements": {"VolumeDriver"}}
+	case "/VolumeDriver.Capabilities":
+		response = map[string]map[string]string{"Capabilities": {"Scope": "local"}}
+	case "/VolumeDriver.Create":
+		response = errResponse(p.create(req.Name, req.Opts))
+	case "/VolumeDriver.Remove":
+		response = errResponse(p.remove(req.Name))
+	case "/VolumeDriver.Mount":
+		mountpoint, err := p.use(req.Name, req.ID)
+		response = mountResponse(mountpoint, err)
+	case "/VolumeDriver.Unmount":
+		response = errResponse(p.release(req.Name, req.ID))
+	case "/VolumeDriver.Path":
+		info, err := p.get(req.Name)
+		response = mountResponse(info.Mountpoint, err)
+	case "/VolumeDriver.Get":
+		info, err := p.get(req.Name)
+		if err != nil {
+			response = errResponse(err)
+		} else {
+			response = map[string]interface{}{"Volume": info, "Err": ""}
+		}
+	case "/VolumeDriver.List":
+		response = map[string]interface{}{"Volumes": p.list(), "Err": ""}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	p.respond(w, response)
+}
+
+func (p *VolumePlugin) respond(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", pluginContentType)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		p.Errorf("Error writing plugin response: %v", err)
+	}
+}
+
+func errResponse(err error) map[string]string {
+	if err != nil {
+		return map[string]string{"Err": err.Error()}
+	}
+	return map[string]string{"Err": ""}
+}
+
+func mountResponse(mountpoint string, err error) map[string]string {
+	if err != nil {
+		return errResponse(err)
+	}
+	return map[string]string{"Mountpoint": mountpoint, "Err": ""}
+}
+
+// create records a new volume. Options are checked now, rather than when a container starts.
+func (p *VolumePlugin) create(name string, opts map[string]string) error {
+	if !pluginVolumeName.MatchString(name) {
+		return fmt.Errorf("invalid volume name '%s'", name)
+	}
+	if opts["url"] == "" {
+		return fmt.Errorf("volume %s needs a url option", name)
+	}
+	for opt := range opts {
+		if !pluginVolumeOptions[opt] {
+			return fmt.Errorf("unknown option '%s' for volume %s", opt, name)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.volumes[name]; ok {
+		return fmt.Errorf("volume %s already exists", name)
+	}
+	p.volumes[name] = &pluginVolume{Opts: opts, users: map[string]bool{}}
+	if err := p.saveState(); err != nil {
+		delete(p.volumes, name)
+		return err
+	}
+	p.Infof("Created volume %s for %s", name, opts["url"])
+	return nil
+}
+
+// remove deletes a volume which no container uses.
+func (p *VolumePlugin) remove(name string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	v, ok := p.volumes[name]
+	if !ok {
+		return fmt.Errorf("no volume %s", name)
+	}
+	if len(v.users) > 0 {
+		return fmt.Errorf("volume %s is in use", name)
+	}
+	delete(p.volumes, name)
+	if err := p.saveState(); err != nil {
+		p.volumes[name] = v
+		return err
+	}
+	os.Remove(p.mountpoint(name))
+	p.Infof("Removed volume %s", name)
+	return nil
+}
+
+// use mounts a volume for a container, unless it's already mounted for another.
+func (p *VolumePlugin) use(name, id string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	v, ok := p.volumes[name]
+	if !ok {
+		return "", fmt.Errorf("no volume %s", name)
+	}
+	mountpoint := p.mountpoint(name)
+	if v.unmount == nil {
+		if err := os.MkdirAll(mountpoint, 0755); err != nil {
+			return "", err
+		}
+		unmount, err := p.mount(name, v.Opts, mountpoint)
+		if err != nil {
+			return "", fmt.Errorf("unable to mount volume %s: %v", name, err)
+		}
+		v.unmount = unmount
+		p.Infof("Mounted volume %s at %s", name, mountpoint)
+	}
+	v.users[id] = true
+	return mountpoint, nil
+}
+
+// release unmounts a volume once no container uses it.
+func (p *VolumePlugin) release(name, id string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	v, ok := p.volumes[name]
+	if !ok {
+		return fmt.Errorf("no volume %s", name)
+	}
+	delete(v.users, id)
+	if len(v.users) > 0 || v.unmount == nil {
+		return nil
+	}
+	err := v.unmount()
+	v.unmount = nil
+	if err != nil {
+		return fmt.Errorf("unable to unmount volume %s: %v", name, err)
+	}
+	p.Infof("Unmounted volume %s", name)
+	return nil
+}
+
+// get describes a volume. The mountpoint is only reported while mounted.
+func (p *VolumePlugin) get(name string) (pluginVolumeInfo, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	v, ok := p.volumes[name]
+	if !ok {
+		return pluginVolumeInfo{}, fmt.Errorf("no volume %s", name)
+	}
+	return p.info(name, v), nil
+}
+
+// list describes all volumes, sorted by name.
+func (p *VolumePlugin) list() []pluginVolumeInfo {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	infos := []pluginVolumeInfo{}
+	for name, v := range p.volumes {
+		infos = append(infos, p.info(name, v))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (p *VolumePlugin) info(name string, v *pluginVolume) pluginVolumeInfo {
+	info := pluginVolumeInfo{Name: name, Status: map[string]string{"url": v.Opts["url"]}}
+	if v.unmount != nil {
+		info.Mountpoint = p.mountpoint(name)
+	}
+	return info
+}
+
+// Close unmounts all volumes, e.g. when the plugin is stopped.
+func (p *VolumePlugin) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for name, v := range p.volumes {
+		if v.unmount == nil {
+			continue
+		}
+		if err := v.unmount(); err != nil {
+			p.Errorf("Unable to unmount volume %s: %v", name, err)
+		}
+		v.unmount, v.users = nil, map[string]bool{}
+	}
+}
+
+// execMount mounts a volume by running keywhiz-fs in a child process, with the volume's options
+// as flags. defaults are used for options the volume doesn't set, e.g. the plugin's own --key, and
+// args are further flags, e.g. --debug. The child reports when it is mounted as a daemon would. It
+// is stopped like any mount, with SIGTERM, and dies with the plugin.
+func execMount(defaults map[string]string, args []string) pluginMounter {
+	return func(name string, opts map[string]string, mountpoint string) (func() error, error) {
+		merged := map[string]string{}
+		for opt, value := range defaults {
+			merged[opt] = value
+		}
+		for opt, value := range opts {
+			merged[opt] = value
+		}
+		flags := append([]string{}, args...)
+		for opt, value := range merged {
+			if opt != "url" && value != "" {
+				flags = append(flags, fmt.Sprintf("--%s=%s", opt, value))
+			}
+		}
+		// Each volume's mount has its own control socket, next to its mountpoint. Volume names
+		// start with a letter or digit, so the socket can't clash with another mountpoint.
+		flags = append(flags, fmt.Sprintf("--control-socket=%s", filepath.Join(filepath.Dir(mountpoint), "."+name+".sock")))
+		sort.Strings(flags[len(args):])
+		flags = append(flags, "mount", "--no-daemon", merged["url"], mountpoint)
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		cmd := exec.Command("/proc/self/exe", flags...)
+		cmd.Env = append(os.Environ(), daemonEnv+"=1")
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		cmd.ExtraFiles = []*os.File{w}
+		cmd.SysProcAttr = volumeProcAttr()
+		err = cmd.Start()
+		w.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		if msg, _ := ioutil.ReadAll(r); string(msg) != daemonReadyMsg {
+			return nil, fmt.Errorf("keywhiz-fs exited: %v", <-exited)
+		}
+
+		return func() error {
+			cmd.Process.Signal(syscall.SIGTERM)
+			select {
+			case <-exited:
+				return nil
+			case <-time.After(pluginStopTimeout):
+				cmd.Process.Kill()
+				<-exited
+				return lazyUnmount(mountpoint)
+			}
+		}, nil
+	}
+}
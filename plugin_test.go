@@ -0,0 +1,105 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pluginCall posts a request to the plugin API and decodes the response.
+func pluginCall(t *testing.T, plugin *VolumePlugin, endpoint string, request interface{}) map[string]interface{} {
+	body, _ := json.Marshal(request)
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(w, httptest.NewRequest("POST", "/"+endpoint, bytes.NewReader(body)))
+	assert.Equal(t, pluginContentType, w.Header().Get("Content-Type"))
+	response := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response
+}
+
+func TestVolumePlugin(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := ioutil.TempDir("", "kwfs_plugin")
+	assert.NoError(err)
+	defer os.RemoveAll(root)
+
+	mounts, unmounts := []string{}, 0
+	mounter := func(name string, opts map[string]string, mountpoint string) (func() error, error) {
+		if opts["url"] == "https://down" {
+			return nil, fmt.Errorf("unreachable")
+		}
+		mounts = append(mounts, fmt.Sprintf("%s %s %s", name, opts["url"], mountpoint))
+		return func() error { unmounts++; return nil }, nil
+	}
+	plugin, err := NewVolumePlugin(root, mounter, logConfig)
+	assert.NoError(err)
+
+	assert.Equal([]interface{}{"VolumeDriver"}, pluginCall(t, plugin, "Plugin.Activate", nil)["Implements"])
+	assert.Equal(map[string]interface{}{"Scope": "local"}, pluginCall(t, plugin, "VolumeDriver.Capabilities", nil)["Capabilities"])
+
+	// Invalid volumes are rejected when created.
+	assert.Contains(pluginCall(t, plugin, "VolumeDriver.Create", pluginRequest{Name: "app"})["Err"], "url")
+	assert.Contains(pluginCall(t, plugin, "VolumeDriver.Create", pluginRequest{Name: "../app", Opts: map[string]string{"url": "https://kw"}})["Err"], "invalid volume name")
+	assert.Contains(pluginCall(t, plugin, "VolumeDriver.Create", pluginRequest{Name: "app", Opts: map[string]string{"url": "https://kw", "mirror": "/"}})["Err"], "unknown option")
+
+	create := pluginRequest{Name: "app", Opts: map[string]string{"url": "https://kw", "key": "/etc/app.pem"}}
+	assert.Equal("", pluginCall(t, plugin, "VolumeDriver.Create", create)["Err"])
+	assert.Contains(pluginCall(t, plugin, "VolumeDriver.Create", create)["Err"], "already exists")
+	assert.Equal("", pluginCall(t, plugin, "VolumeDriver.Create", pluginRequest{Name: "down", Opts: map[string]string{"url": "https://down"}})["Err"])
+
+	// Mounted once, for the first container, and unmounted after the last.
+	mountpoint := root + "/app"
+	assert.Equal(mountpoint, pluginCall(t, plugin, "VolumeDriver.Mount", pluginRequest{Name: "app", ID: "c1"})["Mountpoint"])
+	assert.Equal(mountpoint, pluginCall(t, plugin, "VolumeDriver.Mount", pluginRequest{Name: "app", ID: "c2"})["Mountpoint"])
+	assert.Equal([]string{"app https://kw " + mountpoint}, mounts)
+	assert.Equal(mountpoint, pluginCall(t, plugin, "VolumeDriver.Path", pluginRequest{Name: "app"})["Mountpoint"])
+	assert.Contains(pluginCall(t, plugin, "VolumeDriver.Mount", pluginRequest{Name: "down", ID: "c1"})["Err"], "unreachable")
+	assert.Contains(pluginCall(t, plugin, "VolumeDriver.Mount", pluginRequest{Name: "missing", ID: "c1"})["Err"], "no volume")
+
+	assert.Contains(pluginCall(t, plugin, "VolumeDriver.Remove", pluginRequest{Name: "app"})["Err"], "in use")
+	assert.Equal("", pluginCall(t, plugin, "VolumeDriver.Unmount", pluginRequest{Name: "app", ID: "c1"})["Err"])
+	assert.Equal(0, unmounts)
+	assert.Equal("", pluginCall(t, plugin, "VolumeDriver.Unmount", pluginRequest{Name: "app", ID: "c2"})["Err"])
+	assert.Equal(1, unmounts)
+
+	volume := pluginCall(t, plugin, "VolumeDriver.Get", pluginRequest{Name: "app"})["Volume"].(map[string]interface{})
+	assert.Equal("app", volume["Name"])
+	assert.Nil(volume["Mountpoint"], "not mounted")
+	assert.Len(pluginCall(t, plugin, "VolumeDriver.List", nil)["Volumes"], 2)
+
+	// Volumes survive restarts of the plugin, unmounted.
+	pluginCall(t, plugin, "VolumeDriver.Mount", pluginRequest{Name: "app", ID: "c3"})
+	plugin.Close()
+	assert.Equal(2, unmounts)
+	plugin, err = NewVolumePlugin(root, mounter, logConfig)
+	assert.NoError(err)
+	assert.Len(pluginCall(t, plugin, "VolumeDriver.List", nil)["Volumes"], 2)
+	assert.Equal("", pluginCall(t, plugin, "VolumeDriver.Remove", pluginRequest{Name: "app"})["Err"])
+	assert.Contains(pluginCall(t, plugin, "VolumeDriver.Get", pluginRequest{Name: "app"})["Err"], "no volume")
+
+	w := httptest.NewRecorder()
+	plugin.ServeHTTP(w, httptest.NewRequest("POST", "/VolumeDriver.Unknown", nil))
+	assert.Equal(http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+// procDir is where process information is read from. Overridden in tests.
+var procDir = "/proc"
+
+// ProcessRule allows the executables it matches to access the secrets it names. An executable
+// matches if it has the given path and content hash; either may be omitted, but not both.
+type ProcessRule struct {
+	// Secrets are regular expressions matched against whole secret names.
+	Secrets []string `json:"secrets"`
+	Exe     string   `json:"exe,omitempty"`
+	SHA256  string   `json:"sha256,omitempty"`
+
+	secrets []*regexp.Regexp
+}
+
+// ProcessPolicy restricts access to secrets by the executable of the calling process, as found
+// in /proc/<pid>/exe. Everything not allowed by a rule is denied.
+type ProcessPolicy struct {
+	*log.Logger
+	rules []ProcessRule
+
+	// Hashes of executables, by device, inode and modification time.
+	hashes map[exeKey]string
+	lock   sync.Mutex
+}
+
+type exeKey struct {
+	dev, ino uint64
+	mtime    int64
+}
+
+// LoadProcessPolicy reads a policy file, a JSON list of rules such as:
+//
+//	[{"secrets": ["db\\..*"], "exe": "/usr/bin/app", "sha256": "e3b0c442..."}]
+func LoadProcessPolicy(file string, logConfig log.Config) (*ProcessPolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []ProcessRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", file, err)
+	}
+	return NewProcessPolicy(rules, logConfig)
+}
+
+// NewProcessPolicy validates rules and creates a policy enforcing them.
+func NewProcessPolicy(rules []ProcessRule, logConfig log.Config) (*ProcessPolicy, error) {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Exe == "" && rule.SHA256 == "" {
+			return nil, fmt.Errorf("rule %d: exe or sha256 required", i)
+		}
+		if rule.Exe != "" && !filepath.IsAbs(rule.Exe) {
+			return nil, fmt.Errorf("rule %d: exe must be an absolute path, got '%s'", i, rule.Exe)
+		}
+		rule.SHA256 = strings.ToLower(rule.SHA256)
+		var err error
+		if rule.secrets, err = compilePatterns(rule.Secrets); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	logger := log.New("kwfs_policy", logConfig)
+	return &ProcessPolicy{Logger: logger, rules: rules, hashes: map[exeKey]string{}}, nil
+}
+
+// Allowed returns true if the process pid may access the named secret. Denials are logged.
+func (p *ProcessPolicy) Allowed(name string, pid uint32) bool {
+	exe, err := os.Readlink(p.exeFile(pid))
+	if err != nil {
+		p.Warnf("Denied access to %s by pid %d: unable to resolve executable: %v", name, pid, err)
+		return false
+	}
+
+	for _, rule := range p.rules {
+		if !rule.matchesSecret(name) || (rule.Exe != "" && rule.Exe != exe) {
+			continue
+		}
+		if rule.SHA256 != "" {
+			hash, err := p.exeHash(pid)
+			if err != nil {
+				p.Warnf("Denied access to %s by pid %d (%s): unable to hash executable: %v", name, pid, exe, err)
+				return false
+			}
+			if rule.SHA256 != hash {
+				continue
+			}
+		}
+		return true
+	}
+	p.Warnf("Denied access to %s by pid %d (%s): no matching rule", name, pid, exe)
+	return false
+}
+
+func (rule ProcessRule) matchesSecret(name string) bool {
+	for _, re := range rule.secrets {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ProcessPolicy) exeFile(pid uint32) string {
+	return filepath.Join(procDir, strconv.FormatUint(uint64(pid), 10), "exe")
+}
+
+// exeHash returns the hex-encoded SHA-256 of the executable of pid. Hashes are cached, since
+// executables are large and rarely change.
+func (p *ProcessPolicy) exeHash(pid uint32) (string, error) {
+	// Opening /proc/<pid>/exe reads the executable actually running, even if it was replaced.
+	f, err := os.Open(p.exeFile(pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	key := exeKey{mtime: info.ModTime().UnixNano()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		key.dev, key.ino = uint64(stat.Dev), stat.Ino
+	}
+
+	p.lock.Lock()
+	hash, ok := p.hashes[key]
+	p.lock.Unlock()
+	if ok {
+		return hash, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+
+	p.lock.Lock()
+	p.hashes[key] = hash
+	p.lock.Unlock()
+	return hash, nil
+}
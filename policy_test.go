@@ -0,0 +1,92 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProc points ProcessPolicy at a fake /proc in which pid 100 runs "bin/app" and pid 200
+// runs "bin/other", returning the directory and a cleanup function.
+func fakeProc() (string, func()) {
+	dir, err := ioutil.TempDir("", "proc")
+	panicOnError(err)
+
+	panicOnError(os.Mkdir(filepath.Join(dir, "bin"), 0755))
+	for pid, exe := range map[string]string{"100": "app", "200": "other"} {
+		path := filepath.Join(dir, "bin", exe)
+		panicOnError(ioutil.WriteFile(path, []byte("binary "+exe), 0755))
+		panicOnError(os.Mkdir(filepath.Join(dir, pid), 0755))
+		panicOnError(os.Symlink(path, filepath.Join(dir, pid, "exe")))
+		panicOnError(ioutil.WriteFile(filepath.Join(dir, pid, "comm"), []byte(exe+"\n"), 0644))
+	}
+
+	oldDir := procDir
+	procDir = dir
+	return dir, func() {
+		procDir = oldDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProcessPolicy(t *testing.T) {
+	assert := assert.New(t)
+	dir, cleanup := fakeProc()
+	defer cleanup()
+
+	hash := sha256.Sum256([]byte("binary other"))
+	policy, err := NewProcessPolicy([]ProcessRule{
+		{Secrets: []string{"db\\..*"}, Exe: filepath.Join(dir, "bin", "app")},
+		{Secrets: []string{"api.key"}, SHA256: hex.EncodeToString(hash[:])},
+		{Secrets: []string{"hmac.key"}, Exe: filepath.Join(dir, "bin", "other"), SHA256: "00"},
+	}, logConfig)
+	assert.NoError(err)
+
+	assert.True(policy.Allowed("db.password", 100))
+	assert.False(policy.Allowed("db.password", 200))
+	assert.True(policy.Allowed("api.key", 200))
+	assert.True(policy.Allowed("api.key", 200), "cached hash")
+	assert.False(policy.Allowed("api.key", 100))
+	assert.False(policy.Allowed("hmac.key", 200), "path matches, hash doesn't")
+	assert.False(policy.Allowed("other", 100))
+	assert.False(policy.Allowed("db.password", 300), "unknown pid")
+}
+
+func TestProcessPolicyInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewProcessPolicy([]ProcessRule{{Secrets: []string{"a"}}}, logConfig)
+	assert.Error(err)
+	_, err = NewProcessPolicy([]ProcessRule{{Secrets: []string{"a"}, Exe: "bin/app"}}, logConfig)
+	assert.Error(err)
+	_, err = NewProcessPolicy([]ProcessRule{{Secrets: []string{"("}, Exe: "/bin/app"}}, logConfig)
+	assert.Error(err)
+
+	file, err := ioutil.TempFile("", "policy")
+	assert.NoError(err)
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"secrets": ["a"], "exe": "/bin/app"}]`)
+	file.Close()
+	policy, err := LoadProcessPolicy(file.Name(), logConfig)
+	assert.NoError(err)
+	assert.Len(policy.rules, 1)
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// runtimeProfiles are served under .pprof/ in the text format of runtime/pprof, besides the CPU
+// profile in .pprof/profile.
+var runtimeProfiles = []string{"heap", "allocs", "goroutine", "threadcreate", "block", "mutex"}
+
+// Duration of CPU profiles read from .pprof/profile, unless given as profile?seconds=N.
+const (
+	defaultCPUProfileSeconds = 30
+	maxCPUProfileSeconds     = 300
+)
+
+// profileRequest parses the name of a file under .pprof/, e.g. "heap" or "profile?seconds=10".
+// seconds is only set for the CPU profile.
+func profileRequest(name string) (profile string, seconds int, ok bool) {
+	base, query := name, ""
+	if i := strings.Index(name, "?"); i >= 0 {
+		base, query = name[:i], name[i+1:]
+	}
+	if base != "profile" {
+		for _, p := range runtimeProfiles {
+			if base == p && query == "" {
+				return p, 0, true
+			}
+		}
+		return "", 0, false
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", 0, false
+	}
+	seconds = defaultCPUProfileSeconds
+	if s := values.Get("seconds"); s != "" {
+		seconds, err = strconv.Atoi(s)
+		if err != nil || seconds <= 0 || seconds > maxCPUProfileSeconds {
+			return "", 0, false
+		}
+	}
+	return base, seconds, true
+}
+
+// cpuProfile profiles the CPU for the given duration. Only one CPU profile can be collected at a
+// time, so EBUSY is returned while another is in progress.
+func cpuProfile(duration time.Duration) ([]byte, fuse.Status) {
+	var b bytes.Buffer
+	if err := pprof.StartCPUProfile(&b); err != nil {
+		return nil, fuse.Status(syscall.EBUSY)
+	}
+	time.Sleep(duration)
+	pprof.StopCPUProfile()
+	return b.Bytes(), fuse.OK
+}
+
+// profileFile serves a profile which is collected on the first read, so that opening the file
+// doesn't block for the duration of a CPU profile. The size of a profile isn't known until it's
+// collected, so the file must be opened with direct I/O for reads to go past its reported size.
+type profileFile struct {
+	nodefs.File
+	name    string
+	collect func() ([]byte, fuse.Status)
+	once    sync.Once
+	data    []byte
+	status  fuse.Status
+}
+
+// newProfileFile creates a file serving the profile returned by collect.
+func newProfileFile(name string, collect func() ([]byte, fuse.Status)) nodefs.File {
+	return &profileFile{File: nodefs.NewDefaultFile(), name: name, collect: collect}
+}
+
+func (f *profileFile) String() string {
+	return fmt.Sprintf("profileFile(%s)", f.name)
+}
+
+func (f *profileFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.once.Do(func() {
+		f.data, f.status = f.collect()
+	})
+	if f.status != fuse.OK {
+		return nil, f.status
+	}
+	if off < 0 {
+		return nil, fuse.EINVAL
+	}
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	end := off + int64(len(buf))
+	if end > int64(len(f.data)) || end < off {
+		end = int64(len(f.data))
+	}
+	return fuse.ReadResultData(f.data[off:end]), fuse.OK
+}
+
+func (f *profileFile) GetAttr(out *fuse.Attr) fuse.Status {
+	out.Mode = fuse.S_IFREG | 0444
+	return fuse.OK
+}
+
+// openProfile opens a file under .pprof/.
+func (kwfs KeywhizFs) openProfile(name string, context *fuse.Context) (nodefs.File, fuse.Status) {
+	profile, seconds, ok := profileRequest(name[len(".pprof/"):])
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	attr, status := kwfs.getAttr(name, context, nil)
+	if status != fuse.OK {
+		return nil, status
+	}
+
+	collect := func() ([]byte, fuse.Status) {
+		return kwfs.profile(profile), fuse.OK
+	}
+	if profile == "profile" {
+		collect = func() ([]byte, fuse.Status) {
+			kwfs.Infof("Collecting %ds CPU profile", seconds)
+			return cpuProfile(time.Duration(seconds) * time.Second)
+		}
+	}
+	file := NewAttrFile(nodefs.NewReadOnlyFile(newProfileFile(name, collect)), attr)
+	return &nodefs.WithFlags{File: file, FuseFlags: fuse.FOPEN_DIRECT_IO}, fuse.OK
+}
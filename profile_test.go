@@ -0,0 +1,79 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		name    string
+		profile string
+		seconds int
+		ok      bool
+	}{
+		{"heap", "heap", 0, true},
+		{"goroutine", "goroutine", 0, true},
+		{"mutex", "mutex", 0, true},
+		{"profile", "profile", defaultCPUProfileSeconds, true},
+		{"profile?seconds=5", "profile", 5, true},
+		{"profile?seconds=0", "", 0, false},
+		{"profile?seconds=3600", "", 0, false},
+		{"profile?seconds=five", "", 0, false},
+		{"heap?seconds=5", "", 0, false},
+		{"cpu", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, c := range cases {
+		profile, seconds, ok := profileRequest(c.name)
+		assert.Equal(c.ok, ok, c.name)
+		assert.Equal(c.profile, profile, c.name)
+		assert.Equal(c.seconds, seconds, c.name)
+	}
+}
+
+func TestProfileFile(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	file := newProfileFile("heap", func() ([]byte, fuse.Status) {
+		calls++
+		return []byte("heap profile"), fuse.OK
+	})
+
+	buf := make([]byte, 4)
+	res, status := file.Read(buf, 0)
+	assert.Equal(fuse.OK, status)
+	data, _ := res.Bytes(buf)
+	assert.Equal("heap", string(data))
+
+	res, status = file.Read(buf, 5)
+	assert.Equal(fuse.OK, status)
+	data, _ = res.Bytes(buf)
+	assert.Equal("prof", string(data))
+	assert.Equal(1, calls, "profile collected once")
+
+	failing := newProfileFile("profile", func() ([]byte, fuse.Status) {
+		return nil, fuse.EIO
+	})
+	_, status = failing.Read(buf, 0)
+	assert.Equal(fuse.EIO, status)
+}
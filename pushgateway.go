@@ -0,0 +1,177 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/square/keywhiz-fs/log"
+)
+
+// pushQuantiles are the quantiles of histograms and timers reported to Prometheus.
+var pushQuantiles = []float64{0.5, 0.75, 0.95, 0.99}
+
+// MetricsPusher periodically pushes a metrics registry to a Prometheus Pushgateway, for fleets
+// where scraping every mount is impractical. Metrics are pushed to a group identified by the
+// host and the mount point, which is replaced on every push, and deleted on Stop.
+type MetricsPusher struct {
+	*log.Logger
+	group    string
+	registry metrics.Registry
+	client   *http.Client
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewMetricsPusher starts pushing registry to the Pushgateway at gateway every interval.
+func NewMetricsPusher(gateway string, interval time.Duration, registry metrics.Registry, mountpoint string, logConfig log.Config) (*MetricsPusher, error) {
+	u, err := url.Parse(gateway)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%s is not an http:// or https:// URL", gateway)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	p := &MetricsPusher{
+		Logger:   log.New("kwfs_push", logConfig),
+		group:    pushGroupURL(gateway, hostname, mountpoint),
+		registry: registry,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go p.run(interval)
+	return p, nil
+}
+
+// pushGroupURL returns the URL of the group of a mount on the Pushgateway. The mount point
+// holds slashes, so it is base64-encoded as the Pushgateway requires.
+func pushGroupURL(gateway, hostname, mountpoint string) string {
+	return fmt.Sprintf("%s/metrics/job/keywhizfs/instance/%s/mountpoint@base64/%s",
+		strings.TrimSuffix(gateway, "/"), url.PathEscape(hostname), base64.URLEncoding.EncodeToString([]byte(mountpoint)))
+}
+
+func (p *MetricsPusher) run(interval time.Duration) {
+	defer close(p.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.push(); err != nil {
+				p.Warnf("Error pushing metrics: %v", err)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop stops pushing, and deletes the metrics of the mount from the Pushgateway, so that it
+// doesn't keep reporting a mount which is gone.
+func (p *MetricsPusher) Stop() {
+	close(p.stop)
+	<-p.stopped
+	if err := p.request("DELETE", nil); err != nil {
+		p.Warnf("Error deleting metrics from the Pushgateway: %v", err)
+	}
+}
+
+func (p *MetricsPusher) push() error {
+	var body bytes.Buffer
+	writePrometheus(&body, p.registry)
+	return p.request("PUT", &body)
+}
+
+func (p *MetricsPusher) request(method string, body io.Reader) error {
+	req, err := http.NewRequest(method, p.group, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Pushgateway responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// prometheusName converts a metric name, like runtime.cache.stale_served, into a Prometheus
+// metric name, like keywhizfs_runtime_cache_stale_served.
+func prometheusName(name string) string {
+	return "keywhizfs_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// writePrometheus writes the metrics of registry in the Prometheus text format, sorted by name.
+// Counters and gauges are reported as they are, and histograms and timers as summaries of their
+// samples. Other metrics are skipped.
+func writePrometheus(w io.Writer, registry metrics.Registry) {
+	all := map[string]interface{}{}
+	var names []string
+	registry.Each(func(name string, metric interface{}) {
+		all[name] = metric
+		names = append(names, name)
+	})
+	sort.Strings(names)
+
+	float := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	summary := func(name string, count int64, quantiles []float64) {
+		fmt.Fprintf(w, "# TYPE %s summary\n", name)
+		for i, q := range pushQuantiles {
+			fmt.Fprintf(w, "%s{quantile=\"%s\"} %s\n", name, float(q), float(quantiles[i]))
+		}
+		fmt.Fprintf(w, "%s_count %d\n", name, count)
+	}
+	for _, name := range names {
+		pname := prometheusName(name)
+		switch metric := all[name].(type) {
+		case metrics.Counter:
+			fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", pname, pname, metric.Count())
+		case metrics.Gauge:
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", pname, pname, metric.Value())
+		case metrics.GaugeFloat64:
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %s\n", pname, pname, float(metric.Value()))
+		case metrics.Histogram:
+			h := metric.Snapshot()
+			summary(pname, h.Count(), h.Percentiles(pushQuantiles))
+		case metrics.Timer:
+			t := metric.Snapshot()
+			summary(pname, t.Count(), t.Percentiles(pushQuantiles))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("runtime.cache.stale_served", registry).Inc(3)
+	metrics.GetOrRegisterGauge("runtime.memory.locked", registry).Update(1)
+	metrics.GetOrRegisterGaugeFloat64("runtime.mem.gc.cpu-fraction", registry).Update(0.25)
+	metrics.GetOrRegisterHistogram("keywhiz.latency", registry, metrics.NewUniformSample(10)).Update(5)
+
+	var out bytes.Buffer
+	writePrometheus(&out, registry)
+	assert.Equal(`# TYPE keywhizfs_keywhiz_latency summary
+keywhizfs_keywhiz_latency{quantile="0.5"} 5
+keywhizfs_keywhiz_latency{quantile="0.75"} 5
+keywhizfs_keywhiz_latency{quantile="0.95"} 5
+keywhizfs_keywhiz_latency{quantile="0.99"} 5
+keywhizfs_keywhiz_latency_count 1
+# TYPE keywhizfs_runtime_cache_stale_served counter
+keywhizfs_runtime_cache_stale_served 3
+# TYPE keywhizfs_runtime_mem_gc_cpu_fraction gauge
+keywhizfs_runtime_mem_gc_cpu_fraction 0.25
+# TYPE keywhizfs_runtime_memory_locked gauge
+keywhizfs_runtime_memory_locked 1
+`, out.String())
+}
+
+func TestMetricsPusher(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	var methods []string
+	var paths []string
+	var body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		methods = append(methods, r.Method)
+		paths = append(paths, r.URL.Path)
+		if r.Method == "PUT" {
+			body = string(data)
+		}
+	}))
+	defer gateway.Close()
+
+	_, err := NewMetricsPusher("pushgateway:9091", time.Second, metrics.NewRegistry(), "/mnt", logConfig)
+	assert.Error(err)
+
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("runtime.cache.stale_served", registry).Inc(3)
+	pusher, err := NewMetricsPusher(gateway.URL+"/", 10*time.Millisecond, registry, "/run/secrets", logConfig)
+	assert.NoError(err)
+	waitFor(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(methods) > 0
+	})
+	pusher.Stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal("PUT", methods[0])
+	assert.Equal("DELETE", methods[len(methods)-1])
+	assert.Regexp("^/metrics/job/keywhizfs/instance/[^/]+/mountpoint@base64/L3J1bi9zZWNyZXRz$", paths[0])
+	assert.Equal(paths[0], paths[len(paths)-1])
+	assert.Contains(body, "keywhizfs_runtime_cache_stale_served 3\n")
+}
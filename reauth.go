@@ -0,0 +1,103 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// reauthInterval is the least time between two rebuilds of the HTTP client after authentication
+// errors, so that a server refusing a request for good doesn't cause a rebuild every time.
+var reauthInterval = 10 * time.Second
+
+// get sends a GET request for u with do.
+func (c Client) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+// do sends req with the HTTP client in use. If the server answers 401 or 403, the certificate
+// or token files may have been rotated since the client was built, e.g. by an agent renewing
+// them: the client is rebuilt from the files and the request retried once, instead of holding on
+// to a dead TLS identity until the next refresh.
+func (c Client) do(req *http.Request) (*http.Response, error) {
+	conn := c.current()
+	resp, err := c.send(conn, req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return resp, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	if !c.reauthenticate(conn, resp.StatusCode) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return c.send(c.current(), retry)
+}
+
+// send sends req with the HTTP client of conn, counting the response in the
+// runtime.server.status.<status> metric, or runtime.server.status.timeout or .error if there was
+// none. The clock skew with the server is recorded from responses.
+func (c Client) send(conn *clientConn, req *http.Request) (*http.Response, error) {
+	resp, err := conn.http.Do(req)
+	status := "error"
+	if err == nil {
+		c.recordClockSkew(resp, time.Now())
+		status = strconv.Itoa(resp.StatusCode)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		status = "timeout"
+	}
+	metrics.GetOrRegisterCounter("runtime.server.status."+status, c.registry).Inc(1)
+	return resp, err
+}
+
+// reauthenticate replaces conn with a client built from the certificate files again, unless
+// that happened less than reauthInterval ago or they can't be loaded.
+func (c Client) reauthenticate(conn *clientConn, status int) bool {
+	now, last := monotonic(time.Now()), atomic.LoadInt64(c.lastReauth)
+	if last != 0 && now-last < int64(reauthInterval) || !atomic.CompareAndSwapInt64(c.lastReauth, last, now) {
+		return false
+	}
+	httpClient, err := conn.params.buildClient()
+	if err != nil {
+		c.Errorf("Server returned %d, unable to reload certificate files: %v", status, err)
+		return false
+	}
+	c.reauths.Inc(1)
+	c.Warnf("Server returned %d, reloaded certificate files and retrying", status)
+	// Lose to a concurrent Reload, which built a client with newer settings.
+	if atomic.CompareAndSwapPointer(c.conn, unsafe.Pointer(conn), unsafe.Pointer(&clientConn{httpClient, conn.url, conn.params})) {
+		conn.http.CloseIdleConnections()
+	}
+	return true
+}
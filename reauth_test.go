@@ -0,0 +1,86 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientReauthenticates(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-reauth")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// The server only accepts the rotated certificate.
+	requests := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "rotated" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.TLS.ClientAuth = tls.RequestClientCert
+	server.StartTLS()
+	defer server.Close()
+
+	original := newTestCert(t, "original", false, nil)
+	file := writeChain(t, dir, original, original)
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(file, file, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+	reauths := client.reauths.Count()
+
+	// Without new certificate files, the request fails after one rebuild.
+	_, err = client.Fetch("foo")
+	assert.Error(err)
+	assert.Equal(2, requests)
+	assert.Equal(reauths+1, client.reauths.Count())
+
+	// Rebuilds are rate limited.
+	rotated := newTestCert(t, "rotated", false, nil)
+	writeChain(t, dir, rotated, rotated)
+	_, err = client.Fetch("foo")
+	assert.Error(err)
+	assert.Equal(3, requests)
+
+	// Once allowed, the rotated certificate is picked up and the request retried.
+	*client.lastReauth = 0
+	secret, err := client.Fetch("foo")
+	assert.NoError(err)
+	assert.Equal("Nobody_PgPass", secret.Name)
+	assert.Equal(5, requests)
+	assert.Equal(reauths+2, client.reauths.Count())
+
+	// The new client is kept.
+	_, err = client.Fetch("foo")
+	assert.NoError(err)
+	assert.Equal(6, requests)
+}
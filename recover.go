@@ -0,0 +1,100 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	rdebug "runtime/debug"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// recoverPanic recovers from a panic in the FUSE operation op on name, e.g. caused by a bug
+// parsing one malformed secret, so that it fails with EIO instead of crashing the process and
+// leaving the mountpoint stranded. Must be deferred directly.
+func (kwfs KeywhizFs) recoverPanic(op, name string, status *fuse.Status) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	kwfs.Cache.panicked(fmt.Sprintf("in %s('%v')", op, name), r)
+	*status = fuse.EIO
+}
+
+// recoverPanic recovers from a panic while what, failing it with an error in *err like
+// KeywhizFs.recoverPanic. Must be deferred directly.
+func (c *Cache) recoverPanic(what string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	*err = c.panicked(what, r)
+}
+
+// panicked logs a recovered panic with its stack trace, counts it in the runtime.panics metric,
+// and returns it as an error.
+func (c *Cache) panicked(what string, r interface{}) error {
+	c.Errorf("Panic %s: %v\n%s", what, r, rdebug.Stack())
+	c.panics.Inc(1)
+	return fmt.Errorf("panic %s: %v", what, r)
+}
+
+// withRecovery wraps an open file so that a panic reading, writing or flushing it fails the
+// operation with EIO, like recoverPanic does for operations on paths. Flags set with
+// nodefs.WithFlags must stay outermost to be seen, so the wrapper goes inside them.
+func (kwfs KeywhizFs) withRecovery(name string, file nodefs.File) nodefs.File {
+	if flags, ok := file.(*nodefs.WithFlags); ok {
+		wrapped := *flags
+		wrapped.File = kwfs.withRecovery(name, flags.File)
+		return &wrapped
+	}
+	return &recoveringFile{File: file, kwfs: kwfs, name: name}
+}
+
+type recoveringFile struct {
+	nodefs.File
+	kwfs KeywhizFs
+	name string
+}
+
+func (f *recoveringFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *recoveringFile) Read(buf []byte, off int64) (result fuse.ReadResult, status fuse.Status) {
+	defer f.kwfs.recoverPanic("Read", f.name, &status)
+	return f.File.Read(buf, off)
+}
+
+func (f *recoveringFile) Write(data []byte, off int64) (written uint32, status fuse.Status) {
+	defer f.kwfs.recoverPanic("Write", f.name, &status)
+	return f.File.Write(data, off)
+}
+
+func (f *recoveringFile) Truncate(size uint64) (status fuse.Status) {
+	defer f.kwfs.recoverPanic("Truncate", f.name, &status)
+	return f.File.Truncate(size)
+}
+
+func (f *recoveringFile) Flush() (status fuse.Status) {
+	defer f.kwfs.recoverPanic("Flush", f.name, &status)
+	return f.File.Flush()
+}
+
+func (f *recoveringFile) Fsync(flags int) (status fuse.Status) {
+	defer f.kwfs.recoverPanic("Fsync", f.name, &status)
+	return f.File.Fsync(flags)
+}
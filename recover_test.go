@@ -0,0 +1,92 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// PanickingBackend panics on every request, like a bug parsing a malformed response would.
+type PanickingBackend struct{}
+
+func (b PanickingBackend) Fetch(name string) (*Secret, error) {
+	panic("malformed secret " + name)
+}
+
+func (b PanickingBackend) List() ([]Secret, bool) {
+	panic("malformed listing")
+}
+
+func (b PanickingBackend) Invalidate(name string) {}
+
+func TestRecoverPanic(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	kwfs, _, _ := NewKeywhizFs(nil, PanickingBackend{}, Ownership{Uid: 12345, Gid: 12345}, timeouts, metricsHandle, logConfig)
+	panics := metrics.GetOrRegisterCounter("runtime.panics", metricsHandle.Registry)
+	before := panics.Count()
+
+	status := func() (status fuse.Status) {
+		defer kwfs.recoverPanic("Test", "secret", &status)
+		panic("bug")
+	}()
+	assert.Equal(fuse.EIO, status)
+	assert.Equal(before+1, panics.Count())
+
+	// Panics in backend requests fail them.
+	assert.False(kwfs.Cache.Warmup())
+	_, status = kwfs.Open("secret", 0, &fuse.Context{})
+	assert.Equal(fuse.EIO, status)
+	_, status = kwfs.GetAttr("secret", &fuse.Context{})
+	assert.Equal(fuse.EIO, status)
+	assert.True(panics.Count() >= before+4)
+}
+
+func TestRecoverPanicInFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	timeouts := Timeouts{0, 1 * time.Second, 2 * time.Second, 1 * time.Hour, 0, 0, 0}
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	kwfs, _, _ := NewKeywhizFs(nil, PanickingBackend{}, Ownership{Uid: 12345, Gid: 12345}, timeouts, metricsHandle, logConfig)
+	panics := metrics.GetOrRegisterCounter("runtime.panics", metricsHandle.Registry)
+	before := panics.Count()
+
+	commit := func(string, []byte) fuse.Status { panic("bug") }
+	file := kwfs.withRecovery("secret", newWritableFile("secret", []byte("a"), &fuse.Attr{}, commit))
+	_, status := file.Write([]byte("b"), 0)
+	assert.Equal(fuse.OK, status)
+	assert.Equal(fuse.EIO, file.Flush())
+	assert.Equal(fuse.EIO, file.Fsync(0))
+
+	// Flags stay visible to go-fuse.
+	collect := func() ([]byte, fuse.Status) { panic("bug") }
+	file = kwfs.withRecovery(".pprof/heap", &nodefs.WithFlags{File: newProfileFile("heap", collect), FuseFlags: fuse.FOPEN_DIRECT_IO})
+	flags, ok := file.(*nodefs.WithFlags)
+	assert.True(ok)
+	assert.Equal(uint32(fuse.FOPEN_DIRECT_IO), flags.FuseFlags)
+	_, status = file.Read(make([]byte, 10), 0)
+	assert.Equal(fuse.EIO, status)
+
+	assert.NotNil(kwfs.StatFs(""))
+	assert.Equal(before+3, panics.Count())
+}
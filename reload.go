@@ -0,0 +1,232 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	klog "github.com/square/keywhiz-fs/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// reloadableSettings can be changed in the config file and applied with SIGHUP, without
+// remounting. Changes to other settings take effect on restart.
+var reloadableSettings = map[string]bool{
+	"debug":         true,
+	"cert":          true,
+	"key":           true,
+	"ca":            true,
+	"url":           true,
+	"timeout":       true,
+	"cache-timeout": true,
+	"max-stale":     true,
+	"offline":       true,
+}
+
+// ConfigReloader re-reads the config file and applies changed settings to a running mount.
+type ConfigReloader struct {
+	file string
+	// applied are the settings of the config file in effect: those read at startup, updated by
+	// reloads only for the settings they applied.
+	applied map[string][]string
+	// pinned are settings given on the command line, which take precedence over the config file.
+	pinned map[string]bool
+	// certIsKey is set while the certificate is read from the key file, as when --cert is unset.
+	certIsKey bool
+	// client is the main server's client, or nil without a Keywhiz server. Extra servers share its
+	// certificate files and timeout.
+	client *Client
+	extras []*Client
+	cache  *Cache
+}
+
+// commandLineSettings returns the names of flags and arguments given in args.
+func commandLineSettings(app *kingpin.Application, args []string) (map[string]bool, error) {
+	context, err := app.ParseContext(args)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, element := range context.Elements {
+		switch clause := element.Clause.(type) {
+		case *kingpin.FlagClause:
+			names[clause.Model().Name] = true
+		case *kingpin.ArgClause:
+			names[clause.Model().Name] = true
+		}
+	}
+	return names, nil
+}
+
+// changedSettings returns the sorted names of settings which differ between two versions of the
+// config file, except those pinned by the command line.
+func changedSettings(old, new map[string][]string, pinned map[string]bool) []string {
+	names := map[string]bool{}
+	for name := range old {
+		names[name] = true
+	}
+	for name := range new {
+		names[name] = true
+	}
+
+	changed := []string{}
+	for name := range names {
+		if pinned[name] {
+			continue
+		}
+		oldValues, inOld := old[name]
+		newValues, inNew := new[name]
+		if inOld != inNew || !reflect.DeepEqual(oldValues, newValues) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Reload re-reads the config file and applies changes to reloadable settings. Nothing is applied
+// if any of them is invalid. Changes to other settings, and removed settings, are logged and take
+// effect on restart.
+func (r *ConfigReloader) Reload() error {
+	config, err := loadConfig(r.file)
+	if err != nil {
+		return err
+	}
+	changed := changedSettings(r.applied, config, r.pinned)
+	if len(changed) == 0 {
+		logger.Infof("Reloaded %s, no settings changed", r.file)
+		return nil
+	}
+
+	var certFile, keyFile, caFile string
+	var serverURL *url.URL
+	var timeout time.Duration
+	if r.client != nil {
+		conn := r.client.current()
+		certFile, keyFile, caFile = conn.params.CertFile, conn.params.KeyFile, conn.params.CaBundle
+		serverURL, timeout = conn.url, conn.params.timeout
+	}
+	certIsKey := r.certIsKey
+	reconnect := false
+	var debug *bool
+	var fresh, maxStale *time.Duration
+	var offline *bool
+
+	var reloaded, restart []string
+	applied := map[string][]string{}
+	for name, values := range r.applied {
+		applied[name] = values
+	}
+	for _, name := range changed {
+		values, ok := config[name]
+		clientSetting := name != "debug" && name != "cache-timeout" && name != "max-stale" && name != "offline"
+		if !reloadableSettings[name] || !ok || len(values) != 1 || (clientSetting && r.client == nil) {
+			restart = append(restart, name)
+			continue
+		}
+		value := values[0]
+
+		switch name {
+		case "debug":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for debug: %v", err)
+			}
+			debug = &b
+		case "offline":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for offline: %v", err)
+			}
+			offline = &b
+		case "cache-timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for cache-timeout: %v", err)
+			}
+			fresh = &d
+		case "max-stale":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for max-stale: %v", err)
+			}
+			maxStale = &d
+		case "timeout":
+			timeout, err = time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for timeout: %v", err)
+			}
+		case "url":
+			serverURL, err = url.Parse(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for url: %v", err)
+			}
+		case "cert":
+			certFile, certIsKey = value, value == ""
+		case "key":
+			keyFile = value
+		case "ca":
+			caFile = value
+		}
+		if clientSetting {
+			reconnect = true
+		}
+		reloaded = append(reloaded, fmt.Sprintf("%s=%s", name, value))
+		applied[name] = values
+	}
+	if certIsKey {
+		certFile = keyFile
+	}
+
+	if reconnect {
+		if err := r.client.Reload(certFile, keyFile, caFile, serverURL, timeout); err != nil {
+			return fmt.Errorf("unable to reload client: %v", err)
+		}
+		for _, extra := range r.extras {
+			if err := extra.Reload(certFile, keyFile, caFile, extra.current().url, timeout); err != nil {
+				logger.Errorf("Unable to reload client for %s: %v", extra.current().url, err)
+			}
+		}
+	}
+	if debug != nil {
+		klog.SetDebug(*debug)
+	}
+	if fresh != nil {
+		r.cache.SetFreshThreshold(*fresh)
+	}
+	if maxStale != nil {
+		r.cache.SetMaxStale(*maxStale)
+	}
+	if offline != nil {
+		r.cache.SetOffline(*offline)
+	}
+	// Settings which take effect on restart are left out, so that they are still reported as
+	// changed by later reloads.
+	r.applied, r.certIsKey = applied, certIsKey
+
+	if len(reloaded) > 0 {
+		logger.Infof("Reloaded %s: %s", r.file, strings.Join(reloaded, ", "))
+	}
+	if len(restart) > 0 {
+		logger.Warnf("Changes to %s in %s take effect on restart", strings.Join(restart, ", "), r.file)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	klog "github.com/square/keywhiz-fs/log"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestChangedSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	old := map[string][]string{"timeout": {"10s"}, "key": {"a.pem"}, "include": {"^a"}, "debug": {"true"}}
+	new := map[string][]string{"timeout": {"20s"}, "key": {"a.pem"}, "include": {"^a", "^b"}, "ca": {"ca.pem"}, "debug": {"true"}}
+	assert.Equal([]string{"ca", "include", "timeout"}, changedSettings(old, new, nil))
+	assert.Equal([]string{"ca", "include"}, changedSettings(old, new, map[string]bool{"timeout": true}))
+	assert.Equal([]string{"debug", "include", "key", "timeout"}, changedSettings(old, nil, nil))
+}
+
+func TestCommandLineSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	app := kingpin.New("test", "")
+	app.Flag("key", "").String()
+	app.Flag("timeout", "").Duration()
+	cmd := app.Command("mount", "").Default()
+	cmd.Arg("url", "").String()
+	cmd.Arg("mountpoint", "").String()
+
+	names, err := commandLineSettings(app, []string{"--timeout=5s", "https://localhost:4444"})
+	assert.NoError(err)
+	assert.Equal(map[string]bool{"timeout": true, "url": true}, names)
+}
+
+func TestConfigReloader(t *testing.T) {
+	assert := assert.New(t)
+	logger = klog.New("kwfs_main", logConfig)
+	defer klog.SetDebug(false)
+
+	dir, err := ioutil.TempDir("", "kwfs-reload")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keywhiz-fs.yaml")
+
+	serverURL, _ := url.Parse("https://localhost:4444")
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient(clientFile, clientFile, testCaFile, serverURL, time.Second, ClientOptions{}, logConfig, metricsHandle)
+	cache := NewCache(&client, Timeouts{Fresh: time.Minute}, logConfig, nil)
+	config := map[string][]string{"url": {"https://localhost:4444"}, "timeout": {"1s"}, "asuser": {"keywhiz"}}
+	reloader := &ConfigReloader{file, config, map[string]bool{"ca": true}, true, &client, nil, cache}
+
+	write := func(content string) {
+		assert.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+	}
+
+	write("url: https://other:4444\ntimeout: 3s\nasuser: app\ndebug: true\ncache-timeout: 5s\nca: pinned.crt\n")
+	assert.NoError(reloader.Reload())
+	conn := client.current()
+	assert.Equal("https://other:4444", conn.url.String())
+	assert.Equal(3*time.Second, conn.params.timeout)
+	assert.Equal(3*time.Second, conn.http.Timeout)
+	assert.Equal(testCaFile, conn.params.CaBundle, "pinned by the command line")
+	assert.Equal(5*time.Second, cache.freshThreshold())
+	assert.True(logger.DebugEnabled())
+	assert.Equal([]string{"keywhiz"}, reloader.applied["asuser"], "takes effect on restart")
+	assert.Equal([]string{"3s"}, reloader.applied["timeout"])
+
+	// Invalid settings are not applied at all.
+	write("url: https://third:4444\ntimeout: soon\n")
+	assert.Error(reloader.Reload())
+	assert.Equal("https://other:4444", client.current().url.String())
+
+	// Certificate files which can't be loaded keep the client as it is.
+	write("url: https://third:4444\nkey: missing.pem\n")
+	assert.Error(reloader.Reload())
+	assert.Equal("https://other:4444", client.current().url.String())
+	assert.Equal(clientFile, client.current().params.CertFile)
+}
+
+func TestConfigReloaderWithoutClient(t *testing.T) {
+	assert := assert.New(t)
+	logger = klog.New("kwfs_main", logConfig)
+
+	dir, err := ioutil.TempDir("", "kwfs-reload")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keywhiz-fs.yaml")
+
+	cache := NewCache(MapBackend{}, Timeouts{Fresh: time.Minute}, logConfig, nil)
+	reloader := &ConfigReloader{file, map[string][]string{}, map[string]bool{}, false, nil, nil, cache}
+
+	// Settings of the Keywhiz client take effect on restart, if ever.
+	assert.NoError(ioutil.WriteFile(file, []byte("url: https://other:4444\ncache-timeout: 5s\nmax-stale: 1m\n"), 0644))
+	assert.NoError(reloader.Reload())
+	assert.Equal(5*time.Second, cache.freshThreshold())
+	assert.Equal(time.Minute, cache.MaxStale())
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+// systemctlCommand is run to signal systemd units. Replaced in tests.
+var systemctlCommand = "systemctl"
+
+// signalTimeout bounds a run of systemctl signaling a unit.
+const signalTimeout = 10 * time.Second
+
+// signalNames are the signals which may be sent to processes on rotation.
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// signalName returns the name of a signal in signalNames, e.g. SIGHUP.
+func signalName(signal syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == signal {
+			return "SIG" + name
+		}
+	}
+	return signal.String()
+}
+
+// SignalRule names the process to signal when the secrets it matches change, by its PID file or
+// its systemd unit.
+type SignalRule struct {
+	// Secrets are regular expressions matched against whole secret names.
+	Secrets []string `json:"secrets"`
+	// PidFile holds the process ID of the process, read again for every signal.
+	PidFile string `json:"pidfile,omitempty"`
+	// Unit is a systemd unit, whose main process is signaled.
+	Unit string `json:"unit,omitempty"`
+	// Signal is the name of the signal, with or without SIG, e.g. "USR1". Defaults to HUP.
+	Signal string `json:"signal,omitempty"`
+
+	secrets []*regexp.Regexp
+	signal  syscall.Signal
+}
+
+// signalTarget is a process to signal, as named by a rule.
+type signalTarget struct {
+	pidFile string
+	unit    string
+	signal  syscall.Signal
+}
+
+func (t signalTarget) String() string {
+	if t.unit != "" {
+		return "unit " + t.unit
+	}
+	return "process in " + t.pidFile
+}
+
+// ReloadSignals signals the processes using secrets when their content changes, so that they
+// reload their credentials. Signals are sent one change at a time, and a burst of changes queued
+// meanwhile signals each process once.
+type ReloadSignals struct {
+	*log.Logger
+	rules   []SignalRule
+	changes chan SecretChange
+}
+
+// LoadReloadSignals reads a signal file, a JSON list of rules such as:
+//
+//	[{"secrets": ["nginx\\..*"], "pidfile": "/run/nginx.pid"},
+//	 {"secrets": ["db\\.pem"], "unit": "pgbouncer.service", "signal": "USR1"}]
+func LoadReloadSignals(file string, logConfig log.Config) (*ReloadSignals, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []SignalRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid signal file %s: %v", file, err)
+	}
+	return NewReloadSignals(rules, logConfig)
+}
+
+// SignalsUnits returns true if any rule names a systemd unit, which is signaled by running
+// systemctl.
+func (s *ReloadSignals) SignalsUnits() bool {
+	for _, rule := range s.rules {
+		if rule.Unit != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewReloadSignals validates rules and starts sending signals for the changes passed to Changed.
+func NewReloadSignals(rules []SignalRule, logConfig log.Config) (*ReloadSignals, error) {
+	for i := range rules {
+		rule := &rules[i]
+		var err error
+		if rule.secrets, err = compilePatterns(rule.Secrets); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		if (rule.PidFile == "") == (rule.Unit == "") {
+			return nil, fmt.Errorf("rule %d: exactly one of pidfile and unit is required", i)
+		}
+		name := strings.TrimPrefix(strings.ToUpper(rule.Signal), "SIG")
+		if name == "" {
+			name = "HUP"
+		}
+		signal, ok := signalNames[name]
+		if !ok {
+			return nil, fmt.Errorf("rule %d: unsupported signal '%s'", i, rule.Signal)
+		}
+		rule.signal = signal
+	}
+	s := &ReloadSignals{log.New("kwfs_signal", logConfig), rules, make(chan SecretChange, changeHookQueue)}
+	go s.run()
+	return s, nil
+}
+
+// Changed queues the signals for change. It never blocks, so it may be registered with
+// Cache.OnChange. Deleted secrets aren't signaled for, since they keep being served until their
+// deletion.
+func (s *ReloadSignals) Changed(change SecretChange) {
+	if change.Deleted {
+		return
+	}
+	select {
+	case s.changes <- change:
+	default:
+		s.Warnf("Too many changes waiting to be signaled, not signaling for %s", change.Name)
+	}
+}
+
+func (s *ReloadSignals) run() {
+	for change := range s.changes {
+		targets := map[signalTarget][]string{}
+		s.collect(targets, change.Name)
+		// Changes queued meanwhile, e.g. a certificate rotated along with its key, are signaled
+		// together.
+		for pending := len(s.changes); pending > 0; pending-- {
+			s.collect(targets, (<-s.changes).Name)
+		}
+		for target, names := range targets {
+			s.send(target, names)
+		}
+	}
+}
+
+// collect adds the targets of the rules matching the named secret.
+func (s *ReloadSignals) collect(targets map[signalTarget][]string, name string) {
+	for _, rule := range s.rules {
+		if rule.matchesSecret(name) {
+			target := signalTarget{rule.PidFile, rule.Unit, rule.signal}
+			targets[target] = append(targets[target], name)
+		}
+	}
+}
+
+// send signals target and logs the outcome.
+func (s *ReloadSignals) send(target signalTarget, names []string) error {
+	var err error
+	if target.unit != "" {
+		err = signalUnit(target.unit, target.signal)
+	} else {
+		err = signalPidFile(target.pidFile, target.signal)
+	}
+	if err != nil {
+		s.Warnf("Unable to send %s to %s for %s: %v", signalName(target.signal), target, strings.Join(names, ", "), err)
+		return err
+	}
+	s.Infof("Sent %s to %s for %s", signalName(target.signal), target, strings.Join(names, ", "))
+	return nil
+}
+
+func (rule SignalRule) matchesSecret(name string) bool {
+	for _, re := range rule.secrets {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// signalPidFile sends signal to the process whose ID is in pidFile.
+func signalPidFile(pidFile string, signal syscall.Signal) error {
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid process ID in %s", pidFile)
+	}
+	return syscall.Kill(pid, signal)
+}
+
+// signalUnit sends signal to the main process of a systemd unit.
+func signalUnit(unit string, signal syscall.Signal) error {
+	ctx, cancel := context.WithTimeout(context.Background(), signalTimeout)
+	defer cancel()
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, systemctlCommand, "kill", "--kill-who=main", "--signal="+signalName(signal), unit)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadSignalRules(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewReloadSignals([]SignalRule{{Secrets: []string{"db"}}}, logConfig)
+	assert.EqualError(err, "rule 0: exactly one of pidfile and unit is required")
+	_, err = NewReloadSignals([]SignalRule{{Secrets: []string{"db"}, PidFile: "/run/db.pid", Unit: "db.service"}}, logConfig)
+	assert.Error(err)
+	_, err = NewReloadSignals([]SignalRule{{Secrets: []string{"db"}, Unit: "db.service", Signal: "KILL"}}, logConfig)
+	assert.EqualError(err, "rule 0: unsupported signal 'KILL'")
+	_, err = NewReloadSignals([]SignalRule{{Secrets: []string{"("}, Unit: "db.service"}}, logConfig)
+	assert.Error(err)
+
+	signals, err := NewReloadSignals([]SignalRule{
+		{Secrets: []string{"db\\..*"}, Unit: "db.service"},
+		{Secrets: []string{"db\\.pem"}, PidFile: "/run/proxy.pid", Signal: "sigusr1"},
+	}, logConfig)
+	assert.NoError(err)
+	targets := map[signalTarget][]string{}
+	signals.collect(targets, "db.pem")
+	signals.collect(targets, "db.key")
+	signals.collect(targets, "web.pem")
+	assert.Equal(map[signalTarget][]string{
+		{unit: "db.service", signal: syscall.SIGHUP}:         {"db.pem", "db.key"},
+		{pidFile: "/run/proxy.pid", signal: syscall.SIGUSR1}: {"db.pem"},
+	}, targets)
+	assert.True(signals.SignalsUnits())
+
+	signals, err = NewReloadSignals([]SignalRule{{Secrets: []string{"db"}, PidFile: "/run/db.pid"}}, logConfig)
+	assert.NoError(err)
+	assert.False(signals.SignalsUnits())
+}
+
+func TestReloadSignalsPidFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_signal")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "test.pid")
+	assert.NoError(ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644))
+
+	received := make(chan os.Signal, 4)
+	signal.Notify(received, syscall.SIGUSR2)
+	defer signal.Stop(received)
+
+	signals, err := NewReloadSignals([]SignalRule{{Secrets: []string{"app\\..*"}, PidFile: pidFile, Signal: "USR2"}}, logConfig)
+	assert.NoError(err)
+	signals.Changed(SecretChange{Name: "other"})
+	signals.Changed(SecretChange{Name: "app.key", Deleted: true})
+	signals.Changed(SecretChange{Name: "app.pem"})
+	select {
+	case sig := <-received:
+		assert.Equal(syscall.SIGUSR2, sig)
+	case <-time.After(5 * time.Second):
+		assert.Fail("no signal received")
+	}
+
+	assert.Error(signalPidFile(filepath.Join(dir, "missing.pid"), syscall.SIGUSR2))
+	assert.NoError(ioutil.WriteFile(pidFile, []byte("garbage"), 0644))
+	assert.EqualError(signalPidFile(pidFile, syscall.SIGUSR2), "invalid process ID in "+pidFile)
+}
+
+func TestReloadSignalsUnit(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_signal")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "systemctl")
+	assert.NoError(ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0755))
+	defer func(command string) { systemctlCommand = command }(systemctlCommand)
+	systemctlCommand = script
+
+	signals, err := NewReloadSignals([]SignalRule{{Secrets: []string{"db\\.pem"}, Unit: "pgbouncer.service"}}, logConfig)
+	assert.NoError(err)
+	assert.NoError(signals.send(signalTarget{unit: "pgbouncer.service", signal: syscall.SIGHUP}, []string{"db.pem"}))
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(err)
+	assert.Equal("kill --kill-who=main --signal=SIGHUP pgbouncer.service\n", string(data))
+
+	systemctlCommand = "false"
+	assert.Error(signalUnit("pgbouncer.service", syscall.SIGHUP))
+}
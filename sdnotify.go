@@ -0,0 +1,128 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state such as "READY=1" to systemd, if it started keywhiz-fs as a
+// Type=notify service. It does nothing otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog: half of WATCHDOG_USEC, or
+// zero if the watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// probeMount checks that the filesystem at mountpoint is served by this process, by reading its
+// .running file. Opening a file always reaches the FUSE server, unlike stat which may be answered
+// from the kernel's attribute cache.
+func probeMount(mountpoint string) error {
+	data, err := ioutil.ReadFile(filepath.Join(mountpoint, ".running"))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, running()) {
+		return fmt.Errorf("mounted by another process (%s)", data)
+	}
+	return nil
+}
+
+// superviseMount tells systemd that keywhiz-fs is ready once the mount serves requests, then pings
+// the watchdog for as long as it keeps doing so. If the FUSE server deadlocks, pings stop and
+// systemd restarts keywhiz-fs instead of leaving a hung mount.
+func superviseMount(mountpoint string) {
+	interval := watchdogInterval()
+	timeout := interval
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	// A probe which timed out is waited for again rather than piling up more stuck probes.
+	var probe chan error
+	check := func() error {
+		if probe == nil {
+			probe = make(chan error, 1)
+			go func(result chan error) {
+				result <- probeMount(mountpoint)
+			}(probe)
+		}
+		select {
+		case err := <-probe:
+			probe = nil
+			return err
+		case <-time.After(timeout):
+			return fmt.Errorf("no response within %v", timeout)
+		}
+	}
+
+	for {
+		err := check()
+		if err == nil {
+			break
+		}
+		logger.Warnf("Mount not ready: %v", err)
+		time.Sleep(time.Second)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warnf("Unable to notify systemd: %v", err)
+	}
+	if interval == 0 {
+		return
+	}
+
+	logger.Infof("Pinging systemd watchdog every %v", interval)
+	for range time.Tick(interval) {
+		if err := check(); err != nil {
+			logger.Errorf("Mount is not responding, not pinging watchdog: %v", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logger.Warnf("Unable to ping systemd watchdog: %v", err)
+		}
+	}
+}
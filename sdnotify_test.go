@@ -0,0 +1,89 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSdNotify(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_sdnotify")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.NoError(sdNotify("READY=1"), "no-op outside of systemd")
+
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.NoError(err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	assert.NoError(sdNotify("READY=1"))
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	assert.NoError(err)
+	assert.Equal("READY=1", string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.Setenv("WATCHDOG_USEC", os.Getenv("WATCHDOG_USEC"))
+	defer os.Setenv("WATCHDOG_PID", os.Getenv("WATCHDOG_PID"))
+
+	os.Setenv("WATCHDOG_USEC", "")
+	os.Setenv("WATCHDOG_PID", "")
+	assert.Zero(watchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(15*time.Second, watchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(15*time.Second, watchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", "1")
+	assert.Zero(watchdogInterval(), "watchdog of another process")
+}
+
+func TestProbeMount(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs_probe")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.Error(probeMount(dir), "not mounted")
+
+	ioutil.WriteFile(filepath.Join(dir, ".running"), []byte("pid=1"), 0644)
+	assert.Error(probeMount(dir), "mounted by another process")
+
+	ioutil.WriteFile(filepath.Join(dir, ".running"), running(), 0644)
+	assert.NoError(probeMount(dir))
+}
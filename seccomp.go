@@ -0,0 +1,88 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Seccomp constants missing from golang.org/x/sys/unix.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+)
+
+// seccompFilter returns a BPF program which allows the system calls numbered allowed, made with
+// the calling convention of arch, and fails all others with EPERM.
+func seccompFilter(arch uint32, allowed []uint32) []unix.SockFilter {
+	deny := uint32(seccompRetErrno | unix.EPERM)
+	// Offsets of the nr and arch fields of struct seccomp_data.
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+	}
+	// Each match jumps over the remaining comparisons and the deny to the final allow.
+	for i, nr := range allowed {
+		jump := uint8(len(allowed) - i)
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: jump, K: nr})
+	}
+	return append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+}
+
+// enableSeccomp restricts all threads of the process to the system calls keywhiz-fs needs once
+// mounted: file, network and memory management, signals, threads and timers. Others, such as
+// mount, ptrace or prctl, fail with EPERM, which limits what a compromise of the JSON parsing or
+// HTTP stack can do. The restriction can't be lifted, and is inherited by child processes.
+func enableSeccomp() error {
+	allowed := []uint32{}
+	for _, nr := range seccompSyscalls {
+		allowed = append(allowed, nr)
+	}
+	sort.Slice(allowed, func(i, j int) bool { return allowed[i] < allowed[j] })
+	filter := seccompFilter(seccompArch, allowed)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs is per-thread, and required by the filter of the same thread. TSYNC then
+	// applies both to all other threads.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("unable to set no_new_privs: %v", err)
+	}
+	tid, _, errno := unix.Syscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return fmt.Errorf("unable to install seccomp filter: %v", errno)
+	}
+	if tid != 0 {
+		return fmt.Errorf("unable to install seccomp filter: thread %d can't be synchronized", tid)
+	}
+	return nil
+}
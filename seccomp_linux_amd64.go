@@ -0,0 +1,164 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+const (
+	// seccompArch is AUDIT_ARCH_X86_64.
+	seccompArch = 0xc000003e
+	sysSeccomp  = 317
+)
+
+// seccompSyscalls are the system calls allowed by the sandbox, by number.
+var seccompSyscalls = map[string]uint32{
+	"read":              0,
+	"write":             1,
+	"open":              2,
+	"close":             3,
+	"stat":              4,
+	"fstat":             5,
+	"lstat":             6,
+	"poll":              7,
+	"lseek":             8,
+	"mmap":              9,
+	"mprotect":          10,
+	"munmap":            11,
+	"brk":               12,
+	"rt_sigaction":      13,
+	"rt_sigprocmask":    14,
+	"rt_sigreturn":      15,
+	"ioctl":             16,
+	"pread64":           17,
+	"pwrite64":          18,
+	"readv":             19,
+	"writev":            20,
+	"access":            21,
+	"pipe":              22,
+	"select":            23,
+	"sched_yield":       24,
+	"mremap":            25,
+	"madvise":           28,
+	"dup":               32,
+	"dup2":              33,
+	"nanosleep":         35,
+	"getitimer":         36,
+	"setitimer":         38,
+	"getpid":            39,
+	"socket":            41,
+	"connect":           42,
+	"accept":            43,
+	"sendto":            44,
+	"recvfrom":          45,
+	"sendmsg":           46,
+	"recvmsg":           47,
+	"shutdown":          48,
+	"bind":              49,
+	"listen":            50,
+	"getsockname":       51,
+	"getpeername":       52,
+	"socketpair":        53,
+	"setsockopt":        54,
+	"getsockopt":        55,
+	"clone":             56,
+	"execve":            59,
+	"exit":              60,
+	"wait4":             61,
+	"kill":              62,
+	"uname":             63,
+	"fcntl":             72,
+	"flock":             73,
+	"fsync":             74,
+	"fdatasync":         75,
+	"ftruncate":         77,
+	"getcwd":            79,
+	"rename":            82,
+	"mkdir":             83,
+	"unlink":            87,
+	"readlink":          89,
+	"chmod":             90,
+	"fchmod":            91,
+	"fchown":            93,
+	"umask":             95,
+	"gettimeofday":      96,
+	"getrlimit":         97,
+	"getrusage":         98,
+	"sysinfo":           99,
+	"getuid":            102,
+	"getgid":            104,
+	"geteuid":           107,
+	"getegid":           108,
+	"getppid":           110,
+	"getgroups":         115,
+	"getresuid":         118,
+	"getresgid":         120,
+	"sigaltstack":       131,
+	"statfs":            137,
+	"fstatfs":           138,
+	"arch_prctl":        158,
+	"umount2":           166,
+	"gettid":            186,
+	"tkill":             200,
+	"futex":             202,
+	"sched_getaffinity": 204,
+	"epoll_create":      213,
+	"getdents64":        217,
+	"set_tid_address":   218,
+	"restart_syscall":   219,
+	"timer_create":      222,
+	"timer_settime":     223,
+	"timer_gettime":     224,
+	"timer_delete":      226,
+	"clock_gettime":     228,
+	"clock_getres":      229,
+	"clock_nanosleep":   230,
+	"exit_group":        231,
+	"epoll_wait":        232,
+	"epoll_ctl":         233,
+	"tgkill":            234,
+	"waitid":            247,
+	"openat":            257,
+	"mkdirat":           258,
+	"fchownat":          260,
+	"newfstatat":        262,
+	"unlinkat":          263,
+	"renameat":          264,
+	"symlinkat":         266,
+	"readlinkat":        267,
+	"fchmodat":          268,
+	"faccessat":         269,
+	"pselect6":          270,
+	"ppoll":             271,
+	"set_robust_list":   273,
+	"splice":            275,
+	"epoll_pwait":       281,
+	"accept4":           288,
+	"eventfd2":          290,
+	"epoll_create1":     291,
+	"dup3":              292,
+	"pipe2":             293,
+	"preadv":            295,
+	"pwritev":           296,
+	"recvmmsg":          299,
+	"prlimit64":         302,
+	"sendmmsg":          307,
+	"renameat2":         316,
+	"getrandom":         318,
+	"statx":             332,
+	"rseq":              334,
+	"pidfd_send_signal": 424,
+	"pidfd_open":        434,
+	"clone3":            435,
+	"faccessat2":        439,
+	"epoll_pwait2":      441,
+}
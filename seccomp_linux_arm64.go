@@ -0,0 +1,148 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+const (
+	// seccompArch is AUDIT_ARCH_AARCH64.
+	seccompArch = 0xc00000b7
+	sysSeccomp  = 277
+)
+
+// seccompSyscalls are the system calls allowed by the sandbox, by number.
+var seccompSyscalls = map[string]uint32{
+	"getcwd":            17,
+	"eventfd2":          19,
+	"epoll_create1":     20,
+	"epoll_ctl":         21,
+	"epoll_pwait":       22,
+	"dup":               23,
+	"dup3":              24,
+	"fcntl":             25,
+	"ioctl":             29,
+	"flock":             32,
+	"mkdirat":           34,
+	"unlinkat":          35,
+	"symlinkat":         36,
+	"renameat":          38,
+	"umount2":           39,
+	"statfs":            43,
+	"fstatfs":           44,
+	"ftruncate":         46,
+	"faccessat":         48,
+	"fchmod":            52,
+	"fchmodat":          53,
+	"fchownat":          54,
+	"fchown":            55,
+	"openat":            56,
+	"close":             57,
+	"pipe2":             59,
+	"getdents64":        61,
+	"lseek":             62,
+	"read":              63,
+	"write":             64,
+	"readv":             65,
+	"writev":            66,
+	"pread64":           67,
+	"pwrite64":          68,
+	"preadv":            69,
+	"pwritev":           70,
+	"pselect6":          72,
+	"ppoll":             73,
+	"splice":            76,
+	"readlinkat":        78,
+	"newfstatat":        79,
+	"fstat":             80,
+	"fsync":             82,
+	"fdatasync":         83,
+	"exit":              93,
+	"exit_group":        94,
+	"waitid":            95,
+	"set_tid_address":   96,
+	"futex":             98,
+	"set_robust_list":   99,
+	"nanosleep":         101,
+	"getitimer":         102,
+	"setitimer":         103,
+	"timer_create":      107,
+	"timer_gettime":     108,
+	"timer_settime":     110,
+	"timer_delete":      111,
+	"clock_gettime":     113,
+	"clock_getres":      114,
+	"clock_nanosleep":   115,
+	"sched_getaffinity": 123,
+	"sched_yield":       124,
+	"restart_syscall":   128,
+	"kill":              129,
+	"tkill":             130,
+	"tgkill":            131,
+	"sigaltstack":       132,
+	"rt_sigaction":      134,
+	"rt_sigprocmask":    135,
+	"rt_sigreturn":      139,
+	"getresuid":         148,
+	"getresgid":         150,
+	"getgroups":         158,
+	"uname":             160,
+	"getrlimit":         163,
+	"getrusage":         165,
+	"umask":             166,
+	"gettimeofday":      169,
+	"getpid":            172,
+	"getppid":           173,
+	"getuid":            174,
+	"geteuid":           175,
+	"getgid":            176,
+	"getegid":           177,
+	"gettid":            178,
+	"sysinfo":           179,
+	"socket":            198,
+	"socketpair":        199,
+	"bind":              200,
+	"listen":            201,
+	"accept":            202,
+	"connect":           203,
+	"getsockname":       204,
+	"getpeername":       205,
+	"sendto":            206,
+	"recvfrom":          207,
+	"setsockopt":        208,
+	"getsockopt":        209,
+	"shutdown":          210,
+	"sendmsg":           211,
+	"recvmsg":           212,
+	"brk":               214,
+	"munmap":            215,
+	"mremap":            216,
+	"clone":             220,
+	"execve":            221,
+	"mmap":              222,
+	"mprotect":          226,
+	"madvise":           233,
+	"accept4":           242,
+	"recvmmsg":          243,
+	"wait4":             260,
+	"prlimit64":         261,
+	"sendmmsg":          269,
+	"renameat2":         276,
+	"getrandom":         278,
+	"statx":             291,
+	"rseq":              293,
+	"pidfd_send_signal": 424,
+	"pidfd_open":        434,
+	"clone3":            435,
+	"faccessat2":        439,
+	"epoll_pwait2":      441,
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSeccompFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := seccompFilter(0xc000003e, []uint32{0, 1, 60})
+	assert.Len(filter, 9)
+	assert.EqualValues(0xc000003e, filter[1].K)
+	assert.EqualValues(seccompRetErrno|unix.EPERM, filter[2].K, "other architectures denied")
+	for i, nr := range []uint32{0, 1, 60} {
+		allow := 4 + i + 1 + int(filter[4+i].Jt) + 1
+		assert.Equal(nr, filter[4+i].K)
+		assert.EqualValues(seccompRetAllow, filter[allow-1].K, "syscall %d allowed", nr)
+	}
+	assert.EqualValues(seccompRetErrno|unix.EPERM, filter[7].K)
+}
+
+// TestEnableSeccomp runs itself in a child process, since the filter can't be removed.
+func TestEnableSeccomp(t *testing.T) {
+	if os.Getenv("KWFS_SECCOMP_TEST") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestEnableSeccomp$")
+		cmd.Env = append(os.Environ(), "KWFS_SECCOMP_TEST=1")
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+		return
+	}
+
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	assert.NoError(enableSeccomp())
+
+	// Files, network and threads still work.
+	_, err := ioutil.ReadFile(testCaFile)
+	assert.NoError(err)
+	resp, err := http.Get(server.URL)
+	if assert.NoError(err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal("ok", string(body))
+	}
+
+	// The control socket is created with a umask.
+	old := unix.Umask(0077)
+	assert.Equal(0077, unix.Umask(old))
+
+	assert.Equal(unix.EPERM, unix.Prctl(unix.PR_SET_DUMPABLE, 1, 0, 0, 0))
+	assert.Equal(unix.EPERM, unix.Mount("none", "/tmp", "tmpfs", 0, ""))
+}
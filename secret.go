@@ -15,13 +15,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/sys/unix"
 )
@@ -31,17 +38,94 @@ func ParseSecret(data []byte) (s *Secret, err error) {
 	if err = json.Unmarshal(data, &s); err != nil {
 		return nil, fmt.Errorf("Fail to deserialize JSON Secret: %v", err)
 	}
+	s.Content.setLength(s.Length)
+	if err = s.verifyDigest(); err != nil {
+		return nil, err
+	}
 	return
 }
 
-// ParseSecretList deserializes raw JSON into a list of Secret structs.
+// ParseSecretList deserializes raw JSON into a list of Secret structs. Content isn't checked
+// against digests, so that one bad secret doesn't fail the whole listing; see Client.List.
 func ParseSecretList(data []byte) (secrets []Secret, err error) {
 	if err = json.Unmarshal(data, &secrets); err != nil {
 		return nil, fmt.Errorf("Fail to deserialize JSON []Secret: %v", err)
 	}
+	for _, s := range secrets {
+		s.Content.setLength(s.Length)
+	}
 	return
 }
 
+// ContentCorrupt is returned when secret content doesn't match the digest sent along with it.
+type ContentCorrupt struct {
+	Name string
+}
+
+func (e ContentCorrupt) Error() string {
+	return fmt.Sprintf("content of %s doesn't match its digest", e.Name)
+}
+
+// InvalidSignature is returned when secret content isn't signed by the expected key.
+type InvalidSignature struct {
+	Name string
+}
+
+func (e InvalidSignature) Error() string {
+	return fmt.Sprintf("content of %s isn't signed by the secret verify key", e.Name)
+}
+
+// signedMessage returns what the server signs for a secret: its name, a newline, and the decoded
+// content. Including the name keeps a signed secret from being served under another name.
+func signedMessage(name string, data []byte) []byte {
+	return append([]byte(name+"\n"), data...)
+}
+
+// verifySignature checks that content is signed by key. Listings carry no content, and pass.
+func (s Secret) verifySignature(key ed25519.PublicKey) error {
+	if s.Content.lazyContent == nil {
+		return nil
+	}
+	if len(s.Signature) != ed25519.SignatureSize || !ed25519.Verify(key, signedMessage(s.Name, s.Content.Bytes()), s.Signature) {
+		return InvalidSignature{s.Name}
+	}
+	return nil
+}
+
+// verifyDigest checks content against the digest sent by the server, if any, to catch
+// truncation or corruption on the way. Digests are "sha256:" followed by the hex-encoded SHA-256
+// of the decoded content. Keywhiz's own checksum field is an HMAC keyed by the server, which
+// clients can't verify, so it is ignored.
+func (s Secret) verifyDigest() error {
+	// Listings carry no content, only its digest.
+	if s.Digest == "" || s.Content.lazyContent == nil {
+		return nil
+	}
+	parts := strings.SplitN(s.Digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" {
+		return fmt.Errorf("unsupported digest for %s: %s", s.Name, s.Digest)
+	}
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid digest for %s: %v", s.Name, err)
+	}
+	sum := sha256.Sum256(s.Content.Bytes())
+	if !bytes.Equal(sum[:], expected) {
+		return ContentCorrupt{s.Name}
+	}
+	return nil
+}
+
+// contentDigest returns the digest of the content, as "sha256:<hex>", or the digest sent by the
+// server if the content isn't known, as for listings.
+func (s Secret) contentDigest() string {
+	if s.Content.Empty() {
+		return s.Digest
+	}
+	sum := sha256.Sum256(s.Content.Bytes())
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
 // Secret represents data returned after processing a server request.
 //
 // json tags after fields indicate to json decoder the key name in JSON
@@ -50,10 +134,23 @@ type Secret struct {
 	Content     content   `json:"secret"`
 	Length      uint64    `json:"secretLength"`
 	CreatedAt   time.Time `json:"creationDate"`
+	UpdatedAt   time.Time `json:"updateDate"`
 	IsVersioned bool
 	Mode        string
 	Owner       string
 	Group       string
+	// Aliases are alternative names for the secret, e.g. names it had before being renamed.
+	Aliases []string `json:"aliases,omitempty"`
+	// Digest is the digest of the content, e.g. "sha256:<hex>", if sent by the server.
+	Digest string `json:"digest,omitempty"`
+	// Signature is an ed25519 signature of the name and content, if signed by the server.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// listedAlias returns true if alias is shown as a symlink at the root of the mount. Aliases never
+// shadow special files, and don't reach into directories.
+func listedAlias(alias string) bool {
+	return !strings.HasPrefix(alias, ".") && !strings.Contains(alias, "/")
 }
 
 // ModeValue function helps by converting a textual mode to the expected value for fuse.
@@ -70,25 +167,179 @@ func (s Secret) ModeValue() uint32 {
 	return uint32(modeValue | unix.S_IFREG)
 }
 
-// content is a helper type used to convert base64-encoded data from the server.
-type content []byte
+// ModifiedAt returns when the secret content last changed, falling back to its creation time
+// for servers which do not report updates.
+func (s Secret) ModifiedAt() time.Time {
+	if s.UpdatedAt.After(s.CreatedAt) {
+		return s.UpdatedAt
+	}
+	return s.CreatedAt
+}
+
+// content is secret content as sent by the server. Content is normally base64-encoded, but is
+// decoded on first use rather than when parsed so that listings of large secrets do not pay for
+// decoding (and holding both copies of) content which is never read.
+type content struct {
+	*lazyContent
+}
+
+type lazyContent struct {
+	once sync.Once
+	// size is the length of the undecoded content, used to tell empty content apart without
+	// decoding it.
+	size int
+	// length is the decoded length reported by the server, if any, used to detect encoding.
+	length uint64
+
+	raw         []byte
+	data        []byte
+	encoding    string
+	contentType string
+}
+
+// Encodings detected for secret content.
+const (
+	encodingBase64 = "base64"
+	encodingRaw    = "raw"
+)
+
+// decodedContent wraps content which is already decoded.
+func decodedContent(data []byte) content {
+	return content{&lazyContent{size: len(data), data: data, encoding: encodingRaw}}
+}
 
 func (c *content) UnmarshalJSON(data []byte) error {
-	var s string
-	if err := json.Unmarshal(data, &s); err != nil {
-		return fmt.Errorf("secret should be a string, got '%s' (%v)", data, err)
+	raw, ok := unquoteJSON(data)
+	if !ok {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("secret should be a string, got %d bytes (%v)", len(data), err)
+		}
+		raw = []byte(s)
+	}
+	*c = content{&lazyContent{size: len(raw), raw: raw}}
+	return nil
+}
+
+// unquoteJSON returns a copy of the characters of a JSON string without escape sequences, which
+// includes any base64, so that the undecoded content isn't held in a string which can't be
+// wiped. Returns false for other strings, which need unescaping.
+func unquoteJSON(data []byte) ([]byte, bool) {
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return nil, false
+	}
+	quoted := data[1 : len(data)-1]
+	for _, b := range quoted {
+		if b == '\\' || b == '"' || b < 0x20 {
+			return nil, false
+		}
 	}
+	if !utf8.Valid(quoted) {
+		return nil, false
+	}
+	return append([]byte{}, quoted...), true
+}
 
-	// Go's base64 requires padding to be present so we add it if necessary.
-	if m := len(s) % 4; m != 0 {
-		s += strings.Repeat("=", 4-m)
+// wipeBytes overwrites b with zeros.
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
 	}
+}
 
-	decoded, err := base64.StdEncoding.DecodeString(s)
-	if err != nil {
-		return fmt.Errorf("secret not valid base64, got '%+v' (%v)", s, err)
+// setLength records the decoded length reported by the server, which disambiguates content
+// sent raw that also happens to be valid base64.
+func (c content) setLength(length uint64) {
+	if c.lazyContent != nil {
+		c.length = length
 	}
+}
 
-	*c = decoded
-	return nil
+// Empty returns true if there is no content, without decoding it.
+func (c content) Empty() bool {
+	return c.lazyContent == nil || c.size == 0
+}
+
+// Bytes returns the decoded content. The returned slice must not be modified.
+func (c content) Bytes() []byte {
+	if c.lazyContent == nil {
+		return nil
+	}
+	c.once.Do(c.decode)
+	return c.data
+}
+
+// wipe overwrites the content with zeros, whether decoded or not.
+func (c content) wipe() {
+	if c.lazyContent == nil {
+		return
+	}
+	c.once.Do(func() {})
+	wipeBytes(c.data)
+	wipeBytes(c.raw)
+	c.raw = nil
+}
+
+// Encoding returns how the content was sent by the server, "base64" or "raw".
+func (c content) Encoding() string {
+	if c.lazyContent == nil {
+		return encodingRaw
+	}
+	c.once.Do(c.decode)
+	return c.encoding
+}
+
+// ContentType returns the MIME type sniffed from the decoded content, such as
+// "text/plain; charset=utf-8" or "application/octet-stream".
+func (c content) ContentType() string {
+	if c.lazyContent == nil {
+		return http.DetectContentType(nil)
+	}
+	c.once.Do(c.decode)
+	return c.contentType
+}
+
+// String describes content without revealing it, so secrets can't be logged by formatting them.
+func (c content) String() string {
+	if c.lazyContent == nil {
+		return "content(empty)"
+	}
+	return fmt.Sprintf("content(%d bytes)", c.size)
+}
+
+// GoString is used for the %#v verb and also describes content without revealing it.
+func (c content) GoString() string {
+	return c.String()
+}
+
+// decode decodes base64 content, falling back to using content verbatim if it is not valid
+// base64 or only the undecoded content matches the length reported by the server. It runs once,
+// on first access, and the undecoded content is wiped once decoded.
+func (c *lazyContent) decode() {
+	if c.encoding == "" {
+		padded := c.raw
+		// Go's base64 requires padding to be present so we add it if necessary.
+		if m := len(padded) % 4; m != 0 {
+			padded = make([]byte, len(c.raw)+4-m)
+			copy(padded, c.raw)
+			copy(padded[len(c.raw):], "===")
+		}
+
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(padded)))
+		n, err := base64.StdEncoding.Decode(decoded, padded)
+		decoded = decoded[:n]
+		rawLength := c.length != 0 && uint64(len(c.raw)) == c.length
+		if err == nil && !(rawLength && uint64(len(decoded)) != c.length) {
+			c.data, c.encoding = decoded, encodingBase64
+			wipeBytes(c.raw)
+		} else {
+			wipeBytes(decoded)
+			c.data, c.encoding = c.raw, encodingRaw
+		}
+		if len(padded) != len(c.raw) {
+			wipeBytes(padded)
+		}
+		c.raw = nil
+	}
+	c.contentType = http.DetectContentType(c.data)
 }
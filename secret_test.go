@@ -15,6 +15,10 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"testing"
 	"time"
 
@@ -33,7 +37,7 @@ func TestDeserializeSecret(t *testing.T) {
 	assert.Equal("0400", s.Mode)
 	assert.Equal("nobody", s.Owner)
 	assert.Equal("nobody", s.Group)
-	assert.EqualValues("asddas", s.Content)
+	assert.EqualValues("asddas", s.Content.Bytes())
 
 	expectedCreatedAt := time.Date(2011, time.September, 29, 15, 46, 0, 232000000, time.UTC)
 	assert.Equal(s.CreatedAt.Unix(), expectedCreatedAt.Unix())
@@ -45,7 +49,41 @@ func TestDeserializeSecretWithoutBase64Padding(t *testing.T) {
 	s, err := ParseSecret(fixture("secretWithoutBase64Padding.json"))
 	assert.NoError(err)
 	assert.Equal("NonexistentOwner_Pass", s.Name)
-	assert.EqualValues("12345", s.Content)
+	assert.EqualValues("12345", s.Content.Bytes())
+}
+
+func TestSecretContentDetection(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		json        string
+		content     string
+		encoding    string
+		contentType string
+	}{
+		{`{"secret":"YXNkZGFz","secretLength":6}`, "asddas", "base64", "text/plain; charset=utf-8"},
+		{`{"secret":"AAEC"}`, "\x00\x01\x02", "base64", "application/octet-stream"},
+		// Not valid base64, sent verbatim.
+		{`{"secret":"pass word!"}`, "pass word!", "raw", "text/plain; charset=utf-8"},
+		// Valid base64, but the reported length only matches the undecoded content.
+		{`{"secret":"abcd","secretLength":4}`, "abcd", "raw", "text/plain; charset=utf-8"},
+		// Escape sequences are unescaped before decoding.
+		{`{"secret":"line\nbreak"}`, "line\nbreak", "raw", "text/plain; charset=utf-8"},
+		{`{"secret":"YXNk\u005aGFz"}`, "asddas", "base64", "text/plain; charset=utf-8"},
+	}
+	for _, c := range cases {
+		s, err := ParseSecret([]byte(c.json))
+		assert.NoError(err)
+		assert.False(s.Content.Empty())
+		assert.Equal(c.content, string(s.Content.Bytes()), c.json)
+		assert.Equal(c.encoding, s.Content.Encoding(), c.json)
+		assert.Equal(c.contentType, s.Content.ContentType(), c.json)
+	}
+
+	s, err := ParseSecret([]byte(`{"name":"empty"}`))
+	assert.NoError(err)
+	assert.True(s.Content.Empty())
+	assert.Empty(s.Content.Bytes())
 }
 
 func TestDeserializeSecretList(t *testing.T) {
@@ -59,6 +97,20 @@ func TestDeserializeSecretList(t *testing.T) {
 	}
 }
 
+func TestSecretModifiedAt(t *testing.T) {
+	assert := assert.New(t)
+
+	created := time.Date(2016, time.June, 29, 20, 5, 21, 0, time.UTC)
+	updated := created.Add(time.Hour)
+
+	assert.Equal(created, Secret{CreatedAt: created}.ModifiedAt())
+	assert.Equal(updated, Secret{CreatedAt: created, UpdatedAt: updated}.ModifiedAt())
+
+	s, err := ParseSecret([]byte(`{"name":"a","secret":"","creationDate":"2016-06-29T20:05:21.000Z","updateDate":"2016-06-29T21:05:21.000Z"}`))
+	assert.NoError(err)
+	assert.Equal(updated.Unix(), s.ModifiedAt().Unix())
+}
+
 func TestSecretModeValue(t *testing.T) {
 	assert := assert.New(t)
 
@@ -74,3 +126,91 @@ func TestSecretModeValue(t *testing.T) {
 		assert.Equal(c.mode|unix.S_IFREG, c.secret.ModeValue())
 	}
 }
+
+func TestSecretDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	// sha256("hello")
+	digest := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	s, err := ParseSecret([]byte(`{"name": "a", "secret": "aGVsbG8=", "digest": "` + digest + `"}`))
+	assert.NoError(err)
+	assert.Equal("hello", string(s.Content.Bytes()))
+
+	_, err = ParseSecret([]byte(`{"name": "a", "secret": "aGVsbA==", "digest": "` + digest + `"}`))
+	assert.Equal(ContentCorrupt{"a"}, err)
+
+	_, err = ParseSecret([]byte(`{"name": "a", "secret": "", "digest": "` + digest + `"}`))
+	assert.Equal(ContentCorrupt{"a"}, err, "truncated to nothing")
+
+	_, err = ParseSecret([]byte(`{"name": "a", "secret": "aGVsbG8=", "digest": "md5:5d41402abc4b2a76b9719d911017c592"}`))
+	assert.Error(err)
+
+	// Listings carry no content to verify.
+	secrets, err := ParseSecretList([]byte(`[{"name": "a", "digest": "` + digest + `"}]`))
+	assert.NoError(err)
+	assert.Len(secrets, 1)
+
+	// Content in listings is left for the client to verify, secret by secret.
+	secrets, err = ParseSecretList([]byte(`[{"name": "a", "secret": "aGVsbA==", "digest": "` + digest + `"}]`))
+	assert.NoError(err)
+	assert.Equal(ContentCorrupt{"a"}, secrets[0].verifyDigest())
+}
+
+func TestSecretSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	sign := func(name, data string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(private, signedMessage(name, []byte(data))))
+	}
+
+	s, err := ParseSecret([]byte(`{"name": "a", "secret": "aGVsbG8=", "signature": "` + sign("a", "hello") + `"}`))
+	assert.NoError(err)
+	assert.NoError(s.verifySignature(public))
+
+	s, _ = ParseSecret([]byte(`{"name": "a", "secret": "aGVsbG8=", "signature": "` + sign("b", "hello") + `"}`))
+	assert.Equal(InvalidSignature{"a"}, s.verifySignature(public), "signed for another name")
+
+	s, _ = ParseSecret([]byte(`{"name": "a", "secret": "aGVsbA==", "signature": "` + sign("a", "hello") + `"}`))
+	assert.Equal(InvalidSignature{"a"}, s.verifySignature(public))
+
+	s, _ = ParseSecret([]byte(`{"name": "a", "secret": "aGVsbG8="}`))
+	assert.Equal(InvalidSignature{"a"}, s.verifySignature(public), "unsigned")
+
+	// Listings carry no content to verify.
+	secrets, _ := ParseSecretList([]byte(`[{"name": "a"}]`))
+	assert.NoError(secrets[0].verifySignature(public))
+}
+
+func TestSecretContentWipesUndecoded(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte(`{"secret":"YXNkZGFz"}`)
+	s, err := ParseSecret(data)
+	assert.NoError(err)
+	raw := s.Content.raw
+	assert.EqualValues("YXNkZGFz", raw)
+
+	// The undecoded content is copied from the response, and wiped once decoded.
+	wipeBytes(data)
+	assert.EqualValues("asddas", s.Content.Bytes())
+	assert.Equal(make([]byte, len(raw)), raw)
+	assert.EqualValues("asddas", s.Content.Bytes())
+}
+
+func TestSecretContentIsNotFormatted(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := ParseSecret([]byte(`{"name":"foo","secret":"YXNkZGFz"}`))
+	assert.NoError(err)
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		assert.NotContains(fmt.Sprintf(format, s), "YXNkZGFz", format)
+		assert.NotContains(fmt.Sprintf(format, *s), "YXNkZGFz", format)
+	}
+	assert.Equal("content(8 bytes)", s.Content.String())
+	assert.Equal("content(empty)", content{}.String())
+
+	_, err = ParseSecret([]byte(`{"secret":["YXNkZGFz"]}`))
+	assert.Error(err)
+	assert.NotContains(err.Error(), "YXNkZGFz")
+}
@@ -25,6 +25,17 @@ type SecretMap struct {
 	lock     sync.Mutex
 	timeouts Timeouts
 	now      func() time.Time
+	// index is built on first use after the map changes, and dropped by every change.
+	index *secretIndex
+}
+
+// secretIndex holds the directory parts of secret names and the aliases of secrets, so that
+// looking them up on every stat doesn't scan all secrets.
+type secretIndex struct {
+	dirs    map[string]bool
+	aliases map[string]string
+	// expires is when the first entry scheduled for deletion expires, or zero if none is.
+	expires time.Time
 }
 
 // SecretTime contains a Secret record along with a timestamp when it was inserted.
@@ -37,11 +48,13 @@ type SecretTime struct {
 	Time    time.Time
 	ttl     time.Time
 	deleted bool
+	// listed is when a listing last showed that the cached content is current.
+	listed time.Time
 }
 
 // NewSecretMap initializes a new SecretMap.
 func NewSecretMap(timeouts Timeouts, now func() time.Time) *SecretMap {
-	return &SecretMap{make(map[string]SecretTime), sync.Mutex{}, timeouts, now}
+	return &SecretMap{make(map[string]SecretTime), sync.Mutex{}, timeouts, now, nil}
 }
 
 func (m *SecretMap) getNow() time.Time {
@@ -63,6 +76,7 @@ func (m *SecretMap) Get(key string) (s SecretTime, ok bool) {
 	s, ok = m.m[key]
 	if ok && isExpired(s, m.getNow()) {
 		delete(m.m, key)
+		m.index = nil
 		return SecretTime{deleted: true}, false
 	}
 	return
@@ -76,7 +90,18 @@ func (m *SecretMap) Put(key string, value Secret, updated time.Time) {
 	if updated.Equal(time.Time{}) {
 		updated = m.getNow()
 	}
-	m.m[key] = SecretTime{value, updated, time.Time{}, false}
+	m.m[key] = SecretTime{value, updated, time.Time{}, false, time.Time{}}
+	m.index = nil
+}
+
+// Confirm records that a listing showed the content of an entry to be current.
+func (m *SecretMap) Confirm(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if v, ok := m.m[key]; ok {
+		v.listed = m.getNow()
+		m.m[key] = v
+	}
 }
 
 // Schedules an entry for deletion.
@@ -90,6 +115,7 @@ func (m *SecretMap) Delete(key string) {
 			v.ttl = expire
 		}
 		m.m[key] = v
+		m.index = nil
 	}
 }
 
@@ -106,6 +132,7 @@ func (m *SecretMap) DeleteAll() {
 		}
 		m.m[k] = v
 	}
+	m.index = nil
 }
 
 // Similar to Overwrite, but keeps all the keys which aren't in m2 and marks them for delayed deletion.
@@ -119,7 +146,7 @@ func (m *SecretMap) Replace(m2 *SecretMap) {
 	expire := m.getNow().Add(m.timeouts.DeletionDelay)
 	for k, v := range m.m {
 		// Only hold on to secrets which actually have data.
-		if len(v.Secret.Content) == 0 {
+		if v.Secret.Content.Empty() {
 			delete(m.m, k)
 		} else if v.ttl.IsZero() {
 			v.ttl = expire
@@ -131,6 +158,48 @@ func (m *SecretMap) Replace(m2 *SecretMap) {
 	for k, v := range m2.m {
 		m.m[k] = v
 	}
+	m.index = nil
+}
+
+// Wipe overwrites the content of all secrets with zeros and empties the map.
+func (m *SecretMap) Wipe() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, v := range m.m {
+		v.Secret.Content.wipe()
+	}
+	m.m = make(map[string]SecretTime)
+	m.index = nil
+}
+
+// Remove drops an entry right away, rather than scheduling its deletion. Returns false if there
+// was no entry.
+func (m *SecretMap) Remove(key string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.m[key]
+	delete(m.m, key)
+	m.index = nil
+	return ok
+}
+
+// Entries returns the stored entries, including those scheduled for deletion, in no particular
+// order.
+func (m *SecretMap) Entries() []SecretTime {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries := make([]SecretTime, 0, len(m.m))
+	now := m.getNow()
+	for key, value := range m.m {
+		if isExpired(value, now) {
+			delete(m.m, key)
+			m.index = nil
+		} else {
+			entries = append(entries, value)
+		}
+	}
+	return entries
 }
 
 // Values returns a slice of stored secrets in no particular order.
@@ -144,6 +213,7 @@ func (m *SecretMap) Values() []Secret {
 	for key, value := range m.m {
 		if isExpired(value, now) {
 			delete(m.m, key)
+			m.index = nil
 		} else {
 			values[i] = value.Secret
 			i++
@@ -152,6 +222,62 @@ func (m *SecretMap) Values() []Secret {
 	return values[0:i]
 }
 
+// Pending returns true if the entry is scheduled for deletion, but not yet dropped.
+func (m *SecretMap) Pending(key string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.m[key]
+	return ok && !s.ttl.IsZero() && !isExpired(s, m.getNow())
+}
+
+// IsDirectory returns true if name is the directory part of stored secret names.
+func (m *SecretMap) IsDirectory(name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.names().dirs[name]
+}
+
+// Alias returns the name of a stored secret which reports name as one of its aliases. Only
+// aliases which are listed are found, see listedAlias.
+func (m *SecretMap) Alias(name string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	target, ok := m.names().aliases[name]
+	return target, ok
+}
+
+// names returns the index of stored names, rebuilding it if the map changed or an entry expired
+// since it was built. The lock must be held.
+func (m *SecretMap) names() *secretIndex {
+	now := m.getNow()
+	if m.index != nil && (m.index.expires.IsZero() || !m.index.expires.Before(now)) {
+		return m.index
+	}
+	index := &secretIndex{dirs: make(map[string]bool), aliases: make(map[string]string)}
+	for key, value := range m.m {
+		if isExpired(value, now) {
+			delete(m.m, key)
+			continue
+		}
+		if !value.ttl.IsZero() && (index.expires.IsZero() || value.ttl.Before(index.expires)) {
+			index.expires = value.ttl
+		}
+		name := value.Secret.Name
+		for i := range name {
+			if name[i] == '/' {
+				index.dirs[name[:i]] = true
+			}
+		}
+		for _, alias := range value.Secret.Aliases {
+			if _, ok := index.aliases[alias]; !ok && listedAlias(alias) {
+				index.aliases[alias] = name
+			}
+		}
+	}
+	m.index = index
+	return index
+}
+
 // Len returns the count of values stored (not including keys marked for
 // delayed deletion).
 // Only used by tests.
@@ -81,3 +81,54 @@ func TestSecretMapTimestamp(t *testing.T) {
 	assert.True(ok)
 	assert.True(val.Time.After(earlierTime))
 }
+
+func TestSecretMapWipe(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := ParseSecret(fixture("secret.json"))
+	assert.NoError(err)
+	data := s.Content.Bytes()
+	assert.NotEmpty(data)
+
+	secretMap := NewSecretMap(timeouts, nil)
+	secretMap.Put("foo", *s, time.Time{})
+	secretMap.Put("undecoded", Secret{Name: "undecoded", Content: content{&lazyContent{size: 4, raw: []byte("c2VjcmV0")}}}, time.Time{})
+	secretMap.Wipe()
+
+	assert.Equal(0, secretMap.Len())
+	assert.Equal(make([]byte, len(data)), data, "content overwritten")
+}
+
+func TestSecretMapIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	fake_now := time.Now()
+	secretMap := NewSecretMap(timeouts, func() time.Time { return fake_now })
+	secretMap.Put("a/b/c", Secret{Name: "a/b/c", Aliases: []string{"short", ".hidden", "a/b/d"}}, time.Time{})
+
+	assert.True(secretMap.IsDirectory("a"))
+	assert.True(secretMap.IsDirectory("a/b"))
+	assert.False(secretMap.IsDirectory("a/b/c"))
+	assert.False(secretMap.IsDirectory("b"))
+	target, ok := secretMap.Alias("short")
+	assert.True(ok)
+	assert.Equal("a/b/c", target)
+	_, ok = secretMap.Alias(".hidden")
+	assert.False(ok, "not listed")
+	_, ok = secretMap.Alias("a/b/d")
+	assert.False(ok, "not listed")
+
+	// Changes are reflected right away.
+	secretMap.Put("d/e", Secret{Name: "d/e"}, time.Time{})
+	assert.True(secretMap.IsDirectory("d"))
+	secretMap.Remove("d/e")
+	assert.False(secretMap.IsDirectory("d"))
+
+	// Entries scheduled for deletion are indexed until they expire.
+	secretMap.Delete("a/b/c")
+	assert.True(secretMap.IsDirectory("a"))
+	fake_now = fake_now.Add(2 * time.Hour)
+	assert.False(secretMap.IsDirectory("a"))
+	_, ok = secretMap.Alias("short")
+	assert.False(ok)
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Exit codes of the mount command. Fatal errors exit with 1.
+const (
+	// exitUnmounted: unmounted cleanly, after in-flight requests completed.
+	exitUnmounted = 0
+	// exitDetached: still busy when the shutdown timeout expired, so lazily unmounted.
+	exitDetached = 2
+)
+
+// mount is a mounted FUSE server.
+type mount struct {
+	server *fuse.Server
+	point  string
+}
+
+// unmountAll unmounts mounts in order. An unmount waits for in-flight requests to complete, and
+// is retried while the mount is busy, e.g. because files are open. Mounts still busy when the
+// timeout expires are detached lazily: they disappear from the filesystem right away, and are
+// cleaned up by the kernel once no longer used. Returns false if any mount had to be detached.
+func unmountAll(mounts []mount, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	clean := true
+	for _, m := range mounts {
+		err := m.server.Unmount()
+		for err != nil && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+			err = m.server.Unmount()
+		}
+		if err == nil {
+			continue
+		}
+		logger.Warnf("Unable to unmount %s within %v, detaching: %v", m.point, timeout, err)
+		clean = false
+		if err := lazyUnmount(m.point); err != nil {
+			logger.Errorf("Unable to detach %s: %v", m.point, err)
+		}
+	}
+	return clean
+}
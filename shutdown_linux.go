@@ -0,0 +1,38 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+)
+
+// lazyUnmount detaches a mount, like umount -l.
+func lazyUnmount(point string) error {
+	if os.Geteuid() == 0 {
+		return unix.Unmount(point, unix.MNT_DETACH)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("fusermount", "-u", "-z", point)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("fusermount: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
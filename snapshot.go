@@ -0,0 +1,192 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// snapshotFstypes are the filesystem types, as reported by statfs(2), which snapshots may be
+// written to, so that secrets never reach a disk. Overridden in tests.
+var snapshotFstypes = map[int64]string{
+	0x01021994: "tmpfs",
+	0x858458f6: "ramfs",
+}
+
+// WriteSnapshot materializes the secrets of kwfs in dir, for applications which can't tolerate
+// the latency of FUSE, or need secrets while keywhiz-fs restarts. Files get the modes and, when
+// running as root, owners of the mount. dir must be on tmpfs.
+//
+// The snapshot is written to a new directory next to dir, and dir is a symlink to it, replaced
+// with rename(2): readers see either the previous snapshot or the new one, never a mix. Nothing
+// is replaced unless the content of every secret is available. Secrets are subject to the same
+// ownership and process policy checks for caller as opening their files, and recorded in the
+// audit log the same way; those denied are left out. Returns the number of secrets written.
+func WriteSnapshot(kwfs *KeywhizFs, dir string, caller *fuse.Context) (int, error) {
+	if !filepath.IsAbs(dir) {
+		return 0, fmt.Errorf("%s is not an absolute path", dir)
+	}
+	dir = filepath.Clean(dir)
+	parent, base := filepath.Dir(dir), filepath.Base(dir)
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(parent, &stat); err != nil {
+		return 0, err
+	}
+	if _, ok := snapshotFstypes[int64(stat.Type)]; !ok {
+		return 0, fmt.Errorf("%s is not on tmpfs", parent)
+	}
+	previous, err := snapshotTarget(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	version := filepath.Join(parent, fmt.Sprintf(".%s-%d", base, time.Now().UnixNano()))
+	count, err := writeSnapshotFiles(kwfs, version, caller)
+	if err == nil {
+		link := filepath.Join(parent, "."+base+".tmp")
+		os.Remove(link)
+		if err = os.Symlink(filepath.Base(version), link); err == nil {
+			err = os.Rename(link, dir)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(version)
+		return 0, err
+	}
+
+	if previous != "" {
+		os.RemoveAll(previous)
+	}
+	kwfs.Infof("Wrote snapshot of %d secrets to %s", count, dir)
+	return count, nil
+}
+
+// snapshotTarget returns the directory a previous snapshot at dir links to, or "" if there is
+// none. Anything else at dir is an error, rather than being replaced.
+func snapshotTarget(dir string) (string, error) {
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	parent, base := filepath.Dir(dir), filepath.Base(dir)
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(dir)
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(target, "/") && strings.HasPrefix(target, "."+base+"-") {
+			return filepath.Join(parent, target), nil
+		}
+	}
+	return "", fmt.Errorf("%s exists and is not a snapshot", dir)
+}
+
+// writeSnapshotFiles writes a file for each secret of kwfs under the new directory root.
+func writeSnapshotFiles(kwfs *KeywhizFs, root string, caller *fuse.Context) (int, error) {
+	owned := os.Geteuid() == 0
+	mkdir := func(path string) error {
+		if err := os.Mkdir(path, 0755); err != nil {
+			return err
+		}
+		if owned {
+			return os.Chown(path, int(kwfs.Ownership.Uid), int(kwfs.Ownership.Gid))
+		}
+		return nil
+	}
+	if err := mkdir(root); err != nil {
+		return 0, err
+	}
+
+	names := []string{}
+	for _, s := range kwfs.Cache.SecretList() {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+
+	dirs := map[string]bool{}
+	count := 0
+	for _, name := range names {
+		secret, ok := kwfs.Cache.Secret(name)
+		if !ok {
+			return 0, fmt.Errorf("content of %s is unavailable", name)
+		}
+		if !kwfs.allowed(secret, caller) {
+			kwfs.Warnf("Left %s out of snapshot, denied to %s", name, prettyContext(caller))
+			kwfs.Audit.Record(name, caller, false, false)
+			continue
+		}
+		if strings.Contains(name, "..") || strings.HasPrefix(name, "/") {
+			return 0, fmt.Errorf("invalid secret name %s", name)
+		}
+
+		// Namespaced secrets, e.g. prod/db, are in directories.
+		path := filepath.Join(root, name)
+		for _, d := range parentDirs(name) {
+			if dirs[d] {
+				continue
+			}
+			if err := mkdir(filepath.Join(root, d)); err != nil {
+				return 0, err
+			}
+			dirs[d] = true
+		}
+
+		// Writes to the snapshot don't reach the server, so it is never writable.
+		attr := kwfs.secretAttr(secret)
+		mode := os.FileMode(attr.Mode & 0777)
+		if kwfs.WriteThrough {
+			mode &^= 0200
+		}
+		if err := ioutil.WriteFile(path, secret.Content.Bytes(), mode); err != nil {
+			return 0, err
+		}
+		// WriteFile's mode is subject to the umask.
+		if err := os.Chmod(path, mode); err != nil {
+			return 0, err
+		}
+		if owned {
+			if err := os.Chown(path, int(attr.Uid), int(attr.Gid)); err != nil {
+				return 0, err
+			}
+		}
+		kwfs.Audit.Record(name, caller, false, true)
+		count++
+	}
+	return count, nil
+}
+
+// parentDirs returns the directories containing a namespaced secret, outermost first, e.g. "a"
+// and "a/b" for "a/b/c".
+func parentDirs(name string) []string {
+	var dirs []string
+	for i, c := range name {
+		if c == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	return dirs
+}
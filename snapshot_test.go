@@ -0,0 +1,114 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// snapshotOwner owns the secrets of the snapshot.
+const snapshotOwner uint32 = 12345
+
+func TestWriteSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	parent, err := ioutil.TempDir("", "kwfs_snapshot")
+	assert.NoError(err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "secrets")
+
+	timeouts := Timeouts{0, 10 * time.Millisecond, 20 * time.Millisecond, 1 * time.Hour, 0, 0, 0}
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	backend := MapBackend{"db": "password", "prod/api": "token"}
+	kwfs, _, _ := NewKeywhizFs(nil, backend, Ownership{Uid: snapshotOwner, Gid: snapshotOwner}, timeouts, metricsHandle, logConfig)
+
+	// Only the filesystem of the temporary directory is allowed, whether it is tmpfs or not.
+	oldFstypes := snapshotFstypes
+	defer func() { snapshotFstypes = oldFstypes }()
+	snapshotFstypes = map[int64]string{}
+	_, err = WriteSnapshot(kwfs, dir, nil)
+	assert.EqualError(err, parent+" is not on tmpfs")
+	var stat unix.Statfs_t
+	assert.NoError(unix.Statfs(parent, &stat))
+	snapshotFstypes[int64(stat.Type)] = "test"
+
+	_, err = WriteSnapshot(kwfs, "secrets", nil)
+	assert.Error(err, "relative")
+
+	count, err := WriteSnapshot(kwfs, dir, nil)
+	assert.NoError(err)
+	assert.Equal(2, count)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "db"))
+	assert.NoError(err)
+	assert.Equal("password", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "prod", "api"))
+	assert.NoError(err)
+	assert.Equal("token", string(data))
+	info, err := os.Stat(filepath.Join(dir, "db"))
+	assert.NoError(err)
+	assert.EqualValues(0440, info.Mode().Perm())
+	if os.Geteuid() == 0 {
+		assert.EqualValues(snapshotOwner, info.Sys().(*syscall.Stat_t).Uid)
+	}
+	first, err := os.Readlink(dir)
+	assert.NoError(err)
+
+	// A new snapshot replaces the previous one, which is removed.
+	backend["new"] = "value"
+	kwfs.Cache.Clear()
+	count, err = WriteSnapshot(kwfs, dir, nil)
+	assert.NoError(err)
+	assert.Equal(3, count)
+	second, err := os.Readlink(dir)
+	assert.NoError(err)
+	assert.NotEqual(first, second)
+	entries, err := ioutil.ReadDir(parent)
+	assert.NoError(err)
+	assert.Len(entries, 2, "the link and the latest snapshot")
+
+	// Secrets the caller can't access are left out.
+	kwfs.EnforceOwnership = true
+	stranger := &fuse.Context{Owner: fuse.Owner{Uid: snapshotOwner + 1, Gid: snapshotOwner + 1}}
+	count, err = WriteSnapshot(kwfs, dir, stranger)
+	assert.NoError(err)
+	assert.Equal(0, count)
+	owner := &fuse.Context{Owner: fuse.Owner{Uid: snapshotOwner, Gid: snapshotOwner}}
+	count, err = WriteSnapshot(kwfs, dir, owner)
+	assert.NoError(err)
+	assert.Equal(3, count)
+	kwfs.EnforceOwnership = false
+
+	// Anything else is never replaced.
+	other := filepath.Join(parent, "other")
+	assert.NoError(os.Mkdir(other, 0755))
+	_, err = WriteSnapshot(kwfs, other, nil)
+	assert.EqualError(err, other+" exists and is not a snapshot")
+}
+
+func TestParentDirs(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(parentDirs("db"))
+	assert.Equal([]string{"a", "a/b"}, parentDirs("a/b/c"))
+}
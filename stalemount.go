@@ -0,0 +1,101 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// staleMountTimeout bounds how long to wait for an existing mount to respond at startup.
+const staleMountTimeout = 5 * time.Second
+
+// mountFstype returns the filesystem type, e.g. "fuse.keywhiz-fs", of the topmost mount at
+// mountpoint according to the mount table, or "" if nothing is mounted there.
+func mountFstype(mountpoint string) (string, error) {
+	f, err := os.Open(mountinfoFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Fields: mount ID, parent ID, major:minor, root, mount point, options, optional fields,
+	// "-", filesystem type, ...
+	var fstype string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != mountpoint {
+			continue
+		}
+		for i := 5; i+1 < len(fields); i++ {
+			if fields[i] == "-" {
+				fstype = fields[i+1]
+				break
+			}
+		}
+	}
+	return fstype, scanner.Err()
+}
+
+// isKeywhizFstype returns true for the filesystem types of keywhiz-fs and mirror mounts.
+func isKeywhizFstype(fstype string) bool {
+	return fstype == "fuse."+KeywhizFs{}.String() || fstype == "fuse."+(&MirrorFs{}).String()
+}
+
+// recoverStaleMount detaches a dead keywhiz-fs mount left at mountpoint by a crashed process, so
+// that restarting doesn't require an operator to run fusermount -uz. A mount is dead when its
+// FUSE server is gone, so that accessing it fails with ENOTCONN. Other mounts are left alone.
+func recoverStaleMount(mountpoint string) error {
+	if abs, err := filepath.Abs(mountpoint); err == nil {
+		mountpoint = abs
+	}
+	mountpoint = filepath.Clean(mountpoint)
+
+	fstype, err := mountFstype(mountpoint)
+	if err != nil || !isKeywhizFstype(fstype) {
+		return err
+	}
+
+	// A hung, rather than dead, mount may block stat(2) indefinitely.
+	result := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(mountpoint)
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(staleMountTimeout):
+		logger.Warnf("Existing %s mount at %s is not responding, leaving it alone", fstype, mountpoint)
+		return nil
+	}
+
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ENOTCONN {
+		if err == nil {
+			logger.Warnf("%s is already mounted by a running keywhiz-fs", mountpoint)
+		}
+		return nil
+	}
+	logger.Warnf("Detaching dead %s mount at %s", fstype, mountpoint)
+	if err := lazyUnmount(mountpoint); err != nil {
+		return fmt.Errorf("unable to detach dead mount at %s: %v", mountpoint, err)
+	}
+	return nil
+}
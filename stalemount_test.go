@@ -0,0 +1,56 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountFstype(t *testing.T) {
+	assert := assert.New(t)
+	defer fakeFusectl()()
+
+	fstype, err := mountFstype("/mnt/key whiz")
+	assert.NoError(err)
+	assert.Equal("fuse.kwfs", fstype)
+
+	fstype, err = mountFstype("/")
+	assert.NoError(err)
+	assert.Equal("ext4", fstype)
+
+	fstype, err = mountFstype("/mnt")
+	assert.NoError(err)
+	assert.Equal("", fstype)
+}
+
+func TestIsKeywhizFstype(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isKeywhizFstype("fuse.keywhiz-fs"))
+	assert.True(isKeywhizFstype("fuse.keywhiz-fs-mirror"))
+	assert.False(isKeywhizFstype("fuse.sshfs"))
+	assert.False(isKeywhizFstype(""))
+}
+
+func TestRecoverStaleMountIgnoresOtherMounts(t *testing.T) {
+	assert := assert.New(t)
+	defer fakeFusectl()()
+
+	// Neither is a keywhiz-fs mount, so both are left alone without being accessed.
+	assert.NoError(recoverStaleMount("/mnt/key whiz"))
+	assert.NoError(recoverStaleMount("/mnt"))
+}
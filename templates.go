@@ -0,0 +1,99 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// templateSuffix marks template files in a template directory.
+const templateSuffix = ".tmpl"
+
+// Template renders a configuration file from several secrets, for applications which expect
+// a single file such as database.yml. Templates use Go's text/template syntax, with a
+// `secret` function returning the content of a secret by name:
+//
+//	password: {{ secret "db.password" }}
+type Template struct {
+	Name string
+	Mode uint32
+	text string
+}
+
+// LoadTemplates reads every <name>.tmpl file in dir as a template named <name>. Templates are
+// parsed up front so that syntax errors are reported on startup.
+func LoadTemplates(dir string) (map[string]*Template, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]*Template{}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), templateSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(info.Name(), templateSuffix)
+		if name == "" || strings.HasPrefix(name, ".") {
+			return nil, fmt.Errorf("invalid template name '%s'", info.Name())
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		t := &Template{Name: name, Mode: uint32(info.Mode().Perm()) & 0444, text: string(data)}
+		if _, err := t.parse(nil); err != nil {
+			return nil, err
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+// Render executes the template, looking up secrets with lookup. Rendering fails if a referenced
+// secret is not available.
+func (t *Template) Render(lookup func(name string) (*Secret, bool)) ([]byte, error) {
+	tmpl, err := t.parse(lookup)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (t *Template) parse(lookup func(name string) (*Secret, bool)) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"secret": func(name string) (string, error) {
+			if lookup == nil {
+				return "", nil
+			}
+			s, ok := lookup(name)
+			if !ok {
+				return "", fmt.Errorf("secret '%s' not available", name)
+			}
+			return string(s.Content.Bytes()), nil
+		},
+	}
+	return template.New(t.Name).Funcs(funcs).Option("missingkey=error").Parse(t.text)
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTemplates writes the given templates to a temporary directory, returning its path.
+func writeTemplates(templates map[string]string) string {
+	dir, err := ioutil.TempDir("", "templates")
+	panicOnError(err)
+	for name, text := range templates {
+		panicOnError(ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0640))
+	}
+	return dir
+}
+
+func TestTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := writeTemplates(map[string]string{
+		"database.yml.tmpl": "user: app\npassword: {{ secret \"db.password\" }}\n",
+		"README":            "not a template",
+	})
+	defer os.RemoveAll(dir)
+
+	templates, err := LoadTemplates(dir)
+	assert.NoError(err)
+	assert.Len(templates, 1)
+	tmpl := templates["database.yml"]
+	assert.EqualValues(0440, tmpl.Mode)
+
+	lookup := func(name string) (*Secret, bool) {
+		if name != "db.password" {
+			return nil, false
+		}
+		return &Secret{Name: name, Content: decodedContent([]byte("hunter2"))}, true
+	}
+	data, err := tmpl.Render(lookup)
+	assert.NoError(err)
+	assert.Equal("user: app\npassword: hunter2\n", string(data))
+
+	_, err = tmpl.Render(func(string) (*Secret, bool) { return nil, false })
+	assert.Error(err)
+
+	bad := writeTemplates(map[string]string{"bad.tmpl": "{{ secret "})
+	defer os.RemoveAll(bad)
+	_, err = LoadTemplates(bad)
+	assert.Error(err)
+}
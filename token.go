@@ -0,0 +1,99 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenSource reads a bearer token from a file, e.g. as written by an auth proxy exchanging
+// platform identity for tokens. The file is only read again once its modification time or size
+// changed, so that renewed tokens are picked up without reading it for every request.
+type tokenSource struct {
+	file    string
+	lock    sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+func newTokenSource(file string) *tokenSource {
+	return &tokenSource{file: file}
+}
+
+// Token returns the current token.
+func (s *tokenSource) Token() (string, error) {
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.token != "" && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.token, nil
+	}
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("no token in %s", s.file)
+	}
+	if strings.ContainsAny(token, "\r\n") {
+		return "", errors.New("token file must hold a single line")
+	}
+	s.token, s.modTime, s.size = token, info.ModTime(), info.Size()
+	return token, nil
+}
+
+// bearerTransport authenticates requests to host with the token of a tokenSource. Requests to
+// other hosts, e.g. after a redirect, are sent without it.
+type bearerTransport struct {
+	http.RoundTripper
+	source *tokenSource
+	host   string
+}
+
+func (t bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	token, err := t.source.Token()
+	if err != nil {
+		return nil, fmt.Errorf("reading bearer token: %v", err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// checkTokenURL returns an error if a bearer token from tokenFile would be sent to serverURL in
+// the clear.
+func checkTokenURL(serverURL *url.URL, tokenFile string) error {
+	if tokenFile != "" && serverURL != nil && serverURL.Scheme == "http" {
+		return fmt.Errorf("--token-file can't be used with %s, use https:// or unix://", serverURL)
+	}
+	return nil
+}
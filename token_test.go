@@ -0,0 +1,147 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenSourceReloads(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-token")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+
+	source := newTokenSource(file)
+	_, err = source.Token()
+	assert.Error(err)
+
+	assert.NoError(ioutil.WriteFile(file, []byte("first\n"), 0600))
+	token, err := source.Token()
+	assert.NoError(err)
+	assert.Equal("first", token)
+
+	assert.NoError(ioutil.WriteFile(file, []byte("second-token\n"), 0600))
+	token, err = source.Token()
+	assert.NoError(err)
+	assert.Equal("second-token", token)
+
+	assert.NoError(ioutil.WriteFile(file, []byte("\n"), 0600))
+	_, err = source.Token()
+	assert.EqualError(err, "no token in "+file)
+}
+
+func TestClientSendsBearerToken(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-token")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+	assert.NoError(ioutil.WriteFile(file, []byte("s3cr3t\n"), 0600))
+
+	var authorization string
+	var certificates int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		certificates = len(r.TLS.PeerCertificates)
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient("", "", testCaFile, serverURL, time.Second, ClientOptions{TokenFile: file}, logConfig, metricsHandle)
+
+	_, err = client.Fetch("foo")
+	assert.Nil(err)
+	assert.Equal("Bearer s3cr3t", authorization)
+	assert.Zero(certificates)
+
+	// A renewed token is sent with the next request.
+	later := time.Now().Add(time.Second)
+	assert.NoError(ioutil.WriteFile(file, []byte("renewed\n"), 0600))
+	assert.NoError(os.Chtimes(file, later, later))
+	_, err = client.Fetch("foo")
+	assert.Nil(err)
+	assert.Equal("Bearer renewed", authorization)
+}
+
+func TestBearerTokenOnlySentToServer(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-token")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+	assert.NoError(ioutil.WriteFile(file, []byte("s3cr3t\n"), 0600))
+
+	authorization := "unset"
+	other := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, string(fixture("secret.json")))
+	}))
+	other.TLS = testCerts(testCaFile)
+	other.StartTLS()
+	defer other.Close()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+r.URL.Path, http.StatusFound)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient("", "", testCaFile, serverURL, time.Second, ClientOptions{TokenFile: file}, logConfig, metricsHandle)
+
+	_, err = client.Fetch("foo")
+	assert.Nil(err)
+	assert.Equal("", authorization, "redirected without the token")
+}
+
+func TestCheckTokenURL(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(raw string) *url.URL {
+		u, err := url.Parse(raw)
+		panicOnError(err)
+		return u
+	}
+	assert.NoError(checkTokenURL(parse("https://keywhiz.example.com"), "token"))
+	assert.NoError(checkTokenURL(parse("unix:///run/keywhiz.sock"), "token"))
+	assert.NoError(checkTokenURL(parse("http://keywhiz.example.com"), ""))
+	assert.EqualError(checkTokenURL(parse("http://keywhiz.example.com"), "token"),
+		"--token-file can't be used with http://keywhiz.example.com, use https:// or unix://")
+
+	metricsHandle := setupMetrics(metricsURL, metricsPrefix, *mountpoint)
+	client := NewClient("", "", testCaFile, parse("https://keywhiz.example.com"), time.Second, ClientOptions{TokenFile: "token"}, logConfig, metricsHandle)
+	assert.Error(client.Reload("", "", testCaFile, parse("http://keywhiz.example.com"), time.Second))
+}
@@ -0,0 +1,375 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+// Span kinds, as defined by OpenTelemetry.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+)
+
+// Span status codes, as defined by OpenTelemetry.
+const (
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// traceExportInterval is how often finished spans are exported, and traceBatchSize how many
+// spans are exported at most in one request.
+var (
+	traceExportInterval = 5 * time.Second
+	traceBatchSize      = 512
+)
+
+// Tracer records spans for FUSE operations and server requests and exports them to an
+// OpenTelemetry collector, using OTLP over HTTP with JSON encoding. A nil Tracer records
+// nothing.
+type Tracer struct {
+	*log.Logger
+	endpoint string
+	client   *http.Client
+	spans    chan *Span
+	flush    chan chan struct{}
+}
+
+// NewTracer creates a tracer exporting spans to the OTLP/HTTP endpoint, e.g.
+// http://localhost:4318/v1/traces.
+func NewTracer(endpoint string, logConfig log.Config) *Tracer {
+	t := &Tracer{
+		Logger:   log.New("kwfs_tracer", logConfig),
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *Span, 8*traceBatchSize),
+		flush:    make(chan chan struct{}),
+	}
+	go t.export()
+	return t
+}
+
+// Span is a timed operation within a trace. Spans of FUSE operations exist without a Tracer
+// too, only to carry the request ID of the operation; they record nothing.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []otlpAttribute
+	status   int
+	message  string
+	lock     sync.Mutex
+}
+
+// StartSpan starts a span, as a child of parent or as the root of a new trace if parent is nil.
+func (t *Tracer) StartSpan(parent *Span, name string) *Span {
+	return t.startSpan(parent, name, spanKindInternal)
+}
+
+func (t *Tracer) startSpan(parent *Span, name string, kind int) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// newRequestSpan returns an untraced span, with a new request ID.
+func newRequestSpan() *Span {
+	s := &Span{}
+	rand.Read(s.traceID[:])
+	return s
+}
+
+// RequestID identifies the operation the span belongs to in logs, audit events and server
+// requests. It is the trace ID, so traced operations can also be found in traces.
+func (s *Span) RequestID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetAttribute records a string, bool or int attribute of the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	var v otlpValue
+	switch value := value.(type) {
+	case bool:
+		v.BoolValue = &value
+	case int:
+		i := strconv.Itoa(value)
+		v.IntValue = &i
+	default:
+		str := fmt.Sprint(value)
+		v.StringValue = &str
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attrs = append(s.attrs, otlpAttribute{key, v})
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(message string) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status, s.message = spanStatusError, message
+}
+
+// End finishes the span and queues it for export. Spans are dropped if the queue is full, so
+// that a slow collector never slows down the filesystem.
+func (s *Span) End() {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.lock.Lock()
+	s.end = time.Now()
+	s.lock.Unlock()
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+// traceparent returns the W3C trace context header value for the span.
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// Flush exports all finished spans.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	done := make(chan struct{})
+	t.flush <- done
+	<-done
+}
+
+func (t *Tracer) export() {
+	var batch []*Span
+	ticker := time.NewTicker(traceExportInterval)
+	for {
+		var done chan struct{}
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done = <-t.flush:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+		}
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > traceBatchSize {
+				n = traceBatchSize
+			}
+			if err := t.post(batch[:n]); err != nil {
+				t.Warnf("Error exporting %d spans: %v", n, err)
+			}
+			batch = batch[n:]
+		}
+		batch = nil
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+func (t *Tracer) post(spans []*Span) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP/JSON encoding of spans. IDs are hex-encoded and 64-bit integers are strings.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func otlpRequest(spans []*Span) otlpTraces {
+	service := "keywhiz-fs"
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = []otlpAttribute{{"service.name", otlpValue{StringValue: &service}}}
+
+	var scope otlpScopeSpans
+	scope.Scope.Name = "github.com/square/keywhiz-fs"
+	for _, s := range spans {
+		s.lock.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		out.Status.Code, out.Status.Message = s.status, s.message
+		if out.Status.Code == 0 {
+			out.Status.Code = spanStatusOK
+		}
+		s.lock.Unlock()
+		scope.Spans = append(scope.Spans, out)
+	}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpTraces{[]otlpResourceSpans{resource}}
+}
+
+// traceHash identifies a secret in traces without revealing its name.
+func traceHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// traceRoute returns a request path with secret and group names replaced by their hashes.
+func traceRoute(p string) string {
+	parts := strings.Split(p, "/")
+	for i := 1; i < len(parts); i++ {
+		switch parts[i-1] {
+		case "secret", "secrets", "group", "groups":
+			if parts[i] != "" {
+				parts[i] = traceHash(parts[i])
+			}
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+type spanKey struct{}
+
+// withSpan returns a context carrying span as the parent of requests made with it.
+func withSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// tracingTransport records a span for every server request, as a child of the span carried by
+// the request's context, and propagates the trace to the server in a traceparent header.
+type tracingTransport struct {
+	http.RoundTripper
+	tracer *Tracer
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent, _ := req.Context().Value(spanKey{}).(*Span)
+	span := t.tracer.startSpan(parent, "HTTP "+req.Method, spanKindClient)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("url.path", traceRoute(req.URL.Path))
+	defer span.End()
+
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent", span.traceparent())
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError(resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCollector is an OTLP/HTTP collector recording the spans exported to it.
+type fakeCollector struct {
+	*httptest.Server
+	lock  sync.Mutex
+	spans []otlpSpan
+}
+
+func newFakeCollector() *fakeCollector {
+	c := &fakeCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		data, _ := ioutil.ReadAll(r.Body)
+		panicOnError(json.Unmarshal(data, &traces))
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for _, resource := range traces.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				c.spans = append(c.spans, scope.Spans...)
+			}
+		}
+	}))
+	return c
+}
+
+// span returns the exported span with the given name.
+func (c *fakeCollector) span(name string) (otlpSpan, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return otlpSpan{}, false
+}
+
+// attribute returns the value of a span attribute as a string.
+func (s otlpSpan) attribute(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key != key {
+			continue
+		}
+		switch {
+		case a.Value.StringValue != nil:
+			return *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			return *a.Value.IntValue
+		case a.Value.BoolValue != nil && *a.Value.BoolValue:
+			return "true"
+		case a.Value.BoolValue != nil:
+			return "false"
+		}
+	}
+	return ""
+}
+
+func TestTracerExport(t *testing.T) {
+	assert := assert.New(t)
+	collector := newFakeCollector()
+	defer collector.Close()
+
+	tracer := NewTracer(collector.URL+"/v1/traces", logConfig)
+	parent := tracer.StartSpan(nil, "parent")
+	parent.SetAttribute("fuse.op", "Open")
+	child := tracer.StartSpan(parent, "child")
+	child.SetAttribute("count", 3)
+	child.SetAttribute("hit", true)
+	child.SetError("failed")
+	child.End()
+	parent.End()
+	tracer.Flush()
+
+	p, ok := collector.span("parent")
+	assert.True(ok)
+	c, ok := collector.span("child")
+	assert.True(ok)
+	assert.Len(p.TraceID, 32)
+	assert.Len(p.SpanID, 16)
+	assert.Empty(p.ParentSpanID)
+	assert.Equal(p.TraceID, c.TraceID)
+	assert.Equal(p.SpanID, c.ParentSpanID)
+	assert.Equal("Open", p.attribute("fuse.op"))
+	assert.Equal("3", c.attribute("count"))
+	assert.Equal("true", c.attribute("hit"))
+	assert.Equal(spanStatusOK, p.Status.Code)
+	assert.Equal(spanStatusError, c.Status.Code)
+	assert.Equal("failed", c.Status.Message)
+
+	// A nil tracer records nothing.
+	var none *Tracer
+	span := none.StartSpan(nil, "nothing")
+	assert.Nil(span)
+	span.SetAttribute("key", "value")
+	span.End()
+	none.Flush()
+}
+
+func TestRequestSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	span := newRequestSpan()
+	assert.Regexp("^[0-9a-f]{32}$", span.RequestID())
+	assert.NotEqual(span.RequestID(), newRequestSpan().RequestID())
+	// Untraced spans record nothing.
+	span.SetAttribute("key", "value")
+	span.SetError("failed")
+	span.End()
+	assert.Empty(span.attrs)
+
+	var none *Span
+	assert.Empty(none.RequestID())
+
+	collector := newFakeCollector()
+	defer collector.Close()
+	tracer := NewTracer(collector.URL, logConfig)
+	traced := tracer.StartSpan(nil, "fuse.Open")
+	traced.End()
+	tracer.Flush()
+	s, ok := collector.span("fuse.Open")
+	assert.True(ok)
+	assert.Equal(s.TraceID, traced.RequestID())
+}
+
+func TestTracingTransport(t *testing.T) {
+	assert := assert.New(t)
+	collector := newFakeCollector()
+	defer collector.Close()
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(404)
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(collector.URL, logConfig)
+	client := &http.Client{Transport: tracingTransport{http.DefaultTransport, tracer}}
+	parent := tracer.StartSpan(nil, "fuse.Open")
+	req, _ := http.NewRequest("GET", server.URL+"/secret/db.password", nil)
+	resp, err := client.Do(req.WithContext(withSpan(req.Context(), parent)))
+	assert.NoError(err)
+	resp.Body.Close()
+	parent.End()
+	tracer.Flush()
+
+	p, _ := collector.span("fuse.Open")
+	s, ok := collector.span("HTTP GET")
+	assert.True(ok)
+	assert.Equal(p.SpanID, s.ParentSpanID)
+	assert.Equal("404", s.attribute("http.response.status_code"))
+	assert.Equal("/secret/"+traceHash("db.password"), s.attribute("url.path"))
+	assert.Equal("00-"+s.TraceID+"-"+s.SpanID+"-01", traceparent)
+}
+
+func TestTraceRoute(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("/secret/"+traceHash("a"), traceRoute("/secret/a"))
+	assert.Equal("/automation/v2/secrets/"+traceHash("a"), traceRoute("/automation/v2/secrets/a"))
+	assert.Equal("/secrets", traceRoute("/secrets"))
+	assert.Equal("/secrets/", traceRoute("/secrets/"))
+	assert.Equal("/_status", traceRoute("/_status"))
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Locations of the fuse control filesystem and of the mount table, variables for testing.
+var (
+	fusectlDir    = "/sys/fs/fuse/connections"
+	mountinfoFile = "/proc/self/mountinfo"
+)
+
+// fuseTunables are the kernel settings of a FUSE connection which may be adjusted at runtime.
+// max_background limits the number of outstanding background requests (e.g. readahead and
+// asynchronous reads); past congestion_threshold the kernel starts throttling new ones.
+var fuseTunables = []string{"congestion_threshold", "max_background"}
+
+// FuseTuning reads and adjusts the request queue limits of a mounted filesystem through the
+// fuse control filesystem (usually mounted at /sys/fs/fuse/connections).
+type FuseTuning struct {
+	mountpoint string
+
+	// dir is the connection directory in the fuse control filesystem, found on first use
+	// since it only exists once the filesystem is mounted.
+	lock sync.Mutex
+	dir  string
+}
+
+// NewFuseTuning creates a FuseTuning for the filesystem mounted at mountpoint.
+func NewFuseTuning(mountpoint string) *FuseTuning {
+	if abs, err := filepath.Abs(mountpoint); err == nil {
+		mountpoint = abs
+	}
+	return &FuseTuning{mountpoint: filepath.Clean(mountpoint)}
+}
+
+// isFuseTunable returns true if name is a setting known to FuseTuning.
+func isFuseTunable(name string) bool {
+	for _, tunable := range fuseTunables {
+		if name == tunable {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the current value of a setting.
+func (t *FuseTuning) Get(name string) (int, error) {
+	file, err := t.file(name)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Set changes the value of a setting. Values must fit in 16 bits, as in the kernel.
+func (t *FuseTuning) Set(name string, value int) error {
+	if value <= 0 || value > 65535 {
+		return fmt.Errorf("invalid value for %s: %d", name, value)
+	}
+	file, err := t.file(name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(strconv.Itoa(value)+"\n"), 0644)
+}
+
+func (t *FuseTuning) file(name string) (string, error) {
+	if !isFuseTunable(name) {
+		return "", fmt.Errorf("unknown FUSE setting '%s'", name)
+	}
+	dir, err := t.connectionDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// connectionDir finds the fuse control directory of the mount. Connections are named after
+// the device number of the mount, which is looked up in the mount table rather than with
+// stat(2) so that it can be called from within a FUSE operation.
+func (t *FuseTuning) connectionDir() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.dir != "" {
+		return t.dir, nil
+	}
+
+	f, err := os.Open(mountinfoFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Fields: mount ID, parent ID, major:minor, root, mount point, ...
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != t.mountpoint {
+			continue
+		}
+		var major, minor uint64
+		if _, err := fmt.Sscanf(fields[2], "%d:%d", &major, &minor); err != nil {
+			return "", fmt.Errorf("bad device number in mount table: %v", fields[2])
+		}
+		t.dir = filepath.Join(fusectlDir, strconv.FormatUint(major<<20|minor, 10))
+		return t.dir, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s is not mounted", t.mountpoint)
+}
+
+// unescapeMountinfo decodes the octal escapes (e.g. "\040" for space) used in the mount table.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFusectl points FuseTuning at a fake mount table and control filesystem containing a
+// connection for a filesystem mounted at "/mnt/key whiz", returning a cleanup function.
+func fakeFusectl() func() {
+	dir, err := ioutil.TempDir("", "fusectl")
+	panicOnError(err)
+
+	mountinfo := filepath.Join(dir, "mountinfo")
+	panicOnError(ioutil.WriteFile(mountinfo, []byte(
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+			"45 22 0:44 / /mnt/key\\040whiz rw,nosuid,nodev shared:30 - fuse.kwfs kwfs rw\n"), 0644))
+
+	conn := filepath.Join(dir, "44")
+	panicOnError(os.Mkdir(conn, 0755))
+	panicOnError(ioutil.WriteFile(filepath.Join(conn, "max_background"), []byte("12\n"), 0644))
+	panicOnError(ioutil.WriteFile(filepath.Join(conn, "congestion_threshold"), []byte("9\n"), 0644))
+
+	oldDir, oldMountinfo := fusectlDir, mountinfoFile
+	fusectlDir, mountinfoFile = dir, mountinfo
+	return func() {
+		fusectlDir, mountinfoFile = oldDir, oldMountinfo
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFuseTuning(t *testing.T) {
+	assert := assert.New(t)
+	defer fakeFusectl()()
+
+	tuning := NewFuseTuning("/mnt/key whiz/")
+	value, err := tuning.Get("max_background")
+	assert.NoError(err)
+	assert.Equal(12, value)
+
+	assert.NoError(tuning.Set("congestion_threshold", 100))
+	value, err = tuning.Get("congestion_threshold")
+	assert.NoError(err)
+	assert.Equal(100, value)
+
+	assert.Error(tuning.Set("max_background", 0))
+	assert.Error(tuning.Set("max_background", 70000))
+	_, err = tuning.Get("waiting")
+	assert.Error(err)
+
+	_, err = NewFuseTuning("/mnt/other").Get("max_background")
+	assert.Error(err)
+}
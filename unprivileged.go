@@ -0,0 +1,104 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// fuseConfFile is where fusermount reads user_allow_other from.
+	fuseConfFile = "/etc/fuse.conf"
+	// procStatusFile lists the capability sets of the process.
+	procStatusFile = "/proc/self/status"
+)
+
+// checkUnprivilegedMount checks that a user other than root can mount at points with fusermount,
+// so that misconfiguration is reported clearly rather than as a failed fusermount.
+func checkUnprivilegedMount(config MountConfig, points []string) error {
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		return fmt.Errorf("fusermount is required to mount as a user other than root: %v", err)
+	}
+	if config.AllowOther {
+		allowed, err := userAllowOther()
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("allow_other requires user_allow_other in %s, or pass --no-allow-other", fuseConfFile)
+		}
+	}
+	for _, point := range points {
+		if err := unix.Access(point, unix.W_OK); err != nil {
+			return fmt.Errorf("%s must be writable by uid %d: %v", point, os.Geteuid(), err)
+		}
+	}
+	return nil
+}
+
+// userAllowOther returns true if fuse.conf lets users other than root mount with allow_other.
+func userAllowOther() (bool, error) {
+	f, err := os.Open(fuseConfFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "user_allow_other" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// hasCapabilities returns true if the process has any permitted, effective, inheritable or
+// ambient capabilities.
+func hasCapabilities() (bool, error) {
+	f, err := os.Open(procStatusFile)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "CapInh:", "CapPrm:", "CapEff:", "CapAmb:":
+			caps, err := strconv.ParseUint(fields[1], 16, 64)
+			if err != nil {
+				return false, fmt.Errorf("invalid %s %s", fields[0], fields[1])
+			}
+			if caps != 0 {
+				return true, nil
+			}
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Capability constants missing from golang.org/x/sys/unix.
+const (
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// dropCapabilities clears all capabilities of an unprivileged process once mounted, e.g. ambient
+// capabilities granted by systemd or CAP_IPC_LOCK set on the binary for mlockall, since they
+// aren't needed anymore. Capabilities are per-thread, so this requires stopping all threads,
+// which Go can't do in binaries built with cgo.
+func dropCapabilities() error {
+	if has, err := hasCapabilities(); err != nil || !has {
+		return err
+	}
+
+	// Kernels before 4.3 have no ambient capabilities, and fail with EINVAL.
+	_, _, errno := syscall.AllThreadsSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("not supported by binaries built with cgo, build with CGO_ENABLED=0")
+	} else if errno != 0 && errno != syscall.EINVAL {
+		return fmt.Errorf("unable to clear ambient capabilities: %v", errno)
+	}
+
+	header := struct {
+		version uint32
+		pid     int32
+	}{linuxCapabilityVersion3, 0}
+	// Effective, permitted and inheritable sets, as two 32-bit halves.
+	data := [6]uint32{}
+	_, _, errno = syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data)), 0)
+	runtime.KeepAlive(&header)
+	runtime.KeepAlive(&data)
+	if errno != 0 {
+		return fmt.Errorf("unable to clear capabilities: %v", errno)
+	}
+	return nil
+}
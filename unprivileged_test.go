@@ -0,0 +1,72 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAllowOther(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-fuseconf")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func(file string) { fuseConfFile = file }(fuseConfFile)
+
+	fuseConfFile = filepath.Join(dir, "missing.conf")
+	allowed, err := userAllowOther()
+	assert.NoError(err)
+	assert.False(allowed)
+
+	fuseConfFile = filepath.Join(dir, "fuse.conf")
+	assert.NoError(ioutil.WriteFile(fuseConfFile, []byte("# user_allow_other\nmount_max = 1000\n"), 0644))
+	allowed, err = userAllowOther()
+	assert.NoError(err)
+	assert.False(allowed, "commented out")
+
+	assert.NoError(ioutil.WriteFile(fuseConfFile, []byte("mount_max = 1000\n user_allow_other \n"), 0644))
+	allowed, err = userAllowOther()
+	assert.NoError(err)
+	assert.True(allowed)
+}
+
+func TestHasCapabilities(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kwfs-status")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func(file string) { procStatusFile = file }(procStatusFile)
+	procStatusFile = filepath.Join(dir, "status")
+
+	status := "Name:\tkeywhiz-fs\nCapInh:\t0000000000000000\nCapPrm:\t%s\nCapEff:\t%s\n" +
+		"CapBnd:\t000001ffffffffff\nCapAmb:\t0000000000000000\n"
+	assert.NoError(ioutil.WriteFile(procStatusFile, []byte(fmt.Sprintf(status, "0000000000000000", "0000000000000000")), 0644))
+	has, err := hasCapabilities()
+	assert.NoError(err)
+	assert.False(has, "bounding set doesn't count")
+
+	assert.NoError(ioutil.WriteFile(procStatusFile, []byte(fmt.Sprintf(status, "0000000000004000", "0000000000004000")), 0644))
+	has, err = hasCapabilities()
+	assert.NoError(err)
+	assert.True(has, "CAP_IPC_LOCK")
+}
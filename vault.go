@@ -0,0 +1,281 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/square/keywhiz-fs/log"
+)
+
+// vaultMaxDepth bounds how deep nested Vault paths are listed.
+const vaultMaxDepth = 16
+
+// VaultOptions are settings of a VaultBackend.
+type VaultOptions struct {
+	// TokenFile holds the Vault token, e.g. as written by Vault Agent. It is re-read on every
+	// request, so that renewed tokens are picked up. VAULT_TOKEN is used if empty.
+	TokenFile string
+	// CaFile verifies the Vault server's certificate. The system roots are used if empty.
+	CaFile string
+	// Field is the key of the KV entry holding the content of a secret.
+	Field string
+	// KVVersion is the version of the KV secrets engine, 1 or 2.
+	KVVersion int
+	Timeout   time.Duration
+}
+
+// VaultBackend serves secrets from a HashiCorp Vault KV secrets engine, so that secrets moved
+// from Keywhiz to Vault keep their file layout. Each KV entry under the prefix is a secret named
+// by its path relative to the prefix, with the content of its Field. With KV version 2, the
+// custom metadata keys "mode", "owner" and "group" set the file's attributes as they would in
+// Keywhiz.
+type VaultBackend struct {
+	*log.Logger
+	http    *http.Client
+	address *url.URL
+	mount   string
+	prefix  string
+	options VaultOptions
+}
+
+// vaultResponse is the body of a Vault API response.
+type vaultResponse struct {
+	Data json.RawMessage `json:"data"`
+}
+
+// vaultList is the data of a listing. Names of sub-paths end with "/".
+type vaultList struct {
+	Keys []string `json:"keys"`
+}
+
+// vaultEntry is the data of a KV version 2 entry. Version 1 entries are just the Data.
+type vaultEntry struct {
+	Data     map[string]interface{} `json:"data"`
+	Metadata struct {
+		CreatedTime    time.Time         `json:"created_time"`
+		CustomMetadata map[string]string `json:"custom_metadata"`
+	} `json:"metadata"`
+}
+
+// NewVaultBackend returns a backend for the KV secrets engine at u, whose path is the mount
+// point of the engine followed by an optional prefix, e.g.
+// https://vault.example.com:8200/secret/myapp.
+func NewVaultBackend(u *url.URL, options VaultOptions, logConfig log.Config) (*VaultBackend, error) {
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("no secrets engine in Vault url %s", u)
+	}
+	if options.KVVersion != 1 && options.KVVersion != 2 {
+		return nil, fmt.Errorf("unsupported KV version %d", options.KVVersion)
+	}
+	if options.Field == "" {
+		return nil, errors.New("no Vault field for secret content")
+	}
+	prefix := ""
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if options.CaFile != "" {
+		pem, err := ioutil.ReadFile(options.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", options.CaFile)
+		}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
+		Timeout:   options.Timeout,
+	}
+
+	address := &url.URL{Scheme: u.Scheme, Host: u.Host}
+	logger := log.New("kwfs_vault", logConfig)
+	return &VaultBackend{logger, client, address, parts[0], prefix, options}, nil
+}
+
+// List lists every entry under the prefix. Listings of the KV engine don't include content or
+// its length, which file attributes need, so each entry is also read.
+func (b *VaultBackend) List() ([]Secret, bool) {
+	names, err := b.listNames("", 0)
+	if err != nil {
+		b.Errorf("Error listing Vault secrets: %v", err)
+		return nil, false
+	}
+
+	secrets := []Secret{}
+	for _, name := range names {
+		secret, err := b.Fetch(name)
+		if _, deleted := err.(SecretDeleted); deleted {
+			continue
+		} else if err != nil {
+			b.Errorf("Error listing Vault secrets: %v", err)
+			return nil, false
+		}
+		secrets = append(secrets, *secret)
+	}
+	return secrets, true
+}
+
+// listNames returns the names of entries under dir, relative to the prefix.
+func (b *VaultBackend) listNames(dir string, depth int) ([]string, error) {
+	if depth > vaultMaxDepth {
+		return nil, fmt.Errorf("paths nested deeper than %d at %s", vaultMaxDepth, dir)
+	}
+	data, err := b.request("LIST", b.apiPath("metadata", dir))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var list vaultList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, key := range list.Keys {
+		if !strings.HasSuffix(key, "/") {
+			names = append(names, dir+key)
+			continue
+		}
+		nested, err := b.listNames(dir+key, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, nested...)
+	}
+	return names, nil
+}
+
+// Fetch reads a KV entry. Entries without the content field are reported as deleted.
+func (b *VaultBackend) Fetch(name string) (*Secret, error) {
+	data, err := b.request("GET", b.apiPath("data", name))
+	if err != nil {
+		b.Errorf("Error retrieving Vault secret %v: %v", name, err)
+		return nil, err
+	}
+	if data == nil {
+		return nil, SecretDeleted{}
+	}
+	var entry vaultEntry
+	if b.options.KVVersion == 1 {
+		err = json.Unmarshal(data, &entry.Data)
+	} else {
+		err = json.Unmarshal(data, &entry)
+	}
+	if err != nil {
+		b.Errorf("Error decoding Vault secret %v: %v", name, err)
+		return nil, err
+	}
+
+	metadata := entry.Metadata
+	value, ok := entry.Data[b.options.Field].(string)
+	if !ok {
+		b.Warnf("Vault secret %v has no string field '%s', ignoring it", name, b.options.Field)
+		return nil, SecretDeleted{}
+	}
+	return &Secret{
+		Name:      name,
+		Content:   decodedContent([]byte(value)),
+		Length:    uint64(len(value)),
+		CreatedAt: metadata.CreatedTime,
+		Mode:      metadata.CustomMetadata["mode"],
+		Owner:     metadata.CustomMetadata["owner"],
+		Group:     metadata.CustomMetadata["group"],
+	}, nil
+}
+
+// Invalidate does nothing, since the backend holds nothing per secret.
+func (b *VaultBackend) Invalidate(name string) {}
+
+// apiPath returns the API path of an entry or directory. KV version 2 separates entry data
+// and metadata (including listings) under different paths.
+func (b *VaultBackend) apiPath(kind, name string) string {
+	if b.options.KVVersion == 1 {
+		return path.Join("/v1", b.mount, b.prefix, name)
+	}
+	return path.Join("/v1", b.mount, kind, b.prefix, name)
+}
+
+// request makes a Vault API request and returns the data of the response, or nil if nothing
+// exists at apiPath.
+func (b *VaultBackend) request(method, apiPath string) (json.RawMessage, error) {
+	token, err := b.token()
+	if err != nil {
+		return nil, err
+	}
+	u := *b.address
+	u.Path = apiPath
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	now := time.Now()
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b.Infof("%s %s %d %v", method, apiPath, resp.StatusCode, time.Since(now))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var response vaultResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, err
+		}
+		return response.Data, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		msg := responseMessage(body)
+		return nil, fmt.Errorf("bad response code %d: %s", resp.StatusCode, msg)
+	}
+}
+
+// token returns the Vault token to authenticate with.
+func (b *VaultBackend) token() (string, error) {
+	if b.options.TokenFile == "" {
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		return "", errors.New("no Vault token, set VAULT_TOKEN or a token file")
+	}
+	data, err := ioutil.ReadFile(b.options.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
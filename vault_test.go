@@ -0,0 +1,123 @@
+// Copyright 2015 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVaultBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(403)
+			return
+		}
+		switch {
+		case r.Method == "LIST" && r.URL.Path == "/v1/secret/metadata/app":
+			fmt.Fprint(w, `{"data": {"keys": ["db", "tls/", "empty"]}}`)
+		case r.Method == "LIST" && r.URL.Path == "/v1/secret/metadata/app/tls":
+			fmt.Fprint(w, `{"data": {"keys": ["key"]}}`)
+		case r.Method == "GET" && r.URL.Path == "/v1/secret/data/app/db":
+			fmt.Fprint(w, `{"data": {"data": {"value": "password"}, "metadata": {"created_time": "2018-03-01T10:00:00Z", "custom_metadata": {"mode": "0400", "owner": "db"}}}}`)
+		case r.Method == "GET" && r.URL.Path == "/v1/secret/data/app/tls/key":
+			fmt.Fprint(w, `{"data": {"data": {"value": "-----BEGIN"}, "metadata": {}}}`)
+		case r.Method == "GET" && r.URL.Path == "/v1/secret/data/app/empty":
+			fmt.Fprint(w, `{"data": {"data": {"other": "x"}, "metadata": {}}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kwfs-vault")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(ioutil.WriteFile(tokenFile, []byte("s.token\n"), 0600))
+
+	u, _ := url.Parse(server.URL + "/secret/app")
+	options := VaultOptions{TokenFile: tokenFile, Field: "value", KVVersion: 2, Timeout: time.Second}
+	backend, err := NewVaultBackend(u, options, logConfig)
+	assert.NoError(err)
+
+	secrets, ok := backend.List()
+	assert.True(ok)
+	assert.Len(secrets, 2)
+	assert.Equal("db", secrets[0].Name)
+	assert.Equal("tls/key", secrets[1].Name)
+
+	secret, err := backend.Fetch("db")
+	assert.NoError(err)
+	assert.Equal("password", string(secret.Content.Bytes()))
+	assert.EqualValues(len("password"), secret.Length)
+	assert.Equal("0400", secret.Mode)
+	assert.Equal("db", secret.Owner)
+	assert.Equal(2018, secret.CreatedAt.Year())
+
+	_, err = backend.Fetch("missing")
+	assert.Equal(SecretDeleted{}, err)
+
+	assert.NoError(ioutil.WriteFile(tokenFile, []byte("s.expired"), 0600))
+	_, err = backend.Fetch("db")
+	assert.Error(err)
+	_, ok = backend.List()
+	assert.False(ok)
+}
+
+func TestVaultBackendKVVersion1(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "LIST" && r.URL.Path == "/v1/kv":
+			fmt.Fprint(w, `{"data": {"keys": ["api"]}}`)
+		case r.Method == "GET" && r.URL.Path == "/v1/kv/api":
+			fmt.Fprint(w, `{"data": {"value": "key"}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("VAULT_TOKEN", "s.token")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	u, _ := url.Parse(server.URL + "/kv")
+	backend, err := NewVaultBackend(u, VaultOptions{Field: "value", KVVersion: 1}, logConfig)
+	assert.NoError(err)
+
+	secrets, ok := backend.List()
+	assert.True(ok)
+	assert.Len(secrets, 1)
+	assert.Equal("key", string(secrets[0].Content.Bytes()))
+
+	_, err = NewVaultBackend(u, VaultOptions{Field: "value", KVVersion: 3}, logConfig)
+	assert.Error(err)
+	u, _ = url.Parse(server.URL)
+	_, err = NewVaultBackend(u, VaultOptions{Field: "value", KVVersion: 2}, logConfig)
+	assert.Error(err, "no secrets engine")
+}